@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PromptAdaptation describes prompt tweaks applied to models matching Model.
+// Model is a case-insensitive glob (e.g. "llama*") or a plain substring.
+type PromptAdaptation struct {
+	Model   string            `json:"model"`
+	Prefix  string            `json:"prefix,omitempty"`
+	Suffix  string            `json:"suffix,omitempty"`
+	Replace map[string]string `json:"replace,omitempty"` // old -> new, "" removes the text
+}
+
+// LoadPromptAdaptations reads prompt adaptations from a JSON file containing
+// an array of PromptAdaptation. An empty path means no adaptations.
+func LoadPromptAdaptations(filePath string) ([]PromptAdaptation, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt adaptation file: %w", err)
+	}
+
+	var adaptations []PromptAdaptation
+	if err := json.Unmarshal(data, &adaptations); err != nil {
+		return nil, fmt.Errorf("failed to parse prompt adaptation file: %w", err)
+	}
+
+	for i, adaptation := range adaptations {
+		if adaptation.Model == "" {
+			return nil, fmt.Errorf("prompt adaptation %d: model pattern is required", i)
+		}
+		if _, err := path.Match(strings.ToLower(adaptation.Model), ""); err != nil {
+			return nil, fmt.Errorf("prompt adaptation %d: invalid model pattern %q: %w", i, adaptation.Model, err)
+		}
+	}
+
+	return adaptations, nil
+}
+
+// matches reports whether the adaptation applies to the given model name
+func (pa PromptAdaptation) matches(model string) bool {
+	pattern := strings.ToLower(pa.Model)
+	model = strings.ToLower(model)
+	if ok, _ := path.Match(pattern, model); ok {
+		return true
+	}
+	return strings.Contains(model, pattern)
+}
+
+// adaptPrompt applies every adaptation matching model to prompt, in file order
+func adaptPrompt(adaptations []PromptAdaptation, model, prompt string) string {
+	for _, adaptation := range adaptations {
+		if !adaptation.matches(model) {
+			continue
+		}
+		olds := make([]string, 0, len(adaptation.Replace))
+		for old := range adaptation.Replace {
+			olds = append(olds, old)
+		}
+		sort.Strings(olds)
+		for _, old := range olds {
+			prompt = strings.ReplaceAll(prompt, old, adaptation.Replace[old])
+		}
+		prompt = adaptation.Prefix + prompt + adaptation.Suffix
+	}
+	return prompt
+}
@@ -2,15 +2,20 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/kataras/golog"
 	"github.com/tmc/langchaingo/llms"
 	ollamallm "github.com/tmc/langchaingo/llms/ollama"
 	"github.com/tmc/langchaingo/llms/openai"
 	"github.com/tmc/langchaingo/prompts"
+	"github.com/tmc/langchaingo/schema"
 )
 
 // Agent handles AI operations for generating notes and chat responses
@@ -19,37 +24,72 @@ type Agent struct {
 	llm         llms.Model
 	cfg         Config
 	provider    LLMProvider
+	adaptations []PromptAdaptation
+	prompts     *PromptManager
+	limiter     *llmLimiter // nil without LLM_MAX_CONCURRENCY
+	models      *modelCache // clients of models requested per call
+}
+
+// modelCache keeps the LLM clients of the models requests asked for, so a
+// client is created once per model
+type modelCache struct {
+	mu     sync.Mutex
+	models map[string]llms.Model
 }
 
 // NewAgent creates a new agent
 func NewAgent(cfg Config, vectorStore *VectorStore) (*Agent, error) {
-	llm, err := createLLM(cfg)
+	llm, err := createLLM(cfg, "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LLM: %w", err)
 	}
 
-	provider := NewGeminiClient(cfg.GoogleAPIKey, llm)
+	provider := NewGeminiClient(cfg.GoogleAPIKey, llm, cfg.UploadsDir)
+
+	adaptations, err := LoadPromptAdaptations(cfg.PromptAdaptationFile)
+	if err != nil {
+		return nil, err
+	}
+
+	promptManager, err := NewPromptManager(cfg.PromptsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Vision OCR runs on the same model, so it shares the limit
+	limiter := newLLMLimiter(cfg.LLMMaxConcurrency, cfg.LLMMaxQueue)
+	if vectorStore != nil {
+		vectorStore.llmLimiter = limiter
+	}
 
 	return &Agent{
 		vectorStore: vectorStore,
 		llm:         llm,
 		cfg:         cfg,
 		provider:    provider,
+		adaptations: adaptations,
+		prompts:     promptManager,
+		limiter:     limiter,
+		models:      &modelCache{models: make(map[string]llms.Model)},
 	}, nil
 }
 
-// createLLM creates an LLM based on configuration
-func createLLM(cfg Config) (llms.Model, error) {
+// createLLM creates an LLM based on configuration. model overrides the
+// configured model when not empty.
+func createLLM(cfg Config, model string) (llms.Model, error) {
 	if cfg.IsOllama() {
-		return ollamallm.New(
-			ollamallm.WithModel(cfg.OllamaModel),
-			ollamallm.WithServerURL(cfg.OllamaBaseURL),
-		)
+		if model == "" {
+			model = cfg.OllamaModel
+		}
+		return ollamallm.New(ollamaOptions(cfg, model)...)
 	}
 
+	if model == "" {
+		model = cfg.OpenAIModel
+	}
 	opts := []openai.Option{
-		openai.WithToken(cfg.OpenAIAPIKey),
-		openai.WithModel(cfg.OpenAIModel),
+		openai.WithToken(cfg.OpenAIToken()),
+		openai.WithModel(model),
 	}
 	if cfg.OpenAIBaseURL != "" {
 		opts = append(opts, openai.WithBaseURL(cfg.OpenAIBaseURL))
@@ -58,35 +98,260 @@ func createLLM(cfg Config) (llms.Model, error) {
 	return openai.New(opts...)
 }
 
+// modelName returns the name of the default chat/generation model
+func (a *Agent) modelName() string {
+	if a.cfg.IsOllama() {
+		return a.cfg.OllamaModel
+	}
+	return a.cfg.OpenAIModel
+}
+
+// ValidateModel checks a model requested for a single call: it must be the
+// default model or one of LLM_ALLOWED_MODELS
+func (a *Agent) ValidateModel(model string) error {
+	model = strings.TrimSpace(model)
+	if model == "" || model == a.modelName() {
+		return nil
+	}
+	for _, allowed := range a.cfg.LLMAllowedModels {
+		if model == allowed {
+			return nil
+		}
+	}
+	if len(a.cfg.LLMAllowedModels) == 0 {
+		return fmt.Errorf("model %q is not available: set LLM_ALLOWED_MODELS to allow choosing a model per request", model)
+	}
+	return fmt.Errorf("model %q is not available, choose one of: %s", model, strings.Join(a.cfg.LLMAllowedModels, ", "))
+}
+
+// withModel returns an agent generating with model, sharing everything else
+// with a; a itself for the default model. The model must pass ValidateModel.
+func (a *Agent) withModel(model string) (*Agent, error) {
+	model = strings.TrimSpace(model)
+	if model == "" || model == a.modelName() {
+		return a, nil
+	}
+	if err := a.ValidateModel(model); err != nil {
+		return nil, err
+	}
+
+	a.models.mu.Lock()
+	llm, ok := a.models.models[model]
+	if !ok {
+		var err error
+		if llm, err = createLLM(a.cfg, model); err != nil {
+			a.models.mu.Unlock()
+			return nil, fmt.Errorf("failed to create LLM for model %s: %w", model, err)
+		}
+		a.models.models[model] = llm
+	}
+	a.models.mu.Unlock()
+
+	agent := *a
+	agent.llm = llm
+	if agent.cfg.IsOllama() {
+		agent.cfg.OllamaModel = model
+	} else {
+		agent.cfg.OpenAIModel = model
+	}
+	return &agent, nil
+}
+
+// pptModel generates slide deck outlines
+const pptModel = "gemini-3-flash-preview"
+
+// ErrLLMTimeout is returned when the model does not answer within
+// LLM_TIMEOUT_SECONDS (or the request deadline)
+var ErrLLMTimeout = errors.New("the model did not respond in time")
+
+// llmContext bounds a generation by LLM_TIMEOUT_SECONDS. It derives from the
+// request context, so a client disconnect cancels the generation too.
+func (a *Agent) llmContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.cfg.LLMTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, a.cfg.LLMTimeout)
+}
+
+// llmError tells a generation that failed because its context ended apart
+// from a model error: it then wraps ErrLLMTimeout or context.Canceled. A
+// model missing on the server wraps ErrModelNotFound.
+func llmError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %v", ErrLLMTimeout, err)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return fmt.Errorf("%w: %v", context.Canceled, err)
+	}
+	return modelNotFoundError(err)
+}
+
+// preparePrompt puts SYSTEM_PROMPT_PREFIX in front of a prompt and applies
+// the adaptations for the model. Every text generation goes through it, so
+// operator guardrails apply to all notebooks and prompt types.
+func (a *Agent) preparePrompt(model, prompt string) string {
+	if a.cfg.SystemPromptPrefix != "" {
+		prompt = a.cfg.SystemPromptPrefix + "\n\n" + prompt
+	}
+	return adaptPrompt(a.adaptations, model, prompt)
+}
+
+// seedOptions returns the call options pinning the sampling seed of a
+// transformation: the request's seed, or LLM_SEED
+func (a *Agent) seedOptions(req *TransformationRequest) (int, []llms.CallOption) {
+	seed := a.cfg.LLMSeed
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	if seed == 0 {
+		return 0, nil
+	}
+	return seed, []llms.CallOption{llms.WithSeed(seed)}
+}
+
+// generateWithRetry generates text with the default LLM, retrying transient
+// failures. Each attempt waits for a slot of LLM_MAX_CONCURRENCY, which is
+// freed during the backoff between attempts.
+func (a *Agent) generateWithRetry(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	prompt = a.preparePrompt(a.modelName(), prompt)
+	start := time.Now()
+	response, err := withRetry(ctx, a.cfg.LLMMaxRetries, func(ctx context.Context) (string, error) {
+		return limited(ctx, a.limiter, func(ctx context.Context) (string, error) {
+			return a.provider.GenerateFromSinglePrompt(ctx, a.llm, prompt, options...)
+		})
+	})
+	observeSince(llmDuration, start, a.modelName(), metricOutcome(err))
+	return response, err
+}
+
+// generateContentWithRetry is generateWithRetry for a prompt followed by
+// further parts, such as images for a multimodal model
+func (a *Agent) generateContentWithRetry(ctx context.Context, prompt string, parts []llms.ContentPart, options ...llms.CallOption) (string, error) {
+	msg := llms.MessageContent{
+		Role:  llms.ChatMessageTypeHuman,
+		Parts: append([]llms.ContentPart{llms.TextContent{Text: a.preparePrompt(a.modelName(), prompt)}}, parts...),
+	}
+
+	start := time.Now()
+	response, err := withRetry(ctx, a.cfg.LLMMaxRetries, func(ctx context.Context) (string, error) {
+		return limited(ctx, a.limiter, func(ctx context.Context) (string, error) {
+			resp, err := a.llm.GenerateContent(ctx, []llms.MessageContent{msg}, options...)
+			if err != nil {
+				return "", err
+			}
+			if len(resp.Choices) == 0 {
+				return "", fmt.Errorf("empty response from model")
+			}
+			return resp.Choices[0].Content, nil
+		})
+	})
+	observeSince(llmDuration, start, a.modelName(), metricOutcome(err))
+	return response, err
+}
+
+// generateWithUsage is like generateWithRetry but also reports token usage
+func (a *Agent) generateWithUsage(ctx context.Context, prompt string, options ...llms.CallOption) (string, TokenUsage, error) {
+	prompt = a.preparePrompt(a.modelName(), prompt)
+
+	var usage TokenUsage
+	start := time.Now()
+	response, err := withRetry(ctx, a.cfg.LLMMaxRetries, func(ctx context.Context) (string, error) {
+		return limited(ctx, a.limiter, func(ctx context.Context) (string, error) {
+			text, u, err := a.provider.GenerateWithUsage(ctx, a.llm, prompt, options...)
+			usage = u
+			return text, err
+		})
+	})
+	observeSince(llmDuration, start, a.modelName(), metricOutcome(err))
+	llmTokens.WithLabelValues(a.modelName(), "prompt").Add(float64(usage.PromptTokens))
+	llmTokens.WithLabelValues(a.modelName(), "completion").Add(float64(usage.CompletionTokens))
+	return response, usage, err
+}
+
 // GenerateTransformation generates a note based on transformation type
 func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationRequest, sources []Source) (*TransformationResponse, error) {
-	// Build context from sources
+	// The rest of the generation runs on the requested model
+	a, err := a.withModel(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Type == "translate" {
+		return a.translate(ctx, req, sources)
+	}
+
+	// Sources without content (e.g. URLs that were never fetched) would only
+	// feed the model a placeholder, so they are left out
+	sources, skipped := splitEmptySources(sources)
+	if len(sources) == 0 {
+		return nil, errNoSourceContent
+	}
+
+	// Build context from sources, first limiting each source to
+	// MaxContextLength characters, then sharing the model's token budget
+	// among them
+	limit := a.cfg.MaxContextLength
+	if limit <= 0 {
+		limit = 100000 // Default to 100k chars if config is invalid
+	}
+	if a.cfg.MaxSourceBytes > 0 && a.cfg.MaxSourceBytes < limit {
+		limit = a.cfg.MaxSourceBytes
+	}
+
+	contents := make([]string, len(sources))
+	needs := make([]int, len(sources))
+	for i, src := range sources {
+		contents[i] = truncateUTF8(src.Content, limit)
+		needs[i] = estimateTokens(contents[i])
+	}
+
+	model := a.modelName()
+	if req.Type == "ppt" {
+		model = pptModel
+	}
+	window := a.contextWindow(model)
+	budget := sourceTokenBudget(window, estimateTokens(a.prompts.Get(req.Type)+req.Prompt))
+	allowed := allocateTokens(needs, budget)
+
 	var sourceContext strings.Builder
+	var truncated []map[string]interface{}
+	if req.Query != "" {
+		// The sources hold only the excerpts retrieved for the query
+		sourceContext.WriteString(fmt.Sprintf("（以下是来源中与主题“%s”相关的片段，请只围绕这个主题生成内容。）\n", req.Query))
+	}
 	for i, src := range sources {
 		sourceContext.WriteString(fmt.Sprintf("\n## Source %d: %s\n", i+1, src.Name))
 
-		// Use MaxContextLength from config, or default to a safe large value if not set (or too small)
-		limit := a.cfg.MaxContextLength
-		if limit <= 0 {
-			limit = 100000 // Default to 100k chars if config is invalid
+		content := contents[i]
+		if allowed[i] < needs[i] {
+			// Cut the same share of characters as of tokens
+			content = truncateUTF8(content, int(int64(len(content))*int64(allowed[i])/int64(needs[i])))
 		}
-
-		if src.Content != "" {
-			if len(src.Content) <= limit {
-				sourceContext.WriteString(src.Content)
-			} else {
-				// Truncate content instead of replacing it entirely
-				sourceContext.WriteString(src.Content[:limit])
-				sourceContext.WriteString(fmt.Sprintf("\n... [Content truncated, total length: %d]", len(src.Content)))
-			}
-		} else {
-			sourceContext.WriteString(fmt.Sprintf("[Source content: %s, type: %s]", src.Name, src.Type))
+		sourceContext.WriteString(content)
+		if len(content) < len(src.Content) {
+			// Truncate content instead of replacing it entirely
+			sourceContext.WriteString(fmt.Sprintf("\n... [Content truncated, total length: %d]", len(src.Content)))
+			truncated = append(truncated, map[string]interface{}{
+				"id":               src.ID,
+				"name":             src.Name,
+				"original_length":  len(src.Content),
+				"used_length":      len(content),
+				"dropped_length":   len(src.Content) - len(content),
+				"estimated_tokens": needs[i],
+				"allowed_tokens":   allowed[i],
+			})
 		}
 		sourceContext.WriteString("\n")
 	}
 
 	// Build prompt using f-string format (no Go template reserved names issue)
-	promptTemplate := getTransformationPrompt(req.Type)
+	promptTemplate := a.prompts.Get(req.Type)
+	length := req.Length
+	multiLength := req.Type == "summary" && len(req.Lengths) > 1
+	if multiLength {
+		promptTemplate = multiLengthSummaryPrompt()
+		length = strings.Join(req.Lengths, ", ")
+	}
 
 	prompt := prompts.NewPromptTemplate(
 		promptTemplate,
@@ -97,29 +362,95 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 	promptValue, err := prompt.Format(map[string]any{
 		"sources": sourceContext.String(),
 		"type":    req.Type,
-		"length":  req.Length,
+		"length":  length,
 		"format":  req.Format,
 		"prompt":  req.Prompt,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to format prompt: %w", err)
 	}
+	promptValue = withOutputLanguage(promptValue, req.Language)
+	if isQuizJSON(req) {
+		promptValue += quizJSONInstruction
+	}
 
 	// Generate response
 	var response string
 	var genErr error
 
+	trace := GenerationTrace{
+		Model:                 a.modelName(),
+		PromptTemplate:        req.Type,
+		PromptTemplateVersion: promptTemplateVersion,
+		SourceCount:           len(sources),
+		ContextLength:         sourceContext.Len(),
+		PromptLength:          len(promptValue),
+		StartedAt:             time.Now(),
+	}
+
+	seed, seedOptions := a.seedOptions(req)
+	llmCtx, cancel := a.llmContext(ctx)
+	defer cancel()
 	if req.Type == "ppt" {
-		response, genErr = a.provider.GenerateTextWithModel(ctx, promptValue, "gemini-3-flash-preview")
+		trace.Model = pptModel
+		if seed != 0 {
+			golog.Infof("seed %d ignored: %s does not support seeded sampling", seed, pptModel)
+		}
+		start := time.Now()
+		response, genErr = limited(llmCtx, a.limiter, func(ctx context.Context) (string, error) {
+			return a.provider.GenerateTextWithModel(ctx, a.preparePrompt(pptModel, promptValue), pptModel)
+		})
+		observeSince(llmDuration, start, pptModel, metricOutcome(genErr))
 	} else {
-		ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
-		defer cancel()
-		response, genErr = a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+		trace.Seed = seed
+		options := seedOptions
+		if req.OnChunk != nil {
+			options = append(options[:len(options):len(options)], llms.WithStreamingFunc(func(_ context.Context, chunk []byte) error {
+				req.OnChunk(string(chunk))
+				return nil
+			}))
+		}
+		var usage TokenUsage
+		response, usage, genErr = a.generateWithUsage(llmCtx, promptValue, options...)
+		trace.TokenUsage = &usage
 	}
-
 	if genErr != nil {
-		return nil, fmt.Errorf("failed to generate response: %w", genErr)
+		return nil, fmt.Errorf("failed to generate response: %w", llmError(llmCtx, genErr))
+	}
+
+	// Output fed to a renderer or an image model must be well-formed; retry
+	// once with a stricter prompt rather than saving broken content
+	formatRetried := false
+	normalize, ok := formatEnforcedTypes[req.Type]
+	if isQuizJSON(req) {
+		normalize, ok = normalizeQuizJSON, true
+	}
+	if ok {
+		normalized, err := normalize(response)
+		if err != nil {
+			golog.Warnf("%s output failed validation, retrying: %v", req.Type, err)
+			formatRetried = true
+			retryCtx, cancel := a.llmContext(ctx)
+			defer cancel()
+			retry, usage, genErr := a.generateWithUsage(retryCtx, promptValue+strictFormatInstruction(req.Type, err), seedOptions...)
+			if genErr != nil {
+				return nil, fmt.Errorf("failed to generate response: %w", llmError(retryCtx, genErr))
+			}
+			if trace.TokenUsage != nil {
+				trace.TokenUsage.PromptTokens += usage.PromptTokens
+				trace.TokenUsage.CompletionTokens += usage.CompletionTokens
+				trace.TokenUsage.TotalTokens += usage.TotalTokens
+			}
+			if normalized, err = normalize(retry); err != nil {
+				return nil, fmt.Errorf("model did not produce a valid %s: %w", req.Type, err)
+			}
+		}
+		response = normalized
+	} else if req.Type != "ppt" {
+		// Notes are rendered as Markdown, however the model wrapped them
+		response = cleanNoteMarkdown(response, a.cfg.NoteEscapeHTML)
 	}
+	trace.DurationMs = time.Since(trace.StartedAt).Milliseconds()
 
 	// Build source summaries
 	sourceSummaries := make([]SourceSummary, len(sources))
@@ -131,55 +462,225 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 		}
 	}
 
+	metadata := map[string]interface{}{
+		"length": req.Length,
+		"format": req.Format,
+		"trace":  trace,
+	}
+	if formatRetried {
+		metadata["format_retried"] = true
+	}
+	if req.Debug || a.cfg.DebugPrompts {
+		metadata["debug"] = PromptDebug{Prompt: promptValue, Context: sourceContext.String()}
+	}
+	if len(skipped) > 0 {
+		metadata["skipped_sources"] = skipped
+	}
+	if isQuizJSON(req) {
+		// Keep the structured quiz for clients and show it as markdown
+		quiz, err := parseQuiz(response)
+		if err != nil {
+			return nil, fmt.Errorf("model did not produce a valid quiz: %w", err)
+		}
+		metadata["quiz"] = quiz
+		response = renderQuiz(quiz)
+	}
+	if len(truncated) > 0 {
+		metadata["truncated_for_context"] = true
+		metadata["truncated_sources"] = truncated
+		metadata["context_budget"] = map[string]interface{}{
+			"model":          model,
+			"context_window": window,
+			"source_tokens":  budget,
+		}
+	}
+
+	if multiLength {
+		variants, err := parseSummaryVariants(response, req.Lengths)
+		if err != nil {
+			// Keep the raw output rather than failing the whole generation
+			metadata["variants_error"] = err.Error()
+		} else {
+			primary := req.Lengths[0]
+			if _, ok := variants["medium"]; ok {
+				primary = "medium"
+			}
+			response = variants[primary]
+			metadata["length"] = primary
+			metadata["variants"] = variants
+		}
+		metadata["lengths"] = req.Lengths
+	}
+
 	return &TransformationResponse{
 		Type:      req.Type,
 		Content:   response,
 		Sources:   sourceSummaries,
 		CreatedAt: time.Now(),
-		Metadata: map[string]interface{}{
-			"length": req.Length,
-			"format": req.Format,
-		},
+		Metadata:  metadata,
 	}, nil
 }
 
-// Chat performs a chat query with RAG
-func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []ChatMessage) (*ChatResponse, error) {
-	// Perform similarity search to find relevant sources
-	docs, err := a.vectorStore.SimilaritySearch(ctx, message, a.cfg.MaxSources)
+// summaryVariantMarker matches the "=== short ===" lines separating summary variants
+var summaryVariantMarker = regexp.MustCompile(`(?m)^\s*={2,}\s*([A-Za-z_]+)\s*={2,}\s*$`)
+
+// parseSummaryVariants splits a multi-length summary response into its
+// variants, keyed by length. Every requested length must be present.
+func parseSummaryVariants(response string, lengths []string) (map[string]string, error) {
+	matches := summaryVariantMarker.FindAllStringSubmatchIndex(response, -1)
+	variants := make(map[string]string, len(matches))
+	for i, m := range matches {
+		end := len(response)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		name := strings.ToLower(response[m[2]:m[3]])
+		if text := strings.TrimSpace(response[m[1]:end]); text != "" {
+			variants[name] = text
+		}
+	}
+
+	result := make(map[string]string, len(lengths))
+	for _, length := range lengths {
+		text, ok := variants[length]
+		if !ok {
+			return nil, fmt.Errorf("response is missing the %s summary", length)
+		}
+		result[length] = text
+	}
+	return result, nil
+}
+
+// errNoSourceContent is returned when none of the sources of a
+// transformation has any content
+var errNoSourceContent = errors.New("none of the selected sources has any content")
+
+// splitEmptySources separates sources with content from those without,
+// which are logged and summarized for the note metadata
+func splitEmptySources(sources []Source) ([]Source, []SourceSummary) {
+	usable := make([]Source, 0, len(sources))
+	var skipped []SourceSummary
+	for _, src := range sources {
+		if strings.TrimSpace(src.Content) == "" {
+			golog.Warnf("skipping source %s (%s) with no content", src.Name, src.Type)
+			skipped = append(skipped, SourceSummary{ID: src.ID, Name: src.Name, Type: src.Type})
+			continue
+		}
+		usable = append(usable, src)
+	}
+	return usable, skipped
+}
+
+// truncateUTF8 cuts s to at most maxBytes without splitting a multi-byte rune
+func truncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
+
+// truncateRunes cuts s to at most maxRunes characters
+func truncateRunes(s string, maxRunes int) string {
+	for i := range s {
+		if maxRunes == 0 {
+			return s[:i]
+		}
+		maxRunes--
+	}
+	return s
+}
+
+// citationWord returns the word of the chat context labels, CHAT_CITATION_LABEL
+func (a *Agent) citationWord() string {
+	if word := strings.TrimSpace(a.cfg.ChatCitationLabel); word != "" {
+		return word
+	}
+	return "来源"
+}
+
+// chatDiversityCandidates is how many times MAX_SOURCES chunks are
+// retrieved for a chat before capping the chunks per source
+const chatDiversityCandidates = 3
+
+// Chat performs a chat query with RAG. When sourceIDs is not empty, retrieval
+// is restricted to those sources.
+func (a *Agent) Chat(ctx context.Context, notebookID, message string, scope ChatScope, history []ChatMessage, options ...llms.CallOption) (*ChatResponse, error) {
+	// The rest of the answer runs on the requested model
+	a, err := a.withModel(scope.Model)
 	if err != nil {
-		return nil, fmt.Errorf("failed to search documents: %w", err)
+		return nil, err
 	}
 
-	// Build context from retrieved documents
+	// Perform similarity search to find relevant sources
+	var docs []schema.Document
+	if scope.Note == nil || !scope.NoteOnly {
+		// With a per-source cap, more candidates are retrieved so the cap
+		// can make room for other sources
+		limit := a.cfg.MaxSources
+		if limit <= 0 {
+			limit = 5
+		}
+		candidates := limit
+		if a.cfg.ChatMaxChunksPerSource > 0 {
+			candidates *= chatDiversityCandidates
+		}
+		var err error
+		docs, err = a.vectorStore.SearchNotebook(ctx, notebookID, message, candidates, scope.SourceIDs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search documents: %w", err)
+		}
+		docs = diversifyBySource(docs, limit, a.cfg.ChatMaxChunksPerSource)
+
+		if scope.LoadImages != nil {
+			scope.Images = scope.LoadImages(ctx, chatImageSourceIDs(scope.SourceIDs, docs))
+		}
+	}
+
+	// Build context from the note the chat is about and retrieved documents
 	var contextBuilder strings.Builder
+	if note := scope.Note; note != nil {
+		content := note.Content
+		if a.cfg.MaxSourceBytes > 0 && len(content) > a.cfg.MaxSourceBytes {
+			content = truncateUTF8(content, a.cfg.MaxSourceBytes)
+		}
+		contextBuilder.WriteString(fmt.Sprintf("用户正在询问以下笔记，请以它为权威依据回答：\n笔记标题: %s\n笔记内容:\n%s\n\n", note.Title, content))
+	}
 	if len(docs) > 0 {
 		contextBuilder.WriteString("来源中的相关信息：\n\n")
 		for i, doc := range docs {
-			contextBuilder.WriteString(fmt.Sprintf("[来源 %d] %s\n", i+1, doc.PageContent))
+			contextBuilder.WriteString(fmt.Sprintf("%s %s\n", chatContextLabel(a.citationWord(), i+1), doc.PageContent))
+			if speakers, ok := doc.Metadata["speakers"].([]string); ok && len(speakers) > 0 {
+				contextBuilder.WriteString(fmt.Sprintf("发言人: %s\n", strings.Join(speakers, ", ")))
+			}
 			if source, ok := doc.Metadata["source"].(string); ok {
 				contextBuilder.WriteString(fmt.Sprintf("来源: %s\n\n", source))
 			}
 		}
 	}
+	if len(scope.Images) > 0 {
+		contextBuilder.WriteString("附带的图片来源：\n")
+		for i, img := range scope.Images {
+			contextBuilder.WriteString(fmt.Sprintf("[图片 %d] %s\n", i+1, img.Name))
+		}
+		contextBuilder.WriteString("请结合图片本身的内容回答。\n")
+	} else if len(docs) == 0 && scope.Note == nil {
+		contextBuilder.WriteString("来源中没有找到与问题相关的信息。请明确告诉用户笔记本的来源中没有相关内容，不要编造来源中的信息。\n")
+	}
 
-	// Build chat history
+	// Build chat history: the summary of earlier turns, then recent turns
 	var historyBuilder strings.Builder
-	for i, msg := range history {
-		if i >= 10 { // Limit history
-			break
-		}
-		role := "用户"
-		if msg.Role == "assistant" {
-			role = "助手"
-		}
-		historyBuilder.WriteString(fmt.Sprintf("%s: %s\n", role, msg.Content))
+	if scope.HistorySummary != "" {
+		historyBuilder.WriteString(fmt.Sprintf("此前对话的摘要：%s\n\n", scope.HistorySummary))
 	}
+	historyBuilder.WriteString(formatChatHistory(history))
 
 	// Create RAG prompt using f-string format
 	promptTemplate := prompts.NewPromptTemplate(
 		chatSystemPrompt(),
-		[]string{"history", "context", "question"},
+		[]string{"history", "context", "question", "label"},
 	)
 	promptTemplate.TemplateFormat = prompts.TemplateFormatFString
 
@@ -187,46 +688,153 @@ func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []
 		"history":  historyBuilder.String(),
 		"context":  contextBuilder.String(),
 		"question": message,
+		"label":    a.citationWord(),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to format prompt: %w", err)
 	}
 
 	// Generate response
-	ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
+	llmCtx, cancel := a.llmContext(ctx)
 	defer cancel()
 
-	response, err := a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+	var response string
+	if len(scope.Images) > 0 {
+		parts := make([]llms.ContentPart, 0, 2*len(scope.Images))
+		for i, img := range scope.Images {
+			parts = append(parts,
+				llms.TextContent{Text: fmt.Sprintf("[图片 %d] %s", i+1, img.Name)},
+				llms.BinaryPart(img.MimeType, img.Data))
+		}
+		response, err = a.generateContentWithRetry(llmCtx, promptValue, parts, options...)
+	} else {
+		response, err = a.generateWithRetry(llmCtx, promptValue, options...)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate response: %w", err)
+		return nil, fmt.Errorf("failed to generate response: %w", llmError(llmCtx, err))
 	}
 
-	// Build source summaries
+	// Build source summaries and citations. The sources are those the answer
+	// cites, or every retrieved one when it cites none.
+	cited := citedLabels(response, a.citationWord(), len(docs))
+	isCited := make(map[int]bool, len(cited))
+	for _, label := range cited {
+		isCited[label] = true
+	}
 	sourceSummaries := make([]SourceSummary, 0, len(docs))
+	citations := make([]Citation, 0, len(docs))
 	sourceMap := make(map[string]bool)
-	for _, doc := range docs {
-		if source, ok := doc.Metadata["source"].(string); ok {
-			if !sourceMap[source] {
-				sourceSummaries = append(sourceSummaries, SourceSummary{
-					ID:   source,
-					Name: source,
-					Type: "file",
-				})
-				sourceMap[source] = true
-			}
+	for i, doc := range docs {
+		source, ok := doc.Metadata["source"].(string)
+		if !ok {
+			continue
+		}
+		id, _ := doc.Metadata["source_id"].(string)
+		if id == "" {
+			id = source
 		}
+		if !sourceMap[id] && (len(cited) == 0 || isCited[i+1]) {
+			sourceSummaries = append(sourceSummaries, SourceSummary{
+				ID:   id,
+				Name: source,
+				Type: "file",
+			})
+			sourceMap[id] = true
+		}
+
+		chunk, _ := doc.Metadata["chunk"].(int)
+		start, _ := doc.Metadata["start_offset"].(int)
+		end, _ := doc.Metadata["end_offset"].(int)
+		chunkID, _ := doc.Metadata["chunk_id"].(string)
+		citations = append(citations, Citation{
+			Label:       i + 1,
+			SourceID:    id,
+			SourceName:  source,
+			ChunkIndex:  chunk,
+			StartOffset: start,
+			EndOffset:   end,
+			ChunkID:     chunkID,
+			Score:       doc.Score,
+			Cited:       isCited[i+1],
+		})
+	}
+
+	for _, img := range scope.Images {
+		if !sourceMap[img.SourceID] {
+			sourceSummaries = append(sourceSummaries, SourceSummary{ID: img.SourceID, Name: img.Name, Type: "image"})
+			sourceMap[img.SourceID] = true
+		}
+	}
+
+	metadata := map[string]interface{}{
+		"docs_retrieved": len(docs),
+	}
+	if scope.Model != "" {
+		metadata["model"] = a.modelName()
+	}
+	if len(cited) > 0 {
+		metadata["cited_labels"] = cited
+	}
+	if len(scope.Images) > 0 {
+		metadata["images_attached"] = len(scope.Images)
+	}
+	if scope.Note != nil {
+		metadata["note_id"] = scope.Note.ID
+	}
+	if scope.Debug || a.cfg.DebugPrompts {
+		metadata["debug"] = PromptDebug{Prompt: promptValue, Context: contextBuilder.String()}
 	}
 
 	return &ChatResponse{
 		Message:   response,
 		Sources:   sourceSummaries,
+		Citations: citations,
 		SessionID: notebookID,
-		Metadata: map[string]interface{}{
-			"docs_retrieved": len(docs),
-		},
+		Metadata:  metadata,
 	}, nil
 }
 
+// ChatScope selects what a chat answer is grounded in
+type ChatScope struct {
+	SourceIDs []string // restricts retrieval to these sources
+	Note      *Note    // given to the model as authoritative context
+	NoteOnly  bool     // answer from Note alone, without retrieval
+	Debug     bool     // return the rendered prompt in the metadata
+	// HistorySummary condenses the turns older than the history passed to Chat
+	HistorySummary string
+	Images         []ChatImage // image sources sent to a multimodal model
+	Model          string      // answers with this model instead of the default
+	// LoadImages loads the image sources among the given source IDs. Chat
+	// calls it after retrieval to fill Images; nil attaches no images.
+	LoadImages func(ctx context.Context, sourceIDs []string) []ChatImage
+}
+
+// chatImageSourceIDs returns the sources whose images are attached to a chat
+// question: those the user selected, or else the sources of the retrieved
+// chunks, such as the OCR text of an image, best first
+func chatImageSourceIDs(selected []string, docs []schema.Document) []string {
+	if len(selected) > 0 {
+		return selected
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		if id, _ := doc.Metadata["source_id"].(string); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ChatImage is an image source attached to a chat question
+type ChatImage struct {
+	SourceID string
+	Name     string
+	MimeType string
+	Data     []byte
+}
+
 // Slide represents a parsed PPT slide
 type Slide struct {
 	Style   string
@@ -299,8 +907,9 @@ func (a *Agent) ParsePPTSlides(content string) []Slide {
 	return slides
 }
 
-// GeneratePodcastScript generates a podcast script from sources
-func (a *Agent) GeneratePodcastScript(ctx context.Context, sources []Source, voice string) (string, error) {
+// GeneratePodcastScript generates a two-host podcast script from sources.
+// Use SynthesizePodcast to turn it into audio.
+func (a *Agent) GeneratePodcastScript(ctx context.Context, sources []Source) (string, error) {
 	req := &TransformationRequest{
 		Type:   "podcast",
 		Length: "medium",
@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// shortenRetryDelay makes withRetry back off briefly for the rest of a test
+func shortenRetryDelay(t *testing.T) {
+	t.Helper()
+	saved := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	t.Cleanup(func() { retryBaseDelay = saved })
+}
+
+// flakyCall returns a function for withRetry that fails with the given
+// errors in turn and then succeeds, counting its calls
+func flakyCall(calls *int, errs ...error) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		*calls++
+		if *calls <= len(errs) {
+			return "", errs[*calls-1]
+		}
+		return "ok", nil
+	}
+}
+
+func TestWithRetryRetriesTransientErrors(t *testing.T) {
+	shortenRetryDelay(t)
+
+	var calls int
+	result, err := withRetry(context.Background(), 2, flakyCall(&calls, errors.New("API returned unexpected status code: 503")))
+	if err != nil {
+		t.Fatalf("withRetry() error = %v", err)
+	}
+	if result != "ok" || calls != 2 {
+		t.Errorf("withRetry() = %q after %d calls, want \"ok\" after 2", result, calls)
+	}
+}
+
+func TestWithRetryStopsOnPermanentErrors(t *testing.T) {
+	permanent := fmt.Errorf("API returned unexpected status code: 400")
+	var calls int
+	_, err := withRetry(context.Background(), 3, flakyCall(&calls, permanent))
+	if !errors.Is(err, permanent) {
+		t.Fatalf("withRetry() error = %v, want %v", err, permanent)
+	}
+	if calls != 1 {
+		t.Errorf("withRetry() made %d calls, want 1", calls)
+	}
+}
+
+func TestWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+	var calls int
+	_, err := withRetry(context.Background(), 0, flakyCall(&calls, transient, transient))
+	if !errors.Is(err, transient) {
+		t.Fatalf("withRetry() error = %v, want %v", err, transient)
+	}
+	if calls != 1 {
+		t.Errorf("withRetry() made %d calls, want 1", calls)
+	}
+}
+
+func TestWithRetryStopsWhenContextIsCanceled(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var calls int
+	start := time.Now()
+	_, err := withRetry(ctx, 3, flakyCall(&calls, transient, transient))
+	if !errors.Is(err, transient) {
+		t.Fatalf("withRetry() error = %v, want %v", err, transient)
+	}
+	if calls != 1 {
+		t.Errorf("withRetry() made %d calls, want 1", calls)
+	}
+	if elapsed := time.Since(start); elapsed >= retryBaseDelay/2 {
+		t.Errorf("withRetry() returned after %v, want it to stop waiting on cancel", elapsed)
+	}
+}
+
+func TestWithRetrySkipsRetryPastDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var calls int
+	_, err := withRetry(ctx, 3, flakyCall(&calls, errors.New("request timeout")))
+	if err == nil {
+		t.Fatal("withRetry() succeeded, want the timeout error")
+	}
+	if calls != 1 {
+		t.Errorf("withRetry() made %d calls, want 1", calls)
+	}
+}
+
+// flakyModel is an llms.Model that fails with errs in turn and then answers
+type flakyModel struct {
+	errs  []error
+	calls int
+}
+
+func (m *flakyModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	m.calls++
+	if m.calls <= len(m.errs) {
+		return nil, m.errs[m.calls-1]
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: "ok"}}}, nil
+}
+
+func (m *flakyModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+func TestGenerateWithRetryRetriesTransientErrors(t *testing.T) {
+	shortenRetryDelay(t)
+
+	transient := errors.New("API returned unexpected status code: 503")
+	model := &flakyModel{errs: []error{transient, transient}}
+	agent := &Agent{
+		llm:      model,
+		cfg:      Config{LLMMaxRetries: 2},
+		provider: NewGeminiClient("", model, ""),
+		limiter:  newLLMLimiter(1, 0),
+	}
+
+	result, err := agent.generateWithRetry(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("generateWithRetry() error = %v", err)
+	}
+	if result != "ok" || model.calls != 3 {
+		t.Errorf("generateWithRetry() = %q after %d calls, want \"ok\" after 3", result, model.calls)
+	}
+	if load := agent.limiter.load(); load.InFlight != 0 {
+		t.Errorf("generateWithRetry() left %d slots taken, want 0", load.InFlight)
+	}
+}
@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// defaultContextWindow is assumed for models missing from
+// modelContextWindows when MODEL_CONTEXT_WINDOW is not set
+const defaultContextWindow = 32768
+
+// modelContextWindows maps model name prefixes to their context window in
+// tokens. The longest matching prefix wins.
+var modelContextWindows = map[string]int{
+	"gpt-3.5-turbo": 16385,
+	"gpt-4":         8192,
+	"gpt-4-turbo":   128000,
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"gpt-5":         400000,
+	"o1":            200000,
+	"o3":            200000,
+	"o4-mini":       200000,
+	"gemini-":       1048576,
+	"claude-":       200000,
+	"deepseek":      65536,
+	"llama3":        8192,
+	"llama3.1":      131072,
+	"llama3.2":      131072,
+	"llama3.3":      131072,
+	"qwen2.5":       32768,
+	"qwen3":         40960,
+	"mistral":       32768,
+	"gemma2":        8192,
+	"gemma3":        131072,
+}
+
+// contextWindow returns the context window of a model in tokens
+func (a *Agent) contextWindow(model string) int {
+	if a.cfg.ModelContextWindow > 0 {
+		return a.cfg.ModelContextWindow
+	}
+	name := strings.ToLower(model)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	window, matched := defaultContextWindow, 0
+	for prefix, size := range modelContextWindows {
+		if strings.HasPrefix(name, prefix) && len(prefix) > matched {
+			window, matched = size, len(prefix)
+		}
+	}
+	return window
+}
+
+// estimateTokens roughly estimates the tokens in a text: one per CJK
+// character and one per four bytes of anything else
+func estimateTokens(text string) int {
+	cjk, other := 0, 0
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			cjk++
+		} else {
+			other += len(string(r))
+		}
+	}
+	return cjk + (other+3)/4
+}
+
+// sourceTokenBudget returns the tokens left for source content in a prompt
+// of the given overhead, keeping room for the model's answer
+func sourceTokenBudget(window, promptTokens int) int {
+	reserve := window / 4
+	if reserve > 8192 {
+		reserve = 8192
+	}
+	budget := window - reserve - promptTokens
+	if budget < 0 {
+		return 0
+	}
+	return budget
+}
+
+// allocateTokens shares a token budget fairly among sources needing the
+// given numbers of tokens: sources smaller than an equal share keep all of
+// theirs, and what they leave is split among the larger ones
+func allocateTokens(needs []int, budget int) []int {
+	alloc := make([]int, len(needs))
+	order := make([]int, len(needs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return needs[order[i]] < needs[order[j]] })
+
+	for k, i := range order {
+		share := budget / (len(order) - k)
+		if needs[i] < share {
+			share = needs[i]
+		}
+		alloc[i] = share
+		budget -= share
+	}
+	return alloc
+}
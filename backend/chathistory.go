@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/prompts"
+)
+
+// Session metadata keys caching the summary of the older turns of a chat
+const (
+	historySummaryKey      = "history_summary"
+	historySummaryUntilKey = "history_summary_until" // ID of the last summarized message
+	historyPrunedKey       = "history_pruned"        // Messages deleted by CHAT_HISTORY_LIMIT so far
+)
+
+// formatChatHistory renders chat messages as the history block of a prompt
+func formatChatHistory(history []ChatMessage) string {
+	var b strings.Builder
+	for _, msg := range history {
+		role := "用户"
+		if msg.Role == "assistant" {
+			role = "助手"
+		}
+		b.WriteString(fmt.Sprintf("%s: %s\n", role, msg.Content))
+	}
+	return b.String()
+}
+
+// SummarizeChatHistory condenses chat messages, and the summary of the turns
+// before them if any, into a "conversation so far" summary
+func (a *Agent) SummarizeChatHistory(ctx context.Context, previous string, messages []ChatMessage) (string, error) {
+	prompt := prompts.NewPromptTemplate(chatHistoryPrompt(), []string{"summary", "history"})
+	prompt.TemplateFormat = prompts.TemplateFormatFString
+
+	if previous == "" {
+		previous = "无"
+	}
+	promptValue, err := prompt.Format(map[string]any{
+		"summary": previous,
+		"history": formatChatHistory(messages),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+
+	ctx, cancel := a.llmContext(ctx)
+	defer cancel()
+
+	summary, err := a.generateWithRetry(ctx, promptValue)
+	if err != nil {
+		return "", llmError(ctx, err)
+	}
+	return strings.TrimSpace(summary), nil
+}
+
+// chatHistory returns the part of a session's history given verbatim to the
+// model and the summary of the turns before it.
+//
+// The summary is cached in the session metadata. Turns after it are kept
+// verbatim until there are more than CHAT_SUMMARIZE_AFTER of them; then all
+// but the last CHAT_HISTORY_WINDOW are folded into the summary in one call.
+// A summary without a last message covers turns pruned from the session.
+// Without summarization only the last CHAT_HISTORY_WINDOW messages are kept.
+func (s *Server) chatHistory(ctx context.Context, session *ChatSession, history []ChatMessage) ([]ChatMessage, string) {
+	window := s.cfg.ChatHistoryWindow
+	if window <= 0 {
+		window = 10
+	}
+	threshold := s.cfg.ChatSummarizeAfter
+	if threshold <= 0 {
+		if len(history) > window {
+			history = history[len(history)-window:]
+		}
+		return history, ""
+	}
+	threshold = max(threshold, window)
+
+	// Turns covered by the cached summary are left out, unless the last one
+	// was deleted, in which case everything is summarized again
+	summary, _ := session.Metadata[historySummaryKey].(string)
+	until, _ := session.Metadata[historySummaryUntilKey].(string)
+	recent := history
+	if summary != "" && until != "" {
+		summary = ""
+		for i, msg := range history {
+			if msg.ID == until {
+				summary, _ = session.Metadata[historySummaryKey].(string)
+				recent = history[i+1:]
+				break
+			}
+		}
+	}
+	if len(recent) <= threshold {
+		return recent, summary
+	}
+
+	older, kept := recent[:len(recent)-window], recent[len(recent)-window:]
+	updated, err := s.agent.SummarizeChatHistory(ctx, summary, older)
+	if err != nil {
+		golog.Warnf("failed to summarize history of chat session %s, keeping the last %d messages: %v", session.ID, window, err)
+		return kept, summary
+	}
+
+	if session.Metadata == nil {
+		session.Metadata = make(map[string]interface{})
+	}
+	session.Metadata[historySummaryKey] = updated
+	session.Metadata[historySummaryUntilKey] = older[len(older)-1].ID
+	if err := s.store.UpdateChatSessionMetadata(ctx, session.ID, session.Metadata); err != nil {
+		golog.Errorf("failed to cache history summary of chat session %s: %v", session.ID, err)
+	}
+	golog.Infof("summarized %d messages of chat session %s", len(older), session.ID)
+	return kept, updated
+}
+
+// pruneChatHistory deletes the oldest messages of a session beyond
+// CHAT_HISTORY_LIMIT and returns how many were deleted. With summarization
+// on, only messages already folded into the history summary are deleted, so
+// the model keeps their gist; the others wait for the next summary.
+func (s *Server) pruneChatHistory(ctx context.Context, sessionID string) int {
+	limit := s.cfg.ChatHistoryLimit
+	if limit <= 0 {
+		return 0
+	}
+	session, err := s.store.GetChatSession(ctx, sessionID)
+	if err != nil {
+		golog.Errorf("failed to load chat session %s for pruning: %v", sessionID, err)
+		return 0
+	}
+	excess := len(session.Messages) - limit
+	if excess <= 0 {
+		return 0
+	}
+
+	if session.Metadata == nil {
+		session.Metadata = make(map[string]interface{})
+	}
+	if s.cfg.ChatSummarizeAfter > 0 {
+		summary, _ := session.Metadata[historySummaryKey].(string)
+		until, _ := session.Metadata[historySummaryUntilKey].(string)
+		covered := 0
+		for i, msg := range session.Messages {
+			if summary != "" && msg.ID == until {
+				covered = i + 1
+				break
+			}
+		}
+		if covered <= excess {
+			// The last summarized message goes as well; the summary then
+			// covers everything before the remaining messages
+			excess = covered
+			session.Metadata[historySummaryUntilKey] = ""
+		}
+		if excess == 0 {
+			return 0
+		}
+	}
+
+	ids := make([]string, excess)
+	for i, msg := range session.Messages[:excess] {
+		ids[i] = msg.ID
+	}
+	pruned, _ := session.Metadata[historyPrunedKey].(float64)
+	session.Metadata[historyPrunedKey] = int(pruned) + excess
+	// The summary is saved first: should the deletion fail, the model sees
+	// some turns twice rather than none
+	if err := s.store.UpdateChatSessionMetadata(ctx, sessionID, session.Metadata); err != nil {
+		golog.Errorf("failed to update chat session %s before pruning: %v", sessionID, err)
+		return 0
+	}
+	n, err := s.store.DeleteChatMessages(ctx, sessionID, ids)
+	if err != nil {
+		golog.Errorf("failed to prune chat session %s: %v", sessionID, err)
+		return 0
+	}
+	golog.Infof("pruned %d messages of chat session %s", n, sessionID)
+	return n
+}
+
+// recordPruned tells the client how many old messages an exchange pruned
+func recordPruned(response *ChatResponse, pruned int) {
+	if pruned == 0 {
+		return
+	}
+	if response.Metadata == nil {
+		response.Metadata = make(map[string]interface{})
+	}
+	response.Metadata["history_pruned"] = pruned
+}
@@ -0,0 +1,41 @@
+package backend
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// chatContextLabel returns the marker of the n-th retrieved chunk in a chat's
+// context, which the model is asked to cite answers with
+func chatContextLabel(word string, n int) string {
+	return fmt.Sprintf("[%s %d]", word, n)
+}
+
+// citationPattern matches the markers of a cited chunk in an answer:
+// "[来源 2]", several labels in one pair of brackets such as "[来源 1, 3]",
+// and the bare "[2]" some models shorten them to
+func citationPattern(word string) *regexp.Regexp {
+	label := `(?:` + regexp.QuoteMeta(word) + `\s*)?\d+`
+	return regexp.MustCompile(`\[\s*(` + label + `(?:\s*[,，、;；]\s*` + label + `)*)\s*\]`)
+}
+
+// citedLabels returns the labels from 1 to count cited in an answer, in the
+// order first cited
+func citedLabels(answer, word string, count int) []int {
+	var labels []int
+	seen := make(map[int]bool)
+	digits := regexp.MustCompile(`\d+`)
+	for _, m := range citationPattern(word).FindAllStringSubmatch(answer, -1) {
+		for _, d := range digits.FindAllString(strings.ReplaceAll(m[1], word, ""), -1) {
+			n, err := strconv.Atoi(d)
+			if err != nil || n < 1 || n > count || seen[n] {
+				continue
+			}
+			seen[n] = true
+			labels = append(labels, n)
+		}
+	}
+	return labels
+}
@@ -3,9 +3,41 @@ package backend
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Chunk overlap modes
+const (
+	OverlapModeAbsolute = "absolute"
+	OverlapModePercent  = "percent"
+)
+
+// Duplicate notebook name policies
+const (
+	DuplicatePolicyAllow  = "allow"
+	DuplicatePolicyWarn   = "warn"
+	DuplicatePolicyReject = "reject"
+)
+
+// LLM providers
+const (
+	LLMProviderOpenAI = "openai"
+	LLMProviderOllama = "ollama"
+)
+
+// pgvector index methods
+const (
+	PGVectorIndexHNSW    = "hnsw"
+	PGVectorIndexIVFFlat = "ivfflat"
 )
 
 // Config holds the application configuration
@@ -13,40 +45,145 @@ type Config struct {
 	// Server settings
 	ServerHost string
 	ServerPort string
+	SkipPreflight bool // skip the LLM connectivity checks before the server starts
+
+	// CORS settings (empty origins = same-origin only)
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSAllowCredentials bool
+
+	// Request timeouts (0 disables)
+	RequestTimeout   time.Duration // default for API routes without a specific timeout
+	HealthTimeout    time.Duration
+	MetricsEnabled   bool // serve Prometheus metrics on /metrics
+	UploadTimeout    time.Duration
+	ChatTimeout      time.Duration
+	TransformTimeout time.Duration
 
 	// LLM settings
+	LLMProvider       string // "openai" (any OpenAI-compatible server), "ollama", or empty to detect
 	OpenAIAPIKey      string
 	OpenAIBaseURL     string
 	OpenAIModel       string
 	EmbeddingModel    string
+	EmbeddingBatchSize int // chunks sent per embedding request
 	GoogleAPIKey      string
+	ImageBackend      string // "auto", "gemini" or "openai"
+	InfographModel    string // image model, empty for the backend's default
+	InfographAspectRatio string
+	InfographSize     string // "1K"/"2K"/"4K" for Gemini, "1024x1792" style for OpenAI
 	OllamaBaseURL     string
 	OllamaModel       string
+	OllamaKeepAlive   string // how long Ollama keeps models loaded, e.g. "30m" or "-1", empty for Ollama's default
+	OllamaPreload     bool   // warm up the chat model on startup
+	LLMMaxRetries     int
+	LLMTimeout        time.Duration // per generation call, 0 disables
+	LLMSeed           int           // default sampling seed of transformations, 0 for none
+	LLMAllowedModels  []string      // models requests may choose instead of the default
+	LLMMaxConcurrency int           // generations running at once, 0 for no limit
+	LLMMaxQueue       int           // generations waiting for a slot before 503s, 0 for no limit
+	PromptAdaptationFile string
+	SystemPromptPrefix string // prepended to every prompt
+	OutputLanguage    string // language of transformations, "auto" follows the sources
+	DebugPrompts      bool   // return the rendered prompt of chats and transformations in their metadata
+	ChatHistoryWindow  int // recent chat messages given verbatim to the model
+	ChatSummarizeAfter int // messages after which older turns are summarized, 0 to drop them instead
+	ChatHistoryLimit   int // messages stored per chat session, older ones are pruned; 0 keeps all
+	LLMMultimodal     string // "auto" detects image input support from the model name, "true" or "false"
+	ChatMaxImages     int    // image sources attached to a chat question with a multimodal model
+	PromptsDir        string
 
 	// Vector store settings
 	VectorStoreType    string // "memory", "supabase", "pgvector", "redis", "sqlite"
+	SkipStartupReindex bool   // index notebooks on first use instead of on startup
+	MaxIndexedNotebooks int   // notebooks kept indexed when indexing on first use, 0 for no limit
 	SupabaseURL        string
 	SupabaseKey        string
 	PostgreSQLURL      string
+	PGVectorTable      string // table of the pgvector store
+	PGVectorIndex      string // "hnsw" or "ivfflat"
 	RedisURL           string
+	RedisPrefix        string // key prefix of the Redis vector store
 	SQLitePath         string
 
+	// DataDir is the absolute directory the default paths of the databases,
+	// uploads, prompts and temporary files are derived from
+	DataDir            string
+
 	// Store settings (for checkpoints)
 	StoreType          string // "memory", "sqlite", "postgres", "redis"
 	StorePath          string
 
+	// File storage settings
+	UploadsDir         string // uploaded files and generated assets are written here first
+	UploadSessionsDir  string // parts of resumable uploads in progress
+	MaxUploadBytes     int64    // 0 = unlimited
+	AllowedUploadExtensions []string // "*" allows any extension
+	StorageBackend     string // "local" or "s3"
+	S3Endpoint         string // empty for AWS
+	S3Region           string
+	S3Bucket           string
+	S3AccessKey        string
+	S3SecretKey        string
+	S3Prefix           string
+	S3PublicURL        string // when set, /uploads redirects here instead of proxying
+	S3PathStyle        bool   // address the bucket by path, as most S3-compatible servers expect
+	S3SourceBuckets    []string // buckets besides S3_BUCKET that s3:// file sources may be read from
+	FetchAllowPrivate  bool     // let URL sources, file URLs and webhooks reach private and local addresses
+
 	// Application settings
+	NotebookDuplicatePolicy string // "allow", "warn" or "reject"
 	MaxSources         int
+	ChatMaxChunksPerSource int // chunks of one source in a chat's context before other sources get a turn, 0 for no cap
+	ChatCitationLabel  string // word of the [来源 N] labels chat answers cite their context with
+	SimilarityThreshold float64 // minimum retrieval score (0-1), 0 keeps every match
+	RerankEnabled      bool   // rerank retrieved chunks with RERANK_URL before taking the best
+	RerankURL          string // rerank endpoint, e.g. https://api.cohere.com/v2/rerank
+	RerankAPIKey       string
+	RerankModel        string
+	RerankAPI          string // request format: "cohere" or "tei"
+	RerankCandidates   int    // chunks retrieved for the reranker to choose from
 	MaxContextLength   int
+	ModelContextWindow int // context window in tokens, 0 looks it up by model name
+	MaxSourceBytes     int
 	ChunkSize          int
 	ChunkOverlap       int
+	ChunkOverlapMode   string // "absolute" or "percent"
+	TranscriptChunkByTurn bool
+	TransformBatchWorkers int
+	TransformBatchMax  int // transformations accepted in one batch request
+	TransformTopK      int // chunks retrieved for transformations with a query
+	TranslateChunkSize int // characters translated per LLM call
+	StreamingThreshold int // total source characters above which transformations use map-reduce
+	StreamingWindowSize int
+	StreamingWorkers   int
+	JobWorkers         int
+	WebhookSecret      string // signs job callbacks, see WebhookSignatureHeader
+	WebhookMaxRetries  int
+	SitemapMaxPages    int
+	SitemapWorkers     int
+	NoteHistoryLimit   int // versions kept per note, 0 disables history
+	NoteEscapeHTML     bool // escape raw HTML tags in generated notes
+	ChatTitleMode      string // "llm" or "truncate"
 
 	// Podcast generation
 	EnablePodcast      bool
 	PodcastVoice       string
+	PodcastVoiceHost1  string
+	PodcastVoiceHost2  string
+	PodcastTTSModel    string
 
 	// Document conversion
 	EnableMarkitdown   bool
+	SourceEncoding     string // forces the encoding of text files, empty = detect
+	OCREngine          string // "auto", "tesseract", "vision", "none"
+	TesseractPath      string
+	OCRLanguages       string
+
+	// Note export
+	PDFRenderer        string // chromium, google-chrome or wkhtmltopdf binary, empty = detect
+	PDFNoSandbox       bool   // run chromium without its sandbox, for containers that cannot provide one
 
 	// LangSmith tracing (optional)
 	LangChainAPIKey    string
@@ -62,58 +199,341 @@ func loadEnv() {
 	_ = godotenv.Load(".env.local")
 }
 
+// LoadConfigFile loads configuration from a YAML or JSON file, with
+// environment variables (and .env) overriding its values. Keys are the
+// environment variable names, in any case; nested maps join their keys with
+// "_" and lists become comma-separated values, so
+//
+//	openai:
+//	  api_key: sk-...
+//	cors_allowed_origins: [https://a.example, https://b.example]
+//
+// sets OPENAI_API_KEY and CORS_ALLOWED_ORIGINS.
+func LoadConfigFile(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Config{}, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flattenConfig(values, "", doc); err != nil {
+		return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	// File values only fill in what the environment leaves unset
+	loadEnv()
+	for key, value := range values {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+	cfg := LoadConfig()
+
+	// A misspelled key would otherwise leave its setting at the default
+	var unknown []string
+	for key := range values {
+		if !envKeyRead(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return Config{}, fmt.Errorf("invalid config file %s: unknown keys %s", path, strings.Join(unknown, ", "))
+	}
+	return cfg, nil
+}
+
+// flattenConfig turns a parsed config file into environment variable values
+func flattenConfig(values map[string]string, prefix string, node interface{}) error {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+			if prefix != "" {
+				name = prefix + "_" + name
+			}
+			if err := flattenConfig(values, name, child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return fmt.Errorf("%s: lists may only hold plain values", prefix)
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		// An empty value keeps the default
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+	return nil
+}
+
 // LoadConfig loads configuration from environment variables with defaults
 func LoadConfig() Config {
 	// Load .env file first (if exists)
 	loadEnv()
 
+	// Paths not set explicitly live under DATA_DIR
+	dataDir := getEnv("DATA_DIR", "./data")
+	if abs, err := filepath.Abs(dataDir); err == nil {
+		dataDir = abs
+	}
+
 	cfg := Config{
 		ServerHost:       getEnv("SERVER_HOST", "0.0.0.0"),
 		ServerPort:       getEnv("SERVER_PORT", "8080"),
+		SkipPreflight:    getEnvBool("SKIP_PREFLIGHT", false),
+		CORSAllowedOrigins:   getEnvList("CORS_ALLOWED_ORIGINS", nil),
+		CORSAllowedMethods:   getEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
+		CORSAllowedHeaders:   getEnvList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Authorization", "Idempotency-Key"}),
+		CORSAllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		RequestTimeout:   getEnvDuration("REQUEST_TIMEOUT", 60*time.Second),
+		HealthTimeout:    getEnvDuration("HEALTH_TIMEOUT", 5*time.Second),
+		MetricsEnabled:   getEnvBool("METRICS_ENABLED", false),
+		UploadTimeout:    getEnvDuration("UPLOAD_TIMEOUT", 10*time.Minute),
+		ChatTimeout:      getEnvDuration("CHAT_TIMEOUT", 5*time.Minute),
+		TransformTimeout: getEnvDuration("TRANSFORM_TIMEOUT", 10*time.Minute),
+		LLMProvider:      strings.ToLower(getEnv("LLM_PROVIDER", "")),
 		OpenAIAPIKey:     getEnv("OPENAI_API_KEY", ""),
 		OpenAIBaseURL:    getEnv("OPENAI_BASE_URL", ""),
 		OpenAIModel:      getEnv("OPENAI_MODEL", "gpt-4o-mini"),
-		EmbeddingModel:   getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
+		EmbeddingModel:   getEnv("EMBEDDING_MODEL", ""),
+		EmbeddingBatchSize: getEnvInt("EMBEDDING_BATCH_SIZE", 64),
 		GoogleAPIKey:     getEnv("GOOGLE_API_KEY", ""),
+		ImageBackend:     strings.ToLower(getEnv("IMAGE_BACKEND", ImageBackendAuto)),
+		InfographModel:   getEnv("INFOGRAPH_MODEL", ""),
+		InfographAspectRatio: getEnv("INFOGRAPH_ASPECT_RATIO", ""),
+		InfographSize:    getEnv("INFOGRAPH_SIZE", ""),
 		OllamaBaseURL:    getEnv("OLLAMA_BASE_URL", "http://localhost:11434"),
 		OllamaModel:      getEnv("OLLAMA_MODEL", "llama3.2"),
+		OllamaKeepAlive:  getEnv("OLLAMA_KEEP_ALIVE", ""),
+		OllamaPreload:    getEnvBool("OLLAMA_PRELOAD", false),
+		LLMMaxRetries:    getEnvInt("LLM_MAX_RETRIES", 3),
+		LLMTimeout:       time.Duration(getEnvInt("LLM_TIMEOUT_SECONDS", 300)) * time.Second,
+		LLMSeed:          getEnvInt("LLM_SEED", 0),
+		LLMAllowedModels: getEnvList("LLM_ALLOWED_MODELS", nil),
+		LLMMaxConcurrency: getEnvInt("LLM_MAX_CONCURRENCY", 0),
+		LLMMaxQueue:      getEnvInt("LLM_MAX_QUEUE", 0),
+		PromptAdaptationFile: getEnv("PROMPT_ADAPTATION_FILE", ""),
+		SystemPromptPrefix: strings.TrimSpace(getEnv("SYSTEM_PROMPT_PREFIX", "")),
+		PromptsDir:       getEnv("PROMPTS_DIR", filepath.Join(dataDir, "prompts")),
+		OutputLanguage:   getEnv("OUTPUT_LANGUAGE", "zh"),
+		DebugPrompts:     getEnvBool("DEBUG_PROMPTS", false),
+		ChatHistoryWindow: getEnvInt("CHAT_HISTORY_WINDOW", 10),
+		ChatSummarizeAfter: getEnvInt("CHAT_SUMMARIZE_AFTER", 20),
+		ChatHistoryLimit: getEnvInt("CHAT_HISTORY_LIMIT", 0),
+		LLMMultimodal:    strings.ToLower(getEnv("LLM_MULTIMODAL", "auto")),
+		ChatMaxImages:    getEnvInt("CHAT_MAX_IMAGES", 4),
 		VectorStoreType:  getEnv("VECTOR_STORE_TYPE", "sqlite"),
+		SkipStartupReindex: getEnvBool("SKIP_STARTUP_REINDEX", false),
+		MaxIndexedNotebooks: getEnvInt("MAX_INDEXED_NOTEBOOKS", 0),
 		SupabaseURL:      getEnv("SUPABASE_URL", ""),
 		SupabaseKey:      getEnv("SUPABASE_KEY", ""),
 		PostgreSQLURL:    getEnv("POSTGRES_URL", ""),
+		PGVectorTable:    getEnv("PGVECTOR_TABLE", "notex_chunks"),
+		PGVectorIndex:    getEnv("PGVECTOR_INDEX", PGVectorIndexHNSW),
 		RedisURL:         getEnv("REDIS_URL", "redis://localhost:6379"),
-		SQLitePath:       getEnv("SQLITE_PATH", "./data/vector.db"),
+		RedisPrefix:      getEnv("REDIS_PREFIX", "notex"),
+		SQLitePath:       getEnv("SQLITE_PATH", filepath.Join(dataDir, "vector.db")),
+		DataDir:          dataDir,
 		StoreType:        getEnv("STORE_TYPE", "sqlite"),
-		StorePath:        getEnv("STORE_PATH", "./data/checkpoints.db"),
+		StorePath:        getEnv("STORE_PATH", filepath.Join(dataDir, "checkpoints.db")),
+		UploadsDir:       getEnv("UPLOADS_DIR", filepath.Join(dataDir, "uploads")),
+		UploadSessionsDir: getEnv("UPLOAD_SESSIONS_DIR", filepath.Join(dataDir, "upload_sessions")),
+		MaxUploadBytes:   int64(getEnvInt("MAX_UPLOAD_BYTES", 50<<20)),
+		AllowedUploadExtensions: getEnvList("ALLOWED_UPLOAD_EXTENSIONS", defaultUploadExtensions),
+		StorageBackend:   getEnv("STORAGE_BACKEND", StorageBackendLocal),
+		S3Endpoint:       getEnv("S3_ENDPOINT", ""),
+		S3Region:         getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:         getEnv("S3_BUCKET", ""),
+		S3AccessKey:      getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:      getEnv("S3_SECRET_KEY", ""),
+		S3Prefix:         getEnv("S3_PREFIX", ""),
+		S3PublicURL:      getEnv("S3_PUBLIC_URL", ""),
+		S3PathStyle:      getEnvBool("S3_PATH_STYLE", false),
+		S3SourceBuckets:  getEnvList("S3_SOURCE_BUCKETS", nil),
+		FetchAllowPrivate: getEnvBool("FETCH_ALLOW_PRIVATE", false),
+		NotebookDuplicatePolicy: getEnv("NOTEBOOK_DUPLICATE_POLICY", DuplicatePolicyWarn),
 		MaxSources:       getEnvInt("MAX_SOURCES", 5),
+		ChatMaxChunksPerSource: getEnvInt("CHAT_MAX_CHUNKS_PER_SOURCE", 2),
+		ChatCitationLabel: getEnv("CHAT_CITATION_LABEL", "来源"),
+		SimilarityThreshold: getEnvFloat("SIMILARITY_THRESHOLD", 0),
+		RerankEnabled:    getEnvBool("RERANK_ENABLED", false),
+		RerankURL:        getEnv("RERANK_URL", ""),
+		RerankAPIKey:     getEnv("RERANK_API_KEY", ""),
+		RerankModel:      getEnv("RERANK_MODEL", ""),
+		RerankAPI:        strings.ToLower(getEnv("RERANK_API", RerankAPICohere)),
+		RerankCandidates: getEnvInt("RERANK_CANDIDATES", 20),
 		MaxContextLength: getEnvInt("MAX_CONTEXT_LENGTH", 128000),
+		ModelContextWindow: getEnvInt("MODEL_CONTEXT_WINDOW", 0),
+		MaxSourceBytes:   getEnvInt("MAX_SOURCE_BYTES", 1048576),
 		ChunkSize:        getEnvInt("CHUNK_SIZE", 1000),
-		ChunkOverlap:     getEnvInt("CHUNK_OVERLAP", 200),
-		EnablePodcast:    getEnvBool("ENABLE_PODCAST", true),
+		TransformBatchWorkers: getEnvInt("TRANSFORM_BATCH_WORKERS", 3),
+		TransformBatchMax: getEnvInt("TRANSFORM_BATCH_MAX", 10),
+		TransformTopK:    getEnvInt("TRANSFORM_TOP_K", 20),
+		TranslateChunkSize: getEnvInt("TRANSLATE_CHUNK_SIZE", 4000),
+		StreamingThreshold: getEnvInt("STREAMING_THRESHOLD", 200000),
+		StreamingWindowSize: getEnvInt("STREAMING_WINDOW_SIZE", 50000),
+		StreamingWorkers: getEnvInt("STREAMING_WORKERS", 2),
+		JobWorkers:       getEnvInt("JOB_WORKERS", 2),
+		WebhookSecret:    getEnv("WEBHOOK_SECRET", ""),
+		WebhookMaxRetries: getEnvInt("WEBHOOK_MAX_RETRIES", 3),
+		SitemapMaxPages:  getEnvInt("SITEMAP_MAX_PAGES", 100),
+		SitemapWorkers:   getEnvInt("SITEMAP_WORKERS", 4),
+		NoteHistoryLimit: getEnvInt("NOTE_HISTORY_LIMIT", 20),
+		NoteEscapeHTML:   getEnvBool("NOTE_ESCAPE_HTML", true),
+		ChatTitleMode:    getEnv("CHAT_TITLE_MODE", ChatTitleModeLLM),
+		TranscriptChunkByTurn: getEnvBool("TRANSCRIPT_CHUNK_BY_TURN", true),
+		EnablePodcast:    getEnvBool("ENABLE_PODCAST", false),
 		PodcastVoice:     getEnv("PODCAST_VOICE", "alloy"),
+		PodcastVoiceHost2: getEnv("PODCAST_VOICE_HOST2", "echo"),
+		PodcastTTSModel:  getEnv("PODCAST_TTS_MODEL", "tts-1"),
 		EnableMarkitdown: getEnvBool("ENABLE_MARKITDOWN", true),
+		SourceEncoding:   getEnv("SOURCE_ENCODING", ""),
+		OCREngine:        getEnv("OCR_ENGINE", OCREngineAuto),
+		TesseractPath:    getEnv("TESSERACT_PATH", "tesseract"),
+		OCRLanguages:     getEnv("OCR_LANGUAGES", "eng+chi_sim"),
+		PDFRenderer:      getEnv("PDF_RENDERER", ""),
+		PDFNoSandbox:     getEnvBool("PDF_NO_SANDBOX", false),
 		LangChainAPIKey:  getEnv("LANGCHAIN_API_KEY", ""),
 		LangChainProject: getEnv("LANGCHAIN_PROJECT", "open-notebook"),
 	}
 
+	cfg.ChunkOverlap, cfg.ChunkOverlapMode = getEnvOverlap("CHUNK_OVERLAP", 200)
+	cfg.PodcastVoiceHost1 = getEnv("PODCAST_VOICE_HOST1", cfg.PodcastVoice)
+
 	// Auto-detect provider from base URL or model name
-	if cfg.OpenAIBaseURL == "" && cfg.OpenAIModel != "" {
+	if cfg.LLMProvider == "" && cfg.OpenAIBaseURL == "" && cfg.OpenAIModel != "" {
 		if contains(cfg.OpenAIModel, "ollama") || contains(cfg.OpenAIModel, "llama") {
 			cfg.OpenAIBaseURL = cfg.OllamaBaseURL
 		}
 	}
 
+	// Ollama does not serve OpenAI's embedding models, so the default
+	// embedding model depends on the provider. An empty EMBEDDING_MODEL turns
+	// embeddings off.
+	if _, ok := lookupEnv("EMBEDDING_MODEL"); !ok {
+		cfg.EmbeddingModel = defaultOpenAIEmbeddingModel
+		if cfg.IsOllama() {
+			cfg.EmbeddingModel = defaultOllamaEmbeddingModel
+		}
+	}
+
 	return cfg
 }
 
+// Default embedding models of each provider, used without EMBEDDING_MODEL
+const (
+	defaultOpenAIEmbeddingModel = "text-embedding-3-small"
+	defaultOllamaEmbeddingModel = "nomic-embed-text"
+)
+
 // ValidateConfig validates the configuration
 func ValidateConfig(cfg Config) error {
 	// Check if at least one LLM provider is configured
-	hasOpenAI := cfg.OpenAIAPIKey != ""
-	hasOllama := cfg.OpenAIBaseURL != "" && contains(cfg.OpenAIBaseURL, "11434")
+	switch cfg.LLMProvider {
+	case "", LLMProviderOpenAI, LLMProviderOllama:
+	default:
+		return fmt.Errorf("LLM_PROVIDER must be openai or ollama, got %q", cfg.LLMProvider)
+	}
+
+	// Local OpenAI-compatible servers (vLLM, LM Studio) often need no key,
+	// so a base URL is enough
+	hasOpenAI := cfg.OpenAIAPIKey != "" || (cfg.LLMProvider == LLMProviderOpenAI && cfg.OpenAIBaseURL != "")
+	hasOllama := cfg.IsOllama()
 
 	if !hasOpenAI && !hasOllama {
-		return fmt.Errorf("either OPENAI_API_KEY or OLLAMA_BASE_URL must be set")
+		return fmt.Errorf("either OPENAI_API_KEY, OPENAI_BASE_URL with LLM_PROVIDER=openai, or OLLAMA_BASE_URL must be set")
+	}
+
+	if cfg.ServerPort != ServerPortAuto {
+		if port, err := strconv.Atoi(cfg.ServerPort); err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("SERVER_PORT must be a port number or %s, got %q", ServerPortAuto, cfg.ServerPort)
+		}
+	}
+
+	if cfg.LLMTimeout < 0 {
+		return fmt.Errorf("LLM_TIMEOUT_SECONDS must not be negative")
+	}
+
+	// A wildcard with credentials would let any site make authenticated
+	// requests, so browsers forbid it and it is refused here too
+	if cfg.CORSAllowCredentials && slices.Contains(cfg.CORSAllowedOrigins, "*") {
+		return fmt.Errorf("CORS_ALLOW_CREDENTIALS cannot be used with CORS_ALLOWED_ORIGINS=*; list the allowed origins")
+	}
+
+	if cfg.OllamaKeepAlive != "" {
+		_, durationErr := time.ParseDuration(cfg.OllamaKeepAlive)
+		_, secondsErr := strconv.Atoi(cfg.OllamaKeepAlive)
+		if durationErr != nil && secondsErr != nil {
+			return fmt.Errorf("OLLAMA_KEEP_ALIVE must be a duration like 30m or a number of seconds, got %q", cfg.OllamaKeepAlive)
+		}
+	}
+
+	if cfg.TransformBatchMax <= 0 {
+		return fmt.Errorf("TRANSFORM_BATCH_MAX must be a positive number, got %d", cfg.TransformBatchMax)
+	}
+
+	// Validate chunking configuration
+	if cfg.ChunkSize <= 0 {
+		return fmt.Errorf("CHUNK_SIZE must be a positive number, got %d", cfg.ChunkSize)
+	}
+	switch cfg.ChunkOverlapMode {
+	case OverlapModePercent:
+		if cfg.ChunkOverlap < 0 || cfg.ChunkOverlap >= 100 {
+			return fmt.Errorf("CHUNK_OVERLAP percentage must be between 0%% and 99%%, got %d%%", cfg.ChunkOverlap)
+		}
+	case OverlapModeAbsolute:
+		if cfg.ChunkOverlap < 0 || cfg.ChunkOverlap >= cfg.ChunkSize {
+			return fmt.Errorf("CHUNK_OVERLAP (%d) must be at least 0 and smaller than CHUNK_SIZE (%d)", cfg.ChunkOverlap, cfg.ChunkSize)
+		}
+	default:
+		return fmt.Errorf(`CHUNK_OVERLAP must be a number of characters or a percentage such as "20%%"`)
+	}
+
+	if cfg.RerankEnabled {
+		if cfg.RerankURL == "" {
+			return fmt.Errorf("RERANK_URL must be set when RERANK_ENABLED is true")
+		}
+		if cfg.RerankAPI != RerankAPICohere && cfg.RerankAPI != RerankAPITEI {
+			return fmt.Errorf("RERANK_API must be %s or %s, got %q", RerankAPICohere, RerankAPITEI, cfg.RerankAPI)
+		}
+	}
+
+	switch cfg.ChatTitleMode {
+	case ChatTitleModeLLM, ChatTitleModeTruncate:
+	default:
+		return fmt.Errorf("CHAT_TITLE_MODE must be llm or truncate, got %q", cfg.ChatTitleMode)
+	}
+
+	if cfg.MaxUploadBytes < 0 {
+		return fmt.Errorf("MAX_UPLOAD_BYTES must not be negative")
+	}
+
+	switch cfg.StorageBackend {
+	case StorageBackendLocal:
+	case StorageBackendS3:
+		if cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+			return fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required when STORAGE_BACKEND=s3")
+		}
+	default:
+		return fmt.Errorf("STORAGE_BACKEND must be local or s3, got %q", cfg.StorageBackend)
+	}
+
+	switch cfg.NotebookDuplicatePolicy {
+	case DuplicatePolicyAllow, DuplicatePolicyWarn, DuplicatePolicyReject:
+	default:
+		return fmt.Errorf("NOTEBOOK_DUPLICATE_POLICY must be one of allow, warn, reject, got %q", cfg.NotebookDuplicatePolicy)
 	}
 
 	// Validate vector store configuration
@@ -126,8 +546,17 @@ func ValidateConfig(cfg Config) error {
 		if cfg.PostgreSQLURL == "" {
 			return fmt.Errorf("POSTGRES_URL required for postgres vector store")
 		}
+		if !pgIdentifierPattern.MatchString(cfg.PGVectorTable) {
+			return fmt.Errorf("PGVECTOR_TABLE must be a lowercase SQL identifier, got %q", cfg.PGVectorTable)
+		}
+		if cfg.PGVectorIndex != PGVectorIndexHNSW && cfg.PGVectorIndex != PGVectorIndexIVFFlat {
+			return fmt.Errorf("PGVECTOR_INDEX must be %s or %s, got %q", PGVectorIndexHNSW, PGVectorIndexIVFFlat, cfg.PGVectorIndex)
+		}
 	case "redis":
-		// Redis URL has default
+		// Redis URL has default; the server needs the RediSearch module
+		if cfg.RedisPrefix == "" {
+			return fmt.Errorf("REDIS_PREFIX must not be empty")
+		}
 	case "sqlite":
 		// SQLite path has default
 	case "memory":
@@ -139,9 +568,74 @@ func ValidateConfig(cfg Config) error {
 	return nil
 }
 
+// TempDir returns the directory of temporary files, such as the output of
+// document conversions
+func (c *Config) TempDir() string {
+	return filepath.Join(c.DataDir, "tmp")
+}
+
+// EnsureDataDir creates DATA_DIR and its temporary directory and checks that
+// they are writable. Errors name the absolute path, so a misconfigured or
+// read-only volume is easy to spot.
+func EnsureDataDir(cfg Config) error {
+	if err := prepareDataDir(cfg); err != nil {
+		return err
+	}
+	fmt.Printf("📁 Data directory: %s\n", cfg.DataDir)
+	return nil
+}
+
+// prepareDataDir creates the data directories and probes them with a file
+func prepareDataDir(cfg Config) error {
+	for _, dir := range []string{cfg.DataDir, cfg.TempDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("cannot create data directory %s (set DATA_DIR to a writable directory): %w", dir, err)
+		}
+	}
+
+	probe, err := os.CreateTemp(cfg.TempDir(), ".write_check_*")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable (set DATA_DIR to a writable directory): %w", cfg.DataDir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+// envKeys records the environment variables read by LoadConfig, which are
+// the keys a config file may set
+var envKeys struct {
+	sync.Mutex
+	read map[string]bool
+}
+
+// lookupEnv is os.LookupEnv, recording that the configuration reads key
+func lookupEnv(key string) (string, bool) {
+	envKeys.Lock()
+	if envKeys.read == nil {
+		envKeys.read = make(map[string]bool)
+	}
+	envKeys.read[key] = true
+	envKeys.Unlock()
+	return os.LookupEnv(key)
+}
+
+// readEnv is os.Getenv, recording that the configuration reads key
+func readEnv(key string) string {
+	value, _ := lookupEnv(key)
+	return value
+}
+
+// envKeyRead tells whether LoadConfig reads the environment variable key
+func envKeyRead(key string) bool {
+	envKeys.Lock()
+	defer envKeys.Unlock()
+	return envKeys.read[key]
+}
+
 // getEnv gets an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+	if value := readEnv(key); value != "" {
 		return value
 	}
 	return defaultValue
@@ -149,7 +643,7 @@ func getEnv(key, defaultValue string) string {
 
 // getEnvInt gets an environment variable as an integer or returns a default value
 func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+	if value := readEnv(key); value != "" {
 		if intVal, err := strconv.Atoi(value); err == nil {
 			return intVal
 		}
@@ -157,9 +651,71 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvOverlap gets a chunk overlap either as an absolute value ("200")
+// or as a percentage of the chunk size ("20%"). A value that is neither
+// gets an empty mode, which ValidateConfig rejects.
+func getEnvOverlap(key string, defaultValue int) (int, string) {
+	value := strings.TrimSpace(readEnv(key))
+	if value == "" {
+		return defaultValue, OverlapModeAbsolute
+	}
+	if strings.HasSuffix(value, "%") {
+		if intVal, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(value, "%"))); err == nil {
+			return intVal, OverlapModePercent
+		}
+		return 0, ""
+	}
+	if intVal, err := strconv.Atoi(value); err == nil {
+		return intVal, OverlapModeAbsolute
+	}
+	return 0, ""
+}
+
+// getEnvList gets a comma-separated environment variable as a list or returns a default value
+func getEnvList(key string, defaultValue []string) []string {
+	value := readEnv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvDuration gets an environment variable as a duration ("90s", "5m") or
+// a plain number of seconds, or returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := strings.TrimSpace(readEnv(key))
+	if value == "" {
+		return defaultValue
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+	return defaultValue
+}
+
+// getEnvFloat gets an environment variable as a float or returns a default value
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := readEnv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
 // getEnvBool gets an environment variable as a boolean or returns a default value
 func getEnvBool(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
+	if value := readEnv(key); value != "" {
 		if boolVal, err := strconv.ParseBool(value); err == nil {
 			return boolVal
 		}
@@ -189,11 +745,54 @@ func (c *Config) GetBaseURL() string {
 	return ""
 }
 
-// IsOllama returns true if using Ollama as the LLM provider
+// IsOllama returns true if using Ollama as the LLM provider. Without an
+// explicit LLM_PROVIDER, Ollama is detected from its default port in
+// OPENAI_BASE_URL.
 func (c *Config) IsOllama() bool {
+	if c.LLMProvider != "" {
+		return c.LLMProvider == LLMProviderOllama
+	}
 	return c.OpenAIBaseURL != "" && contains(c.OpenAIBaseURL, "11434")
 }
 
+// OpenAIToken returns the API key for OpenAI-compatible servers. Servers that
+// don't check keys still need a non-empty one for the client, so a
+// placeholder is used when a custom base URL is set without a key.
+func (c *Config) OpenAIToken() string {
+	if c.OpenAIAPIKey == "" && c.OpenAIBaseURL != "" {
+		return "EMPTY"
+	}
+	return c.OpenAIAPIKey
+}
+
+// multimodalModels are name fragments of models that accept images
+var multimodalModels = []string{
+	"gpt-4o", "gpt-4.1", "gpt-4-turbo", "gpt-5",
+	"gemini", "claude-3", "claude-sonnet", "claude-opus",
+	"llava", "bakllava", "vision", "-vl", "minicpm-v", "gemma3", "pixtral",
+}
+
+// IsMultimodal reports whether the chat model accepts images. LLM_MULTIMODAL
+// forces it on or off; in auto mode it is detected from the model name.
+func (c *Config) IsMultimodal() bool {
+	switch c.LLMMultimodal {
+	case "true", "1", "yes":
+		return true
+	case "false", "0", "no":
+		return false
+	}
+	model := strings.ToLower(c.OpenAIModel)
+	if c.IsOllama() {
+		model = strings.ToLower(c.OllamaModel)
+	}
+	for _, fragment := range multimodalModels {
+		if strings.Contains(model, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
 // SupportsFunctionCalling returns true if the configured model supports function calling
 func (c *Config) SupportsFunctionCalling() bool {
 	if c.IsOllama() {
@@ -0,0 +1,317 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tmc/langchaingo/embeddings"
+	ollamallm "github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// Similarity methods
+const (
+	SimilarityMethodEmbedding = "embedding_cosine"
+	SimilarityMethodKeyword   = "keyword_overlap"
+)
+
+// maxEmbeddingInput bounds the characters sent to the embedder per text
+const maxEmbeddingInput = 8000
+
+// Embedding providers
+const (
+	EmbeddingProviderOpenAI = "openai"
+	EmbeddingProviderOllama = "ollama"
+)
+
+// chunkVector is an embedding tagged with the provider and model that
+// produced it. Vectors from different providers, models or dimensions are
+// never compared.
+type chunkVector struct {
+	Provider string
+	Model    string
+	Values   []float32
+}
+
+// embeddingProvider returns the provider embeddings are created with
+func embeddingProvider(cfg Config) string {
+	if cfg.IsOllama() {
+		return EmbeddingProviderOllama
+	}
+	return EmbeddingProviderOpenAI
+}
+
+// createEmbedder creates an embedder for the configured provider, or returns
+// nil when EMBEDDING_MODEL is empty
+func createEmbedder(cfg Config) (embeddings.Embedder, error) {
+	if cfg.EmbeddingModel == "" {
+		return nil, nil
+	}
+
+	var client embeddings.EmbedderClient
+	if cfg.IsOllama() {
+		llm, err := ollamallm.New(ollamaOptions(cfg, cfg.EmbeddingModel)...)
+		if err != nil {
+			return nil, err
+		}
+		client = llm
+	} else {
+		if cfg.OpenAIToken() == "" {
+			return nil, nil
+		}
+		// Embeddings go to the same OpenAI-compatible server as chat
+		opts := []openai.Option{
+			openai.WithToken(cfg.OpenAIToken()),
+			openai.WithEmbeddingModel(cfg.EmbeddingModel),
+		}
+		if cfg.OpenAIBaseURL != "" {
+			opts = append(opts, openai.WithBaseURL(cfg.OpenAIBaseURL))
+		}
+		llm, err := openai.New(opts...)
+		if err != nil {
+			return nil, err
+		}
+		client = llm
+	}
+
+	// embedChunks sends EMBEDDING_BATCH_SIZE chunks per call, so the
+	// embedder's own batching never splits them further
+	return embeddings.NewEmbedder(client)
+}
+
+// embedderFor returns the embedder for a model, creating and caching it on
+// first use. An empty model selects the default EMBEDDING_MODEL. It returns
+// nil when no embedder is available.
+func (vs *VectorStore) embedderFor(model string) (embeddings.Embedder, string, error) {
+	if model == "" || model == vs.cfg.EmbeddingModel {
+		return vs.embedder, vs.cfg.EmbeddingModel, nil
+	}
+
+	vs.embedMu.Lock()
+	defer vs.embedMu.Unlock()
+
+	if embedder, ok := vs.embedders[model]; ok {
+		return embedder, model, nil
+	}
+
+	cfg := vs.cfg
+	cfg.EmbeddingModel = model
+	embedder, err := createEmbedder(cfg)
+	if err != nil {
+		return nil, model, fmt.Errorf("failed to create embedder for %s: %w", model, err)
+	}
+	vs.embedders[model] = embedder
+	return embedder, model, nil
+}
+
+// SetNotebookEmbeddingModel records the embedding model a notebook uses; an
+// empty model restores the default
+func (vs *VectorStore) SetNotebookEmbeddingModel(notebookID, model string) {
+	vs.embedMu.Lock()
+	defer vs.embedMu.Unlock()
+
+	if model == "" {
+		delete(vs.notebookModels, notebookID)
+		return
+	}
+	vs.notebookModels[notebookID] = model
+}
+
+// notebookEmbeddingModel returns a notebook's embedding model override, or
+// an empty string for the default
+func (vs *VectorStore) notebookEmbeddingModel(notebookID string) string {
+	vs.embedMu.Lock()
+	defer vs.embedMu.Unlock()
+	return vs.notebookModels[notebookID]
+}
+
+// embedChunks embeds chunks with the given model, EMBEDDING_BATCH_SIZE
+// chunks per request. Batches failing on rate limits or transient errors are
+// retried with backoff. The result is aligned with chunks: the chunks of a
+// batch that still fails get a nil vector and are left to keyword search. It
+// returns nil when no embedder is available or no batch succeeds.
+func (vs *VectorStore) embedChunks(ctx context.Context, model string, chunks []string) []*chunkVector {
+	embedder, model, err := vs.embedderFor(model)
+	if err != nil {
+		fmt.Printf("[VectorStore] %v, indexing without embeddings\n", err)
+		return nil
+	}
+	if embedder == nil || len(chunks) == 0 {
+		return nil
+	}
+
+	batchSize := vs.cfg.EmbeddingBatchSize
+	if batchSize <= 0 {
+		batchSize = 64
+	}
+
+	vectors := make([]*chunkVector, len(chunks))
+	embedded := 0
+	for offset := 0; offset < len(chunks); offset += batchSize {
+		batch := chunks[offset:min(offset+batchSize, len(chunks))]
+		inputs := make([]string, len(batch))
+		for i, chunk := range batch {
+			inputs[i] = truncateUTF8(chunk, maxEmbeddingInput)
+		}
+
+		values, err := withRetry(ctx, vs.cfg.LLMMaxRetries, func(ctx context.Context) ([][]float32, error) {
+			start := time.Now()
+			values, err := embedder.EmbedDocuments(ctx, inputs)
+			observeSince(embeddingDuration, start, model, "documents", metricOutcome(err))
+			return values, err
+		})
+		if err == nil && len(values) != len(batch) {
+			err = fmt.Errorf("embedder returned %d vectors for %d chunks", len(values), len(batch))
+		}
+		if err != nil {
+			fmt.Printf("[VectorStore] Failed to embed chunks %d-%d with %s, indexing them without embeddings: %v\n",
+				offset, offset+len(batch)-1, model, err)
+			continue
+		}
+
+		for i, v := range values {
+			vectors[offset+i] = &chunkVector{Provider: embeddingProvider(vs.cfg), Model: model, Values: v}
+		}
+		embedded += len(values)
+		if len(chunks) > batchSize {
+			fmt.Printf("[VectorStore] Embedded %d/%d chunks with %s\n", embedded, len(chunks), model)
+		}
+	}
+
+	if embedded == 0 {
+		return nil
+	}
+	if embedded < len(chunks) {
+		fmt.Printf("[VectorStore] %d of %d chunks have no embedding and are searched by keyword, reindex to embed them\n",
+			len(chunks)-embedded, len(chunks))
+	}
+	return vectors
+}
+
+// embedQuery embeds a search query with the given model, or returns nil when
+// no embedder is available or embedding fails
+func (vs *VectorStore) embedQuery(ctx context.Context, model, query string) *chunkVector {
+	embedder, model, err := vs.embedderFor(model)
+	if err != nil || embedder == nil {
+		return nil
+	}
+
+	start := time.Now()
+	values, err := embedder.EmbedQuery(ctx, truncateUTF8(query, maxEmbeddingInput))
+	observeSince(embeddingDuration, start, model, "query", metricOutcome(err))
+	if err != nil {
+		fmt.Printf("[VectorStore] Failed to embed query with %s, using keyword search: %v\n", model, err)
+		return nil
+	}
+	return &chunkVector{Provider: embeddingProvider(vs.cfg), Model: model, Values: values}
+}
+
+// Similarity compares two texts with the embedder when one is configured,
+// otherwise with the keyword overlap metric. It returns the score and the
+// method used.
+func (vs *VectorStore) Similarity(ctx context.Context, a, b string) (float64, string, error) {
+	if vs.embedder == nil {
+		return keywordOverlap(a, b), SimilarityMethodKeyword, nil
+	}
+
+	values, err := vs.embedder.EmbedDocuments(ctx, []string{
+		truncateUTF8(a, maxEmbeddingInput),
+		truncateUTF8(b, maxEmbeddingInput),
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to embed texts: %w", err)
+	}
+	if len(values) != 2 {
+		return 0, "", fmt.Errorf("embedder returned %d vectors, expected 2", len(values))
+	}
+
+	score, err := compareVectors(
+		&chunkVector{Provider: embeddingProvider(vs.cfg), Model: vs.cfg.EmbeddingModel, Values: values[0]},
+		&chunkVector{Provider: embeddingProvider(vs.cfg), Model: vs.cfg.EmbeddingModel, Values: values[1]},
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	return score, SimilarityMethodEmbedding, nil
+}
+
+// compareVectors returns the cosine similarity of two embeddings, rejecting
+// embeddings produced by different providers or models, or with different
+// dimensions
+func compareVectors(a, b *chunkVector) (float64, error) {
+	if a.Provider != b.Provider {
+		return 0, fmt.Errorf("cannot compare embeddings from different providers: %s vs %s", a.Provider, b.Provider)
+	}
+	if a.Model != b.Model {
+		return 0, fmt.Errorf("cannot compare embeddings from different models: %s vs %s", a.Model, b.Model)
+	}
+	return cosineSimilarity(a.Values, b.Values)
+}
+
+// cosineSimilarity returns the cosine similarity of two vectors
+func cosineSimilarity(a, b []float32) (float64, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("vector dimensions differ: %d vs %d", len(a), len(b))
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0, nil
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB)), nil
+}
+
+// keywordOverlap returns the Jaccard overlap of the keyword tokens of two
+// texts: lowercase words longer than two characters plus individual CJK
+// characters, mirroring what the keyword search scorer matches on
+func keywordOverlap(a, b string) float64 {
+	tokensA, tokensB := keywordTokens(a), keywordTokens(b)
+	if len(tokensA) == 0 || len(tokensB) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for token := range tokensA {
+		if tokensB[token] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(tokensA)+len(tokensB)-shared)
+}
+
+// keywordTokens extracts the set of keyword tokens from text
+func keywordTokens(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	var word strings.Builder
+
+	flush := func() {
+		if len([]rune(word.String())) > 2 {
+			tokens[word.String()] = true
+		}
+		word.Reset()
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			tokens[string(r)] = true
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return tokens
+}
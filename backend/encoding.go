@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// legacyEncodings are tried, in order of preference, for text that is not
+// valid UTF-8
+var legacyEncodings = []struct {
+	name string
+	enc  encoding.Encoding
+}{
+	{"gb18030", simplifiedchinese.GB18030},
+	{"big5", traditionalchinese.Big5},
+	{"shift_jis", japanese.ShiftJIS},
+	{"euc-kr", korean.EUCKR},
+	{"windows-1252", charmap.Windows1252},
+}
+
+// decodeText converts file content to UTF-8. A non-empty override names the
+// source encoding (e.g. "gbk", "latin1"); otherwise it is detected from the
+// byte order mark or guessed from the content. Returns the text and the
+// name of the encoding used.
+func decodeText(data []byte, override string) (string, string, error) {
+	if override != "" {
+		enc, err := htmlindex.Get(override)
+		if err != nil {
+			return "", "", fmt.Errorf("unknown SOURCE_ENCODING %q: %w", override, err)
+		}
+		text, err := enc.NewDecoder().Bytes(data)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to decode as %s: %w", override, err)
+		}
+		return strings.TrimPrefix(string(text), "\ufeff"), override, nil
+	}
+
+	// Byte order marks
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), "utf-8", nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}), bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		dec := xunicode.UTF16(xunicode.BigEndian, xunicode.ExpectBOM).NewDecoder()
+		text, err := dec.Bytes(data)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to decode UTF-16: %w", err)
+		}
+		return string(text), "utf-16", nil
+	}
+
+	if utf8.Valid(data) {
+		return string(data), "utf-8", nil
+	}
+
+	// Pick the legacy encoding whose decoding looks most like real text
+	bestName, bestText, bestScore := "", "", -1.0
+	for _, candidate := range legacyEncodings {
+		decoded, err := candidate.enc.NewDecoder().Bytes(data)
+		if err != nil {
+			continue
+		}
+		if score := textPlausibility(string(decoded)); score > bestScore {
+			bestName, bestText, bestScore = candidate.name, string(decoded), score
+		}
+	}
+	if bestName == "" {
+		return "", "", fmt.Errorf("unable to detect text encoding")
+	}
+	return bestText, bestName, nil
+}
+
+// textPlausibility scores decoded text by the share of characters that are
+// common in documents. Wrong decodings produce replacement characters, rare
+// symbols and control codes.
+func textPlausibility(text string) float64 {
+	total, good := 0, 0.0
+	for _, r := range text {
+		total++
+		switch {
+		case r == utf8.RuneError:
+			good -= 5
+		case r < 0x80 && (unicode.IsPrint(r) || unicode.IsSpace(r)):
+			good++
+		case unicode.Is(unicode.Han, r), unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r), unicode.Is(unicode.Hangul, r):
+			good++
+		case unicode.In(r, unicode.Latin) || unicode.IsPunct(r) || unicode.IsSpace(r):
+			good += 0.8
+		case unicode.IsControl(r) || unicode.Is(unicode.Co, r):
+			good -= 2
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return good / float64(total)
+}
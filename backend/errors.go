@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Error codes set in ErrorResponse.Code. They are stable, so clients can
+// branch on them; the Error messages are meant for people and may change.
+const (
+	ErrCodeInvalidRequest      = "INVALID_REQUEST"
+	ErrCodeNotebookNotFound    = "NOTEBOOK_NOT_FOUND"
+	ErrCodeSourceNotFound      = "SOURCE_NOT_FOUND"
+	ErrCodeNoteNotFound        = "NOTE_NOT_FOUND"
+	ErrCodeNoteVersionNotFound = "NOTE_VERSION_NOT_FOUND"
+	ErrCodeTraceNotFound       = "TRACE_NOT_FOUND"
+	ErrCodeChatSessionNotFound = "CHAT_SESSION_NOT_FOUND"
+	ErrCodeChatMessageNotFound = "CHAT_MESSAGE_NOT_FOUND"
+	ErrCodeJobNotFound         = "JOB_NOT_FOUND"
+	ErrCodeDuplicateNotebook   = "DUPLICATE_NOTEBOOK"
+	ErrCodeDuplicateSource     = "DUPLICATE_SOURCE"
+	ErrCodeNoSourceContent     = "NO_SOURCE_CONTENT"
+	ErrCodeFileTooLarge        = "FILE_TOO_LARGE"
+	ErrCodeUnsupportedFileType = "UNSUPPORTED_FILE_TYPE"
+	ErrCodeUploadNotFound      = "UPLOAD_NOT_FOUND"
+	ErrCodeUploadIncomplete    = "UPLOAD_INCOMPLETE"
+	ErrCodeExtractionFailed    = "EXTRACTION_FAILED"
+	ErrCodeFetchFailed         = "FETCH_FAILED"
+	ErrCodeGenerationFailed    = "GENERATION_FAILED"
+	ErrCodeLLMUnavailable      = "LLM_UNAVAILABLE"
+	ErrCodeLLMTimeout          = "LLM_TIMEOUT"
+	ErrCodeLLMBusy             = "LLM_BUSY"
+	ErrCodeModelNotFound       = "MODEL_NOT_FOUND"
+	ErrCodeRateLimited         = "RATE_LIMITED"
+	ErrCodePDFRendererMissing  = "PDF_RENDERER_UNAVAILABLE"
+	ErrCodeTimeout             = "TIMEOUT"
+	ErrCodeCanceled            = "CANCELED"
+	ErrCodeInternal            = "INTERNAL_ERROR"
+	ErrCodeIdempotencyMismatch = "IDEMPOTENCY_KEY_MISMATCH"
+)
+
+// apiError is an error together with the status and code it is reported
+// with, for helpers shared by handlers and background jobs
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	Details string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// response returns the error as the body of an API response
+func (e *apiError) response() ErrorResponse {
+	return ErrorResponse{Error: e.Message, Code: e.Code, Details: e.Details}
+}
+
+// asAPIError returns the apiError in err's chain, or an INTERNAL_ERROR one
+// for other errors, so handlers can report any error a helper returns
+func asAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Internal error", Details: err.Error()}
+}
+
+// errorCodeOf returns the code of an apiError, or INTERNAL_ERROR for other
+// errors
+func errorCodeOf(err error) string {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ErrCodeInternal
+}
+
+// classifyLLMError tells rate limits and unreachable or misconfigured
+// providers apart from other generation failures
+func classifyLLMError(err error) (int, string) {
+	if errors.Is(err, ErrLLMBusy) {
+		return http.StatusServiceUnavailable, ErrCodeLLMBusy
+	}
+	if errors.Is(err, ErrModelNotFound) {
+		return http.StatusServiceUnavailable, ErrCodeModelNotFound
+	}
+	if llms.IsRateLimitError(err) {
+		return http.StatusTooManyRequests, ErrCodeRateLimited
+	}
+	if llms.IsProviderUnavailableError(err) || llms.IsAuthenticationError(err) {
+		return http.StatusServiceUnavailable, ErrCodeLLMUnavailable
+	}
+
+	msg := strings.ToLower(err.Error())
+	if m := statusCodePattern.FindStringSubmatch(msg); m != nil {
+		switch code, _ := strconv.Atoi(m[1]); {
+		case code == http.StatusTooManyRequests:
+			return http.StatusTooManyRequests, ErrCodeRateLimited
+		case code == http.StatusUnauthorized || code == http.StatusForbidden || code >= 500:
+			return http.StatusServiceUnavailable, ErrCodeLLMUnavailable
+		}
+	}
+	if strings.Contains(msg, "too many requests") {
+		return http.StatusTooManyRequests, ErrCodeRateLimited
+	}
+	var netErr net.Error
+	if (errors.As(err, &netErr) && !errors.Is(err, context.DeadlineExceeded)) || strings.Contains(msg, "connection refused") {
+		return http.StatusServiceUnavailable, ErrCodeLLMUnavailable
+	}
+	return http.StatusInternalServerError, ErrCodeGenerationFailed
+}
@@ -0,0 +1,456 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Note export formats
+const (
+	ExportFormatHTML = "html"
+	ExportFormatPDF  = "pdf"
+	ExportFormatDOCX = "docx"
+)
+
+// errNoPDFRenderer is returned when no headless browser or wkhtmltopdf is
+// available to print PDFs
+var errNoPDFRenderer = errors.New("PDF export needs chromium, google-chrome or wkhtmltopdf; install one or set PDF_RENDERER")
+
+// exportImage is an image embedded in an exported note
+type exportImage struct {
+	Name string
+	Data []byte
+	Type string // MIME type
+}
+
+// handleExportNote renders a note as a standalone HTML, PDF or DOCX download
+func (s *Server) handleExportNote(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	format := strings.ToLower(c.DefaultQuery("format", ExportFormatHTML))
+	var body []byte
+	var contentType string
+	switch format {
+	case ExportFormatHTML:
+		body, contentType = []byte(s.exportHTML(ctx, note)), "text/html; charset=utf-8"
+	case ExportFormatPDF:
+		body, err = s.exportPDF(ctx, note)
+		contentType = "application/pdf"
+	case ExportFormatDOCX:
+		body, err = s.exportDOCX(ctx, note)
+		contentType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Invalid format %q, must be html, pdf or docx", format), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if errors.Is(err, errNoPDFRenderer) {
+		c.JSON(http.StatusNotImplemented, ErrorResponse{Error: err.Error(), Code: ErrCodePDFRendererMissing})
+		return
+	}
+	if err != nil {
+		golog.Errorf("failed to export note %s as %s: %v", note.ID, format, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export note", Code: ErrCodeInternal, Details: err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": exportFileName(note.Title) + "." + format,
+	}))
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// exportFileName turns a note title into a file name
+func exportFileName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if name == "" {
+		name = "note"
+	}
+	return name
+}
+
+// exportMarkdown returns the note content followed by the images generated
+// for it (infographic, slides), which are kept in metadata rather than in
+// the content
+func exportMarkdown(note *Note) string {
+	var b strings.Builder
+	b.WriteString(note.Content)
+	if url, _ := note.Metadata["image_url"].(string); url != "" {
+		fmt.Fprintf(&b, "\n\n![%s](%s)\n", note.Title, url)
+	}
+	if slides, ok := note.Metadata["slides"].([]interface{}); ok {
+		for i, slide := range slides {
+			if url, _ := slide.(string); url != "" {
+				fmt.Fprintf(&b, "\n\n![Slide %d](%s)\n", i+1, url)
+			}
+		}
+	}
+	return b.String()
+}
+
+// loadExportImage reads an image served under /uploads from file storage.
+// Other sources are not fetched.
+func (s *Server) loadExportImage(ctx context.Context, src string) (*exportImage, bool) {
+	if !strings.HasPrefix(src, "/uploads/") {
+		return nil, false
+	}
+	name := filepath.Base(src)
+	body, _, err := s.storage.Get(ctx, name)
+	if err != nil {
+		golog.Warnf("failed to read image %s for export: %v", name, err)
+		return nil, false
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, false
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return &exportImage{Name: name, Data: data, Type: contentType}, true
+}
+
+// exportHTML renders a note as a self-contained HTML document, with its
+// images embedded as data URLs
+func (s *Server) exportHTML(ctx context.Context, note *Note) string {
+	body := markdownToHTML(exportMarkdown(note), func(src string) string {
+		if img, ok := s.loadExportImage(ctx, src); ok {
+			return "data:" + img.Type + ";base64," + base64.StdEncoding.EncodeToString(img.Data)
+		}
+		return src
+	})
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%[1]s</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", "PingFang SC", "Microsoft YaHei", sans-serif; line-height: 1.6; max-width: 800px; margin: 2em auto; padding: 0 1em; color: #222; }
+img { max-width: 100%%; }
+pre { background: #f5f5f5; padding: 1em; overflow-x: auto; }
+code { font-family: Menlo, Consolas, monospace; }
+blockquote { border-left: 4px solid #ddd; margin-left: 0; padding-left: 1em; color: #555; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.4em 0.8em; }
+</style>
+</head>
+<body>
+<h1>%[1]s</h1>
+%[2]s</body>
+</html>
+`, html.EscapeString(note.Title), body)
+}
+
+// exportPDF prints the HTML export with a headless browser or wkhtmltopdf
+func (s *Server) exportPDF(ctx context.Context, note *Note) ([]byte, error) {
+	renderer := s.pdfRenderer()
+	if renderer == "" {
+		return nil, errNoPDFRenderer
+	}
+
+	dir, err := os.MkdirTemp("", "notex-export-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "note.html")
+	output := filepath.Join(dir, "note.pdf")
+	if err := os.WriteFile(input, []byte(s.exportHTML(ctx, note)), 0600); err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	if strings.Contains(filepath.Base(renderer), "wkhtmltopdf") {
+		cmd = exec.CommandContext(ctx, renderer, "--quiet", "--encoding", "utf-8", input, output)
+	} else {
+		args := []string{"--headless", "--disable-gpu", "--no-pdf-header-footer", "--print-to-pdf=" + output}
+		if s.cfg.PDFNoSandbox {
+			// Containers running as root often cannot provide chromium's
+			// sandbox; only turned off when asked for
+			args = append(args, "--no-sandbox")
+		}
+		cmd = exec.CommandContext(ctx, renderer, append(args, "file://"+input)...)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w, output: %s", filepath.Base(renderer), err, out)
+	}
+	return os.ReadFile(output)
+}
+
+// pdfRenderer returns the configured PDF renderer, or the first one found
+func (s *Server) pdfRenderer() string {
+	candidates := []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "wkhtmltopdf"}
+	if s.cfg.PDFRenderer != "" {
+		candidates = []string{s.cfg.PDFRenderer}
+	}
+	for _, name := range candidates {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// DOCX export
+
+// docxWriter builds the body of a WordprocessingML document
+type docxWriter struct {
+	s      *Server
+	ctx    context.Context
+	body   strings.Builder
+	images []exportImage
+}
+
+// exportDOCX renders a note as a Word document
+func (s *Server) exportDOCX(ctx context.Context, note *Note) ([]byte, error) {
+	w := &docxWriter{s: s, ctx: ctx}
+	w.paragraph("Title", []mdSpan{{Text: note.Title}})
+	for _, block := range parseMarkdown(exportMarkdown(note)) {
+		w.block(block)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", docxContentTypes},
+		{"_rels/.rels", docxRootRels},
+		{"word/styles.xml", docxStyles},
+		{"word/_rels/document.xml.rels", w.relationships()},
+		{"word/document.xml", docxDocumentStart + w.body.String() + docxDocumentEnd},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(fw, f.content); err != nil {
+			return nil, err
+		}
+	}
+	for i, img := range w.images {
+		fw, err := zw.Create(fmt.Sprintf("word/media/image%d%s", i+1, filepath.Ext(img.Name)))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(img.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *docxWriter) block(block mdBlock) {
+	switch block.Kind {
+	case "heading":
+		w.paragraph(fmt.Sprintf("Heading%d", min(block.Level, 3)), parseInline(block.Text))
+	case "paragraph":
+		w.paragraph("", parseInline(block.Text))
+	case "quote":
+		w.paragraph("Quote", parseInline(block.Text))
+	case "rule":
+		w.body.WriteString(`<w:p><w:pPr><w:pBdr><w:bottom w:val="single" w:sz="6" w:space="1" w:color="auto"/></w:pBdr></w:pPr></w:p>`)
+	case "code":
+		for _, line := range strings.Split(block.Text, "\n") {
+			w.paragraph("Code", []mdSpan{{Text: line}})
+		}
+	case "list":
+		for _, item := range block.Items {
+			marker := "•"
+			if item.Ordered {
+				marker = fmt.Sprintf("%d.", item.Number)
+			}
+			spans := append([]mdSpan{{Text: marker + "\t"}}, parseInline(item.Text)...)
+			fmt.Fprintf(&w.body, `<w:p><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr>`, 720+item.Level*360)
+			w.runs(spans)
+			w.body.WriteString(`</w:p>`)
+		}
+	case "table":
+		w.body.WriteString(`<w:tbl><w:tblPr><w:tblStyle w:val="TableGrid"/><w:tblW w:w="0" w:type="auto"/></w:tblPr>`)
+		for i, row := range block.Rows {
+			w.body.WriteString(`<w:tr>`)
+			for _, cell := range row {
+				spans := parseInline(cell)
+				if i == 0 {
+					for j := range spans {
+						spans[j].Bold = true
+					}
+				}
+				w.body.WriteString(`<w:tc><w:p>`)
+				w.runs(spans)
+				w.body.WriteString(`</w:p></w:tc>`)
+			}
+			w.body.WriteString(`</w:tr>`)
+		}
+		w.body.WriteString(`</w:tbl><w:p/>`)
+	}
+}
+
+func (w *docxWriter) paragraph(style string, spans []mdSpan) {
+	w.body.WriteString(`<w:p>`)
+	if style != "" {
+		fmt.Fprintf(&w.body, `<w:pPr><w:pStyle w:val="%s"/></w:pPr>`, style)
+	}
+	w.runs(spans)
+	w.body.WriteString(`</w:p>`)
+}
+
+func (w *docxWriter) runs(spans []mdSpan) {
+	for _, span := range spans {
+		if span.Image != "" {
+			if img, ok := w.s.loadExportImage(w.ctx, span.Image); ok {
+				w.image(*img)
+				continue
+			}
+			// Images that cannot be embedded are kept as their alt text
+			span.Text = "[" + span.Text + "]"
+		}
+		if span.Text == "" {
+			continue
+		}
+		w.body.WriteString(`<w:r>`)
+		var props strings.Builder
+		if span.Bold {
+			props.WriteString(`<w:b/>`)
+		}
+		if span.Italic {
+			props.WriteString(`<w:i/>`)
+		}
+		if span.Code {
+			props.WriteString(`<w:rFonts w:ascii="Consolas" w:hAnsi="Consolas"/>`)
+		}
+		if span.Link != "" {
+			props.WriteString(`<w:color w:val="0563C1"/><w:u w:val="single"/>`)
+		}
+		if props.Len() > 0 {
+			fmt.Fprintf(&w.body, `<w:rPr>%s</w:rPr>`, props.String())
+		}
+		parts := strings.Split(span.Text, "\t")
+		for i, part := range parts {
+			if i > 0 {
+				w.body.WriteString(`<w:tab/>`)
+			}
+			fmt.Fprintf(&w.body, `<w:t xml:space="preserve">%s</w:t>`, docxEscape(part))
+		}
+		w.body.WriteString(`</w:r>`)
+	}
+}
+
+// image embeds a picture scaled to the page width
+func (w *docxWriter) image(img exportImage) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil || cfg.Width == 0 {
+		golog.Warnf("skipping image %s in docx export: %v", img.Name, err)
+		return
+	}
+	w.images = append(w.images, img)
+	id := len(w.images)
+
+	// EMU: 9525 per pixel at 96 dpi, at most 6 inches wide
+	const maxWidth = 6 * 914400
+	width, height := cfg.Width*9525, cfg.Height*9525
+	if width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	fmt.Fprintf(&w.body, `<w:r><w:drawing><wp:inline><wp:extent cx="%[1]d" cy="%[2]d"/><wp:docPr id="%[3]d" name="Picture %[3]d"/>`+
+		`<a:graphic xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/picture">`+
+		`<pic:pic xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"><pic:nvPicPr><pic:cNvPr id="%[3]d" name="%[4]s"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="rIdImage%[3]d"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%[1]d" cy="%[2]d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr></pic:pic>`+
+		`</a:graphicData></a:graphic></wp:inline></w:drawing></w:r>`, width, height, id, docxEscape(img.Name))
+}
+
+func (w *docxWriter) relationships() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+`)
+	for i, img := range w.images {
+		fmt.Fprintf(&b, `<Relationship Id="rIdImage%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image%d%s"/>`+"\n",
+			i+1, i+1, filepath.Ext(img.Name))
+	}
+	b.WriteString(`</Relationships>`)
+	return b.String()
+}
+
+func docxEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		// Control characters are not allowed in XML
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return html.EscapeString(b.String())
+}
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Default Extension="png" ContentType="image/png"/>
+<Default Extension="jpg" ContentType="image/jpeg"/>
+<Default Extension="jpeg" ContentType="image/jpeg"/>
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>
+</Types>`
+
+const docxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+</Relationships>`
+
+const docxDocumentStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"><w:body>`
+
+const docxDocumentEnd = `<w:sectPr><w:pgSz w:w="11906" w:h="16838"/><w:pgMar w:top="1440" w:right="1440" w:bottom="1440" w:left="1440" w:header="708" w:footer="708" w:gutter="0"/></w:sectPr></w:body></w:document>`
+
+const docxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:docDefaults><w:rPrDefault><w:rPr><w:rFonts w:ascii="Calibri" w:hAnsi="Calibri" w:eastAsia="Microsoft YaHei"/><w:sz w:val="22"/></w:rPr></w:rPrDefault><w:pPrDefault><w:pPr><w:spacing w:after="120" w:line="276" w:lineRule="auto"/></w:pPr></w:pPrDefault></w:docDefaults>
+<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/></w:style>
+<w:style w:type="paragraph" w:styleId="Title"><w:name w:val="Title"/><w:basedOn w:val="Normal"/><w:pPr><w:spacing w:after="240"/></w:pPr><w:rPr><w:b/><w:sz w:val="48"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="240"/><w:outlineLvl w:val="0"/></w:pPr><w:rPr><w:b/><w:sz w:val="36"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="200"/><w:outlineLvl w:val="1"/></w:pPr><w:rPr><w:b/><w:sz w:val="30"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="160"/><w:outlineLvl w:val="2"/></w:pPr><w:rPr><w:b/><w:sz w:val="26"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Quote"><w:name w:val="Quote"/><w:basedOn w:val="Normal"/><w:pPr><w:ind w:left="720"/></w:pPr><w:rPr><w:i/><w:color w:val="555555"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Code"><w:name w:val="Code"/><w:basedOn w:val="Normal"/><w:pPr><w:spacing w:after="0"/><w:shd w:val="clear" w:color="auto" w:fill="F5F5F5"/></w:pPr><w:rPr><w:rFonts w:ascii="Consolas" w:hAnsi="Consolas"/><w:sz w:val="20"/></w:rPr></w:style>
+<w:style w:type="table" w:styleId="TableGrid"><w:name w:val="Table Grid"/><w:tblPr><w:tblBorders><w:top w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:left w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:bottom w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:right w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:insideH w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:insideV w:val="single" w:sz="4" w:space="0" w:color="auto"/></w:tblBorders></w:tblPr></w:style>
+</w:styles>`
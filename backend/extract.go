@@ -0,0 +1,516 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Extraction methods recorded in the "extraction" metadata of file sources
+const (
+	extractionText       = "text"
+	extractionMarkitdown = "markitdown"
+	extractionOffice     = "office_xml"
+	extractionPDFToText  = "pdftotext"
+	extractionPDF        = "pdf_text"
+	extractionOCR        = "ocr"
+	extractionFailed     = "failed"
+)
+
+// extractPlain is the best-effort extraction used when markitdown is disabled
+// or fails: Office Open XML files are read from their XML parts, PDFs with
+// pdftotext if installed or a minimal content stream parser otherwise, and
+// anything else only if it is already text.
+func (vs *VectorStore) extractPlain(ctx context.Context, path string) (string, string, error) {
+	var text, method string
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".docx", ".pptx", ".xlsx":
+		text, err = extractOfficeText(path)
+		method = extractionOffice
+	case ".pdf":
+		if _, lookErr := exec.LookPath("pdftotext"); lookErr == nil {
+			text, err = extractWithPDFToText(ctx, path)
+			method = extractionPDFToText
+			if err == nil && strings.TrimSpace(text) != "" {
+				break
+			}
+		}
+		text, err = extractPDFText(path)
+		method = extractionPDF
+	default:
+		text, err = vs.readTextFile(path)
+		method = extractionText
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", "", fmt.Errorf("no text found in %s", filepath.Base(path))
+	}
+	fmt.Printf("[VectorStore] Extracted %s with %s, size: %d bytes\n", path, method, len(text))
+	return text, method, nil
+}
+
+// readTextFile reads a file that should be text, converting legacy encodings
+// such as GBK or Latin-1 to UTF-8. Binary files are rejected.
+func (vs *VectorStore) readTextFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if isBinaryData(data) {
+		return "", fmt.Errorf("%s is not a text file", filepath.Base(path))
+	}
+	text, encodingName, err := decodeText(data, vs.cfg.SourceEncoding)
+	if err != nil {
+		return "", err
+	}
+	if encodingName != "utf-8" {
+		fmt.Printf("[VectorStore] Decoded %s as %s\n", path, encodingName)
+	}
+	return text, nil
+}
+
+// isBinaryData reports whether data looks like a binary file: NUL bytes
+// outside UTF-16 text
+func isBinaryData(data []byte) bool {
+	if bytes.HasPrefix(data, []byte{0xFF, 0xFE}) || bytes.HasPrefix(data, []byte{0xFE, 0xFF}) {
+		return false
+	}
+	return bytes.IndexByte(data[:min(len(data), 8192)], 0) >= 0
+}
+
+func extractWithPDFToText(ctx context.Context, path string) (string, error) {
+	output, err := exec.CommandContext(ctx, "pdftotext", "-layout", "-enc", "UTF-8", path, "-").Output()
+	if err != nil {
+		return "", fmt.Errorf("pdftotext failed: %w", err)
+	}
+	return string(output), nil
+}
+
+// extractOfficeText reads the text of a .docx, .pptx or .xlsx file from the
+// XML parts of its zip container
+func extractOfficeText(path string) (string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+	}
+	defer r.Close()
+
+	parts := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		parts[f.Name] = f
+	}
+
+	var b strings.Builder
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".docx":
+		if err := appendOfficePart(&b, parts["word/document.xml"], nil); err != nil {
+			return "", err
+		}
+	case ".pptx":
+		for i, name := range numberedParts(parts, "ppt/slides/slide") {
+			fmt.Fprintf(&b, "## Slide %d\n\n", i+1)
+			if err := appendOfficePart(&b, parts[name], nil); err != nil {
+				return "", err
+			}
+			b.WriteString("\n")
+		}
+	case ".xlsx":
+		shared, err := sharedStrings(parts["xl/sharedStrings.xml"])
+		if err != nil {
+			return "", err
+		}
+		for i, name := range numberedParts(parts, "xl/worksheets/sheet") {
+			fmt.Fprintf(&b, "## Sheet %d\n\n", i+1)
+			if err := appendOfficePart(&b, parts[name], shared); err != nil {
+				return "", err
+			}
+			b.WriteString("\n")
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// numberedParts returns the names of the parts prefix1.xml, prefix2.xml, ...
+// in numeric order
+func numberedParts(parts map[string]*zip.File, prefix string) []string {
+	var names []string
+	for name := range parts {
+		n := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".xml")
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".xml") && n != "" && strings.Trim(n, "0123456789") == "" {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(names[i], prefix), ".xml"))
+		b, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(names[j], prefix), ".xml"))
+		return a < b
+	})
+	return names
+}
+
+// appendOfficePart writes the text runs of an Office XML part: paragraphs and
+// spreadsheet rows end lines, tabs and spreadsheet cells are separated by
+// tabs. shared resolves shared string references of spreadsheet cells.
+func appendOfficePart(b *strings.Builder, f *zip.File, shared []string) error {
+	if f == nil {
+		return fmt.Errorf("document content not found")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	decoder := xml.NewDecoder(rc)
+	inText, inValue := false, false
+	cellType := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", f.Name, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "v":
+				inValue = true
+			case "tab":
+				b.WriteString("\t")
+			case "br":
+				b.WriteString("\n")
+			case "c":
+				cellType = ""
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "t" {
+						cellType = attr.Value
+					}
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "v":
+				inValue = false
+			case "p", "row":
+				b.WriteString("\n")
+			case "c":
+				b.WriteString("\t")
+			}
+		case xml.CharData:
+			switch {
+			case inText:
+				b.Write(t)
+			case inValue && cellType == "s":
+				if i, err := strconv.Atoi(strings.TrimSpace(string(t))); err == nil && i >= 0 && i < len(shared) {
+					b.WriteString(shared[i])
+				}
+			case inValue:
+				b.Write(t)
+			}
+		}
+	}
+}
+
+// sharedStrings reads the shared string table of a spreadsheet
+func sharedStrings(f *zip.File) ([]string, error) {
+	if f == nil {
+		return nil, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var table []string
+	var current strings.Builder
+	decoder := xml.NewDecoder(rc)
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return table, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse shared strings: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			inText = t.Name.Local == "t"
+		case xml.EndElement:
+			if t.Name.Local == "t" {
+				inText = false
+			} else if t.Name.Local == "si" {
+				table = append(table, current.String())
+				current.Reset()
+			}
+		case xml.CharData:
+			if inText {
+				current.Write(t)
+			}
+		}
+	}
+}
+
+// extractPDFText pulls the text drawn by a PDF's content streams. It handles
+// uncompressed and Flate-compressed streams with single-byte font encodings,
+// which covers most PDFs produced by office software; text in CID fonts or
+// scanned pages is not recovered, and such files fail the printable text
+// check instead of producing garbage.
+func extractPDFText(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", fmt.Errorf("%s is not a PDF file", filepath.Base(path))
+	}
+
+	var b strings.Builder
+	for rest := data; ; {
+		start := bytes.Index(rest, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		dict := rest[:start]
+		if open := bytes.LastIndex(dict, []byte("<<")); open >= 0 {
+			dict = dict[open:]
+		}
+		body := rest[start+len("stream"):]
+		body = bytes.TrimPrefix(body, []byte("\r"))
+		body = bytes.TrimPrefix(body, []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		rest = body[end+len("endstream"):]
+		content := body[:end]
+
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			decoded, _ := io.ReadAll(flateReader(content))
+			content = decoded
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue // images and other encodings
+		}
+		if bytes.Contains(content, []byte("BT")) {
+			appendPDFContentText(&b, content)
+		}
+	}
+
+	text := strings.TrimSpace(b.String())
+	if !mostlyPrintable(text) {
+		return "", fmt.Errorf("no extractable text in %s", filepath.Base(path))
+	}
+	return text, nil
+}
+
+// flateReader decompresses a Flate stream, yielding what it can of a
+// truncated or corrupt one
+func flateReader(data []byte) io.Reader {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return bytes.NewReader(nil)
+	}
+	return r
+}
+
+// appendPDFContentText writes the strings shown by the text operators of a
+// content stream, starting a new line when the text position moves down
+func appendPDFContentText(b *strings.Builder, content []byte) {
+	var operands [][]byte // string operands since the last operator
+	var numbers []float64 // numeric operands since the last operator
+	lastY := 0.0          // vertical position set by the last Tm
+	lineStart := true
+	newline := func() {
+		if !lineStart {
+			b.WriteString("\n")
+			lineStart = true
+		}
+	}
+	show := func(s []byte) {
+		for _, c := range s {
+			b.WriteRune(rune(c)) // single-byte encodings map onto Latin-1
+		}
+		lineStart = lineStart && len(s) == 0
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			s, n := parsePDFLiteral(content[i:])
+			operands = append(operands, s)
+			i += n
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			hexDigits := bytes.Map(func(r rune) rune {
+				if unicode.IsSpace(r) {
+					return -1
+				}
+				return r
+			}, content[i+1:i+end])
+			if len(hexDigits)%2 == 1 {
+				hexDigits = append(hexDigits, '0')
+			}
+			s, _ := hex.DecodeString(string(hexDigits))
+			operands = append(operands, s)
+			i += end + 1
+		case c == '[' || c == ']':
+			i++
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(content) && (content[j] == '.' || (content[j] >= '0' && content[j] <= '9')) {
+				j++
+			}
+			if v, err := strconv.ParseFloat(string(content[i:j]), 64); err == nil {
+				numbers = append(numbers, v)
+				// Large negative kerning inside TJ arrays separates words
+				if v < -200 && len(operands) > 0 {
+					operands = append(operands, []byte(" "))
+				}
+			}
+			i = j
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '/' || isPDFRegular(c):
+			j := i + 1
+			for j < len(content) && isPDFRegular(content[j]) {
+				j++
+			}
+			op := string(content[i:j])
+			switch op {
+			case "Tj", "TJ":
+				for _, s := range operands {
+					show(s)
+				}
+			case "'", "\"":
+				newline()
+				for _, s := range operands {
+					show(s)
+				}
+			case "T*", "ET":
+				newline()
+			case "Td", "TD":
+				if len(numbers) >= 2 && numbers[len(numbers)-1] != 0 {
+					newline()
+				} else if !lineStart {
+					b.WriteString(" ")
+				}
+			case "Tm":
+				if len(numbers) >= 6 && numbers[len(numbers)-1] != lastY {
+					lastY = numbers[len(numbers)-1]
+					newline()
+				}
+			}
+			if !strings.HasPrefix(op, "/") {
+				operands = operands[:0]
+				numbers = numbers[:0]
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	newline()
+}
+
+func isPDFRegular(c byte) bool {
+	return c > ' ' && !strings.ContainsRune("()<>[]{}/%", rune(c)) && c < 0x7F
+}
+
+// parsePDFLiteral parses a "(...)" string at the start of s, with its escapes
+// and balanced parentheses, returning the string and the bytes it spans
+func parsePDFLiteral(s []byte) ([]byte, int) {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out, i + 1
+			}
+			out = append(out, c)
+		case '\\':
+			if i+1 >= len(s) {
+				return out, len(s)
+			}
+			i++
+			switch e := s[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					j := i
+					for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+						j++
+					}
+					v, _ := strconv.ParseUint(string(s[i:j]), 8, 8)
+					out = append(out, byte(v))
+					i = j - 1
+				} else {
+					out = append(out, e)
+				}
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, len(s)
+}
+
+// mostlyPrintable reports whether extracted text is readable: non-empty and
+// made at least 90% of letters, digits, punctuation and spaces
+func mostlyPrintable(text string) bool {
+	if text == "" || !utf8.ValidString(text) {
+		return false
+	}
+	printable, total := 0, 0
+	for _, r := range text {
+		total++
+		if unicode.IsPrint(r) || unicode.IsSpace(r) {
+			printable++
+		}
+	}
+	return printable*10 >= total*9
+}
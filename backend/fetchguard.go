@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned when a server-side fetch of a URL given by an
+// API caller would connect to a loopback, private, link-local or unspecified
+// address
+var ErrPrivateAddress = errors.New("URL points to a private or local address")
+
+// maxFetchRedirects bounds the redirects followed by a fetch client
+const maxFetchRedirects = 10
+
+// sharedAddressSpace is 100.64.0.0/10 (RFC 6598), where some clouds serve
+// instance metadata
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddress tells whether the server may fetch from ip
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// guardedControl is a net.Dialer Control hook refusing connections to
+// addresses that are not public. It runs after DNS resolution, so a public
+// name resolving to a private address is refused too.
+func guardedControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, ip)
+	}
+	return nil
+}
+
+// checkFetchHost refuses hosts that are known to be local without a DNS
+// lookup: localhost names and non-public literal addresses
+func checkFetchHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, ip)
+	}
+	return nil
+}
+
+// newFetchClient returns the HTTP client fetching URLs given by API callers.
+// Unless allowPrivate (FETCH_ALLOW_PRIVATE), it only connects to public
+// addresses, on every redirect too, so callers cannot reach the server's own
+// network or cloud metadata endpoints through it.
+func newFetchClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	if allowPrivate {
+		return &http.Client{Timeout: timeout}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: guardedControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Through a proxy the dialer would check the proxy instead of the
+	// destination
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported URL scheme %q", req.URL.Scheme)
+			}
+			return checkFetchHost(req.URL.Hostname())
+		},
+	}
+}
@@ -0,0 +1,347 @@
+package backend
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// fencedBlockPattern matches a fenced code block and captures its language and body
+	fencedBlockPattern = regexp.MustCompile("(?s)```[ \\t]*([A-Za-z0-9_-]*)[ \\t]*\\n(.*?)\\n?```")
+	// mindmapFlowchartPattern matches flowchart syntax that is invalid in a mindmap
+	mindmapFlowchartPattern = regexp.MustCompile(`-->|---|==>|^\s*(graph|flowchart)\b`)
+)
+
+const (
+	infographOpening = "Infographic illustration"
+	infographClosing = "suitable for a professional presentation."
+)
+
+// formatEnforcedTypes are transformation types whose output is consumed by a
+// renderer or an image model, so it is validated and cleaned up before saving
+var formatEnforcedTypes = map[string]func(string) (string, error){
+	"mindmap":   normalizeMindmap,
+	"infograph": normalizeInfograph,
+}
+
+// normalizeMindmap extracts the Mermaid mindmap from model output, dropping
+// surrounding prose, and checks that it is a well-formed mindmap. The result
+// is returned as a ```mermaid block.
+func normalizeMindmap(output string) (string, error) {
+	code := ""
+	for _, m := range fencedBlockPattern.FindAllStringSubmatch(output, -1) {
+		if body := strings.TrimSpace(m[2]); strings.HasPrefix(body, "mindmap") {
+			code = m[2]
+			break
+		}
+	}
+	if code == "" {
+		// No fence: take everything from the "mindmap" line up to the first
+		// line that is not indented
+		lines := strings.Split(output, "\n")
+		for i, line := range lines {
+			if strings.TrimSpace(line) != "mindmap" {
+				continue
+			}
+			end := i + 1
+			for end < len(lines) && (strings.TrimSpace(lines[end]) == "" || strings.HasPrefix(lines[end], " ") || strings.HasPrefix(lines[end], "\t")) {
+				end++
+			}
+			code = strings.Join(lines[i:end], "\n")
+			break
+		}
+	}
+	if code == "" {
+		return "", fmt.Errorf("no mermaid mindmap found in output")
+	}
+
+	if err := validateMindmap(code); err != nil {
+		return "", err
+	}
+	return "```mermaid\n" + strings.TrimRight(strings.TrimLeft(code, "\n"), " \t\n") + "\n```", nil
+}
+
+// validateMindmap checks the structure Mermaid requires of a mindmap: the
+// "mindmap" header, a single root and indented child nodes with balanced
+// brackets
+func validateMindmap(code string) error {
+	var nodes []string
+	for _, line := range strings.Split(code, "\n") {
+		if strings.TrimSpace(line) != "" && !strings.HasPrefix(strings.TrimSpace(line), "%%") {
+			nodes = append(nodes, line)
+		}
+	}
+	if len(nodes) == 0 || strings.TrimSpace(nodes[0]) != "mindmap" {
+		return fmt.Errorf("mindmap must start with a \"mindmap\" line")
+	}
+	if len(nodes) < 3 {
+		return fmt.Errorf("mindmap has no branches")
+	}
+
+	rootIndent := indentWidth(nodes[1])
+	if rootIndent == 0 {
+		return fmt.Errorf("mindmap root must be indented under \"mindmap\"")
+	}
+	for i, line := range nodes[1:] {
+		if i > 0 && indentWidth(line) <= rootIndent {
+			return fmt.Errorf("mindmap has more than one root (line %q)", strings.TrimSpace(line))
+		}
+		if mindmapFlowchartPattern.MatchString(line) {
+			return fmt.Errorf("mindmap contains flowchart syntax (line %q)", strings.TrimSpace(line))
+		}
+		if !bracketsBalanced(line) {
+			return fmt.Errorf("unbalanced brackets in mindmap node %q", strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
+
+func indentWidth(line string) int {
+	width := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			width++
+		case '\t':
+			width += 4
+		default:
+			return width
+		}
+	}
+	return width
+}
+
+func bracketsBalanced(line string) bool {
+	pairs := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	var stack []rune
+	for _, r := range line {
+		switch r {
+		case '(', '[', '{':
+			stack = append(stack, r)
+		case ')', ']', '}':
+			if len(stack) == 0 || stack[len(stack)-1] != pairs[r] {
+				return false
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return len(stack) == 0
+}
+
+// normalizeInfograph strips code fences and prose around an infographic
+// image prompt, keeping the text from the expected opening sentence to the
+// expected closing sentence when the model produced them
+func normalizeInfograph(output string) (string, error) {
+	text := strings.TrimSpace(output)
+	if m := fencedBlockPattern.FindStringSubmatch(text); m != nil && len(strings.TrimSpace(m[2])) > len(text)/2 {
+		text = strings.TrimSpace(m[2])
+	}
+
+	if start := strings.Index(text, infographOpening); start > 0 {
+		text = text[start:]
+	}
+	if end := strings.LastIndex(text, infographClosing); end >= 0 {
+		text = text[:end+len(infographClosing)]
+	}
+	text = strings.TrimSpace(text)
+
+	if len([]rune(text)) < 100 {
+		return "", fmt.Errorf("infographic prompt is too short (%d characters)", len([]rune(text)))
+	}
+	return text, nil
+}
+
+// strictFormatInstruction is appended to the prompt when retrying a
+// generation whose output failed validation
+func strictFormatInstruction(transformType string, validationErr error) string {
+	switch transformType {
+	case "quiz":
+		return fmt.Sprintf("\n\n# 重要\n上一次输出无效（%v）。只输出一个符合上述格式的 JSON 对象，不要使用代码块，不要输出任何其他文字。", validationErr)
+	case "mindmap":
+		return fmt.Sprintf("\n\n# 重要\n上一次输出无效（%v）。只输出一个以 ```mermaid 开头、以 ``` 结尾的代码块，第一行必须是 mindmap，只能有一个 root 节点，不要输出任何其他文字。", validationErr)
+	default:
+		return fmt.Sprintf("\n\n# 重要\n上一次输出无效（%v）。只输出绘画提示词本身，以 %q 开头，以 %q 结尾，不要使用代码块，不要输出任何解释。", validationErr, infographOpening, "The background is a clean, light gradient "+infographClosing)
+	}
+}
+
+var (
+	// headingPattern matches an ATX heading and captures its marks and title
+	headingPattern = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*))?$`)
+	// unspacedHeadingPattern matches "##Title", a heading missing the space
+	// after its marks; a single # is left alone, it may be a hashtag
+	unspacedHeadingPattern = regexp.MustCompile(`^(#{2,6})([^#\s].*)$`)
+	// inlineCodePattern matches a code span
+	inlineCodePattern = regexp.MustCompile("`[^`\n]*`")
+	// rawHTMLTagPattern matches a raw HTML tag or the start of a comment
+	rawHTMLTagPattern = regexp.MustCompile(`<(/?[A-Za-z][A-Za-z0-9-]*)(\s[^<>]*)?/?>|<!--`)
+)
+
+// cleanNoteMarkdown tidies the Markdown of a generated note: it removes a
+// ```markdown fence wrapping the whole note, shifts headings so the top
+// level used is #, and with escapeHTML escapes raw HTML tags other than
+// <br> so the note cannot inject markup where it is rendered. Code blocks
+// and code spans are kept as they are.
+func cleanNoteMarkdown(text string, escapeHTML bool) string {
+	lines := strings.Split(stripMarkdownWrapper(text), "\n")
+
+	var fence fenceState
+	minLevel := 7
+	for i, line := range lines {
+		if fence.toggle(line) || fence.open() {
+			continue
+		}
+		if m := unspacedHeadingPattern.FindStringSubmatch(line); m != nil {
+			line = m[1] + " " + m[2]
+		}
+		if m := headingPattern.FindStringSubmatch(line); m != nil {
+			minLevel = min(minLevel, len(m[1]))
+		}
+		lines[i] = line
+	}
+	if escapeHTML {
+		escapeRawHTMLParagraphs(lines)
+	}
+
+	if minLevel > 1 && minLevel < 7 {
+		fence = ""
+		for i, line := range lines {
+			if fence.toggle(line) || fence.open() {
+				continue
+			}
+			if headingPattern.MatchString(line) {
+				lines[i] = line[minLevel-1:]
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stripMarkdownWrapper removes a code fence around the whole text when it is
+// a ```markdown (or ```md) fence, or a bare ``` fence with no other fence
+// inside, and likewise for ~~~ fences. A note that is a code block in
+// another language is kept.
+func stripMarkdownWrapper(text string) string {
+	trimmed := strings.TrimSpace(text)
+	lines := strings.Split(trimmed, "\n")
+	if len(lines) < 2 {
+		return trimmed
+	}
+	first, last := strings.TrimSpace(lines[0]), strings.TrimSpace(lines[len(lines)-1])
+	marker := fenceMarker(first)
+	if marker == "" || last != marker {
+		return trimmed
+	}
+
+	inner := lines[1 : len(lines)-1]
+	switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(first, marker))) {
+	case "markdown", "md":
+	case "":
+		for _, line := range inner {
+			if isFenceLine(line) {
+				return trimmed
+			}
+		}
+	default:
+		return trimmed
+	}
+	return strings.TrimSpace(strings.Join(inner, "\n"))
+}
+
+// isFenceLine tells whether a line opens or closes a fenced code block
+func isFenceLine(line string) bool {
+	return fenceMarker(line) != ""
+}
+
+// fenceMarker returns the ``` or ~~~ of a line opening or closing a fenced
+// code block, or "" for another line
+func fenceMarker(line string) string {
+	trimmed := strings.TrimSpace(line)
+	for _, marker := range []string{"```", "~~~"} {
+		if strings.HasPrefix(trimmed, marker) {
+			return marker
+		}
+	}
+	return ""
+}
+
+// fenceState is the marker of the fenced code block being scanned, or ""
+// outside one. A block is closed only by the marker that opened it, so a ~~~
+// line inside a ``` block is code.
+type fenceState string
+
+// toggle opens or closes a block on a fence line, reporting whether line is one
+func (f *fenceState) toggle(line string) bool {
+	marker := fenceMarker(line)
+	switch {
+	case marker == "":
+		return false
+	case *f == "":
+		*f = fenceState(marker)
+	case string(*f) == marker:
+		*f = ""
+	default:
+		return false
+	}
+	return true
+}
+
+// open tells whether the scan is inside a fenced code block
+func (f fenceState) open() bool {
+	return f != ""
+}
+
+// escapeRawHTMLParagraphs escapes raw HTML in the paragraphs of Markdown
+// lines outside fenced code blocks. Each paragraph is scanned as a whole, so
+// a tag split across lines is escaped too.
+func escapeRawHTMLParagraphs(lines []string) {
+	var fence fenceState
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		// Escaping adds no line breaks, so the paragraph keeps its lines
+		escaped := strings.Split(escapeRawHTML(strings.Join(lines[start:end], "\n")), "\n")
+		copy(lines[start:end], escaped)
+		start = -1
+	}
+	for i, line := range lines {
+		if fence.toggle(line) {
+			flush(i)
+			continue
+		}
+		if fence.open() {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			flush(i)
+		} else if start < 0 {
+			start = i
+		}
+	}
+	flush(len(lines))
+}
+
+// escapeRawHTML escapes the HTML tags of Markdown text outside its code
+// spans, keeping <br> line breaks, which tables need
+func escapeRawHTML(text string) string {
+	var b strings.Builder
+	last := 0
+	escape := func(s string) string {
+		return rawHTMLTagPattern.ReplaceAllStringFunc(s, func(tag string) string {
+			m := rawHTMLTagPattern.FindStringSubmatch(tag)
+			if strings.EqualFold(m[1], "br") && strings.TrimSpace(strings.TrimSuffix(m[2], "/")) == "" {
+				return tag
+			}
+			return "&lt;" + tag[1:]
+		})
+	}
+	for _, span := range inlineCodePattern.FindAllStringIndex(text, -1) {
+		b.WriteString(escape(text[last:span[0]]))
+		b.WriteString(text[span[0]:span[1]])
+		last = span[1]
+	}
+	b.WriteString(escape(text[last:]))
+	return b.String()
+}
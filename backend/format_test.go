@@ -0,0 +1,27 @@
+package backend
+
+import "testing"
+
+func TestCleanNoteMarkdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		escapeHTML bool
+		want       string
+	}{
+		{"tag split across lines", "Hello <span\nclass=\"x\">world</span>", true, "Hello &lt;span\nclass=\"x\">world&lt;/span>"},
+		{"code span kept", "Use `<div>` for <b>blocks</b>", true, "Use `<div>` for &lt;b>blocks&lt;/b>"},
+		{"code fence kept", "```html\n<div>hi</div>\n```", true, "```html\n<div>hi</div>\n```"},
+		{"line breaks kept", "a<br>b<br/>c<br />d", true, "a<br>b<br/>c<br />d"},
+		{"tilde fence kept", "~~~\n<div>x</div>\n~~~\n\n<i>y</i>", true, "~~~\n<div>x</div>\n~~~\n\n&lt;i>y&lt;/i>"},
+		{"tilde line inside backtick fence", "```\n~~~\n<p>\n```\n<p>", true, "```\n~~~\n<p>\n```\n&lt;p>"},
+		{"tilde markdown wrapper", "~~~markdown\n## Title\ntext\n~~~", true, "# Title\ntext"},
+		{"headings in tilde fence kept", "## A\n~~~\n## code\n~~~", true, "# A\n~~~\n## code\n~~~"},
+		{"html kept without escaping", "<b>bold</b>", false, "<b>bold</b>"},
+	}
+	for _, tt := range tests {
+		if got := cleanNoteMarkdown(tt.text, tt.escapeHTML); got != tt.want {
+			t.Errorf("%s: cleanNoteMarkdown(%q) = %q, want %q", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
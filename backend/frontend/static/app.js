@@ -191,6 +191,66 @@ class OpenNotebook {
         }
     }
 
+    // 流式生成笔记：onDelta 接收生成中的内容，返回保存的笔记；
+    // 信息图等后台任务类型直接返回任务
+    async streamTransform(body, onDelta) {
+        const response = await fetch(`${this.apiBase}/notebooks/${this.currentNotebook.id}/transform`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ ...body, stream: true }),
+        });
+        if (!response.ok) {
+            const error = await response.json().catch(() => ({ error: '请求失败' }));
+            throw new Error(error.error || '请求失败');
+        }
+        if (!(response.headers.get('Content-Type') || '').includes('text/event-stream')) {
+            return response.json();
+        }
+
+        const reader = response.body.getReader();
+        const decoder = new TextDecoder();
+        let buffer = '';
+        while (true) {
+            const { value, done } = await reader.read();
+            if (done) break;
+            buffer += decoder.decode(value, { stream: true });
+            let end;
+            while ((end = buffer.indexOf('\n\n')) !== -1) {
+                const block = buffer.slice(0, end);
+                buffer = buffer.slice(end + 2);
+                let event = 'message';
+                let data = '';
+                for (const line of block.split('\n')) {
+                    if (line.startsWith('event:')) event = line.slice(6).trim();
+                    else if (line.startsWith('data:')) data += line.slice(5);
+                }
+                if (!data) continue;
+                const payload = JSON.parse(data);
+                if (event === 'delta') onDelta(payload.content);
+                else if (event === 'done') return payload;
+                else if (event === 'error') throw new Error(payload.error || '生成失败');
+            }
+        }
+        throw new Error('生成中断，请稍后重试');
+    }
+
+    // 轮询后台任务，完成后返回生成的笔记
+    async waitForJob(jobId) {
+        while (true) {
+            await new Promise(resolve => setTimeout(resolve, 3000));
+            const job = await this.api(`/jobs/${jobId}`);
+            if (job.status === 'completed') {
+                const notes = await this.api(`/notebooks/${job.notebook_id}/notes`);
+                const note = notes.find(n => n.id === job.note_id);
+                if (!note) throw new Error('生成的笔记不存在');
+                return note;
+            }
+            if (job.status === 'failed') {
+                throw new Error(job.error || '生成失败');
+            }
+        }
+    }
+
     // 笔记本方法
     async loadNotebooks() {
         try {
@@ -547,7 +607,8 @@ class OpenNotebook {
                 card.dataset.id = source.id;
                 card.querySelector('.source-type-badge').textContent = source.type;
                 card.querySelector('.source-name').textContent = source.name;
-                card.querySelector('.source-meta').textContent = this.formatFileSize(source.file_size) || '文本来源';
+                const language = source.metadata?.language ? ` · ${source.metadata.language}` : '';
+                card.querySelector('.source-meta').textContent = (this.formatFileSize(source.file_size) || '文本来源') + language;
                 card.querySelector('.chunk-count').textContent = source.chunk_count || 0;
 
                 const icon = this.getSourceIcon(source.type);
@@ -570,6 +631,7 @@ class OpenNotebook {
         const icons = {
             file: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M10 4 L24 4 L30 10 L30 36 L10 36 Z"/><polyline points="24,4 24,10 30,10"/></svg>',
             text: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M8 6 L32 6"/><path d="M8 12 L32 12"/><path d="M8 18 L28 18"/><path d="M8 24 L32 24"/><path d="M8 30 L24 30"/></svg>',
+            image: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><rect x="6" y="8" width="28" height="24"/><circle cx="14" cy="16" r="3"/><polyline points="6,30 16,22 22,27 27,22 34,28"/></svg>',
             url: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M12 20 C12 14 16 10 22 10 C28 10 32 14 32 20 C32 26 28 30 22 30"/><path d="M28 20 C28 26 24 30 18 30 C12 30 8 26 8 20 C8 14 12 10 18 10"/></svg>',
         };
         return icons[type] || icons.file;
@@ -631,7 +693,7 @@ class OpenNotebook {
             await this.api(`/notebooks/${this.currentNotebook.id}/sources`, {
                 method: 'POST',
                 body: JSON.stringify({
-                    name: data.get('name'),
+                    name: data.get('name') || undefined,
                     type: 'text',
                     content: data.get('content'),
                 }),
@@ -807,6 +869,18 @@ class OpenNotebook {
             `;
         }
 
+        // Podcast player showing who is speaking. The audio URL and speaker
+        // names are set once the player is in the page, never as HTML.
+        let podcastHTML = '';
+        if (note.metadata?.audio_url) {
+            podcastHTML = `
+                <div class="podcast-player">
+                    <audio controls id="podcastAudio"></audio>
+                    <div class="podcast-speaker" id="podcastSpeaker"></div>
+                </div>
+            `;
+        }
+
         // Determine if we should show the text content
         const showMarkdownContent = (note.type !== 'infograph' && note.type !== 'ppt') || (!note.metadata?.image_url && !note.metadata?.slides);
 
@@ -842,6 +916,7 @@ class OpenNotebook {
                 <div class="note-view-content">
                     ${infographicHTML}
                     ${pptSliderHTML}
+                    ${podcastHTML}
                     <div class="markdown-content" style="${showMarkdownContent ? '' : 'display:none'}">${renderedContent}</div>
                 </div>
             </div>
@@ -874,6 +949,19 @@ class OpenNotebook {
             // Cleanup handler on container remove? We'll leave it for now or add observer
         }
 
+        // Follow the current speaker while the podcast plays
+        if (note.metadata?.audio_url) {
+            const audio = document.getElementById('podcastAudio');
+            const speakerLabel = document.getElementById('podcastSpeaker');
+            const segments = note.metadata.segments || [];
+            audio.src = note.metadata.audio_url;
+            speakerLabel.textContent = segments.length > 0 ? segments[0].speaker : '';
+            audio.addEventListener('timeupdate', () => {
+                const segment = segments.find(s => audio.currentTime >= s.start && audio.currentTime < s.end);
+                if (segment) speakerLabel.textContent = segment.speaker;
+            });
+        }
+
         // Render Mermaid diagrams if any
         if (window.mermaid) {
             try {
@@ -1031,11 +1119,15 @@ class OpenNotebook {
             this.showError('请先添加来源');
             return;
         }
+        if (type === 'compare' && sources.length < 2) {
+            this.showError('对比至少需要两个来源');
+            return;
+        }
 
         const customPrompt = document.getElementById('customPrompt').value;
         const nameMap = {
             summary: '摘要', faq: '常见问题', study_guide: '学习指南', outline: '大纲',
-            podcast: '播客', timeline: '时间线', glossary: '术语表', quiz: '测验',
+            podcast: '播客', timeline: '时间线', glossary: '术语表', explain: '通俗解读', compare: '来源对比', quiz: '测验',
             mindmap: '思维导图', infograph: '信息图', ppt: '幻灯片'
         };
         const typeName = nameMap[type] || '内容';
@@ -1069,17 +1161,23 @@ class OpenNotebook {
 
         try {
             const sourceIds = sources.map(s => s.id);
-            const note = await this.api(`/notebooks/${this.currentNotebook.id}/transform`, {
-                method: 'POST',
-                body: JSON.stringify({
-                    type: type,
-                    prompt: customPrompt || undefined,
-                    source_ids: sourceIds,
-                    length: 'medium',
-                    format: 'markdown',
-                }),
+            let streamed = '';
+            let note = await this.streamTransform({
+                type: type,
+                prompt: customPrompt || undefined,
+                source_ids: sourceIds,
+                length: 'medium',
+                format: 'markdown',
+            }, (delta) => {
+                streamed += delta;
+                placeholder.querySelector('.note-preview').textContent = streamed;
             });
 
+            // 信息图、幻灯片等耗时生成在后台任务中运行
+            if (note.status && note.request) {
+                note = await this.waitForJob(note.id);
+            }
+
             // 3. 停止动画并更新占位符
             if (element) element.classList.remove('loading');
 
@@ -4,8 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -16,32 +14,38 @@ import (
 
 // LLMProvider defines the interface for LLM operations
 type LLMProvider interface {
-	// GenerateImage generates an image using the provider
-	GenerateImage(ctx context.Context, model, prompt string) (string, error)
+	// GenerateImage generates an image using the provider and returns the
+	// path it was saved to
+	GenerateImage(ctx context.Context, model, prompt string, opts ImageOptions) (string, error)
 
 	// GenerateTextWithModel generates text using a specific model
 	GenerateTextWithModel(ctx context.Context, prompt string, model string) (string, error)
 
 	// GenerateFromSinglePrompt generates text from a single prompt using the default LLM
 	GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error)
+
+	// GenerateWithUsage generates text from a single prompt and reports token usage
+	GenerateWithUsage(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, TokenUsage, error)
 }
 
 // GeminiClient is the default implementation of LLMProvider using Google GenAI
 type GeminiClient struct {
 	googleAPIKey string
 	llm          llms.Model // maybe other llm except gemini for chat/summary etc.
+	uploadDir    string     // generated images are saved here
 }
 
 // NewGeminiClient creates a new GeminiClient
-func NewGeminiClient(googleAPIKey string, llm llms.Model) *GeminiClient {
+func NewGeminiClient(googleAPIKey string, llm llms.Model, uploadDir string) *GeminiClient {
 	return &GeminiClient{
 		googleAPIKey: googleAPIKey,
 		llm:          llm,
+		uploadDir:    uploadDir,
 	}
 }
 
 // GenerateImage generates an image using the Google GenAI SDK
-func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string) (string, error) {
+func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string, opts ImageOptions) (string, error) {
 	if n.googleAPIKey == "" {
 		golog.Errorf("google_api_key is not set")
 		return "", fmt.Errorf("google_api_key is not set")
@@ -65,6 +69,13 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string)
 		return "", fmt.Errorf("failed to create genai client: %w", err)
 	}
 
+	var config *genai.GenerateContentConfig
+	if opts.AspectRatio != "" || opts.Size != "" {
+		config = &genai.GenerateContentConfig{
+			ImageConfig: &genai.ImageConfig{AspectRatio: opts.AspectRatio, ImageSize: opts.Size},
+		}
+	}
+
 	var lastErr error
 	for attempt := 1; attempt <= 3; attempt++ {
 		if attempt > 1 {
@@ -75,7 +86,7 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string)
 		}
 
 		genCtx, cancel := context.WithTimeout(ctx, 300*time.Second)
-		resp, err := client.Models.GenerateContent(genCtx, model, genai.Text(prompt), nil)
+		resp, err := client.Models.GenerateContent(genCtx, model, genai.Text(prompt), config)
 		if err != nil {
 			cancel()
 			golog.Errorf("failed to generate content (attempt %d): %v", attempt, err)
@@ -107,22 +118,7 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string)
 
 		cancel()
 		golog.Infof("image data received successfully, saving...")
-
-		// Save the image
-		fileName := fmt.Sprintf("infograph_%d.png", time.Now().UnixNano())
-		uploadDir := "./data/uploads"
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			return "", fmt.Errorf("failed to create upload directory: %w", err)
-		}
-
-		filePath := filepath.Join(uploadDir, fileName)
-		if err := os.WriteFile(filePath, imageData, 0644); err != nil {
-			golog.Errorf("failed to save image to %s: %v", filePath, err)
-			return "", fmt.Errorf("failed to save image: %w", err)
-		}
-
-		golog.Infof("infographic saved to %s", filePath)
-		return filePath, nil
+		return saveGeneratedImage(n.uploadDir, imageData)
 	}
 
 	return "", fmt.Errorf("failed to generate image after 3 attempts: %w", lastErr)
@@ -188,5 +184,45 @@ func (n *GeminiClient) GenerateTextWithModel(ctx context.Context, prompt string,
 
 // GenerateFromSinglePrompt generates text from a single prompt using the specified LLM
 func (n *GeminiClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error) {
-	return llms.GenerateFromSinglePrompt(ctx, n.llm, prompt, options...)
+	return llms.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
+
+// GenerateWithUsage generates text from a single prompt and reports the token usage returned by the LLM
+func (n *GeminiClient) GenerateWithUsage(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, TokenUsage, error) {
+	msg := llms.MessageContent{
+		Role:  llms.ChatMessageTypeHuman,
+		Parts: []llms.ContentPart{llms.TextContent{Text: prompt}},
+	}
+
+	resp, err := llm.GenerateContent(ctx, []llms.MessageContent{msg}, options...)
+	if err != nil {
+		return "", TokenUsage{}, err
+	}
+	if len(resp.Choices) == 0 {
+		return "", TokenUsage{}, fmt.Errorf("empty response from model")
+	}
+
+	choice := resp.Choices[0]
+	usage := TokenUsage{
+		PromptTokens:     intFromInfo(choice.GenerationInfo, "PromptTokens"),
+		CompletionTokens: intFromInfo(choice.GenerationInfo, "CompletionTokens"),
+		TotalTokens:      intFromInfo(choice.GenerationInfo, "TotalTokens"),
+	}
+
+	return choice.Content, usage, nil
+}
+
+// intFromInfo reads an integer value from provider-specific generation info
+func intFromInfo(info map[string]any, key string) int {
+	switch v := info[key].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
 }
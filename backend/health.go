@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Service check statuses
+const (
+	CheckStatusOK      = "ok"
+	CheckStatusError   = "error"
+	CheckStatusSkipped = "skipped"
+)
+
+// runCheck times a dependency probe
+func runCheck(ctx context.Context, probe func(ctx context.Context) error) ServiceCheck {
+	start := time.Now()
+	err := probe(ctx)
+	check := ServiceCheck{Status: CheckStatusOK, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		check.Status = CheckStatusError
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// checkLLM verifies the LLM provider is reachable by listing its models,
+// which costs no tokens
+func checkLLM(ctx context.Context, cfg Config) error {
+	var req *http.Request
+	var err error
+	if cfg.IsOllama() {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(cfg.OllamaBaseURL, "/")+"/api/tags", nil)
+	} else {
+		baseURL := cfg.OpenAIBaseURL
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/models", nil)
+		if err == nil && cfg.OpenAIToken() != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.OpenAIToken())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Health check handler. The store is always probed; the LLM only with
+// ?deep=true. Returns 503 when a dependency is down.
+func (s *Server) handleHealth(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	checks := map[string]ServiceCheck{
+		"store": runCheck(ctx, s.store.Ping),
+	}
+	if c.Query("deep") == "true" {
+		checks["llm"] = runCheck(ctx, func(ctx context.Context) error {
+			return checkLLM(ctx, s.cfg)
+		})
+	} else {
+		checks["llm"] = ServiceCheck{Status: CheckStatusSkipped}
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if check.Status == CheckStatusError {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+
+	resp := HealthResponse{
+		Status:    status,
+		Version:   "1.0.0",
+		Timestamp: time.Now().Unix(),
+		Services: map[string]string{
+			"vector_store": s.cfg.VectorStoreType,
+			"llm":          s.cfg.OpenAIModel,
+		},
+		Checks: checks,
+	}
+	if s.agent.limiter != nil {
+		load := s.agent.limiter.load()
+		resp.LLMLoad = &load
+	}
+	c.JSON(code, resp)
+}
@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// idempotencyKeyHeader lets clients retry a create request without
+// creating the resource twice
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyTTL is how long a key is remembered
+const idempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the keys accepted
+const maxIdempotencyKeyLength = 255
+
+// Resource types recorded for idempotency keys
+const (
+	idempotentNotebook = "notebook"
+	idempotentSource   = "source"
+	idempotentNote     = "note"
+	idempotentJob      = "job"
+)
+
+// keyedLocks serializes requests sharing a key; the zero value is ready to
+// use
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks key and returns the function unlocking it
+func (k *keyedLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.users++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// idempotentRequest is a create request carrying an Idempotency-Key. A nil
+// request, for requests without the header, records nothing.
+type idempotentRequest struct {
+	s        *Server
+	scope    string
+	key      string
+	bodyHash string
+	unlock   func()
+}
+
+// beginIdempotent handles the Idempotency-Key of a create request whose
+// decoded body is body. When the key was already used on the same route and
+// notebook, it responds with the resource created then, or with a 422 if
+// the body differs, and returns true. Otherwise concurrent requests with
+// the key wait until this one calls release, so only one of them creates
+// the resource.
+func (s *Server) beginIdempotent(c *gin.Context, body interface{}) (*idempotentRequest, bool) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		return nil, false
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Idempotency-Key is too long", Code: ErrCodeInvalidRequest})
+		return nil, true
+	}
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to hash request body", Code: ErrCodeInternal, Details: err.Error()})
+		return nil, true
+	}
+	sum := sha256.Sum256(encoded)
+
+	scope := c.Request.Method + " " + c.FullPath() + " " + c.Param("id")
+	r := &idempotentRequest{
+		s:        s,
+		scope:    scope,
+		key:      key,
+		bodyHash: hex.EncodeToString(sum[:]),
+		unlock:   s.idempotencyLocks.lock(scope + " " + key),
+	}
+
+	ctx := c.Request.Context()
+	rec, err := s.store.GetIdempotencyKey(ctx, scope, key, time.Now().Add(-idempotencyKeyTTL))
+	if err != nil {
+		golog.Errorf("failed to look up idempotency key: %v", err)
+		return r, false
+	}
+	if rec == nil {
+		return r, false
+	}
+	defer r.release()
+
+	// Keys recorded before bodies were hashed have no hash to compare
+	if rec.BodyHash != "" && rec.BodyHash != r.bodyHash {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{
+			Error: "Idempotency-Key was already used with a different request body",
+			Code:  ErrCodeIdempotencyMismatch,
+		})
+		return nil, true
+	}
+
+	resource, err := s.idempotentResource(ctx, rec)
+	if err != nil {
+		// The resource was deleted since; the key is spent all the same
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   "The resource created with this Idempotency-Key no longer exists",
+			Code:    ErrCodeInvalidRequest,
+			Details: rec.ResourceID,
+		})
+		return nil, true
+	}
+	golog.Infof("replaying %s %s for idempotency key %q", rec.ResourceType, rec.ResourceID, key)
+	c.Header("Idempotent-Replayed", "true")
+	c.JSON(rec.Status, resource)
+	return nil, true
+}
+
+// idempotentResource loads the current state of a recorded resource
+func (s *Server) idempotentResource(ctx context.Context, rec *IdempotencyRecord) (interface{}, error) {
+	switch rec.ResourceType {
+	case idempotentNotebook:
+		return s.store.GetNotebook(ctx, rec.ResourceID)
+	case idempotentSource:
+		return s.store.GetSource(ctx, rec.ResourceID)
+	case idempotentNote:
+		return s.store.GetNote(ctx, rec.ResourceID)
+	default:
+		return s.store.GetJob(ctx, rec.ResourceID)
+	}
+}
+
+// record remembers the resource created for the key
+func (r *idempotentRequest) record(ctx context.Context, resourceType, id string, status int) {
+	if r == nil {
+		return
+	}
+	rec := IdempotencyRecord{ResourceType: resourceType, ResourceID: id, Status: status, BodyHash: r.bodyHash}
+	if err := r.s.store.SaveIdempotencyKey(ctx, r.scope, r.key, rec, time.Now().Add(-idempotencyKeyTTL)); err != nil {
+		golog.Errorf("failed to save idempotency key: %v", err)
+	}
+}
+
+// uploadDigest returns the hex SHA-256 of an uploaded file, so the body
+// hashed for an upload's Idempotency-Key covers the file's content
+func uploadDigest(file *multipart.FileHeader) (string, error) {
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// release lets the next request with the key proceed
+func (r *idempotentRequest) release() {
+	if r != nil && r.unlock != nil {
+		r.unlock()
+		r.unlock = nil
+	}
+}
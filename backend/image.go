@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// Image generation backends
+const (
+	ImageBackendAuto   = "auto"
+	ImageBackendGemini = "gemini"
+	ImageBackendOpenAI = "openai"
+)
+
+// Default image models of each backend, used without INFOGRAPH_MODEL
+const (
+	defaultGeminiImageModel = "gemini-3-pro-image-preview"
+	defaultOpenAIImageModel = "dall-e-3"
+)
+
+// ImageOptions shapes a generated image. Empty fields leave the model's
+// default.
+type ImageOptions struct {
+	AspectRatio string // e.g. "16:9" or "3:4"
+	Size        string // "1K", "2K", "4K" for Gemini, "1024x1792" style for OpenAI
+}
+
+// imageBackend resolves IMAGE_BACKEND. In auto mode Gemini is used when a
+// Google API key is set, otherwise the OpenAI images API when an OpenAI key
+// is set. It returns "" when no backend is available.
+func imageBackend(cfg Config) string {
+	switch cfg.ImageBackend {
+	case ImageBackendGemini, ImageBackendOpenAI:
+		return cfg.ImageBackend
+	}
+	if cfg.GoogleAPIKey != "" {
+		return ImageBackendGemini
+	}
+	if cfg.OpenAIAPIKey != "" {
+		return ImageBackendOpenAI
+	}
+	return ""
+}
+
+// imageModel returns INFOGRAPH_MODEL, or the default model of the backend
+func imageModel(cfg Config, backend string) string {
+	if cfg.InfographModel != "" {
+		return cfg.InfographModel
+	}
+	if backend == ImageBackendOpenAI {
+		return defaultOpenAIImageModel
+	}
+	return defaultGeminiImageModel
+}
+
+// infographOptions returns the configured shape of infographic images
+func (a *Agent) infographOptions() ImageOptions {
+	return ImageOptions{AspectRatio: a.cfg.InfographAspectRatio, Size: a.cfg.InfographSize}
+}
+
+// GenerateImage generates an image with the configured backend and model,
+// saves it in the uploads directory and returns its path and the model used
+func (a *Agent) GenerateImage(ctx context.Context, prompt string, opts ImageOptions) (string, string, error) {
+	backend := imageBackend(a.cfg)
+	model := imageModel(a.cfg, backend)
+
+	switch backend {
+	case ImageBackendGemini:
+		path, err := a.provider.GenerateImage(ctx, model, prompt, opts)
+		return path, model, err
+	case ImageBackendOpenAI:
+		data, err := generateOpenAIImage(ctx, a.cfg, model, prompt, opts)
+		if err != nil {
+			return "", model, err
+		}
+		path, err := saveGeneratedImage(a.cfg.UploadsDir, data)
+		return path, model, err
+	}
+	return "", "", fmt.Errorf("no image backend available: set GOOGLE_API_KEY or OPENAI_API_KEY")
+}
+
+// generateOpenAIImage generates a PNG with the OpenAI images API
+func generateOpenAIImage(ctx context.Context, cfg Config, model, prompt string, opts ImageOptions) ([]byte, error) {
+	request := map[string]interface{}{
+		"model":  model,
+		"prompt": prompt,
+		"n":      1,
+		"size":   openAIImageSize(model, opts),
+	}
+	if strings.HasPrefix(model, "dall-e") {
+		// gpt-image models always return base64 and reject the parameter
+		request["response_format"] = "b64_json"
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ollama has no images API, so its base URL is not used
+	baseURL := cfg.OpenAIBaseURL
+	if baseURL == "" || cfg.IsOllama() {
+		baseURL = "https://api.openai.com/v1"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/images/generations", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.OpenAIAPIKey)
+
+	golog.Infof("generating image with model %s using the OpenAI images API...", model)
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("images API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode images API response: %w", err)
+	}
+	if len(result.Data) == 0 || result.Data[0].B64JSON == "" {
+		return nil, fmt.Errorf("no image data in response")
+	}
+	return base64.StdEncoding.DecodeString(result.Data[0].B64JSON)
+}
+
+// openAIImageSize returns the size parameter for the OpenAI images API: the
+// configured size when it is a WIDTHxHEIGHT value, otherwise the size of the
+// model closest to the aspect ratio
+func openAIImageSize(model string, opts ImageOptions) string {
+	if strings.Contains(opts.Size, "x") {
+		return opts.Size
+	}
+
+	square, portrait, landscape := "1024x1024", "1024x1792", "1792x1024"
+	if strings.HasPrefix(model, "gpt-image") {
+		portrait, landscape = "1024x1536", "1536x1024"
+	}
+	w, h, ok := strings.Cut(opts.AspectRatio, ":")
+	if !ok {
+		return square
+	}
+	width, err1 := strconv.ParseFloat(w, 64)
+	height, err2 := strconv.ParseFloat(h, 64)
+	switch {
+	case err1 != nil || err2 != nil || width == height:
+		return square
+	case width < height:
+		return portrait
+	default:
+		return landscape
+	}
+}
+
+// saveGeneratedImage writes a generated PNG to the uploads directory
+func saveGeneratedImage(dir string, data []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	filePath := filepath.Join(dir, fmt.Sprintf("infograph_%d.png", time.Now().UnixNano()))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		golog.Errorf("failed to save image to %s: %v", filePath, err)
+		return "", fmt.Errorf("failed to save image: %w", err)
+	}
+
+	golog.Infof("infographic saved to %s", filePath)
+	return filePath, nil
+}
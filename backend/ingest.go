@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// IngestFileOptions controls how IngestFileWithOptions stores a file
+type IngestFileOptions struct {
+	Name     string // display name, defaults to the file's base name
+	FileName string // stored file name, defaults to the file's base name
+	Force    bool   // add the file even if the notebook has a source with the same content
+	URL      string // where the file was downloaded from, if anywhere
+	Index    *bool  // add the source to the vector index; nil follows the notebook's default
+
+	// KeepFailed stores a source recording the error when text extraction
+	// fails, instead of returning the error
+	KeepFailed bool
+}
+
+// DuplicateSourceError is returned when a notebook already has a source with
+// the same content and Force is not set
+type DuplicateSourceError struct {
+	Existing *Source
+}
+
+func (e *DuplicateSourceError) Error() string {
+	return fmt.Sprintf("source already exists in this notebook: %s", e.Existing.Name)
+}
+
+// IngestFile extracts the text of a file, adds it as a source of a notebook
+// and indexes it for search
+func IngestFile(ctx context.Context, store *Store, vectorStore *VectorStore, notebookID, path string) (*Source, error) {
+	return IngestFileWithOptions(ctx, store, vectorStore, notebookID, path, IngestFileOptions{})
+}
+
+// IngestFileWithOptions is IngestFile with control over naming, duplicates
+// and extraction failures. If the source is created but indexing fails, the
+// source is returned together with the error.
+func IngestFileWithOptions(ctx context.Context, store *Store, vectorStore *VectorStore, notebookID, path string, opts IngestFileOptions) (*Source, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = filepath.Base(path)
+	}
+	if opts.FileName == "" {
+		opts.FileName = filepath.Base(path)
+	}
+
+	source := &Source{
+		NotebookID: notebookID,
+		Name:       opts.Name,
+		Type:       "file",
+		FileName:   opts.FileName,
+		URL:        opts.URL,
+		FileSize:   info.Size(),
+		Metadata:   make(map[string]interface{}),
+	}
+	if opts.Index != nil {
+		source.Metadata[sourceIndexKey] = *opts.Index
+	}
+	if isImageFile(path) {
+		// The OCR text is indexed; multimodal chat also gets the image itself
+		source.Type = "image"
+		source.Metadata["mime_type"] = imageMIMETypes[strings.ToLower(filepath.Ext(path))]
+	}
+
+	start := time.Now()
+	content, method, err := vectorStore.extractDocument(ctx, path)
+	observeSince(ingestDuration, start, "extract", metricOutcome(err))
+	if err != nil {
+		if !opts.KeepFailed {
+			return nil, fmt.Errorf("extraction failed: %w", err)
+		}
+		// The failure marker is stored so the upload shows up, but it is not
+		// indexed
+		golog.Errorf("failed to extract document content: %v", err)
+		source.Content = fmt.Sprintf("Failed to extract: %v", err)
+		source.Metadata["extraction"] = extractionFailed
+		source.Metadata["extraction_error"] = err.Error()
+		if err := store.CreateSource(ctx, source); err != nil {
+			return nil, fmt.Errorf("failed to create source: %w", err)
+		}
+		return source, nil
+	}
+
+	source.Content = content
+	source.Metadata["extraction"] = method
+	for key, value := range vectorStore.ExtractionMetadata(path) {
+		source.Metadata[key] = value
+	}
+	return addSource(ctx, store, vectorStore, source, opts.Force)
+}
+
+// IngestURL fetches a web page, adds its text as a source of a notebook and
+// indexes it for search
+func IngestURL(ctx context.Context, store *Store, vectorStore *VectorStore, notebookID, pageURL string) (*Source, error) {
+	page, err := fetchPage(ctx, newWebClient(vectorStore.cfg.FetchAllowPrivate), pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", pageURL, err)
+	}
+
+	name := page.Title
+	if name == "" {
+		name = page.URL
+	}
+	source := &Source{
+		NotebookID: notebookID,
+		Name:       name,
+		Type:       "url",
+		URL:        page.URL,
+		Content:    page.Content,
+		Metadata:   make(map[string]interface{}),
+	}
+	return addSource(ctx, store, vectorStore, source, false)
+}
+
+// addSource stores a source with its content, rejecting duplicates unless
+// forced, and indexes it with the notebook's settings
+func addSource(ctx context.Context, store *Store, vectorStore *VectorStore, source *Source, force bool) (*Source, error) {
+	nb, err := store.GetNotebook(ctx, source.NotebookID)
+	if err != nil {
+		return nil, err
+	}
+
+	markOversizedSource(source, vectorStore.cfg.MaxSourceBytes)
+	setSourceLanguage(source)
+	existing, err := findDuplicateSource(ctx, store, source)
+	if err != nil {
+		golog.Errorf("failed to check for duplicate source: %v", err)
+	} else if existing != nil && !force {
+		return nil, &DuplicateSourceError{Existing: existing}
+	}
+
+	setSourceIndex(source, nil, nb)
+	if err := store.CreateSource(ctx, source); err != nil {
+		return nil, fmt.Errorf("failed to create source: %w", err)
+	}
+	if !sourceIndexed(source) {
+		return source, nil
+	}
+
+	start := time.Now()
+	err = vectorStore.IngestTextWithOptions(ctx, source.Name, source.Content, NotebookIngestOptions(nb).WithSource(source.ID))
+	observeSince(ingestDuration, start, "index", metricOutcome(err))
+	if err != nil {
+		return source, fmt.Errorf("failed to index source: %w", err)
+	}
+	if chunks, err := vectorStore.ListChunks(ctx, source.NotebookID, source.ID); err == nil {
+		source.ChunkCount = len(chunks)
+		store.UpdateSourceChunkCount(ctx, source.ID, source.ChunkCount)
+	}
+	return source, nil
+}
+
+// sourceIndexKey is the source and notebook metadata key turning off vector
+// indexing: sources stored with "index": false are used by transformations
+// but not retrieved by chat or search, which saves chunking and embedding
+// them. A notebook's "index" is the default of its new sources.
+const sourceIndexKey = "index"
+
+// sourceIndexed tells whether a source is added to the vector index
+func sourceIndexed(source *Source) bool {
+	index, ok := source.Metadata[sourceIndexKey].(bool)
+	return !ok || index
+}
+
+// setSourceIndex records in a new source's metadata whether it is indexed,
+// unless already recorded: as requested, or else as its notebook's default
+func setSourceIndex(source *Source, index *bool, nb *Notebook) {
+	if index == nil {
+		if _, set := source.Metadata[sourceIndexKey]; set || nb == nil {
+			return
+		}
+		v, ok := nb.Metadata[sourceIndexKey].(bool)
+		if !ok {
+			return
+		}
+		index = &v
+	}
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata[sourceIndexKey] = *index
+}
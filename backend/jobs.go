@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Job statuses
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCanceled  = "canceled"
+)
+
+// jobCanceledMessage is recorded as the error of a canceled job
+const jobCanceledMessage = "canceled by request"
+
+// asyncTransformTypes are transformations that generate images or audio and
+// always run as background jobs, in batches too
+var asyncTransformTypes = map[string]bool{
+	"infograph": true,
+	"ppt":       true,
+	"podcast":   true,
+}
+
+// startJobWorkers starts the background job workers and re-queues jobs left
+// unfinished by a previous run
+func (s *Server) startJobWorkers(ctx context.Context) {
+	workers := s.cfg.JobWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	s.jobs = make(chan string, 100)
+	for i := 0; i < workers; i++ {
+		go s.jobWorker()
+	}
+
+	jobs, err := s.store.ListUnfinishedJobs(ctx)
+	if err != nil {
+		golog.Errorf("failed to load unfinished jobs: %v", err)
+		return
+	}
+	if len(jobs) > 0 {
+		golog.Infof("resuming %d unfinished jobs", len(jobs))
+	}
+	for _, job := range jobs {
+		s.enqueueJob(job.ID)
+	}
+}
+
+// enqueueJob hands a job to the workers without blocking the caller
+func (s *Server) enqueueJob(id string) {
+	select {
+	case s.jobs <- id:
+	default:
+		go func() { s.jobs <- id }()
+	}
+}
+
+// jobWorker runs queued jobs one at a time
+func (s *Server) jobWorker() {
+	for id := range s.jobs {
+		s.runJob(context.Background(), id)
+	}
+}
+
+// runJob runs a transformation job and records its outcome. The generation
+// runs under a context that DELETE /api/jobs/:id cancels.
+func (s *Server) runJob(ctx context.Context, id string) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	s.trackJob(id, cancel)
+	defer s.untrackJob(id)
+
+	job, err := s.store.GetJob(ctx, id)
+	if err != nil {
+		golog.Errorf("failed to load job %s: %v", id, err)
+		return
+	}
+	if job.Status == JobStatusCanceled {
+		// Canceled while queued; the webhook was sent unless the cancel
+		// reached this run
+		if jobCtx.Err() != nil {
+			s.finishJob(ctx, id, nil)
+		}
+		return
+	}
+
+	if err := s.store.UpdateJobStatus(ctx, id, JobStatusRunning, "", ""); err != nil {
+		golog.Errorf("failed to update job %s: %v", id, err)
+		return
+	}
+	golog.Infof("job %s started: %s transformation for notebook %s", id, job.Type, job.NotebookID)
+
+	note, err := s.runTransformation(jobCtx, job.NotebookID, &job.Request)
+	if err != nil && errors.Is(jobCtx.Err(), context.Canceled) {
+		golog.Infof("job %s canceled", id)
+		if err := s.store.UpdateJobStatus(ctx, id, JobStatusCanceled, "", jobCanceledMessage); err != nil {
+			golog.Errorf("failed to update job %s: %v", id, err)
+		}
+		s.finishJob(ctx, id, nil)
+		return
+	}
+	if err != nil {
+		golog.Errorf("job %s failed: %v", id, err)
+		if err := s.store.UpdateJobStatus(ctx, id, JobStatusFailed, "", err.Error()); err != nil {
+			golog.Errorf("failed to update job %s: %v", id, err)
+		}
+		s.finishJob(ctx, id, nil)
+		return
+	}
+
+	if err := s.store.UpdateJobStatus(ctx, id, JobStatusCompleted, note.ID, ""); err != nil {
+		golog.Errorf("failed to update job %s: %v", id, err)
+		return
+	}
+	golog.Infof("job %s completed: note %s", id, note.ID)
+	s.finishJob(ctx, id, note)
+}
+
+// finishJob sends the job's webhook, if it has a callback URL, without
+// holding up the worker
+func (s *Server) finishJob(ctx context.Context, id string, note *Note) {
+	job, err := s.store.GetJob(ctx, id)
+	if err != nil {
+		golog.Errorf("failed to load job %s: %v", id, err)
+		return
+	}
+	if job.Request.CallbackURL != "" {
+		go s.notifyJob(ctx, job, note)
+	}
+}
+
+// trackJob remembers how to cancel a running job
+func (s *Server) trackJob(id string, cancel context.CancelFunc) {
+	s.jobCancelsMu.Lock()
+	defer s.jobCancelsMu.Unlock()
+	if s.jobCancels == nil {
+		s.jobCancels = make(map[string]context.CancelFunc)
+	}
+	s.jobCancels[id] = cancel
+}
+
+// untrackJob forgets a job once its run is over
+func (s *Server) untrackJob(id string) {
+	s.jobCancelsMu.Lock()
+	defer s.jobCancelsMu.Unlock()
+	if cancel, ok := s.jobCancels[id]; ok {
+		cancel()
+		delete(s.jobCancels, id)
+	}
+}
+
+// cancelJob marks a pending or running job canceled and stops its
+// generation. It reports whether the job was running; the run then records
+// the outcome and sends the webhook.
+func (s *Server) cancelJob(ctx context.Context, id string) (bool, error) {
+	s.jobCancelsMu.Lock()
+	defer s.jobCancelsMu.Unlock()
+
+	if err := s.store.UpdateJobStatus(ctx, id, JobStatusCanceled, "", jobCanceledMessage); err != nil {
+		return false, err
+	}
+	cancel, running := s.jobCancels[id]
+	if running {
+		cancel()
+	}
+	return running, nil
+}
+
+func (s *Server) handleGetJob(c *gin.Context) {
+	ctx := context.Background()
+	id := c.Param("id")
+
+	job, err := s.store.GetJob(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Job not found", Code: ErrCodeJobNotFound})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+func (s *Server) handleCancelJob(c *gin.Context) {
+	ctx := context.Background()
+	id := c.Param("id")
+
+	job, err := s.store.GetJob(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Job not found", Code: ErrCodeJobNotFound})
+		return
+	}
+	switch job.Status {
+	case JobStatusCanceled:
+		c.JSON(http.StatusOK, job)
+		return
+	case JobStatusCompleted, JobStatusFailed:
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Job already finished", Code: ErrCodeInvalidRequest, Details: job.Status})
+		return
+	}
+
+	running, err := s.cancelJob(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel job", Code: ErrCodeInternal})
+		return
+	}
+	golog.Infof("job %s canceled by request", id)
+	if !running {
+		s.finishJob(ctx, id, nil)
+	}
+
+	if job, err = s.store.GetJob(ctx, id); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel job", Code: ErrCodeInternal})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
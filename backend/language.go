@@ -0,0 +1,291 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// languageNames maps the ISO 639-1 codes detected for sources to the names
+// used when asking the model to write in that language
+var languageNames = map[string]string{
+	"zh": "中文",
+	"ja": "日本語",
+	"ko": "한국어",
+	"en": "English",
+	"fr": "Français",
+	"de": "Deutsch",
+	"es": "Español",
+	"pt": "Português",
+	"it": "Italiano",
+	"nl": "Nederlands",
+	"ru": "Русский",
+	"ar": "العربية",
+	"he": "עברית",
+	"el": "Ελληνικά",
+	"th": "ไทย",
+	"hi": "हिन्दी",
+}
+
+// languageSampleSize is the number of bytes looked at to detect the
+// language of a source
+const languageSampleSize = 64 * 1024
+
+// latinStopwords are frequent short words telling Latin-script languages
+// apart
+var latinStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "with", "for", "are", "this"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "du", "que", "pour", "dans", "pas"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "mit", "ein", "eine", "den", "von", "zu"},
+	"es": {"el", "los", "las", "y", "es", "una", "que", "por", "con", "para", "del", "se"},
+	"pt": {"o", "os", "as", "e", "é", "uma", "que", "não", "com", "para", "do", "da"},
+	"it": {"il", "gli", "e", "è", "una", "che", "non", "con", "per", "della", "di", "sono"},
+	"nl": {"de", "het", "en", "een", "is", "van", "niet", "met", "dat", "voor", "zijn", "op"},
+}
+
+// detectLanguage returns the ISO 639-1 code of the dominant language of
+// text, or "" when there is too little text to tell. Like the CJK check in
+// splitText it counts characters by script; Latin-script text is then told
+// apart by its most frequent short words.
+func detectLanguage(text string) string {
+	counts := make(map[string]int)
+	letters := 0
+	var latin strings.Builder
+	for _, r := range truncateUTF8(text, languageSampleSize) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			counts["han"]++
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			counts["kana"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Hebrew, r):
+			counts["he"]++
+		case unicode.Is(unicode.Greek, r):
+			counts["el"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["th"]++
+		case unicode.Is(unicode.Devanagari, r):
+			counts["hi"]++
+		case unicode.Is(unicode.Latin, r):
+			counts["latin"]++
+			latin.WriteRune(unicode.ToLower(r))
+			letters++
+			continue
+		default:
+			if !unicode.IsLetter(r) {
+				latin.WriteRune(' ')
+			}
+			continue
+		}
+		letters++
+		latin.WriteRune(' ')
+	}
+	if letters < 20 {
+		return ""
+	}
+
+	// An ideograph or syllable block carries about as much as a short word,
+	// so alphabetic scripts are weighed per five letters
+	cjk := counts["han"] + counts["kana"]
+	best, bestCount := "zh", cjk
+	if cjk > 0 && counts["kana"]*10 >= cjk {
+		// Japanese mixes kana into nearly every sentence
+		best = "ja"
+	}
+	for _, script := range []string{"ko", "ru", "ar", "he", "el", "th", "hi", "latin"} {
+		n := counts[script]
+		if script != "ko" {
+			n /= 5
+		}
+		if n > bestCount {
+			best, bestCount = script, n
+		}
+	}
+	if best != "latin" {
+		return best
+	}
+
+	hits := make(map[string]int)
+	for _, word := range strings.Fields(latin.String()) {
+		for lang, stopwords := range latinStopwords {
+			for _, stopword := range stopwords {
+				if word == stopword {
+					hits[lang]++
+				}
+			}
+		}
+	}
+	best, bestCount = "en", 0
+	for _, lang := range []string{"en", "fr", "de", "es", "pt", "it", "nl"} {
+		if hits[lang] > bestCount {
+			best, bestCount = lang, hits[lang]
+		}
+	}
+	return best
+}
+
+// setSourceLanguage records the detected language of a source's content in
+// its "language" metadata
+func setSourceLanguage(source *Source) {
+	lang := detectLanguage(source.Content)
+	if lang == "" {
+		return
+	}
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["language"] = lang
+}
+
+// sourceLanguage returns the language recorded for a source, detecting it
+// from the content for sources ingested before languages were recorded
+func sourceLanguage(src Source) string {
+	if lang, ok := src.Metadata["language"].(string); ok && lang != "" {
+		return lang
+	}
+	return detectLanguage(src.Content)
+}
+
+// resolveOutputLanguage returns the language a transformation is written
+// in, from the request's language or OUTPUT_LANGUAGE: "auto" picks the
+// language of most of the selected sources' content, a code from
+// languageNames is spelled out, and anything else is used as given.
+func resolveOutputLanguage(setting string, sources []Source) string {
+	setting = strings.TrimSpace(setting)
+	if !strings.EqualFold(setting, "auto") {
+		if name, ok := languageNames[strings.ToLower(setting)]; ok {
+			return name
+		}
+		if setting == "" {
+			return languageNames["zh"]
+		}
+		return setting
+	}
+
+	weights := make(map[string]int)
+	for _, src := range sources {
+		size := src.ContentLength
+		if size == 0 {
+			size = len(src.Content)
+		}
+		if lang := sourceLanguage(src); lang != "" {
+			weights[lang] += size
+		}
+	}
+	best, bestWeight := "zh", 0
+	for lang, weight := range weights {
+		if weight > bestWeight || (weight == bestWeight && lang < best) {
+			best, bestWeight = lang, weight
+		}
+	}
+	return languageNames[best]
+}
+
+// outputLanguage resolves the language of a transformation over sources
+// without content loaded; sources without a recorded language are detected
+// from the start of their content
+func (s *Server) outputLanguage(ctx context.Context, setting string, sources []Source) string {
+	if setting == "" {
+		setting = s.cfg.OutputLanguage
+	}
+	if strings.EqualFold(strings.TrimSpace(setting), "auto") {
+		sources = append([]Source(nil), sources...)
+		for i, src := range sources {
+			if _, ok := src.Metadata["language"].(string); ok || src.Content != "" || src.ContentLength == 0 {
+				continue
+			}
+			if sample, err := s.store.ReadSourceContent(ctx, src.ID, 0, 4000); err == nil {
+				sources[i].Content = sample
+			}
+		}
+	}
+	return resolveOutputLanguage(setting, sources)
+}
+
+// noteTitles are the titles of generated notes by language code and
+// transformation type; "" is the title of other types
+var noteTitles = map[string]map[string]string{
+	"zh": {
+		"summary":     "摘要",
+		"faq":         "常见问题解答",
+		"study_guide": "学习指南",
+		"outline":     "大纲",
+		"podcast":     "播客脚本",
+		"timeline":    "时间线",
+		"glossary":    "术语表",
+		"explain":     "通俗解读",
+		"compare":     "来源对比",
+		"translate":   "翻译",
+		"quiz":        "测验",
+		"infograph":   "信息图",
+		"ppt":         "幻灯片",
+		"":            "笔记",
+	},
+	"en": {
+		"summary":     "Summary",
+		"faq":         "FAQ",
+		"study_guide": "Study Guide",
+		"outline":     "Outline",
+		"podcast":     "Podcast Script",
+		"timeline":    "Timeline",
+		"glossary":    "Glossary",
+		"explain":     "Plain-Language Explanation",
+		"compare":     "Source Comparison",
+		"translate":   "Translation",
+		"quiz":        "Quiz",
+		"infograph":   "Infographic",
+		"ppt":         "Slides",
+		"":            "Note",
+	},
+}
+
+// noteTitle returns the title of a generated note in language, a code or a
+// name as resolved for the output. Chinese gets Chinese titles, any other
+// language English ones.
+func noteTitle(noteType, language string) string {
+	code := "zh"
+	if language = strings.ToLower(strings.TrimSpace(language)); language != "" {
+		code = "en"
+		for c, name := range languageNames {
+			if language == c || language == strings.ToLower(name) {
+				code = c
+				break
+			}
+		}
+		if language == "chinese" || strings.HasPrefix(language, "zh-") {
+			code = "zh"
+		}
+	}
+	titles, ok := noteTitles[code]
+	if !ok {
+		titles = noteTitles["en"]
+	}
+	if title, ok := titles[noteType]; ok {
+		return title
+	}
+	return titles[""]
+}
+
+// chineseOutputInstruction is the sentence of the built-in templates that
+// fixes the output language
+const chineseOutputInstruction = "无论来源是什么语言，请务必使用中文进行回复"
+
+// withOutputLanguage makes a prompt ask for language instead of Chinese.
+// Templates without the built-in instruction, such as customized ones, get
+// it appended.
+func withOutputLanguage(prompt, language string) string {
+	if language == "" || language == languageNames["zh"] {
+		return prompt
+	}
+	instruction := fmt.Sprintf("无论来源是什么语言，请务必使用%s进行回复", language)
+	if strings.Contains(prompt, chineseOutputInstruction) {
+		return strings.ReplaceAll(prompt, chineseOutputInstruction, instruction)
+	}
+	return prompt + "\n\n**注意：" + instruction + "。**"
+}
@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Lazy indexing: with SKIP_STARTUP_REINDEX an in-process index starts empty
+// and each notebook is indexed the first time it is queried. The indexed
+// ("hot") notebooks are kept in LRU order; with MAX_INDEXED_NOTEBOOKS set the
+// least recently used ones are dropped to bound memory and indexed again on
+// their next query.
+
+// lazyIndexing reports whether notebooks are indexed on first use.
+// Persistent indexes already hold every notebook.
+func (vs *VectorStore) lazyIndexing() bool {
+	return vs.cfg.SkipStartupReindex && !vs.Persistent()
+}
+
+// touchIndexed marks a notebook as recently used and reports whether its
+// sources are indexed, which they always are without lazy indexing
+func (vs *VectorStore) touchIndexed(notebookID string) bool {
+	if !vs.lazyIndexing() {
+		return true
+	}
+	vs.lazyMu.Lock()
+	defer vs.lazyMu.Unlock()
+	el, ok := vs.hotIndex[notebookID]
+	if ok {
+		vs.hot.MoveToFront(el)
+	}
+	return ok
+}
+
+// EnsureIndexed indexes the sources of a notebook if it is not indexed yet,
+// and marks it as recently used. Retrieval paths call it first; it does
+// nothing without lazy indexing. Concurrent calls for the same notebook
+// share one indexing run, and other notebooks are not held up by it.
+func (vs *VectorStore) EnsureIndexed(ctx context.Context, nb *Notebook, sources []Source) error {
+	if vs.touchIndexed(nb.ID) {
+		return nil
+	}
+
+	_, err, _ := vs.indexing.Do(nb.ID, func() (interface{}, error) {
+		// Indexed by a run that finished since the check above
+		if vs.touchIndexed(nb.ID) {
+			return nil, nil
+		}
+		// Callers waiting on this run should not fail because the request
+		// that started it went away
+		return nil, vs.indexNotebook(context.WithoutCancel(ctx), nb, sources)
+	})
+	return err
+}
+
+// indexNotebook ingests the sources of a notebook and marks it as indexed
+func (vs *VectorStore) indexNotebook(ctx context.Context, nb *Notebook, sources []Source) error {
+	start := time.Now()
+	opts := NotebookIngestOptions(nb)
+	vs.SetNotebookEmbeddingModel(nb.ID, opts.EmbeddingModel)
+	indexed := 0
+	for _, src := range sources {
+		if src.Content == "" || !sourceIndexed(&src) {
+			continue
+		}
+		if err := vs.IngestTextWithOptions(ctx, src.Name, src.Content, opts.WithSource(src.ID)); err != nil {
+			return fmt.Errorf("failed to index source %s: %w", src.Name, err)
+		}
+		indexed++
+	}
+	fmt.Printf("[VectorStore] Indexed notebook %s on first use: %d sources in %v\n", nb.ID, indexed, time.Since(start).Round(time.Millisecond))
+
+	vs.markIndexed(ctx, nb.ID)
+	return nil
+}
+
+// markIndexed records that a notebook was fully indexed, e.g. by a reindex
+func (vs *VectorStore) markIndexed(ctx context.Context, notebookID string) {
+	if !vs.lazyIndexing() {
+		return
+	}
+	vs.lazyMu.Lock()
+	defer vs.lazyMu.Unlock()
+	vs.markIndexedLocked(notebookID)
+	vs.evictLocked(ctx)
+}
+
+func (vs *VectorStore) markIndexedLocked(notebookID string) {
+	if el, ok := vs.hotIndex[notebookID]; ok {
+		vs.hot.MoveToFront(el)
+		return
+	}
+	vs.hotIndex[notebookID] = vs.hot.PushFront(notebookID)
+}
+
+// evictLocked drops the least recently used notebooks beyond
+// MAX_INDEXED_NOTEBOOKS
+func (vs *VectorStore) evictLocked(ctx context.Context) {
+	remover, ok := vs.index.(notebookRemover)
+	if !ok || vs.cfg.MaxIndexedNotebooks <= 0 {
+		return
+	}
+	for vs.hot.Len() > vs.cfg.MaxIndexedNotebooks {
+		el := vs.hot.Back()
+		notebookID := el.Value.(string)
+		vs.mu.Lock()
+		removed, err := remover.removeNotebook(ctx, notebookID)
+		vs.mu.Unlock()
+		if err != nil {
+			fmt.Printf("[VectorStore] Failed to evict notebook %s: %v\n", notebookID, err)
+			return
+		}
+		vs.hot.Remove(el)
+		delete(vs.hotIndex, notebookID)
+		fmt.Printf("[VectorStore] Evicted notebook %s from the index: %d chunks\n", notebookID, removed)
+	}
+}
@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrLLMBusy is returned when LLM_MAX_CONCURRENCY generations are running
+// and LLM_MAX_QUEUE more are already waiting for a slot
+var ErrLLMBusy = errors.New("too many generations in progress")
+
+// llmLimiter bounds the generations running at once, so a burst of chats
+// and transformations queues up instead of overwhelming a local model. A nil
+// limiter imposes no limit.
+type llmLimiter struct {
+	slots    chan struct{}
+	maxQueue int // waiting callers allowed, 0 for no limit
+	waiting  atomic.Int64
+}
+
+// newLLMLimiter returns a limiter for maxConcurrency generations, or nil
+// when maxConcurrency is not positive
+func newLLMLimiter(maxConcurrency, maxQueue int) *llmLimiter {
+	if maxConcurrency <= 0 {
+		return nil
+	}
+	return &llmLimiter{slots: make(chan struct{}, maxConcurrency), maxQueue: maxQueue}
+}
+
+// acquire waits for a free slot until ctx ends. It fails at once with
+// ErrLLMBusy when the queue is full. The returned function frees the slot.
+func (l *llmLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	if waiting := l.waiting.Add(1); l.maxQueue > 0 && waiting > int64(l.maxQueue) {
+		l.waiting.Add(-1)
+		return nil, ErrLLMBusy
+	}
+	defer l.waiting.Add(-1)
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *llmLimiter) release() {
+	<-l.slots
+}
+
+// load reports the generations running and waiting, with the limit
+func (l *llmLimiter) load() LLMLoad {
+	if l == nil {
+		return LLMLoad{}
+	}
+	return LLMLoad{
+		InFlight:       len(l.slots),
+		Queued:         int(l.waiting.Load()),
+		MaxConcurrency: cap(l.slots),
+		MaxQueue:       l.maxQueue,
+	}
+}
+
+// limited runs one LLM call once the limiter lets it
+func limited[T any](ctx context.Context, l *llmLimiter, fn func(ctx context.Context) (T, error)) (T, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer release()
+	return fn(ctx)
+}
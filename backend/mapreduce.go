@@ -0,0 +1,274 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/prompts"
+)
+
+// SourceContentReader reads up to length characters of a source's content
+// starting at the given character offset
+type SourceContentReader func(ctx context.Context, sourceID string, offset, length int) (string, error)
+
+// sourceWindow is one window of a source's content processed in the map step
+type sourceWindow struct {
+	source Source
+	offset int
+	part   int
+	total  int
+}
+
+// GenerateTransformationStreaming generates a transformation for sources too
+// large to load at once. Content is read window by window through read, each
+// window is condensed by the LLM (map), and the partial results are combined
+// into the final note (reduce). Sources only need ID, Name, Type and
+// ContentLength set.
+func (a *Agent) GenerateTransformationStreaming(ctx context.Context, req *TransformationRequest, sources []Source, read SourceContentReader) (*TransformationResponse, error) {
+	windowSize := a.cfg.StreamingWindowSize
+	if windowSize <= 0 {
+		windowSize = 50000
+	}
+
+	var windows []sourceWindow
+	var skipped []SourceSummary
+	for _, src := range sources {
+		if src.ContentLength == 0 {
+			golog.Warnf("skipping source %s (%s) with no content", src.Name, src.Type)
+			skipped = append(skipped, SourceSummary{ID: src.ID, Name: src.Name, Type: src.Type})
+			continue
+		}
+		total := (src.ContentLength + windowSize - 1) / windowSize
+		for part := 0; part < total; part++ {
+			windows = append(windows, sourceWindow{
+				source: src,
+				offset: part * windowSize,
+				part:   part + 1,
+				total:  total,
+			})
+		}
+	}
+	if len(windows) == 0 {
+		return a.GenerateTransformation(ctx, req, sources)
+	}
+
+	golog.Infof("streaming transformation %s: %d sources, %d windows of %d chars", req.Type, len(sources), len(windows), windowSize)
+	startedAt := time.Now()
+
+	// Map: condense each window, keeping only the partial results in memory
+	partials := make([]string, len(windows))
+	err := a.forEachBounded(ctx, len(windows), func(ctx context.Context, i int) error {
+		w := windows[i]
+		content, err := read(ctx, w.source.ID, w.offset, windowSize)
+		if err != nil {
+			return fmt.Errorf("failed to read %s part %d: %w", w.source.Name, w.part, err)
+		}
+		partial, err := a.mapWindow(ctx, req, w.source.Name, w.part, w.total, content)
+		if err != nil {
+			return fmt.Errorf("failed to process %s part %d: %w", w.source.Name, w.part, err)
+		}
+		partials[i] = partial
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reduceSources := make([]Source, len(windows))
+	for i, w := range windows {
+		reduceSources[i] = Source{
+			ID:      w.source.ID,
+			Name:    fmt.Sprintf("%s (part %d/%d)", w.source.Name, w.part, w.total),
+			Type:    w.source.Type,
+			Content: partials[i],
+		}
+	}
+
+	// Reduce intermediate results until they fit in the context window
+	rounds := 0
+	for len(reduceSources) > 1 && totalContentLength(reduceSources) > a.contextLimit() {
+		rounds++
+		reduceSources, err = a.reduceRound(ctx, req, reduceSources, rounds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := a.GenerateTransformation(ctx, req, reduceSources)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceSummaries := make([]SourceSummary, len(sources))
+	for i, src := range sources {
+		sourceSummaries[i] = SourceSummary{
+			ID:   src.ID,
+			Name: src.Name,
+			Type: src.Type,
+		}
+	}
+	response.Sources = sourceSummaries
+	response.Metadata["map_reduce"] = map[string]interface{}{
+		"windows":       len(windows),
+		"window_size":   windowSize,
+		"reduce_rounds": rounds,
+		"duration_ms":   time.Since(startedAt).Milliseconds(),
+	}
+	if len(skipped) > 0 {
+		response.Metadata["skipped_sources"] = skipped
+	}
+
+	return response, nil
+}
+
+// contextLimit returns the maximum number of source characters sent in one prompt
+func (a *Agent) contextLimit() int {
+	if a.cfg.MaxContextLength > 0 {
+		return a.cfg.MaxContextLength
+	}
+	return 100000
+}
+
+// reduceRound merges adjacent partial results into groups that fit in the
+// context window and condenses each group into a single result
+func (a *Agent) reduceRound(ctx context.Context, req *TransformationRequest, sources []Source, round int) ([]Source, error) {
+	limit := a.contextLimit()
+
+	var groups [][]Source
+	size := 0
+	for _, src := range sources {
+		if len(groups) == 0 || (size > 0 && size+utf8.RuneCountInString(src.Content) > limit) {
+			groups = append(groups, nil)
+			size = 0
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], src)
+		size += utf8.RuneCountInString(src.Content)
+	}
+	// Guarantee progress when every partial result is larger than the limit
+	if len(groups) == len(sources) {
+		groups = groups[:0]
+		for i := 0; i < len(sources); i += 2 {
+			end := i + 2
+			if end > len(sources) {
+				end = len(sources)
+			}
+			groups = append(groups, sources[i:end])
+		}
+	}
+
+	reduced := make([]Source, len(groups))
+	err := a.forEachBounded(ctx, len(groups), func(ctx context.Context, i int) error {
+		var content strings.Builder
+		for _, src := range groups[i] {
+			content.WriteString(fmt.Sprintf("\n## %s\n%s\n", src.Name, src.Content))
+		}
+		text := truncateRunes(content.String(), limit)
+
+		name := fmt.Sprintf("Combined results (round %d, group %d/%d)", round, i+1, len(groups))
+		partial, err := a.mapWindow(ctx, req, name, i+1, len(groups), text)
+		if err != nil {
+			return fmt.Errorf("failed to combine partial results: %w", err)
+		}
+		reduced[i] = Source{ID: groups[i][0].ID, Name: name, Type: groups[i][0].Type, Content: partial}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reduced, nil
+}
+
+// mapWindow condenses one window of content into the information relevant
+// to the requested transformation, with the map_window template
+func (a *Agent) mapWindow(ctx context.Context, req *TransformationRequest, sourceName string, part, total int, content string) (string, error) {
+	prompt := prompts.NewPromptTemplate(a.prompts.Get(mapWindowPromptType), mapWindowVariables)
+	prompt.TemplateFormat = prompts.TemplateFormatFString
+
+	promptValue, err := prompt.Format(map[string]any{
+		"type":    req.Type,
+		"source":  sourceName,
+		"part":    part,
+		"total":   total,
+		"prompt":  req.Prompt,
+		"content": content,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+	promptValue = withOutputLanguage(promptValue, req.Language)
+
+	ctx, cancel := a.llmContext(ctx)
+	defer cancel()
+
+	_, seedOptions := a.seedOptions(req)
+	response, err := a.generateWithRetry(ctx, promptValue, seedOptions...)
+	if err != nil {
+		return "", llmError(ctx, err)
+	}
+	return response, nil
+}
+
+// forEachBounded runs fn for indexes 0..n-1 using at most StreamingWorkers
+// goroutines and returns the first error
+func (a *Agent) forEachBounded(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	workers := a.cfg.StreamingWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// totalContentLength returns the combined content length of the sources
+// in characters
+func totalContentLength(sources []Source) int {
+	total := 0
+	for _, src := range sources {
+		total += utf8.RuneCountInString(src.Content)
+	}
+	return total
+}
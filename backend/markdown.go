@@ -0,0 +1,407 @@
+package backend
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// A small Markdown parser covering what notes are generated with: headings,
+// paragraphs, nested lists, fenced code, quotes, tables, rules, emphasis,
+// inline code, links and images. Exports render the parsed blocks to HTML
+// and DOCX.
+
+// mdBlock is a block-level element of a Markdown document
+type mdBlock struct {
+	Kind  string // heading, paragraph, list, code, quote, table, rule
+	Level int    // heading level
+	Text  string // heading, paragraph and quote text, code content
+	Lang  string // code block language
+	Items []mdListItem
+	Rows  [][]string // table cells, the first row is the header
+}
+
+type mdListItem struct {
+	Level   int // nesting depth, from 0
+	Ordered bool
+	Number  int
+	Text    string
+}
+
+// mdSpan is a run of inline text with its formatting
+type mdSpan struct {
+	Text   string
+	Bold   bool
+	Italic bool
+	Code   bool
+	Link   string // link target
+	Image  string // image source; Text is the alt text
+}
+
+var (
+	mdHeadingPattern = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdListPattern    = regexp.MustCompile(`^(\s*)([-*+]|(\d+)[.)])\s+(.*)$`)
+	mdRulePattern    = regexp.MustCompile(`^\s*(-\s*){3,}$|^\s*(\*\s*){3,}$|^\s*(_\s*){3,}$`)
+	mdTableSeparator = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+)
+
+// parseMarkdown splits a Markdown document into blocks
+func parseMarkdown(text string) []mdBlock {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var blocks []mdBlock
+	var paragraph []string
+
+	flush := func() {
+		if len(paragraph) > 0 {
+			blocks = append(blocks, mdBlock{Kind: "paragraph", Text: strings.Join(paragraph, " ")})
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flush()
+
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flush()
+			fence := trimmed[:3]
+			block := mdBlock{Kind: "code", Lang: strings.TrimSpace(trimmed[3:])}
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			block.Text = strings.Join(code, "\n")
+			blocks = append(blocks, block)
+
+		case mdHeadingPattern.MatchString(trimmed):
+			flush()
+			m := mdHeadingPattern.FindStringSubmatch(trimmed)
+			blocks = append(blocks, mdBlock{Kind: "heading", Level: len(m[1]), Text: m[2]})
+
+		case mdRulePattern.MatchString(line):
+			flush()
+			blocks = append(blocks, mdBlock{Kind: "rule"})
+
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")))
+			}
+			i--
+			blocks = append(blocks, mdBlock{Kind: "quote", Text: strings.Join(quote, " ")})
+
+		case mdListPattern.MatchString(line):
+			flush()
+			block := mdBlock{Kind: "list"}
+			for ; i < len(lines); i++ {
+				m := mdListPattern.FindStringSubmatch(lines[i])
+				if m == nil {
+					// Lazy continuation of the previous item
+					next := strings.TrimSpace(lines[i])
+					if next == "" || len(block.Items) == 0 || !strings.HasPrefix(lines[i], " ") {
+						break
+					}
+					block.Items[len(block.Items)-1].Text += " " + next
+					continue
+				}
+				item := mdListItem{Level: len(strings.ReplaceAll(m[1], "\t", "    ")) / 2, Text: m[4]}
+				if m[3] != "" {
+					item.Ordered = true
+					fmt.Sscan(m[3], &item.Number)
+				}
+				block.Items = append(block.Items, item)
+			}
+			i--
+			blocks = append(blocks, block)
+
+		case strings.Contains(trimmed, "|") && i+1 < len(lines) && mdTableSeparator.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "-"):
+			flush()
+			block := mdBlock{Kind: "table", Rows: [][]string{splitTableRow(trimmed)}}
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|"); i++ {
+				block.Rows = append(block.Rows, splitTableRow(strings.TrimSpace(lines[i])))
+			}
+			i--
+			blocks = append(blocks, block)
+
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flush()
+	return blocks
+}
+
+func splitTableRow(line string) []string {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+	cells := strings.Split(line, "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+// parseInline splits inline Markdown into formatted spans
+func parseInline(text string) []mdSpan {
+	return appendInline(nil, text, mdSpan{})
+}
+
+func appendInline(spans []mdSpan, text string, style mdSpan) []mdSpan {
+	var plain strings.Builder
+	emit := func(span mdSpan) {
+		if plain.Len() > 0 {
+			s := style
+			s.Text = plain.String()
+			spans = append(spans, s)
+			plain.Reset()
+		}
+		if span.Text != "" || span.Image != "" {
+			spans = append(spans, span)
+		}
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1:
+			plain.WriteByte(rest[1])
+			i += 2
+			continue
+
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end >= 0 {
+				span := style
+				span.Text, span.Code = rest[1:1+end], true
+				emit(span)
+				i += end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if end := strings.Index(rest[2:], rest[:2]); end > 0 {
+				emit(mdSpan{})
+				inner := style
+				inner.Bold = true
+				spans = appendInline(spans, rest[2:2+end], inner)
+				i += end + 4
+				continue
+			}
+
+		case rest[0] == '*':
+			if end := strings.IndexByte(rest[1:], '*'); end > 0 && rest[1] != ' ' {
+				emit(mdSpan{})
+				inner := style
+				inner.Italic = true
+				spans = appendInline(spans, rest[1:1+end], inner)
+				i += end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "!["):
+			if alt, target, n, ok := parseLinkSyntax(rest[1:]); ok {
+				span := style
+				span.Text, span.Image = alt, target
+				emit(span)
+				i += n + 1
+				continue
+			}
+
+		case rest[0] == '[':
+			if label, target, n, ok := parseLinkSyntax(rest); ok {
+				emit(mdSpan{})
+				inner := style
+				inner.Link = target
+				spans = appendInline(spans, label, inner)
+				i += n
+				continue
+			}
+		}
+		plain.WriteByte(rest[0])
+		i++
+	}
+	emit(mdSpan{})
+	return spans
+}
+
+// parseLinkSyntax parses "[label](target)" at the start of s and returns the
+// number of bytes it spans. Balanced parentheses inside the target, as in
+// Wikipedia URLs, belong to it.
+func parseLinkSyntax(s string) (label, target string, n int, ok bool) {
+	closeLabel := strings.Index(s, "](")
+	if !strings.HasPrefix(s, "[") || closeLabel < 0 {
+		return "", "", 0, false
+	}
+	closeTarget, depth := -1, 0
+	for i, c := range s[closeLabel+2:] {
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			if depth == 0 {
+				closeTarget = i
+				break
+			}
+			depth--
+		}
+	}
+	if closeTarget < 0 {
+		return "", "", 0, false
+	}
+	target = strings.TrimSpace(s[closeLabel+2 : closeLabel+2+closeTarget])
+	// Drop an optional title: [label](target "title")
+	if space := strings.IndexByte(target, ' '); space > 0 {
+		target = target[:space]
+	}
+	return s[1:closeLabel], target, closeLabel + 3 + closeTarget, true
+}
+
+// markdownToHTML renders Markdown as an HTML fragment. resolveImage may
+// rewrite image sources, e.g. to embed them; nil keeps them as they are.
+func markdownToHTML(text string, resolveImage func(src string) string) string {
+	var b strings.Builder
+	for _, block := range parseMarkdown(text) {
+		switch block.Kind {
+		case "heading":
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", block.Level, inlineHTML(block.Text, resolveImage), block.Level)
+		case "paragraph":
+			fmt.Fprintf(&b, "<p>%s</p>\n", inlineHTML(block.Text, resolveImage))
+		case "quote":
+			fmt.Fprintf(&b, "<blockquote><p>%s</p></blockquote>\n", inlineHTML(block.Text, resolveImage))
+		case "rule":
+			b.WriteString("<hr>\n")
+		case "code":
+			if block.Lang == "mermaid" {
+				// Left for mermaid.js to draw on the client
+				fmt.Fprintf(&b, "<pre class=\"mermaid\">%s</pre>\n", html.EscapeString(block.Text))
+				continue
+			}
+			class := ""
+			if block.Lang != "" {
+				class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(block.Lang))
+			}
+			fmt.Fprintf(&b, "<pre><code%s>%s</code></pre>\n", class, html.EscapeString(block.Text))
+		case "list":
+			writeHTMLList(&b, block.Items, resolveImage)
+		case "table":
+			b.WriteString("<table>\n")
+			for i, row := range block.Rows {
+				cell := "td"
+				if i == 0 {
+					cell = "th"
+				}
+				b.WriteString("<tr>")
+				for _, text := range row {
+					fmt.Fprintf(&b, "<%s>%s</%s>", cell, inlineHTML(text, resolveImage), cell)
+				}
+				b.WriteString("</tr>\n")
+			}
+			b.WriteString("</table>\n")
+		}
+	}
+	return b.String()
+}
+
+// writeHTMLList renders list items, opening and closing nested lists as the
+// level changes
+func writeHTMLList(b *strings.Builder, items []mdListItem, resolveImage func(string) string) {
+	var open []string // tags of the open lists, innermost last
+	for _, item := range items {
+		tag := "ul"
+		if item.Ordered {
+			tag = "ol"
+		}
+		for len(open) > item.Level+1 {
+			fmt.Fprintf(b, "</li></%s>\n", open[len(open)-1])
+			open = open[:len(open)-1]
+		}
+		switch {
+		case len(open) <= item.Level:
+			for len(open) <= item.Level {
+				fmt.Fprintf(b, "<%s>", tag)
+				open = append(open, tag)
+			}
+		default:
+			b.WriteString("</li>")
+		}
+		fmt.Fprintf(b, "<li>%s", inlineHTML(item.Text, resolveImage))
+	}
+	for len(open) > 0 {
+		fmt.Fprintf(b, "</li></%s>\n", open[len(open)-1])
+		open = open[:len(open)-1]
+	}
+}
+
+func inlineHTML(text string, resolveImage func(string) string) string {
+	var b strings.Builder
+	for _, span := range parseInline(text) {
+		if span.Image != "" {
+			src, ok := safeImageURL(span.Image)
+			if !ok {
+				b.WriteString(html.EscapeString(span.Text))
+				continue
+			}
+			if resolveImage != nil {
+				src = resolveImage(src)
+			}
+			fmt.Fprintf(&b, `<img src="%s" alt="%s">`, html.EscapeString(src), html.EscapeString(span.Text))
+			continue
+		}
+		s := html.EscapeString(span.Text)
+		if span.Code {
+			s = "<code>" + s + "</code>"
+		}
+		if span.Italic {
+			s = "<em>" + s + "</em>"
+		}
+		if span.Bold {
+			s = "<strong>" + s + "</strong>"
+		}
+		if span.Link != "" {
+			href, ok := safeURL(span.Link, "http", "https", "mailto")
+			if !ok {
+				href = "#"
+			}
+			s = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(href), s)
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// safeURL tells whether a link in generated content may be rendered: it must
+// be relative or use one of schemes. Spaces and control characters, which
+// browsers strip to turn " java\tscript:" into a script link, make it unsafe.
+func safeURL(target string, schemes ...string) (string, bool) {
+	if strings.ContainsFunc(target, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme == "" {
+		return target, true
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// safeImageURL is safeURL for image sources, which may also be data URLs of
+// images
+func safeImageURL(src string) (string, bool) {
+	src, ok := safeURL(src, "http", "https", "data")
+	lower := strings.ToLower(src)
+	if ok && strings.HasPrefix(lower, "data:") && !strings.HasPrefix(lower, "data:image/") {
+		return "", false
+	}
+	return src, ok
+}
@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics. The collectors are package-level so the agent and
+// vector store can record without being handed a registry; GET /metrics is
+// only served with METRICS_ENABLED.
+
+// durationBuckets are histogram bucket bounds in seconds, from fast API
+// calls up to long generations
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "notex_http_requests_total",
+		Help: "HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = newDurationHistogram("notex_http_request_duration_seconds",
+		"HTTP request latency by route.", "method", "route")
+	llmDuration = newDurationHistogram("notex_llm_request_duration_seconds",
+		"LLM call latency, including retries.", "model", "outcome")
+	llmTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "notex_llm_tokens_total",
+		Help: "Tokens used by LLM calls that report usage.",
+	}, []string{"model", "type"})
+	embeddingDuration = newDurationHistogram("notex_embedding_duration_seconds",
+		"Embedding call latency.", "model", "kind", "outcome")
+	ingestDuration = newDurationHistogram("notex_ingest_duration_seconds",
+		"Source ingestion time by stage: text extraction and indexing.", "stage", "outcome")
+)
+
+func newDurationHistogram(name, help string, labels ...string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: durationBuckets}, labels)
+}
+
+// observeSince records the time elapsed since start in a histogram
+func observeSince(h *prometheus.HistogramVec, start time.Time, labelValues ...string) {
+	h.WithLabelValues(labelValues...).Observe(time.Since(start).Seconds())
+}
+
+// metricOutcome labels a result as "ok" or "error"
+func metricOutcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// metricsMiddleware counts requests and their latency by route template, so
+// notebook and source IDs don't create a series each
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		observeSince(httpDuration, start, method, route)
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus exposition format,
+// together with the LLM queue, the current vector store size and the Go
+// runtime metrics
+func (s *Server) metricsHandler() gin.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		httpRequests, httpDuration, llmDuration, llmTokens, embeddingDuration, ingestDuration,
+		serverCollector{s},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
+
+var (
+	llmInFlightDesc = prometheus.NewDesc("notex_llm_in_flight",
+		"Generations holding an LLM_MAX_CONCURRENCY slot.", nil, nil)
+	llmQueuedDesc = prometheus.NewDesc("notex_llm_queued",
+		"Generations waiting for a slot.", nil, nil)
+	vectorChunksDesc = prometheus.NewDesc("notex_vector_store_chunks",
+		"Chunks in the vector store.", nil, nil)
+	vectorVectorsDesc = prometheus.NewDesc("notex_vector_store_vectors",
+		"Chunks with an embedding.", nil, nil)
+)
+
+// serverCollector reports gauges read from the server on each scrape
+type serverCollector struct {
+	s *Server
+}
+
+func (c serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- llmInFlightDesc
+	ch <- llmQueuedDesc
+	ch <- vectorChunksDesc
+	ch <- vectorVectorsDesc
+}
+
+func (c serverCollector) Collect(ch chan<- prometheus.Metric) {
+	if limiter := c.s.agent.limiter; limiter != nil {
+		load := limiter.load()
+		ch <- prometheus.MustNewConstMetric(llmInFlightDesc, prometheus.GaugeValue, float64(load.InFlight))
+		ch <- prometheus.MustNewConstMetric(llmQueuedDesc, prometheus.GaugeValue, float64(load.Queued))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.s.cfg.HealthTimeout)
+	defer cancel()
+	if stats, err := c.s.vectorStore.GetStats(ctx); err == nil {
+		ch <- prometheus.MustNewConstMetric(vectorChunksDesc, prometheus.GaugeValue, float64(stats.TotalDocuments))
+		ch <- prometheus.MustNewConstMetric(vectorVectorsDesc, prometheus.GaugeValue, float64(stats.TotalVectors))
+	}
+}
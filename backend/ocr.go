@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"google.golang.org/genai"
+)
+
+// OCR engines
+const (
+	OCREngineAuto      = "auto"
+	OCREngineTesseract = "tesseract"
+	OCREngineVision    = "vision"
+	OCREngineNone      = "none"
+)
+
+const ocrPrompt = "Transcribe all text in this image exactly as written, preserving reading order and line breaks. " +
+	"Use Markdown for tables and headings. Output only the transcribed text without commentary."
+
+// imageMIMETypes maps image extensions supported for OCR to their MIME types
+var imageMIMETypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".bmp":  "image/bmp",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// isImageFile reports whether the path has an image extension supported by OCR
+func isImageFile(path string) bool {
+	_, ok := imageMIMETypes[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+// ocrEngine resolves the configured OCR engine. In auto mode tesseract is
+// preferred when installed, otherwise a vision model is used if a key is set.
+func (vs *VectorStore) ocrEngine() string {
+	switch vs.cfg.OCREngine {
+	case OCREngineTesseract, OCREngineVision, OCREngineNone:
+		return vs.cfg.OCREngine
+	}
+
+	if _, err := exec.LookPath(vs.cfg.TesseractPath); err == nil {
+		return OCREngineTesseract
+	}
+	if vs.cfg.GoogleAPIKey != "" || vs.cfg.OpenAIAPIKey != "" {
+		return OCREngineVision
+	}
+	return OCREngineNone
+}
+
+// ExtractionMetadata returns source metadata describing how a file's content
+// was extracted, or nil when it was read or converted directly
+func (vs *VectorStore) ExtractionMetadata(path string) map[string]interface{} {
+	if !isImageFile(path) {
+		return nil
+	}
+	return map[string]interface{}{
+		"extraction": "ocr",
+		"ocr_engine": vs.ocrEngine(),
+		"ocr_notice": "Content was extracted from an image by OCR and may contain recognition errors",
+	}
+}
+
+// extractImageText runs OCR on an image file
+func (vs *VectorStore) extractImageText(ctx context.Context, path string) (string, error) {
+	engine := vs.ocrEngine()
+	fmt.Printf("[VectorStore] Running OCR (%s) on: %s\n", engine, path)
+
+	var text string
+	var err error
+	switch engine {
+	case OCREngineTesseract:
+		text, err = vs.tesseractOCR(ctx, path)
+	case OCREngineVision:
+		text, err = vs.visionOCR(ctx, path)
+	default:
+		return "", fmt.Errorf("no OCR engine available: install tesseract or set GOOGLE_API_KEY/OPENAI_API_KEY")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", fmt.Errorf("OCR found no text in image")
+	}
+
+	fmt.Printf("[VectorStore] OCR successful, output size: %d bytes\n", len(text))
+	return text, nil
+}
+
+// tesseractOCR extracts text with the tesseract CLI
+func (vs *VectorStore) tesseractOCR(ctx context.Context, path string) (string, error) {
+	args := []string{path, "stdout"}
+	if vs.cfg.OCRLanguages != "" {
+		args = append(args, "-l", vs.cfg.OCRLanguages)
+	}
+
+	cmd := exec.CommandContext(ctx, vs.cfg.TesseractPath, args...)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("tesseract failed: %w, output: %s", err, string(exitErr.Stderr))
+		}
+		return "", fmt.Errorf("tesseract failed: %w", err)
+	}
+	return string(output), nil
+}
+
+// visionOCR transcribes an image with a multimodal model, preferring Gemini
+// when a Google API key is configured
+func (vs *VectorStore) visionOCR(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	mimeType := imageMIMETypes[strings.ToLower(filepath.Ext(path))]
+
+	ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
+	defer cancel()
+
+	if vs.cfg.GoogleAPIKey != "" {
+		client, err := genai.NewClient(ctx, &genai.ClientConfig{
+			APIKey:     vs.cfg.GoogleAPIKey,
+			Backend:    genai.BackendGeminiAPI,
+			HTTPClient: &http.Client{Timeout: 5 * time.Minute},
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create genai client: %w", err)
+		}
+
+		content := genai.NewContentFromParts([]*genai.Part{
+			genai.NewPartFromText(ocrPrompt),
+			genai.NewPartFromBytes(data, mimeType),
+		}, genai.RoleUser)
+		resp, err := client.Models.GenerateContent(ctx, "gemini-3-flash-preview", []*genai.Content{content}, nil)
+		if err != nil {
+			return "", fmt.Errorf("vision OCR failed: %w", err)
+		}
+		return resp.Text(), nil
+	}
+
+	llm, err := createLLM(vs.cfg, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create LLM for vision OCR: %w", err)
+	}
+
+	resp, err := limited(ctx, vs.llmLimiter, func(ctx context.Context) (*llms.ContentResponse, error) {
+		return llm.GenerateContent(ctx, []llms.MessageContent{{
+			Role: llms.ChatMessageTypeHuman,
+			Parts: []llms.ContentPart{
+				llms.TextContent{Text: ocrPrompt},
+				llms.BinaryPart(mimeType, data),
+			},
+		}})
+	})
+	if err != nil {
+		return "", fmt.Errorf("vision OCR failed: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("vision OCR returned no text")
+	}
+	return resp.Choices[0].Content, nil
+}
@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+	ollamallm "github.com/tmc/langchaingo/llms/ollama"
+)
+
+// ollamaPreloadTimeout bounds the warm-up generation; loading a large model
+// from disk can take a while
+const ollamaPreloadTimeout = 5 * time.Minute
+
+// ErrModelNotFound is returned when the model server does not have the
+// requested model, typically an Ollama model that was never pulled
+var ErrModelNotFound = errors.New("model not found")
+
+// modelNotFoundPattern matches Ollama's error for a model that is not
+// pulled, e.g. `model "qwen3" not found, try pulling it first`. Its
+// OpenAI-compatible API reports it the same way.
+var modelNotFoundPattern = regexp.MustCompile(`model ["']?([^"'\s]+)["']? not found`)
+
+// ollamaOptions returns the options of an Ollama client for model
+func ollamaOptions(cfg Config, model string) []ollamallm.Option {
+	opts := []ollamallm.Option{
+		ollamallm.WithModel(model),
+		ollamallm.WithServerURL(cfg.OllamaBaseURL),
+	}
+	if cfg.OllamaKeepAlive != "" {
+		opts = append(opts, ollamallm.WithKeepAlive(cfg.OllamaKeepAlive))
+	}
+	return opts
+}
+
+// modelNotFoundError explains an error for a model the server does not have
+// and tells how to pull it. Other errors are returned as they are.
+func modelNotFoundError(err error) error {
+	if errors.Is(err, ErrModelNotFound) {
+		return err
+	}
+	m := modelNotFoundPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s is not available on the model server, run `ollama pull %s` (%v)", ErrModelNotFound, m[1], m[1], err)
+}
+
+// PreloadModel sends a one-token generation so Ollama loads the chat model
+// before the first real request. It only logs the outcome.
+func (a *Agent) PreloadModel(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, ollamaPreloadTimeout)
+	defer cancel()
+
+	model := a.modelName()
+	golog.Infof("🔥 preloading Ollama model %s...", model)
+	start := time.Now()
+	if _, err := llms.GenerateFromSinglePrompt(ctx, a.llm, "hi", llms.WithMaxTokens(1)); err != nil {
+		golog.Warnf("failed to preload Ollama model %s: %v", model, modelNotFoundError(err))
+		return
+	}
+	golog.Infof("✅ Ollama model %s loaded in %s", model, time.Since(start).Round(time.Millisecond))
+}
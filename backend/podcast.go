@@ -0,0 +1,220 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// The speech API returns raw 24kHz 16-bit mono PCM, which can be
+// concatenated directly and gives exact segment timings
+const (
+	pcmSampleRate     = 24000
+	pcmBytesPerSample = 2
+	maxSpeechInput    = 4000 // characters per speech request, the API limit is 4096
+)
+
+var (
+	// stageDirectionPattern matches [stage directions] in podcast scripts
+	stageDirectionPattern = regexp.MustCompile(`\[[^\]]*\]|【[^】]*】`)
+	// markdownMarkupPattern matches emphasis, heading and list markers around
+	// speaker labels
+	markdownMarkupPattern = regexp.MustCompile(`\*\*|__|^\s*(?:#+|[-*])\s+`)
+)
+
+// PodcastSegment is one speaker turn of a podcast, with its position in the
+// audio in seconds
+type PodcastSegment struct {
+	Speaker string  `json:"speaker"`
+	Voice   string  `json:"voice"`
+	Text    string  `json:"text"`
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+}
+
+// PodcastAudio is the synthesized audio of a podcast script
+type PodcastAudio struct {
+	Path     string
+	Duration float64 // in seconds
+	Segments []PodcastSegment
+}
+
+// parsePodcastScript splits a speaker-tagged script ("主持人1：...") into
+// segments, dropping stage directions and lines before the first speaker.
+// Only labels that recur count as speakers, so a "标题：..." line is not
+// read in a voice of its own. Speakers are assigned the voices in order of
+// appearance.
+func parsePodcastScript(script string, voices []string) []PodcastSegment {
+	type line struct {
+		speaker string
+		text    string
+	}
+	var lines []line
+	turnCount := make(map[string]int)
+	for _, raw := range strings.Split(script, "\n") {
+		text := stageDirectionPattern.ReplaceAllString(raw, "")
+		text = strings.TrimSpace(markdownMarkupPattern.ReplaceAllString(text, ""))
+		if text == "" {
+			continue
+		}
+		if m := speakerLinePattern.FindStringSubmatch(text); m != nil {
+			speaker := strings.TrimSpace(m[1])
+			turnCount[speaker]++
+			lines = append(lines, line{speaker: speaker, text: strings.TrimSpace(m[2])})
+			continue
+		}
+		lines = append(lines, line{text: text})
+	}
+
+	speakerVoices := make(map[string]string)
+	var segments []PodcastSegment
+	for _, l := range lines {
+		if turnCount[l.speaker] < 2 {
+			// Continuation of the current turn
+			if len(segments) > 0 {
+				segments[len(segments)-1].Text += "\n" + l.text
+			}
+			continue
+		}
+		voice, ok := speakerVoices[l.speaker]
+		if !ok {
+			voice = voices[len(speakerVoices)%len(voices)]
+			speakerVoices[l.speaker] = voice
+		}
+		segments = append(segments, PodcastSegment{Speaker: l.speaker, Voice: voice, Text: l.text})
+	}
+	return segments
+}
+
+// podcastVoices returns the voices for the first and second host
+func podcastVoices(cfg Config) []string {
+	return []string{cfg.PodcastVoiceHost1, cfg.PodcastVoiceHost2}
+}
+
+// SynthesizePodcast reads a podcast script aloud, each speaker in their own
+// voice, and saves the concatenated audio as a WAV file in the uploads
+// directory
+func (a *Agent) SynthesizePodcast(ctx context.Context, script string) (*PodcastAudio, error) {
+	if a.cfg.IsOllama() || a.cfg.OpenAIToken() == "" {
+		return nil, fmt.Errorf("podcast audio requires an OpenAI compatible speech API")
+	}
+
+	segments := parsePodcastScript(script, podcastVoices(a.cfg))
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no speaker turns found in podcast script")
+	}
+
+	golog.Infof("synthesizing %d podcast segments...", len(segments))
+	var pcm bytes.Buffer
+	for i := range segments {
+		segments[i].Start = pcmSeconds(pcm.Len())
+		for _, part := range splitSpeechText(segments[i].Text, maxSpeechInput) {
+			audio, err := synthesizeSpeech(ctx, a.cfg, segments[i].Voice, part)
+			if err != nil {
+				return nil, fmt.Errorf("failed to synthesize segment %d: %w", i+1, err)
+			}
+			pcm.Write(audio)
+		}
+		segments[i].End = pcmSeconds(pcm.Len())
+	}
+
+	if err := os.MkdirAll(a.cfg.UploadsDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	path := filepath.Join(a.cfg.UploadsDir, fmt.Sprintf("podcast_%d.wav", time.Now().UnixNano()))
+	if err := writeWAV(path, pcm.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to save podcast audio: %w", err)
+	}
+
+	golog.Infof("podcast audio saved to %s", path)
+	return &PodcastAudio{Path: path, Duration: pcmSeconds(pcm.Len()), Segments: segments}, nil
+}
+
+// synthesizeSpeech converts text to PCM audio with the OpenAI speech API
+func synthesizeSpeech(ctx context.Context, cfg Config, voice, text string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{
+		"model":           cfg.PodcastTTSModel,
+		"voice":           voice,
+		"input":           text,
+		"response_format": "pcm",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := cfg.OpenAIBaseURL
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/audio/speech", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.OpenAIToken())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("speech API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// splitSpeechText splits text longer than limit characters at sentence
+// boundaries
+func splitSpeechText(text string, limit int) []string {
+	runes := []rune(text)
+	var parts []string
+	for len(runes) > limit {
+		cut := limit
+		for i := limit - 1; i > limit/2; i-- {
+			if strings.ContainsRune("。！？.!?\n", runes[i]) {
+				cut = i + 1
+				break
+			}
+		}
+		parts = append(parts, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	return append(parts, string(runes))
+}
+
+func pcmSeconds(n int) float64 {
+	return float64(n) / (pcmSampleRate * pcmBytesPerSample)
+}
+
+// writeWAV wraps raw 24kHz 16-bit mono PCM in a WAV header
+func writeWAV(path string, pcm []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(pcm)))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(pcmSampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint32(pcmSampleRate*pcmBytesPerSample))
+	binary.Write(&buf, binary.LittleEndian, uint16(pcmBytesPerSample))
+	binary.Write(&buf, binary.LittleEndian, uint16(8*pcmBytesPerSample))
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
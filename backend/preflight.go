@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ServerPortAuto makes the server listen on the first free port from 8080
+const ServerPortAuto = "auto"
+
+// autoPortStart and autoPortAttempts bound the ports tried with
+// SERVER_PORT=auto
+const (
+	autoPortStart    = 8080
+	autoPortAttempts = 100
+)
+
+// preflightTimeout bounds each network check of the preflight
+const preflightTimeout = 5 * time.Second
+
+// preflightCheck is one line of the startup checklist. A failed optional
+// check is reported as a warning and does not stop the server.
+type preflightCheck struct {
+	name     string
+	err      error
+	optional bool
+}
+
+// Preflight checks what the server needs before it is created: a writable
+// data directory, a free port and a reachable LLM with its models. It prints
+// a numbered checklist and returns an error when any check failed, so a
+// broken setup is reported at once instead of deep inside NewServer.
+func Preflight(ctx context.Context, cfg Config) error {
+	checks := []preflightCheck{
+		{name: fmt.Sprintf("Data directory %s is writable", cfg.DataDir), err: prepareDataDir(cfg)},
+		{name: fmt.Sprintf("Port %s is available", net.JoinHostPort(cfg.ServerHost, cfg.ServerPort)), err: checkPort(cfg.ServerHost, cfg.ServerPort)},
+	}
+	if !cfg.SkipPreflight {
+		checks = append(checks, preflightLLM(ctx, cfg)...)
+	}
+
+	fmt.Println("Preflight checks:")
+	failed := 0
+	for i, check := range checks {
+		if check.err != nil && check.optional {
+			fmt.Printf("  %d. ⚠️  %s: %v\n", i+1, check.name, check.err)
+			continue
+		}
+		if check.err != nil {
+			failed++
+			fmt.Printf("  %d. ❌ %s: %v\n", i+1, check.name, check.err)
+			continue
+		}
+		fmt.Printf("  %d. ✅ %s\n", i+1, check.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d preflight checks failed (set SKIP_PREFLIGHT=true to skip the LLM checks)", failed, len(checks))
+	}
+	return nil
+}
+
+// checkPort tells whether the server can listen on host:port
+func checkPort(host, port string) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return listenError(port, err)
+	}
+	return ln.Close()
+}
+
+// listenError explains a port already in use, which the bind error alone
+// does not make obvious
+func listenError(port string, err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("port %s is already in use; set SERVER_PORT to a free port, or to %s to pick one", port, ServerPortAuto)
+	}
+	return err
+}
+
+// ResolveServerPort returns the port the server listens on: SERVER_PORT, or
+// with SERVER_PORT=auto the first free port from 8080
+func ResolveServerPort(cfg Config) (string, error) {
+	if cfg.ServerPort != ServerPortAuto {
+		return cfg.ServerPort, nil
+	}
+	for port := autoPortStart; port < autoPortStart+autoPortAttempts; port++ {
+		if checkPort(cfg.ServerHost, strconv.Itoa(port)) == nil {
+			return strconv.Itoa(port), nil
+		}
+	}
+	return "", fmt.Errorf("no free port between %d and %d", autoPortStart, autoPortStart+autoPortAttempts-1)
+}
+
+// preflightLLM checks that the configured LLM server answers and, for
+// Ollama, that the chat and embedding models are pulled. Without the
+// embedding model retrieval falls back to keyword search, so a missing one is
+// only a warning.
+func preflightLLM(ctx context.Context, cfg Config) []preflightCheck {
+	if cfg.IsOllama() {
+		base := strings.TrimSuffix(cfg.OllamaBaseURL, "/")
+		models, err := ollamaModels(ctx, base)
+		checks := []preflightCheck{{name: fmt.Sprintf("Ollama at %s is reachable", base), err: err}}
+		if err != nil {
+			return checks
+		}
+		check := preflightCheck{name: fmt.Sprintf("Ollama model %s is pulled", cfg.OllamaModel)}
+		if !hasOllamaModel(models, cfg.OllamaModel) {
+			check.err = fmt.Errorf("run `ollama pull %s`", cfg.OllamaModel)
+		}
+		checks = append(checks, check)
+
+		if cfg.EmbeddingModel != "" && cfg.EmbeddingModel != cfg.OllamaModel {
+			check := preflightCheck{name: fmt.Sprintf("Ollama embedding model %s is pulled", cfg.EmbeddingModel), optional: true}
+			if !hasOllamaModel(models, cfg.EmbeddingModel) {
+				check.err = fmt.Errorf("run `ollama pull %s` or set EMBEDDING_MODEL to a pulled embedding model; retrieval falls back to keyword search until then", cfg.EmbeddingModel)
+			}
+			checks = append(checks, check)
+		}
+		return checks
+	}
+
+	base := cfg.OpenAIBaseURL
+	if base == "" {
+		base = "https://api.openai.com/v1"
+	}
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	return []preflightCheck{{name: fmt.Sprintf("LLM API at %s is reachable", base), err: checkLLM(ctx, cfg)}}
+}
+
+// ollamaModels lists the models pulled on an Ollama server
+func ollamaModels(ctx context.Context, base string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%v (is `ollama serve` running?)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode model list: %w", err)
+	}
+	models := make([]string, 0, len(result.Models))
+	for _, m := range result.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+// hasOllamaModel tells whether model is among the pulled models; a model
+// without a tag means its "latest" tag
+func hasOllamaModel(models []string, model string) bool {
+	if !strings.Contains(model, ":") {
+		model += ":latest"
+	}
+	for _, m := range models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
@@ -1,5 +1,9 @@
 package backend
 
+// promptTemplateVersion identifies the current revision of the prompt templates.
+// Bump it whenever a template changes so note traces show which wording was used.
+const promptTemplateVersion = "2"
+
 // getTransformationPrompt returns the prompt template for each transformation type
 func getTransformationPrompt(transformType string) string {
 	switch transformType {
@@ -24,6 +28,12 @@ func getTransformationPrompt(transformType string) string {
 	case "glossary":
 		return glossaryPrompt()
 
+	case "explain":
+		return explainPrompt()
+
+	case "compare":
+		return comparePrompt()
+
 	case "quiz":
 		return quizPrompt()
 
@@ -54,6 +64,31 @@ func summaryPrompt() string {
 请提供一个结构良好的摘要，捕捉来源中的关键信息、主要主题和重要细节。`
 }
 
+// multiLengthSummaryPrompt asks for several summary variants in one response,
+// each introduced by a "=== <length> ===" marker line
+func multiLengthSummaryPrompt() string {
+	return `你是一个擅长创建综合摘要的专家。请根据以下来源，以{format}格式为每个指定长度分别创建一个摘要：{length}。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+长度说明：
+- short：一到两句话，概括最核心的内容
+- medium：一到三段，涵盖主要主题和关键信息
+- long：详细摘要，包含重要细节、论据和结论
+
+来源：
+{sources}
+
+请严格按照以下格式输出，每个摘要前单独一行写上对应的标记，不要输出其他内容：
+=== short ===
+（short 摘要）
+=== medium ===
+（medium 摘要）
+=== long ===
+（long 摘要）
+
+只输出上面列出的长度中被要求的那些：{length}。`
+}
+
 func faqPrompt() string {
 	return `你是一个擅长创建常见问题解答（FAQ）文档的专家。请根据以下来源，以{format}格式生成一个全面的FAQ。
 **注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
@@ -141,6 +176,45 @@ func glossaryPrompt() string {
 - 相关术语之间的交叉引用`
 }
 
+// explainPrompt is meant for a single dense source, such as a paper or a
+// contract, explained to a reader without background in the field
+func explainPrompt() string {
+	return `你是一位善于把复杂内容讲清楚的老师。请根据以下来源，以{format}格式用通俗易懂的语言解释其内容，详细程度为{length}。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+来源：
+{sources}
+
+解释应：
+- 先用几句话说明这份来源讲的是什么、为什么重要
+- 按来源的思路逐一解释核心概念，假设读者没有相关背景
+- 遇到专业术语时用简单的话给出定义
+- 用贴近日常生活的类比或例子帮助理解难点
+- 指出容易误解的地方
+- 最后用几条要点总结读者应该记住的内容
+
+只解释来源中的内容，不要编造来源中没有的信息。`
+}
+
+// comparePrompt relies on the "## Source N: name" headings of the source
+// context to tell the compared sources apart
+func comparePrompt() string {
+	return `你是一个擅长对比分析的研究员。请根据以下来源，以{format}格式对它们进行结构化的对比，详细程度为{length}。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+来源（每个来源以“## Source 编号: 名称”开头）：
+{sources}
+
+对比应包括：
+1. 每个来源的一句话概述，注明来源编号和名称
+2. 一个 Markdown 对比表格：每一列对应一个来源（列标题使用来源名称），每一行对应一个对比维度，例如研究问题或主题、方法、数据或证据、主要结论、优点、局限
+3. 各来源的主要共识
+4. 各来源的主要分歧或矛盾之处，并说明各自的依据
+5. 总结：各来源分别适合什么场景或读者
+
+某个来源没有涉及某个维度时，请在表格中写“未提及”，不要编造来源中没有的信息。`
+}
+
 func quizPrompt() string {
 	return `你是一个创建评估材料的教育家。请根据以下来源，以{format}格式创建一个测验。
 **注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
@@ -419,5 +493,53 @@ func chatSystemPrompt() string {
 
 用户问题：{question}
 
-请提供有用的、准确的回答。当引用来源中的信息时，请提及信息来自哪个来源。`
+请提供有用的、准确的回答。当引用来源中的信息时，请在相应句子末尾用上下文中的标签标注出处，例如 [{label} 1]；同时依据多个片段时依次标注，例如 [{label} 1][{label} 3]。不要标注上下文中没有的标签。`
+}
+
+// chatHistoryPrompt condenses the older turns of a long chat, together with
+// the summary of the turns before them, into a new summary
+func chatHistoryPrompt() string {
+	return `请把下面的对话压缩成一段简洁的摘要，供后续对话作为背景使用。
+要求：
+- 保留用户的问题、关注点和偏好，以及助手给出的关键结论、事实和数字
+- 保留仍未解决的问题和双方约定的事项
+- 按时间顺序，使用与对话相同的语言，不超过300字
+- 只输出摘要本身，不要添加开场白
+
+此前的摘要：
+{summary}
+
+对话：
+{history}`
+}
+
+// translatePrompt translates one piece of a source. Unlike the other
+// templates it has no fixed output language: {language} is the target.
+func translatePrompt() string {
+	return `你是一名专业翻译。请把下面的内容完整、忠实地翻译成{language}。
+**注意：译文必须使用{language}，不受原文语言和本说明语言的影响。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+要求：
+- 逐段翻译，不要总结、删减或增加内容
+- 保留原有的段落、标题、列表、表格和 Markdown 格式
+- 专有名词、代码、公式和网址保持原样，必要时在括号中保留原文
+- 只输出译文，不要添加说明或开场白
+
+附加要求：{prompt}
+
+内容：
+{content}`
+}
+
+// Map step prompt for streaming (map-reduce) transformations of large sources
+func mapWindowPrompt() string {
+	return `你正在分段处理一份很长的资料，最终目标是生成一份{type}。以下是来源“{source}”的第 {part}/{total} 部分。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+附加要求（为空则忽略）：{prompt}
+
+内容：
+{content}
+
+请提取这一部分中与最终目标相关的全部关键信息、事实、人物、时间和结论，尽量保留细节和原有顺序。只输出提取的要点，不要添加开场白或总结。`
 }
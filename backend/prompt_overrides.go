@@ -0,0 +1,244 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/prompts"
+)
+
+// transformationTypes lists the transformation types with a built-in prompt template
+var transformationTypes = []string{
+	"summary", "faq", "study_guide", "outline", "podcast", "timeline",
+	"glossary", "explain", "compare", "quiz", "mindmap", "infograph", "ppt", "custom",
+}
+
+// mapWindowPromptType is the template condensing one window of a large
+// source in the map step of map-reduce transformations
+const mapWindowPromptType = "map_window"
+
+// promptTypes lists every template the prompt manager resolves
+var promptTypes = append(slices.Clone(transformationTypes), mapWindowPromptType)
+
+// promptVariables are the placeholders available to transformation templates
+var promptVariables = []string{"sources", "type", "length", "format", "prompt"}
+
+// mapWindowVariables are the placeholders available to the map_window template
+var mapWindowVariables = []string{"type", "source", "part", "total", "prompt", "content"}
+
+// PromptBundle is a portable set of prompt templates keyed by transformation type
+type PromptBundle struct {
+	Version    string            `json:"version"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Templates  map[string]string `json:"templates"`
+}
+
+// PromptManager resolves transformation prompts, preferring user overrides
+// stored as <type>.txt files in a directory over the built-in templates
+type PromptManager struct {
+	dir       string
+	mu        sync.RWMutex
+	overrides map[string]string
+}
+
+// NewPromptManager creates a prompt manager and loads overrides from dir
+func NewPromptManager(dir string) (*PromptManager, error) {
+	pm := &PromptManager{
+		dir:       dir,
+		overrides: make(map[string]string),
+	}
+	if dir == "" {
+		return pm, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create prompts directory: %w", err)
+	}
+
+	for _, t := range promptTypes {
+		content, err := os.ReadFile(pm.path(t))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prompt override %s: %w", t, err)
+		}
+		if err := validatePromptTemplate(t, string(content)); err != nil {
+			return nil, fmt.Errorf("invalid prompt override %s: %w", t, err)
+		}
+		pm.overrides[t] = string(content)
+	}
+
+	return pm, nil
+}
+
+// path returns the override file path for a transformation type
+func (pm *PromptManager) path(transformType string) string {
+	return filepath.Join(pm.dir, transformType+".txt")
+}
+
+// Get returns the effective prompt template for a transformation type or
+// map_window
+func (pm *PromptManager) Get(transformType string) string {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if template, ok := pm.overrides[transformType]; ok {
+		return template
+	}
+	return builtinPrompt(transformType)
+}
+
+// Export returns the effective templates for every prompt type
+func (pm *PromptManager) Export() PromptBundle {
+	templates := make(map[string]string, len(promptTypes))
+	for _, t := range promptTypes {
+		templates[t] = pm.Get(t)
+	}
+
+	return PromptBundle{
+		Version:    promptTemplateVersion,
+		ExportedAt: time.Now(),
+		Templates:  templates,
+	}
+}
+
+// Import validates every template in the bundle and then stores them as
+// overrides. Templates identical to the built-in ones clear the override.
+func (pm *PromptManager) Import(bundle PromptBundle) error {
+	if len(bundle.Templates) == 0 {
+		return fmt.Errorf("bundle contains no templates")
+	}
+
+	types := make([]string, 0, len(bundle.Templates))
+	for t, template := range bundle.Templates {
+		if !isPromptType(t) {
+			return fmt.Errorf("unknown prompt type: %s", t)
+		}
+		if err := validatePromptTemplate(t, template); err != nil {
+			return fmt.Errorf("invalid template for %s: %w", t, err)
+		}
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, t := range types {
+		template := bundle.Templates[t]
+		if template == builtinPrompt(t) {
+			if err := pm.removeOverride(t); err != nil {
+				return err
+			}
+			continue
+		}
+		if pm.dir != "" {
+			if err := os.WriteFile(pm.path(t), []byte(template), 0644); err != nil {
+				return fmt.Errorf("failed to save prompt override %s: %w", t, err)
+			}
+		}
+		pm.overrides[t] = template
+	}
+
+	return nil
+}
+
+// Reset removes the override for a prompt type and returns the restored
+// built-in template
+func (pm *PromptManager) Reset(transformType string) (string, error) {
+	if !isPromptType(transformType) {
+		return "", fmt.Errorf("unknown prompt type: %s", transformType)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if err := pm.removeOverride(transformType); err != nil {
+		return "", err
+	}
+	return builtinPrompt(transformType), nil
+}
+
+// ResetAll removes every override, restoring all built-in templates
+func (pm *PromptManager) ResetAll() error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, t := range promptTypes {
+		if err := pm.removeOverride(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOverride deletes the override for a type; callers must hold pm.mu
+func (pm *PromptManager) removeOverride(transformType string) error {
+	if pm.dir != "" {
+		if err := os.Remove(pm.path(transformType)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove prompt override %s: %w", transformType, err)
+		}
+	}
+	delete(pm.overrides, transformType)
+	return nil
+}
+
+// isPromptType reports whether t has a built-in prompt template
+func isPromptType(t string) bool {
+	return slices.Contains(promptTypes, t)
+}
+
+// builtinPrompt returns the built-in template of a prompt type
+func builtinPrompt(t string) string {
+	if t == mapWindowPromptType {
+		return mapWindowPrompt()
+	}
+	return getTransformationPrompt(t)
+}
+
+// templateVariables returns the placeholders available to the template of a
+// prompt type and those it must include
+func templateVariables(t string) (variables, required []string) {
+	switch t {
+	case mapWindowPromptType:
+		return mapWindowVariables, []string{"content"}
+	case "custom":
+		return promptVariables, []string{"sources", "prompt"}
+	default:
+		return promptVariables, []string{"sources"}
+	}
+}
+
+// validatePromptTemplate checks that a template includes the placeholders its
+// type needs and can be rendered with the variables of its type
+func validatePromptTemplate(transformType, template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("template is empty")
+	}
+
+	variables, required := templateVariables(transformType)
+	for _, name := range required {
+		if !strings.Contains(template, "{"+name+"}") {
+			return fmt.Errorf("missing required placeholder {%s}", name)
+		}
+	}
+
+	values := make(map[string]any, len(variables))
+	for _, name := range variables {
+		values[name] = ""
+	}
+	pt := prompts.NewPromptTemplate(template, variables)
+	pt.TemplateFormat = prompts.TemplateFormatFString
+	if _, err := pt.Format(values); err != nil {
+		return fmt.Errorf("template does not render: %w", err)
+	}
+
+	return nil
+}
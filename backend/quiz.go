@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Quiz question types
+const (
+	QuizMultipleChoice = "multiple_choice"
+	QuizTrueFalse      = "true_false"
+	QuizShortAnswer    = "short_answer"
+)
+
+// quizJSONInstruction is appended to the quiz prompt when the quiz is
+// requested as JSON. It is added after formatting the template, so the
+// braces are not taken for template variables.
+const quizJSONInstruction = `
+
+# 输出格式
+只输出一个 JSON 对象，不要使用代码块，不要输出任何其他文字。格式如下：
+{"questions": [{"type": "multiple_choice", "question": "问题", "options": ["选项A", "选项B", "选项C", "选项D"], "answer": "选项B", "explanation": "解释"}]}
+- type 只能是 multiple_choice、true_false 或 short_answer
+- multiple_choice 至少有两个 options，answer 必须与其中一个选项完全相同
+- true_false 的 answer 只能是 "true" 或 "false"，不需要 options
+- short_answer 的 answer 是参考答案，不需要 options`
+
+// isQuizJSON reports whether a request asks for a structured quiz
+func isQuizJSON(req *TransformationRequest) bool {
+	return req.Type == "quiz" && strings.EqualFold(req.Format, "json")
+}
+
+// normalizeQuizJSON extracts the quiz JSON from model output, validates it
+// and returns it re-encoded
+func normalizeQuizJSON(output string) (string, error) {
+	quiz, err := parseQuiz(output)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(quiz)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// parseQuiz decodes and validates a quiz, tolerating a code fence or prose
+// around the JSON object
+func parseQuiz(output string) (*Quiz, error) {
+	text := strings.TrimSpace(output)
+	if m := fencedBlockPattern.FindStringSubmatch(text); m != nil {
+		text = strings.TrimSpace(m[2])
+	}
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON object found in output")
+	}
+
+	var quiz Quiz
+	if err := json.Unmarshal([]byte(text[start:end+1]), &quiz); err != nil {
+		return nil, fmt.Errorf("invalid quiz JSON: %w", err)
+	}
+	if err := validateQuiz(&quiz); err != nil {
+		return nil, err
+	}
+	return &quiz, nil
+}
+
+// validateQuiz checks every question has a known type, a question text and
+// an answer consistent with its type, normalizing true/false answers
+func validateQuiz(quiz *Quiz) error {
+	if len(quiz.Questions) == 0 {
+		return fmt.Errorf("quiz has no questions")
+	}
+	for i := range quiz.Questions {
+		q := &quiz.Questions[i]
+		q.Type = strings.ToLower(strings.TrimSpace(q.Type))
+		q.Question = strings.TrimSpace(q.Question)
+		q.Answer = strings.TrimSpace(q.Answer)
+		if q.Question == "" {
+			return fmt.Errorf("question %d has no text", i+1)
+		}
+		if q.Answer == "" {
+			return fmt.Errorf("question %d has no answer", i+1)
+		}
+
+		switch q.Type {
+		case QuizMultipleChoice:
+			if len(q.Options) < 2 {
+				return fmt.Errorf("question %d needs at least two options", i+1)
+			}
+			// Accept the option letter as the answer
+			if len(q.Answer) == 1 {
+				if j := int(strings.ToUpper(q.Answer)[0] - 'A'); j >= 0 && j < len(q.Options) {
+					q.Answer = strings.TrimSpace(q.Options[j])
+				}
+			}
+			found := false
+			for _, option := range q.Options {
+				if strings.TrimSpace(option) == q.Answer {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("answer of question %d is not one of its options", i+1)
+			}
+		case QuizTrueFalse:
+			switch strings.ToLower(q.Answer) {
+			case "true", "对", "正确":
+				q.Answer = "true"
+			case "false", "错", "错误":
+				q.Answer = "false"
+			default:
+				return fmt.Errorf("answer of true/false question %d must be true or false", i+1)
+			}
+			q.Options = nil
+		case QuizShortAnswer:
+			q.Options = nil
+		default:
+			return fmt.Errorf("question %d has unknown type %q", i+1, q.Type)
+		}
+	}
+	return nil
+}
+
+// renderQuiz formats a structured quiz as markdown for display
+func renderQuiz(quiz *Quiz) string {
+	var questions, answers strings.Builder
+	for i, q := range quiz.Questions {
+		fmt.Fprintf(&questions, "%d. %s\n", i+1, q.Question)
+		for j, option := range q.Options {
+			fmt.Fprintf(&questions, "   %c. %s\n", 'A'+j, option)
+		}
+		if q.Type == QuizTrueFalse {
+			questions.WriteString("   （判断正误）\n")
+		}
+		questions.WriteString("\n")
+
+		answer := q.Answer
+		switch q.Type {
+		case QuizTrueFalse:
+			answer = map[string]string{"true": "正确", "false": "错误"}[q.Answer]
+		case QuizMultipleChoice:
+			for j, option := range q.Options {
+				if strings.TrimSpace(option) == q.Answer {
+					answer = fmt.Sprintf("%c. %s", 'A'+j, option)
+					break
+				}
+			}
+		}
+		fmt.Fprintf(&answers, "%d. %s", i+1, answer)
+		if q.Explanation != "" {
+			fmt.Fprintf(&answers, " —— %s", q.Explanation)
+		}
+		answers.WriteString("\n")
+	}
+	return "## 测验\n\n" + questions.String() + "## 答案\n\n" + answers.String()
+}
@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// remoteFileTimeout bounds the download of a remote file; large documents can
+// take a while
+const remoteFileTimeout = 10 * time.Minute
+
+// addRemoteFile creates a file source from an s3:// or http(s):// URL. The
+// file is downloaded into the uploads directory and goes through the same
+// checks and extraction as an upload. s3:// objects are read with the
+// S3_ACCESS_KEY and S3_SECRET_KEY credentials and S3_ENDPOINT, whatever the
+// storage backend, from S3_BUCKET or one of S3_SOURCE_BUCKETS. http(s):// URLs
+// must point to public addresses unless FETCH_ALLOW_PRIVATE is set. Errors
+// are *apiError.
+func (s *Server) addRemoteFile(ctx context.Context, notebookID string, req *AddSourceRequest) (*Source, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "s3" && u.Scheme != "http" && u.Scheme != "https") {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "url of a file source must be an s3://, http:// or https:// URL"}
+	}
+	if u.Scheme == "s3" && !s3SourceBucketAllowed(s.cfg, u.Host) {
+		return nil, &apiError{
+			Status:  http.StatusForbidden,
+			Code:    ErrCodeInvalidRequest,
+			Message: fmt.Sprintf("Bucket %q is not allowed; file sources can be read from S3_BUCKET or S3_SOURCE_BUCKETS", u.Host),
+		}
+	}
+	if u.Scheme != "s3" && !s.cfg.FetchAllowPrivate {
+		if err := checkFetchHost(u.Hostname()); err != nil {
+			return nil, privateAddressError(err)
+		}
+	}
+
+	displayName := cleanUploadName(strings.TrimSpace(req.Name))
+	if displayName == "" {
+		displayName = cleanUploadName(path.Base(u.Path))
+	}
+	if displayName == "" {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "name is required when the URL has no file name"}
+	}
+	if !uploadExtensionAllowed(s.cfg.AllowedUploadExtensions, displayName) {
+		return nil, &apiError{
+			Status: http.StatusUnsupportedMediaType,
+			Code:   ErrCodeUnsupportedFileType,
+			Message: fmt.Sprintf("File type %q is not allowed, allowed types: %s",
+				filepath.Ext(displayName), strings.Join(s.cfg.AllowedUploadExtensions, ", ")),
+		}
+	}
+
+	uniqueFileName := uniqueUploadName(displayName)
+	tempPath, err := uploadPath(s.cfg.UploadsDir, uniqueFileName)
+	if err != nil {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "Invalid file name"}
+	}
+	if err := os.MkdirAll(s.cfg.UploadsDir, 0755); err != nil {
+		golog.Errorf("failed to create uploads directory: %v", err)
+		return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to create uploads directory"}
+	}
+
+	golog.Infof("downloading %s for notebook %s", u.Redacted(), notebookID)
+	if err := s.downloadRemoteFile(ctx, u, tempPath); err != nil {
+		os.Remove(tempPath)
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return nil, apiErr
+		}
+		if errors.Is(err, ErrPrivateAddress) {
+			return nil, privateAddressError(err)
+		}
+		return nil, &apiError{Status: http.StatusBadGateway, Code: ErrCodeFetchFailed, Message: "Failed to download file", Details: err.Error()}
+	}
+
+	return s.ingestFile(ctx, notebookID, displayName, uniqueFileName, tempPath, IngestFileOptions{Force: req.Force, URL: u.Redacted(), Index: req.Index})
+}
+
+// downloadRemoteFile writes a remote file to dst, up to MAX_UPLOAD_BYTES
+func (s *Server) downloadRemoteFile(ctx context.Context, u *url.URL, dst string) error {
+	var body io.ReadCloser
+	if u.Scheme == "s3" {
+		cfg := s.cfg
+		cfg.S3Bucket = u.Host
+		cfg.S3Prefix = ""
+		storage, err := newS3Storage(cfg)
+		if err != nil {
+			return &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "s3:// URLs need S3_ACCESS_KEY and S3_SECRET_KEY to be configured"}
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		if body, _, err = storage.Get(ctx, key); err != nil {
+			return err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "notex/1.0 (+https://github.com/smallnest/notex)")
+		resp, err := newFetchClient(remoteFileTimeout, s.cfg.FetchAllowPrivate).Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	reader := body.(io.Reader)
+	if s.cfg.MaxUploadBytes > 0 {
+		reader = io.LimitReader(body, s.cfg.MaxUploadBytes+1)
+	}
+	n, err := io.Copy(f, reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if s.cfg.MaxUploadBytes > 0 && n > s.cfg.MaxUploadBytes {
+		resp := uploadTooLargeError(s.cfg.MaxUploadBytes)
+		return &apiError{Status: http.StatusRequestEntityTooLarge, Code: resp.Code, Message: resp.Error}
+	}
+	return nil
+}
+
+// s3SourceBucketAllowed tells whether file sources may be read from bucket:
+// the storage bucket and S3_SOURCE_BUCKETS are, other buckets the credentials
+// can read are not
+func s3SourceBucketAllowed(cfg Config, bucket string) bool {
+	return bucket != "" && (bucket == cfg.S3Bucket || slices.Contains(cfg.S3SourceBuckets, bucket))
+}
+
+// privateAddressError is the response to a URL the server may not fetch
+func privateAddressError(err error) *apiError {
+	return &apiError{
+		Status:  http.StatusBadRequest,
+		Code:    ErrCodeInvalidRequest,
+		Message: "The URL points to a private or local address; set FETCH_ALLOW_PRIVATE=true to allow it",
+		Details: err.Error(),
+	}
+}
@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Reranker APIs
+const (
+	RerankAPICohere = "cohere" // Cohere, Jina, Xinference, vLLM and other /rerank servers
+	RerankAPITEI    = "tei"    // Hugging Face text-embeddings-inference
+)
+
+// rerankTimeout bounds a rerank request
+const rerankTimeout = 30 * time.Second
+
+// Reranker scores passages by their relevance to a query, typically with a
+// cross-encoder that reads both together. Scores are aligned with texts and
+// higher means more relevant.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, texts []string) ([]float64, error)
+}
+
+// newReranker returns the reranker configured with RERANK_*, or nil when
+// reranking is off
+func newReranker(cfg Config) Reranker {
+	if !cfg.RerankEnabled {
+		return nil
+	}
+	return &httpReranker{
+		url:    cfg.RerankURL,
+		apiKey: cfg.RerankAPIKey,
+		model:  cfg.RerankModel,
+		api:    cfg.RerankAPI,
+		client: &http.Client{Timeout: rerankTimeout},
+	}
+}
+
+// httpReranker calls a rerank endpoint over HTTP
+type httpReranker struct {
+	url    string
+	apiKey string
+	model  string
+	api    string
+	client *http.Client
+}
+
+// rerankResult is one scored passage of a rerank response; Cohere-style APIs
+// call the score relevance_score, TEI calls it score
+type rerankResult struct {
+	Index          int      `json:"index"`
+	RelevanceScore *float64 `json:"relevance_score"`
+	Score          *float64 `json:"score"`
+}
+
+func (r *httpReranker) Rerank(ctx context.Context, query string, texts []string) ([]float64, error) {
+	var request map[string]interface{}
+	if r.api == RerankAPITEI {
+		request = map[string]interface{}{"query": query, "texts": texts}
+	} else {
+		request = map[string]interface{}{"query": query, "documents": texts, "top_n": len(texts)}
+		if r.model != "" {
+			request["model"] = r.model
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("reranker returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var results []rerankResult
+	if r.api == RerankAPITEI {
+		err = json.NewDecoder(resp.Body).Decode(&results)
+	} else {
+		var wrapped struct {
+			Results []rerankResult `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&wrapped)
+		results = wrapped.Results
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode rerank response: %w", err)
+	}
+
+	scores := make([]float64, len(texts))
+	seen := make([]bool, len(texts))
+	for _, result := range results {
+		if result.Index < 0 || result.Index >= len(texts) {
+			return nil, fmt.Errorf("rerank response has an out-of-range index %d", result.Index)
+		}
+		switch {
+		case result.RelevanceScore != nil:
+			scores[result.Index] = *result.RelevanceScore
+		case result.Score != nil:
+			scores[result.Index] = *result.Score
+		default:
+			return nil, fmt.Errorf("rerank response has no score for index %d", result.Index)
+		}
+		seen[result.Index] = true
+	}
+	for i := range seen {
+		if !seen[i] {
+			return nil, fmt.Errorf("rerank response has no score for index %d", i)
+		}
+	}
+	return scores, nil
+}
+
+// rerankDocs reorders docs by the reranker's scores, best first, and keeps
+// the first n. Each doc's score is recorded as rerank_score in its metadata;
+// Score keeps the retrieval score.
+func rerankDocs(ctx context.Context, reranker Reranker, query string, docs []schema.Document, n int) ([]schema.Document, error) {
+	texts := make([]string, len(docs))
+	for i, doc := range docs {
+		texts[i] = doc.PageContent
+	}
+	scores, err := reranker.Rerank(ctx, query, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(docs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+
+	reranked := make([]schema.Document, 0, min(n, len(docs)))
+	for _, i := range order[:min(n, len(order))] {
+		doc := docs[i]
+		metadata := make(map[string]any, len(doc.Metadata)+1)
+		for k, v := range doc.Metadata {
+			metadata[k] = v
+		}
+		metadata["rerank_score"] = scores[i]
+		doc.Metadata = metadata
+		reranked = append(reranked, doc)
+	}
+	return reranked, nil
+}
@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const retryMaxDelay = 30 * time.Second
+
+// retryBaseDelay is the wait before the first retry, doubled on each further
+// one. A variable so tests can shorten it.
+var retryBaseDelay = 1 * time.Second
+
+var statusCodePattern = regexp.MustCompile(`status code:?\s*(\d{3})`)
+
+// withRetry runs fn until it succeeds, returns a non-retryable error, or
+// maxRetries additional attempts have been made. Waits between attempts use
+// exponential backoff with jitter and never outlive the context deadline.
+func withRetry[T any](ctx context.Context, maxRetries int, fn func(ctx context.Context) (T, error)) (T, error) {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var zero T
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(attempt)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				golog.Warnf("not retrying llm call, context deadline is too close: %v", lastErr)
+				return zero, lastErr
+			}
+
+			golog.Infof("retrying llm call in %v (attempt %d/%d): %v", delay, attempt+1, maxRetries+1, lastErr)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return zero, lastErr
+			case <-timer.C:
+			}
+		}
+
+		result, err := fn(ctx)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+
+		if ctx.Err() != nil || !isRetryableError(err) {
+			return zero, err
+		}
+	}
+
+	return zero, lastErr
+}
+
+// backoffDelay returns the wait before the given retry attempt (1-based)
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	// Full jitter in the upper half of the window to avoid synchronized retries
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// isRetryableError reports whether an LLM error is transient (timeouts,
+// rate limits, server errors, network failures)
+func isRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if llms.IsAuthenticationError(err) || llms.IsInvalidRequestError(err) || llms.IsTokenLimitError(err) {
+		return false
+	}
+	if llms.IsRateLimitError(err) || llms.IsTimeoutError(err) || llms.IsProviderUnavailableError(err) {
+		return true
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	if m := statusCodePattern.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code == 429 || code >= 500
+	}
+
+	for _, marker := range []string{"timeout", "connection reset", "connection refused", "eof", "too many requests"} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,18 +2,31 @@ package backend
 
 import (
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
 )
 
 //go:embed frontend/index.html frontend/static
@@ -26,6 +39,14 @@ type Server struct {
 	store       *Store
 	agent       *Agent
 	http        *gin.Engine
+	storage     FileStorage
+	jobs        chan string
+
+	jobCancelsMu sync.Mutex
+	jobCancels   map[string]context.CancelFunc // Running jobs by ID
+
+	idempotencyLocks keyedLocks
+	appendLocks      keyedLocks // serializes appends to a source
 }
 
 // NewServer creates a new server
@@ -48,10 +69,18 @@ func NewServer(cfg Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to create agent: %w", err)
 	}
 
+	storage, err := NewFileStorage(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file storage: %w", err)
+	}
+
 	// Create Gin router
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	router.Use(gin.Recovery(), gin.Logger())
+	if cfg.MetricsEnabled {
+		router.Use(metricsMiddleware())
+	}
 
 	s := &Server{
 		cfg:         cfg,
@@ -59,25 +88,42 @@ func NewServer(cfg Config) (*Server, error) {
 		store:       store,
 		agent:       agent,
 		http:        router,
+		storage:     storage,
 	}
 
-	// Restore vector store from persistent storage
+	// Restore vector store from persistent storage. A persistent vector store
+	// already holds the chunks; POST /api/notebooks/:id/reindex rebuilds them.
+	// With SKIP_STARTUP_REINDEX each notebook is indexed on its first chat.
 	ctx := context.Background()
-	notebooks, _ := store.ListNotebooks(ctx)
-	golog.Infof("🔄 restoring vector index for %d notebooks...", len(notebooks))
-	for _, nb := range notebooks {
-		sources, _ := store.ListSources(ctx, nb.ID)
-		for _, src := range sources {
-			if src.Content != "" {
-				if err := vectorStore.IngestText(ctx, src.Name, src.Content); err != nil {
-					golog.Errorf("failed to restore source %s: %v", src.Name, err)
+	switch {
+	case vectorStore.Persistent():
+		stats, _ := vectorStore.GetStats(ctx)
+		golog.Infof("✅ using persistent vector index: %d documents", stats.TotalDocuments)
+	case cfg.SkipStartupReindex:
+		golog.Infof("⏭️ skipping startup reindex, notebooks are indexed on first use")
+	default:
+		notebooks, _ := store.ListNotebooks(ctx, "", ListOptions{})
+		golog.Infof("🔄 restoring vector index for %d notebooks...", len(notebooks))
+		for _, nb := range notebooks {
+			sources, _ := store.ListSources(ctx, nb.ID)
+			opts := NotebookIngestOptions(&nb)
+			for _, src := range sources {
+				if src.Content != "" && sourceIndexed(&src) {
+					if err := vectorStore.IngestTextWithOptions(ctx, src.Name, src.Content, opts.WithSource(src.ID)); err != nil {
+						golog.Errorf("failed to restore source %s: %v", src.Name, err)
+					}
 				}
 			}
 		}
+		stats, _ := vectorStore.GetStats(ctx)
+		golog.Infof("✅ vector index restored: %d documents", stats.TotalDocuments)
+	}
+
+	if cfg.IsOllama() && cfg.OllamaPreload {
+		go agent.PreloadModel(ctx)
 	}
-	stats, _ := vectorStore.GetStats(ctx)
-	golog.Infof("✅ vector index restored: %d documents", stats.TotalDocuments)
 
+	s.startJobWorkers(ctx)
 	s.setupRoutes()
 
 	return s, nil
@@ -89,8 +135,17 @@ func (s *Server) setupRoutes() {
 	staticFS, _ := fs.Sub(frontendFS, "frontend/static")
 	s.http.StaticFS("/static", http.FS(staticFS))
 
-	// Serve uploaded files
-	s.http.Static("/uploads", "./data/uploads")
+	// Serve uploaded files, from the uploads directory or the storage backend
+	if s.cfg.StorageBackend == StorageBackendS3 {
+		s.http.GET("/uploads/*name", s.handleServeUpload)
+	} else {
+		s.http.Static("/uploads", s.cfg.UploadsDir)
+	}
+
+	// Prometheus metrics, outside /api so scrapers skip CORS and timeouts
+	if s.cfg.MetricsEnabled {
+		s.http.GET("/metrics", s.metricsHandler())
+	}
 
 	// Serve index.html at root - need to serve from root of frontendFS
 	s.http.GET("/", func(c *gin.Context) {
@@ -101,7 +156,11 @@ func (s *Server) setupRoutes() {
 
 	// API routes
 	api := s.http.Group("/api")
+	api.Use(corsMiddleware(s.cfg), timeoutMiddleware(s.cfg.RequestTimeout, s.routeTimeouts()))
 	{
+		// CORS preflight for every API route
+		api.OPTIONS("/*path", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
 		// Health check
 		api.GET("/health", s.handleHealth)
 
@@ -113,67 +172,187 @@ func (s *Server) setupRoutes() {
 			notebooks.GET("/:id", s.handleGetNotebook)
 			notebooks.PUT("/:id", s.handleUpdateNotebook)
 			notebooks.DELETE("/:id", s.handleDeleteNotebook)
+			notebooks.POST("/:id/reindex", s.handleReindexNotebook)
 
 			// Sources within a notebook
 			notebooks.GET("/:id/sources", s.handleListSources)
 			notebooks.POST("/:id/sources", s.handleAddSource)
+			notebooks.GET("/:id/sources/:sourceId", s.handleGetSource)
 			notebooks.DELETE("/:id/sources/:sourceId", s.handleDeleteSource)
+			notebooks.POST("/:id/sources/batch", s.handleBatchAddSources)
+			notebooks.POST("/:id/sources/delete", s.handleDeleteSources)
+			notebooks.GET("/:id/sources/:sourceId/chunks", s.handleListSourceChunks)
+			notebooks.POST("/:id/sources/:sourceId/append", s.handleAppendSource)
 
 			// Notes within a notebook
 			notebooks.GET("/:id/notes", s.handleListNotes)
 			notebooks.POST("/:id/notes", s.handleCreateNote)
+			notebooks.GET("/:id/notes/:noteId", s.handleGetNote)
+			notebooks.PUT("/:id/notes/:noteId", s.handleUpdateNote)
 			notebooks.DELETE("/:id/notes/:noteId", s.handleDeleteNote)
+			notebooks.POST("/:id/notes/:noteId/regenerate", s.handleRegenerateNote)
+			notebooks.GET("/:id/notes/:noteId/versions", s.handleListNoteVersions)
+			notebooks.POST("/:id/notes/:noteId/versions/:versionId/restore", s.handleRestoreNoteVersion)
+			notebooks.GET("/:id/notes/:noteId/trace", s.handleGetNoteTrace)
+			notebooks.GET("/:id/notes/:noteId/export", s.handleExportNote)
+			notebooks.POST("/:id/notes/:noteId/links", s.handleAddNoteLinks)
+			notebooks.DELETE("/:id/notes/:noteId/links/:linkedId", s.handleRemoveNoteLink)
+
+			// Generated assets (infographic and slide images)
+			notebooks.GET("/:id/assets", s.handleListAssets)
 
 			// Transformations
 			notebooks.POST("/:id/transform", s.handleTransform)
+			notebooks.POST("/:id/transform/batch", s.handleBatchTransform)
 
 			// Chat within a notebook
 			notebooks.GET("/:id/chat/sessions", s.handleListChatSessions)
 			notebooks.POST("/:id/chat/sessions", s.handleCreateChatSession)
+			notebooks.POST("/:id/chat/sessions/merge", s.handleMergeChatSessions)
+			notebooks.PUT("/:id/chat/sessions/:sessionId", s.handleRenameChatSession)
 			notebooks.DELETE("/:id/chat/sessions/:sessionId", s.handleDeleteChatSession)
 			notebooks.POST("/:id/chat/sessions/:sessionId/messages", s.handleSendMessage)
+			notebooks.DELETE("/:id/chat/sessions/:sessionId/messages/:messageId", s.handleDeleteChatMessage)
+			notebooks.POST("/:id/chat/sessions/:sessionId/regenerate", s.handleRegenerateMessage)
+			notebooks.GET("/:id/chat/messages", s.handleListRecentChatMessages)
 
 			// Quick chat (auto-create session)
 			notebooks.POST("/:id/chat", s.handleChat)
 		}
 
+		// Prompt templates
+		prompts := api.Group("/prompts")
+		{
+			prompts.GET("/export", s.handleExportPrompts)
+			prompts.POST("/import", s.handleImportPrompts)
+			prompts.POST("/reset", s.handleResetAllPrompts)
+			prompts.POST("/:type/reset", s.handleResetPrompt)
+		}
+
+		// Notebook tags
+		api.GET("/tags", s.handleListTags)
+
+		// Background jobs
+		api.GET("/jobs/:id", s.handleGetJob)
+		api.DELETE("/jobs/:id", s.handleCancelJob)
+
+		// Text similarity (for debugging retrieval)
+		api.POST("/similarity", s.handleSimilarity)
+
 		// Upload endpoint
 		api.POST("/upload", s.handleUpload)
+
+		// Resumable uploads in parts
+		api.POST("/upload/init", s.handleInitUpload)
+		api.GET("/upload/:uploadId", s.handleGetUpload)
+		api.PUT("/upload/:uploadId/part/:part", s.handleUploadPart)
+		api.POST("/upload/:uploadId/complete", s.handleCompleteUpload)
+		api.DELETE("/upload/:uploadId", s.handleAbortUpload)
+	}
+}
+
+// routeTimeouts returns the request timeouts of routes that need a different
+// timeout than REQUEST_TIMEOUT, keyed by method and route path
+func (s *Server) routeTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		"GET /api/health":                                             s.cfg.HealthTimeout,
+		"POST /api/upload":                                            s.cfg.UploadTimeout,
+		"PUT /api/upload/:uploadId/part/:part":                        s.cfg.UploadTimeout,
+		"POST /api/upload/:uploadId/complete":                         s.cfg.UploadTimeout,
+		"POST /api/notebooks/:id/sources":                             s.cfg.UploadTimeout,
+		"POST /api/notebooks/:id/sources/batch":                       s.cfg.UploadTimeout,
+		"POST /api/notebooks/:id/reindex":                             s.cfg.UploadTimeout,
+		"POST /api/notebooks/:id/chat":                                s.cfg.ChatTimeout,
+		"POST /api/notebooks/:id/chat/sessions/:sessionId/messages":   s.cfg.ChatTimeout,
+		"POST /api/notebooks/:id/chat/sessions/:sessionId/regenerate": s.cfg.ChatTimeout,
+		"POST /api/notebooks/:id/transform":                           s.cfg.TransformTimeout,
+		"POST /api/notebooks/:id/transform/batch":                     s.cfg.TransformTimeout,
+		"POST /api/notebooks/:id/notes/:noteId/regenerate":            s.cfg.TransformTimeout,
 	}
 }
 
 // Start starts the server
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%s", s.cfg.ServerHost, s.cfg.ServerPort)
+	addr := net.JoinHostPort(s.cfg.ServerHost, s.cfg.ServerPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return listenError(s.cfg.ServerPort, err)
+	}
 	golog.Infof("server starting on %s", addr)
-	return s.http.Run(addr)
-}
-
-// Health check handler
-func (s *Server) handleHealth(c *gin.Context) {
-	c.JSON(http.StatusOK, HealthResponse{
-		Status:    "ok",
-		Version:   "1.0.0",
-		Timestamp: time.Now().Unix(),
-		Services: map[string]string{
-			"vector_store": s.cfg.VectorStoreType,
-			"llm":          s.cfg.OpenAIModel,
-		},
-	})
+	return s.http.RunListener(ln)
+}
+
+// handleSimilarity compares two texts, or a text and a source, using the
+// configured embedder or the keyword overlap metric as a fallback
+func (s *Server) handleSimilarity(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req SimilarityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	textB := req.TextB
+	if req.SourceID != "" {
+		if textB != "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Provide either text_b or source_id, not both", Code: ErrCodeInvalidRequest})
+			return
+		}
+		source, err := s.store.GetSource(ctx, req.SourceID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source not found", Code: ErrCodeSourceNotFound})
+			return
+		}
+		textB = source.Content
+	}
+	if textB == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "text_b or source_id is required", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	score, method, err := s.vectorStore.Similarity(ctx, req.TextA, textB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to compute similarity", Code: ErrCodeInternal, Details: err.Error()})
+		return
+	}
+
+	resp := SimilarityResponse{Similarity: score, Method: method}
+	if method == SimilarityMethodEmbedding {
+		resp.Model = s.cfg.EmbeddingModel
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // Notebook handlers
 
 func (s *Server) handleListNotebooks(c *gin.Context) {
 	ctx := context.Background()
-	notebooks, err := s.store.ListNotebooks(ctx)
+
+	opts, err := parseListOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	notebooks, err := s.store.ListNotebooks(ctx, strings.TrimSpace(c.Query("tag")), opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notebooks"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notebooks", Code: ErrCodeInternal})
 		return
 	}
 	c.JSON(http.StatusOK, notebooks)
 }
 
+func (s *Server) handleListTags(c *gin.Context) {
+	ctx := context.Background()
+	tags, err := s.store.ListTags(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list tags", Code: ErrCodeInternal})
+		return
+	}
+	c.JSON(http.StatusOK, tags)
+}
+
 func (s *Server) handleCreateNotebook(c *gin.Context) {
 	ctx := context.Background()
 
@@ -181,19 +360,50 @@ func (s *Server) handleCreateNotebook(c *gin.Context) {
 		Name        string                 `json:"name" binding:"required"`
 		Description string                 `json:"description"`
 		Metadata    map[string]interface{} `json:"metadata"`
+		Force       bool                   `json:"force"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	if err := validateNotebookMetadata(s.cfg, req.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	idem, replayed := s.beginIdempotent(c, req)
+	if replayed {
 		return
 	}
+	defer idem.release()
+
+	if s.cfg.NotebookDuplicatePolicy != DuplicatePolicyAllow && !req.Force {
+		existing, err := s.store.FindNotebookByName(ctx, req.Name)
+		if err != nil {
+			golog.Errorf("failed to check for duplicate notebook: %v", err)
+		} else if existing != nil {
+			if s.cfg.NotebookDuplicatePolicy == DuplicatePolicyReject {
+				c.JSON(http.StatusConflict, ErrorResponse{
+					Error:   fmt.Sprintf("A notebook named %q already exists (set force to create it anyway)", existing.Name),
+					Code:    ErrCodeDuplicateNotebook,
+					Details: existing.ID,
+				})
+				return
+			}
+			golog.Warnf("creating notebook %q although notebook %s has the same name", req.Name, existing.ID)
+			c.Header("Warning", fmt.Sprintf(`299 - "duplicate notebook name, existing notebook: %s"`, existing.ID))
+		}
+	}
 
 	notebook, err := s.store.CreateNotebook(ctx, req.Name, req.Description, req.Metadata)
 	if err != nil {
 		golog.Errorf("error creating notebook: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to create notebook: %v", err)})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to create notebook: %v", err), Code: ErrCodeInternal})
 		return
 	}
+	idem.record(ctx, idempotentNotebook, notebook.ID, http.StatusCreated)
 
 	c.JSON(http.StatusCreated, notebook)
 }
@@ -204,7 +414,7 @@ func (s *Server) handleGetNotebook(c *gin.Context) {
 
 	notebook, err := s.store.GetNotebook(ctx, id)
 	if err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
 		return
 	}
 
@@ -222,260 +432,1592 @@ func (s *Server) handleUpdateNotebook(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	if err := validateNotebookMetadata(s.cfg, req.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	previous, err := s.store.GetNotebook(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
 		return
 	}
 
 	notebook, err := s.store.UpdateNotebook(ctx, id, req.Name, req.Description, req.Metadata)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update notebook"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update notebook", Code: ErrCodeInternal})
 		return
 	}
 
+	// Existing vectors cannot be compared with a new model and chunk
+	// settings only apply at ingest time, so rebuild the index on change
+	if NotebookIngestOptions(previous) != NotebookIngestOptions(notebook) {
+		go func() {
+			if _, err := s.reindexNotebook(context.Background(), notebook); err != nil {
+				golog.Errorf("failed to reindex notebook %s: %v", notebook.ID, err)
+			}
+		}()
+	}
+
 	c.JSON(http.StatusOK, notebook)
 }
 
-func (s *Server) handleDeleteNotebook(c *gin.Context) {
-	ctx := context.Background()
-	id := c.Param("id")
-
-	if err := s.store.DeleteNotebook(ctx, id); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete notebook"})
-		return
+// NotebookIngestOptions returns the vector store options for indexing a
+// notebook's sources
+func NotebookIngestOptions(nb *Notebook) IngestOptions {
+	opts := IngestOptions{
+		NotebookID:     nb.ID,
+		EmbeddingModel: notebookEmbeddingModel(nb.Metadata),
 	}
-
-	c.Status(http.StatusNoContent)
+	if size, ok := metadataInt(nb.Metadata["chunk_size"]); ok {
+		opts.ChunkSize = size
+	}
+	if overlap, mode, ok := metadataOverlap(nb.Metadata["chunk_overlap"]); ok {
+		opts.ChunkOverlap, opts.ChunkOverlapMode = overlap, mode
+	}
+	return opts
 }
 
-// Source handlers
-
-func (s *Server) handleListSources(c *gin.Context) {
-	ctx := context.Background()
-	notebookID := c.Param("id")
-
-	sources, err := s.store.ListSources(ctx, notebookID)
+// ingestOptions looks up the vector store options for a notebook
+func (s *Server) ingestOptions(ctx context.Context, notebookID string) IngestOptions {
+	nb, err := s.store.GetNotebook(ctx, notebookID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
-		return
+		return IngestOptions{NotebookID: notebookID}
 	}
-
-	c.JSON(http.StatusOK, sources)
+	return NotebookIngestOptions(nb)
 }
 
-func (s *Server) handleAddSource(c *gin.Context) {
-	ctx := context.Background()
-	notebookID := c.Param("id")
+// notebookEmbeddingModel returns the embedding model a notebook selects in
+// its metadata, or an empty string for the default
+func notebookEmbeddingModel(metadata map[string]interface{}) string {
+	model, _ := metadata["embedding_model"].(string)
+	return strings.TrimSpace(model)
+}
 
-	var req struct {
-		Name     string                 `json:"name" binding:"required"`
-		Type     string                 `json:"type" binding:"required"`
-		URL      string                 `json:"url"`
-		Content  string                 `json:"content"`
-		Metadata map[string]interface{} `json:"metadata"`
+// metadataInt reads a whole number from a JSON metadata value
+func metadataInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), true
+		}
+	case int:
+		return v, true
+	case string:
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return n, true
+		}
 	}
+	return 0, false
+}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
-		return
+// metadataOverlap reads a chunk overlap, either absolute (200) or a
+// percentage of the chunk size ("20%"), from a JSON metadata value
+func metadataOverlap(value interface{}) (int, string, bool) {
+	if v, ok := value.(string); ok && strings.HasSuffix(strings.TrimSpace(v), "%") {
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "%")))
+		if err != nil {
+			return 0, "", false
+		}
+		return n, OverlapModePercent, true
 	}
-
-	source := &Source{
-		NotebookID: notebookID,
-		Name:       req.Name,
-		Type:       req.Type,
-		URL:        req.URL,
-		Content:    req.Content,
-		Metadata:   req.Metadata,
+	if n, ok := metadataInt(value); ok {
+		return n, OverlapModeAbsolute, true
 	}
+	return 0, "", false
+}
 
-	if err := s.store.CreateSource(ctx, source); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
-		return
+// validateNotebookMetadata checks the notebook settings stored in metadata
+// and normalizes its tags
+func validateNotebookMetadata(cfg Config, metadata map[string]interface{}) error {
+	if value, ok := metadata["tags"]; ok && value != nil {
+		tags, ok := normalizeTags(value)
+		if !ok {
+			return fmt.Errorf("metadata.tags must be a list of strings")
+		}
+		metadata["tags"] = tags
 	}
 
-	// Ingest into vector store (synchronous for immediate availability)
-	if source.Content != "" {
-		if err := s.vectorStore.IngestText(ctx, source.Name, source.Content); err != nil {
-			golog.Errorf("failed to ingest text: %v", err)
+	if value, ok := metadata["default_length"]; ok && value != nil {
+		if length, ok := value.(string); !ok || !transformLengths[length] {
+			return fmt.Errorf("metadata.default_length must be short, medium or long")
+		}
+	}
+	if value, ok := metadata["default_format"]; ok && value != nil {
+		if format, ok := value.(string); !ok || !transformFormats[format] {
+			return fmt.Errorf("metadata.default_format must be markdown, bullet_points or paragraphs")
 		}
 	}
 
-	c.JSON(http.StatusCreated, source)
-}
+	if value, ok := metadata["embedding_model"]; ok && value != nil {
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("metadata.embedding_model must be a string")
+		}
+	}
+	if value, ok := metadata[sourceIndexKey]; ok && value != nil {
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("metadata.index must be true or false")
+		}
+	}
 
-func (s *Server) handleDeleteSource(c *gin.Context) {
-	ctx := context.Background()
-	sourceID := c.Param("sourceId")
+	chunkSize := cfg.ChunkSize
+	if value, ok := metadata["chunk_size"]; ok && value != nil {
+		size, ok := metadataInt(value)
+		if !ok || size <= 0 {
+			return fmt.Errorf("metadata.chunk_size must be a positive integer")
+		}
+		chunkSize = size
+	}
 
-	if err := s.store.DeleteSource(ctx, sourceID); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete source"})
-		return
+	if value, ok := metadata["chunk_overlap"]; ok && value != nil {
+		overlap, mode, ok := metadataOverlap(value)
+		if !ok || overlap < 0 {
+			return fmt.Errorf("metadata.chunk_overlap must be a non-negative integer or a percentage such as \"20%%\"")
+		}
+		if mode == OverlapModePercent && overlap >= 100 {
+			return fmt.Errorf("metadata.chunk_overlap percentage must be between 0%% and 99%%")
+		}
+		if mode == OverlapModeAbsolute && overlap >= chunkSize {
+			return fmt.Errorf("metadata.chunk_overlap (%d) must be smaller than chunk_size (%d)", overlap, chunkSize)
+		}
 	}
 
-	c.Status(http.StatusNoContent)
+	return nil
 }
 
-func (s *Server) handleUpload(c *gin.Context) {
-	ctx := context.Background()
-	notebookID := c.PostForm("notebook_id")
-	if notebookID == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "notebook_id required"})
-		return
+// normalizeTags trims tags and drops empty and duplicate ones, comparing
+// case-insensitively and keeping the first spelling
+func normalizeTags(value interface{}) ([]string, bool) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	tags := make([]string, 0, len(list))
+	seen := make(map[string]bool)
+	for _, item := range list {
+		tag, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
 	}
+	return tags, true
+}
 
-	file, err := c.FormFile("file")
+// reindexNotebook re-ingests a notebook's sources with its current settings,
+// e.g. after its embedding model or chunking changed
+func (s *Server) reindexNotebook(ctx context.Context, nb *Notebook) (*ReindexResponse, error) {
+	sources, err := s.store.ListSources(ctx, nb.ID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file required"})
-		return
+		return nil, fmt.Errorf("failed to list sources: %w", err)
 	}
 
-	// Generate unique filename to avoid conflicts
-	ext := filepath.Ext(file.Filename)
-	baseName := file.Filename[:len(file.Filename)-len(ext)]
-	uniqueFileName := fmt.Sprintf("%s_%s%s", baseName, uuid.New().String()[:8], ext)
-	tempPath := fmt.Sprintf("./data/uploads/%s", uniqueFileName)
+	opts := NotebookIngestOptions(nb)
+	s.vectorStore.SetNotebookEmbeddingModel(nb.ID, opts.EmbeddingModel)
+	golog.Infof("reindexing %d sources of notebook %s", len(sources), nb.ID)
 
-	// Ensure uploads directory exists
-	if err := os.MkdirAll("./data/uploads", 0755); err != nil {
-		golog.Errorf("failed to create uploads directory: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create uploads directory"})
-		return
-	}
+	resp := &ReindexResponse{NotebookID: nb.ID}
+	for _, src := range sources {
+		if src.Content == "" || !sourceIndexed(&src) {
+			continue
+		}
+		if err := s.vectorStore.IngestTextWithOptions(ctx, src.Name, src.Content, opts.WithSource(src.ID)); err != nil {
+			golog.Errorf("failed to reindex source %s: %v", src.Name, err)
+			continue
+		}
 
-	// Save file
-	if err := c.SaveUploadedFile(file, tempPath); err != nil {
-		golog.Errorf("failed to save file: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to save file: %v", err)})
-		return
+		chunks, _ := s.vectorStore.ListChunks(ctx, nb.ID, src.ID)
+		s.store.UpdateSourceChunkCount(ctx, src.ID, len(chunks))
+		resp.Sources++
+		resp.Chunks += len(chunks)
 	}
+	s.vectorStore.markIndexed(ctx, nb.ID)
 
-	// Create source
-	source := &Source{
-		NotebookID: notebookID,
-		Name:       file.Filename, // Keep original filename for display
-		Type:       "file",
-		FileName:   uniqueFileName, // Store unique filename
-		FileSize:   file.Size,
-		Metadata:   map[string]interface{}{"path": tempPath},
-	}
+	return resp, nil
+}
 
-	// Extract content
-	content, err := s.vectorStore.ExtractDocument(ctx, tempPath)
+// ensureNotebookIndexed indexes a notebook's sources before a retrieval if
+// they were not indexed on startup. Failures are logged; search then sees
+// whatever was indexed.
+func (s *Server) ensureNotebookIndexed(ctx context.Context, notebookID string) {
+	if s.vectorStore.touchIndexed(notebookID) {
+		return
+	}
+	nb, err := s.store.GetNotebook(ctx, notebookID)
 	if err != nil {
-		golog.Errorf("failed to extract document content: %v", err)
-		source.Content = fmt.Sprintf("Failed to extract: %v", err)
-	} else {
-		source.Content = content
+		golog.Errorf("failed to index notebook %s on first use: %v", notebookID, err)
+		return
 	}
-
-	if err := s.store.CreateSource(ctx, source); err != nil {
-		golog.Errorf("failed to create source: %v", err)
-		// Clean up uploaded file on error
-		os.Remove(tempPath)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to index notebook %s on first use: %v", notebookID, err)
 		return
 	}
-
-	// Ingest into vector store (synchronous for immediate availability)
-	// Get chunk count from vector store stats
-	stats, _ := s.vectorStore.GetStats(ctx)
-	totalDocsBefore := stats.TotalDocuments
-
-	if source.Content != "" && !strings.HasPrefix(source.Content, "Failed to extract") {
-		if err := s.vectorStore.IngestText(ctx, source.Name, source.Content); err != nil {
-			golog.Errorf("failed to ingest document: %v", err)
-		} else {
-			// Get updated stats to calculate chunk count
-			stats, _ = s.vectorStore.GetStats(ctx)
-			chunkCount := stats.TotalDocuments - totalDocsBefore
-
-			// Update source with chunk count
-			source.ChunkCount = chunkCount
-
-			// Update in database
-			s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
-		}
+	if err := s.vectorStore.EnsureIndexed(ctx, nb, sources); err != nil {
+		golog.Errorf("failed to index notebook %s on first use: %v", notebookID, err)
 	}
-
-	c.JSON(http.StatusCreated, source)
 }
 
-// Note handlers
+func (s *Server) handleReindexNotebook(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
 
-func (s *Server) handleListNotes(c *gin.Context) {
-	ctx := context.Background()
-	notebookID := c.Param("id")
+	notebook, err := s.store.GetNotebook(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
+		return
+	}
 
-	notes, err := s.store.ListNotes(ctx, notebookID)
+	resp, err := s.reindexNotebook(ctx, notebook)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notes"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to reindex notebook", Code: ErrCodeInternal, Details: err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, notes)
+	c.JSON(http.StatusOK, resp)
 }
 
-func (s *Server) handleCreateNote(c *gin.Context) {
+func (s *Server) handleDeleteNotebook(c *gin.Context) {
 	ctx := context.Background()
-	notebookID := c.Param("id")
+	id := c.Param("id")
 
-	var req struct {
-		Title     string   `json:"title" binding:"required"`
-		Content   string   `json:"content" binding:"required"`
-		Type      string   `json:"type" binding:"required"`
-		SourceIDs []string `json:"source_ids"`
+	assets, err := s.store.ListAssets(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete notebook", Code: ErrCodeInternal})
+		return
+	}
+	sources, err := s.store.ListSourceHeaders(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete notebook", Code: ErrCodeInternal})
+		return
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	if err := s.store.DeleteNotebook(ctx, id); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete notebook", Code: ErrCodeInternal})
 		return
 	}
 
-	note := &Note{
-		NotebookID: notebookID,
-		Title:      req.Title,
-		Content:    req.Content,
-		Type:       req.Type,
-		SourceIDs:  req.SourceIDs,
+	// Sources go with the notebook in the store, their chunks are removed
+	// from the index here
+	sourceIDs := make([]string, len(sources))
+	for i, src := range sources {
+		sourceIDs[i] = src.ID
+	}
+	if _, err := s.vectorStore.DeleteNotebook(ctx, id, sourceIDs); err != nil {
+		golog.Errorf("failed to remove chunks of notebook %s: %v", id, err)
 	}
 
-	if err := s.store.CreateNote(ctx, note); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create note"})
+	s.removeAssetFiles(ctx, assets)
+
+	c.Status(http.StatusNoContent)
+}
+
+// Source handlers
+
+// sourceSnippetLength is the number of characters of content listed per
+// source unless the full content is requested
+const sourceSnippetLength = 200
+
+// handleListSources lists the sources of a notebook with a snippet of their
+// content, or with the full content when ?full=true
+func (s *Server) handleListSources(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	var sources []Source
+	var err error
+	if full, _ := strconv.ParseBool(c.Query("full")); full {
+		sources, err = s.store.ListSources(ctx, notebookID)
+	} else {
+		sources, err = s.store.ListSourceSnippets(ctx, notebookID, sourceSnippetLength)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources", Code: ErrCodeInternal})
 		return
 	}
 
-	c.JSON(http.StatusCreated, note)
+	c.JSON(http.StatusOK, sources)
 }
 
-func (s *Server) handleDeleteNote(c *gin.Context) {
-	ctx := context.Background()
-	noteID := c.Param("noteId")
+// handleGetSource returns a source with its full content
+func (s *Server) handleGetSource(c *gin.Context) {
+	ctx := c.Request.Context()
 
-	if err := s.store.DeleteNote(ctx, noteID); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete note"})
+	source, err := s.store.GetSource(ctx, c.Param("sourceId"))
+	if err != nil || source.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source not found", Code: ErrCodeSourceNotFound})
 		return
 	}
 
-	c.Status(http.StatusNoContent)
+	c.JSON(http.StatusOK, source)
 }
 
-// Transformation handlers
-
-func (s *Server) handleTransform(c *gin.Context) {
-	ctx := context.Background()
+func (s *Server) handleAddSource(c *gin.Context) {
+	ctx := c.Request.Context()
 	notebookID := c.Param("id")
 
-	var req TransformationRequest
+	var req AddSourceRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
 		return
 	}
 
-	// Get sources
-	sources, err := s.store.ListSources(ctx, notebookID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get sources"})
-		return
+	// Sitemaps create many sources and are not covered by Idempotency-Key
+	var idem *idempotentRequest
+	if req.Type != "sitemap" {
+		var replayed bool
+		if idem, replayed = s.beginIdempotent(c, req); replayed {
+			return
+		}
+		defer idem.release()
+	}
+
+	if req.Type == "sitemap" {
+		if req.URL == "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "url is required for sitemap sources", Code: ErrCodeInvalidRequest})
+			return
+		}
+		include, err := compilePatterns(req.Include)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+			return
+		}
+		exclude, err := compilePatterns(req.Exclude)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+			return
+		}
+
+		resp, err := s.ingestSitemap(ctx, notebookID, req.URL, include, exclude, req.MaxPages, req.Force, req.Index)
+		if errors.Is(err, ErrPrivateAddress) {
+			c.JSON(http.StatusBadRequest, privateAddressError(err).response())
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to read sitemap", Code: ErrCodeFetchFailed, Details: err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, resp)
+		return
+	}
+
+	source, err := s.addSource(ctx, notebookID, &req)
+	if err != nil {
+		apiErr := asAPIError(err)
+		c.JSON(apiErr.Status, apiErr.response())
+		return
+	}
+	idem.record(ctx, idempotentSource, source.ID, http.StatusCreated)
+
+	c.JSON(http.StatusCreated, source)
+}
+
+// maxBatchSources bounds the sources of one batch request
+const maxBatchSources = 100
+
+// handleBatchAddSources creates several text, URL or remote file sources in
+// one request.
+// Items are added in order and independently: one failing, e.g. as a
+// duplicate, leaves the others created.
+func (s *Server) handleBatchAddSources(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	var req BatchAddSourcesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if len(req.Sources) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "sources must not be empty", Code: ErrCodeInvalidRequest})
+		return
+	}
+	if len(req.Sources) > maxBatchSources {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("at most %d sources can be added at once", maxBatchSources), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
+		return
+	}
+
+	results := make([]BatchAddSourceResult, len(req.Sources))
+	for i := range req.Sources {
+		item := &req.Sources[i]
+		result := BatchAddSourceResult{Index: i}
+		var err error
+		if item.Type == "sitemap" {
+			err = &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "sitemap sources cannot be added in a batch"}
+		} else {
+			result.Source, err = s.addSource(ctx, notebookID, item)
+		}
+		if err != nil {
+			apiErr := asAPIError(err)
+			golog.Warnf("batch source %d (%s) not added: %s", i, item.Type, apiErr.Message)
+			result.Error = apiErr.Message
+			result.ErrorCode = apiErr.Code
+			result.Details = apiErr.Details
+		}
+		results[i] = result
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// addSource creates a text or URL source, or a file source from a remote
+// file, and ingests its content. Errors are *apiError.
+func (s *Server) addSource(ctx context.Context, notebookID string, req *AddSourceRequest) (*Source, error) {
+	if req.Type == "" {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "type is required"}
+	}
+	if req.Type == "file" {
+		return s.addRemoteFile(ctx, notebookID, req)
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Type == "text" {
+		if strings.TrimSpace(req.Content) == "" {
+			return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "content is required for text sources"}
+		}
+		if req.Metadata == nil {
+			req.Metadata = make(map[string]interface{})
+		}
+
+		// Pasted HTML is reduced to its text, Markdown and plain text are kept
+		format := detectPastedFormat(req.Content)
+		req.Metadata["format"] = format
+		htmlTitle := ""
+		if format == PastedFormatHTML {
+			htmlTitle, req.Content = htmlToText(req.Content)
+		}
+		if req.Name == "" {
+			req.Name = s.pastedSourceTitle(ctx, req.Content, htmlTitle)
+			req.Metadata["auto_title"] = true
+		}
+	}
+	if req.Name == "" {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "name is required"}
+	}
+
+	source := &Source{
+		NotebookID: notebookID,
+		Name:       req.Name,
+		Type:       req.Type,
+		URL:        req.URL,
+		Content:    req.Content,
+		Metadata:   req.Metadata,
+	}
+	markOversizedSource(source, s.cfg.MaxSourceBytes)
+	setSourceLanguage(source)
+
+	if source.Content != "" {
+		existing, err := findDuplicateSource(ctx, s.store, source)
+		if err != nil {
+			golog.Errorf("failed to check for duplicate source: %v", err)
+		} else if existing != nil && !req.Force {
+			return nil, duplicateSourceAPIError(existing)
+		}
+	}
+
+	nb, _ := s.store.GetNotebook(ctx, notebookID)
+	setSourceIndex(source, req.Index, nb)
+	if err := s.store.CreateSource(ctx, source); err != nil {
+		return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to create source"}
+	}
+
+	// Ingest into vector store (synchronous for immediate availability)
+	if source.Content != "" && sourceIndexed(source) {
+		if err := s.vectorStore.IngestTextWithOptions(ctx, source.Name, source.Content, s.ingestOptions(ctx, source.NotebookID).WithSource(source.ID)); err != nil {
+			golog.Errorf("failed to ingest text: %v", err)
+		}
+	}
+
+	return source, nil
+}
+
+// ingestSitemap fetches the pages listed in a sitemap and creates a source
+// for each, skipping pages that fail or duplicate an existing source. index
+// sets whether the pages are indexed, nil follows the notebook's default.
+func (s *Server) ingestSitemap(ctx context.Context, notebookID, sitemapURL string, include, exclude []*regexp.Regexp, maxPages int, force bool, index *bool) (*SitemapIngestResponse, error) {
+	client := newWebClient(s.cfg.FetchAllowPrivate)
+
+	urls, err := parseSitemap(ctx, client, sitemapURL, 2)
+	if err != nil {
+		return nil, err
+	}
+	urls = filterURLs(urls, include, exclude)
+
+	if maxPages <= 0 || maxPages > s.cfg.SitemapMaxPages {
+		maxPages = s.cfg.SitemapMaxPages
+	}
+	resp := &SitemapIngestResponse{Sitemap: sitemapURL, Found: len(urls), Sources: make([]Source, 0)}
+	if len(urls) > maxPages {
+		golog.Warnf("sitemap %s lists %d matching pages, only the first %d are ingested", sitemapURL, len(urls), maxPages)
+		urls = urls[:maxPages]
+	}
+
+	golog.Infof("ingesting %d pages from sitemap %s", len(urls), sitemapURL)
+	pages, errs := fetchPages(ctx, client, urls, s.cfg.SitemapWorkers)
+	opts := s.ingestOptions(ctx, notebookID)
+	nb, _ := s.store.GetNotebook(ctx, notebookID)
+
+	for i, page := range pages {
+		if errs[i] != nil {
+			resp.Skipped = append(resp.Skipped, SkippedPage{URL: urls[i], Reason: errs[i].Error()})
+			continue
+		}
+
+		name := page.Title
+		if name == "" {
+			name = page.URL
+		}
+		source := &Source{
+			NotebookID: notebookID,
+			Name:       name,
+			Type:       "url",
+			URL:        page.URL,
+			Content:    page.Content,
+			Metadata:   map[string]interface{}{"sitemap": sitemapURL},
+		}
+		markOversizedSource(source, s.cfg.MaxSourceBytes)
+		setSourceLanguage(source)
+
+		existing, err := findDuplicateSource(ctx, s.store, source)
+		if err != nil {
+			golog.Errorf("failed to check for duplicate source: %v", err)
+		} else if existing != nil && !force {
+			resp.Skipped = append(resp.Skipped, SkippedPage{URL: page.URL, Reason: "duplicate of source " + existing.ID})
+			continue
+		}
+
+		setSourceIndex(source, index, nb)
+		if err := s.store.CreateSource(ctx, source); err != nil {
+			resp.Skipped = append(resp.Skipped, SkippedPage{URL: page.URL, Reason: "failed to create source"})
+			continue
+		}
+
+		if sourceIndexed(source) {
+			if err := s.vectorStore.IngestTextWithOptions(ctx, source.Name, source.Content, opts.WithSource(source.ID)); err != nil {
+				golog.Errorf("failed to ingest page %s: %v", page.URL, err)
+			} else if chunks, err := s.vectorStore.ListChunks(ctx, notebookID, source.ID); err == nil {
+				source.ChunkCount = len(chunks)
+				s.store.UpdateSourceChunkCount(ctx, source.ID, source.ChunkCount)
+			}
+		}
+
+		// Keep the response small, pages can be large
+		source.ContentLength = len([]rune(source.Content))
+		source.Content = ""
+		resp.Sources = append(resp.Sources, *source)
+	}
+
+	return resp, nil
+}
+
+// markOversizedSource flags sources whose content exceeds MaxSourceBytes.
+// The full text is still stored; only the context sent to the LLM is cut.
+func markOversizedSource(source *Source, maxBytes int) {
+	if maxBytes <= 0 || len(source.Content) <= maxBytes {
+		return
+	}
+
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["truncated_for_context"] = true
+	source.Metadata["original_length"] = len(source.Content)
+
+	golog.Warnf("source %s is %d bytes, exceeding MAX_SOURCE_BYTES (%d)", source.Name, len(source.Content), maxBytes)
+}
+
+// findDuplicateSource stores the content hash in the source metadata and
+// returns an existing source in the same notebook with identical content
+func findDuplicateSource(ctx context.Context, store *Store, source *Source) (*Source, error) {
+	hash := contentHash(source.Content)
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["content_hash"] = hash
+
+	return store.FindSourceByHash(ctx, source.NotebookID, hash)
+}
+
+// duplicateSourceError builds the 409 response body for a duplicate upload
+func duplicateSourceError(existing *Source) ErrorResponse {
+	return ErrorResponse{
+		Error:   fmt.Sprintf("Source already exists in this notebook: %s (set force to add it anyway)", existing.Name),
+		Code:    ErrCodeDuplicateSource,
+		Details: existing.ID,
+	}
+}
+
+// duplicateSourceAPIError is duplicateSourceError for helpers returning
+// *apiError
+func duplicateSourceAPIError(existing *Source) *apiError {
+	resp := duplicateSourceError(existing)
+	return &apiError{Status: http.StatusConflict, Code: resp.Code, Message: resp.Error, Details: resp.Details}
+}
+
+func (s *Server) handleDeleteSource(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	sourceID := c.Param("sourceId")
+
+	source, err := s.store.GetSource(ctx, sourceID)
+	if err != nil || source.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source not found", Code: ErrCodeSourceNotFound})
+		return
+	}
+
+	if err := s.store.DeleteSource(ctx, source.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete source", Code: ErrCodeInternal})
+		return
+	}
+	s.vectorStore.Delete(ctx, source.NotebookID, source.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleDeleteSources deletes the listed sources of a notebook, or all of
+// them, together with their chunks
+func (s *Server) handleDeleteSources(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	var req DeleteSourcesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if req.All == (len(req.SourceIDs) > 0) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Pass either source_ids or all: true", Code: ErrCodeInvalidRequest})
+		return
+	}
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
+		return
+	}
+
+	var ids []string // nil deletes every source
+	if !req.All {
+		ids = req.SourceIDs
+	}
+	deleted, err := s.store.DeleteSources(ctx, notebookID, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete sources", Code: ErrCodeInternal})
+		return
+	}
+
+	resp := DeleteSourcesResponse{Deleted: len(deleted), DeletedIDs: deleted}
+	found := make(map[string]bool, len(deleted))
+	for _, id := range deleted {
+		found[id] = true
+	}
+	for _, id := range req.SourceIDs {
+		if !found[id] {
+			resp.NotFound = append(resp.NotFound, id)
+		}
+	}
+
+	if req.All {
+		resp.ChunksRemoved, err = s.vectorStore.DeleteNotebook(ctx, notebookID, deleted)
+	} else {
+		resp.ChunksRemoved, err = s.vectorStore.DeleteSources(ctx, notebookID, deleted)
+	}
+	if err != nil {
+		golog.Errorf("failed to remove chunks of deleted sources in notebook %s: %v", notebookID, err)
+	}
+	golog.Infof("deleted %d sources and %d chunks from notebook %s", resp.Deleted, resp.ChunksRemoved, notebookID)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleListSourceChunks(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	sourceID := c.Param("sourceId")
+
+	source, err := s.store.GetSource(ctx, sourceID)
+	if err != nil || source.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source not found", Code: ErrCodeSourceNotFound})
+		return
+	}
+
+	s.ensureNotebookIndexed(ctx, notebookID)
+	chunks, err := s.vectorStore.ListChunks(ctx, source.NotebookID, source.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chunks", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, chunks)
+}
+
+// handleAppendSource appends text to a growing source, such as a running
+// log, and indexes only the appended text
+func (s *Server) handleAppendSource(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	sourceID := c.Param("sourceId")
+
+	var req struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	// Concurrent appends would number their chunks from the same offset
+	unlock := s.appendLocks.lock(sourceID)
+	defer unlock()
+
+	source, err := s.store.GetSource(ctx, sourceID)
+	if err != nil || source.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source not found", Code: ErrCodeSourceNotFound})
+		return
+	}
+
+	// Keep lines of a log apart when the client sends them without a newline
+	text := req.Content
+	if source.Content != "" && !strings.HasSuffix(source.Content, "\n") && !strings.HasPrefix(text, "\n") {
+		text = "\n" + text
+	}
+
+	previousMetadata := maps.Clone(source.Metadata)
+	source.Content += text
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["content_hash"] = contentHash(source.Content)
+	markOversizedSource(source, s.cfg.MaxSourceBytes)
+	setSourceLanguage(source)
+
+	// The text is saved first, so chunks are never indexed for text that
+	// was not stored
+	length, err := s.store.AppendSourceContent(ctx, source, text)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to append to source", Code: ErrCodeInternal})
+		return
+	}
+	offset := length - utf8.RuneCountInString(text)
+
+	if sourceIndexed(source) {
+		added, err := s.vectorStore.AppendText(ctx, source.Name, offset, text, s.ingestOptions(ctx, notebookID).WithSource(source.ID))
+		if err != nil {
+			golog.Errorf("failed to ingest appended text: %v", err)
+			if err := s.store.TruncateSourceContent(ctx, source.ID, offset, previousMetadata); err != nil {
+				golog.Errorf("failed to roll back append to source %s: %v", source.ID, err)
+			}
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to index appended text", Code: ErrCodeInternal, Details: err.Error()})
+			return
+		}
+		if err := s.store.AddSourceChunkCount(ctx, source.ID, added); err != nil {
+			golog.Errorf("failed to update chunk count of source %s: %v", source.ID, err)
+		}
+		source.ChunkCount += added
+	}
+
+	c.JSON(http.StatusOK, source)
+}
+
+func (s *Server) handleUpload(c *gin.Context) {
+	notebookID := c.PostForm("notebook_id")
+	if notebookID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "notebook_id required", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	// Reject oversized uploads before anything is read, and cap what is read
+	// in case the declared length is missing or wrong
+	if maxBytes := s.cfg.MaxUploadBytes; maxBytes > 0 {
+		if c.Request.ContentLength > maxBytes+multipartOverhead {
+			c.JSON(http.StatusRequestEntityTooLarge, uploadTooLargeError(maxBytes))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+multipartOverhead)
+	}
+
+	file, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, uploadTooLargeError(s.cfg.MaxUploadBytes))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file required", Code: ErrCodeInvalidRequest})
+		return
+	}
+	if s.cfg.MaxUploadBytes > 0 && file.Size > s.cfg.MaxUploadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, uploadTooLargeError(s.cfg.MaxUploadBytes))
+		return
+	}
+	if !uploadExtensionAllowed(s.cfg.AllowedUploadExtensions, file.Filename) {
+		c.JSON(http.StatusUnsupportedMediaType, ErrorResponse{
+			Error: fmt.Sprintf("File type %q is not allowed, allowed types: %s",
+				filepath.Ext(file.Filename), strings.Join(s.cfg.AllowedUploadExtensions, ", ")),
+			Code: ErrCodeUnsupportedFileType,
+		})
+		return
+	}
+
+	digest, err := uploadDigest(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to read file", Code: ErrCodeInvalidRequest, Details: err.Error()})
+		return
+	}
+	idem, replayed := s.beginIdempotent(c, map[string]string{
+		"notebook_id": notebookID,
+		"filename":    file.Filename,
+		"file":        digest,
+		"force":       c.PostForm("force"),
+		"index":       c.PostForm("index"),
+	})
+	if replayed {
+		return
+	}
+	defer idem.release()
+
+	// Generate a unique, sanitized filename; the client name is untrusted
+	displayName := cleanUploadName(file.Filename)
+	if displayName == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file name", Code: ErrCodeInvalidRequest})
+		return
+	}
+	uniqueFileName := uniqueUploadName(displayName)
+	tempPath, err := uploadPath(s.cfg.UploadsDir, uniqueFileName)
+	if err != nil {
+		golog.Warnf("rejected upload %q: %v", file.Filename, err)
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file name", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	// Ensure uploads directory exists
+	if err := os.MkdirAll(s.cfg.UploadsDir, 0755); err != nil {
+		golog.Errorf("failed to create uploads directory: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create uploads directory", Code: ErrCodeInternal})
+		return
+	}
+
+	// Save file
+	if err := c.SaveUploadedFile(file, tempPath); err != nil {
+		golog.Errorf("failed to save file: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to save file: %v", err), Code: ErrCodeInternal})
+		return
+	}
+
+	opts := IngestFileOptions{Force: c.PostForm("force") == "true"}
+	if index := c.PostForm("index"); index != "" {
+		v := index == "true"
+		opts.Index = &v
+	}
+	s.ingestUpload(c, notebookID, displayName, uniqueFileName, tempPath, opts, idem)
+}
+
+// ingestUpload extracts, stores and indexes a file saved in the uploads
+// directory and responds with the new source. The original filename is kept
+// for display and the unique one for storage. idem records the source for
+// the request's Idempotency-Key, if any.
+func (s *Server) ingestUpload(c *gin.Context, notebookID, displayName, uniqueFileName, tempPath string, opts IngestFileOptions, idem *idempotentRequest) {
+	ctx := c.Request.Context()
+	source, err := s.ingestFile(ctx, notebookID, displayName, uniqueFileName, tempPath, opts)
+	if err != nil {
+		apiErr := asAPIError(err)
+		c.JSON(apiErr.Status, apiErr.response())
+		return
+	}
+	idem.record(ctx, idempotentSource, source.ID, http.StatusCreated)
+
+	c.JSON(http.StatusCreated, source)
+}
+
+// ingestFile extracts, stores and indexes a file saved in the uploads
+// directory. The file is removed if no source is created. Errors are
+// *apiError.
+func (s *Server) ingestFile(ctx context.Context, notebookID, displayName, uniqueFileName, tempPath string, opts IngestFileOptions) (*Source, error) {
+	opts.Name = displayName
+	opts.FileName = uniqueFileName
+	opts.KeepFailed = true
+	source, err := IngestFileWithOptions(ctx, s.store, s.vectorStore, notebookID, tempPath, opts)
+	var duplicate *DuplicateSourceError
+	if errors.As(err, &duplicate) {
+		os.Remove(tempPath)
+		return nil, duplicateSourceAPIError(duplicate.Existing)
+	}
+	if source == nil {
+		golog.Errorf("failed to create source: %v", err)
+		// Clean up uploaded file on error
+		os.Remove(tempPath)
+		return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to create source"}
+	}
+	if err != nil {
+		golog.Errorf("failed to ingest document: %v", err)
+	}
+	if err := s.storage.Put(ctx, uniqueFileName, tempPath); err != nil {
+		golog.Errorf("failed to store uploaded file %s: %v", uniqueFileName, err)
+	}
+	return source, nil
+}
+
+// uploadTooLargeError describes an upload over MAX_UPLOAD_BYTES
+func uploadTooLargeError(maxBytes int64) ErrorResponse {
+	return ErrorResponse{
+		Error: fmt.Sprintf("File is too large, the maximum upload size is %.1f MB", float64(maxBytes)/(1<<20)),
+		Code:  ErrCodeFileTooLarge,
+	}
+}
+
+// Note handlers
+
+func (s *Server) handleListNotes(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	opts, err := parseListOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	notes, err := s.store.ListNotes(ctx, notebookID, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notes", Code: ErrCodeInternal})
+		return
+	}
+
+	assets, err := s.store.ListAssets(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notes", Code: ErrCodeInternal})
+		return
+	}
+	byNote := make(map[string][]Asset)
+	for _, asset := range assets {
+		byNote[asset.NoteID] = append(byNote[asset.NoteID], asset)
+	}
+	for i := range notes {
+		notes[i].Assets = byNote[notes[i].ID]
+	}
+
+	c.JSON(http.StatusOK, notes)
+}
+
+func (s *Server) handleListAssets(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	assets, err := s.store.ListAssets(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list assets", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, assets)
+}
+
+func (s *Server) handleCreateNote(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	var req struct {
+		Title     string   `json:"title" binding:"required"`
+		Content   string   `json:"content" binding:"required"`
+		Type      string   `json:"type" binding:"required"`
+		SourceIDs []string `json:"source_ids"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	note := &Note{
+		NotebookID: notebookID,
+		Title:      req.Title,
+		Content:    req.Content,
+		Type:       req.Type,
+		SourceIDs:  req.SourceIDs,
+	}
+
+	if err := s.store.CreateNote(ctx, note); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create note", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusCreated, note)
+}
+
+func (s *Server) handleDeleteNote(c *gin.Context) {
+	ctx := context.Background()
+	noteID := c.Param("noteId")
+
+	assets, err := s.store.ListNoteAssets(ctx, noteID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete note", Code: ErrCodeInternal})
+		return
+	}
+
+	if err := s.store.DeleteNote(ctx, noteID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete note", Code: ErrCodeInternal})
+		return
+	}
+
+	// Asset rows are removed by the cascade; remove their files as well
+	s.removeAssetFiles(ctx, assets)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleGetNote(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+
+	render := c.Query("render")
+	if render != "" && render != "html" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "render must be html", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	if note.Assets, err = s.store.ListNoteAssets(ctx, noteID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get note", Code: ErrCodeInternal})
+		return
+	}
+	if err := s.resolveRelatedNotes(ctx, note); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get note", Code: ErrCodeInternal})
+		return
+	}
+	if render == "html" {
+		s.renderNoteHTML(ctx, note)
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+// renderNoteHTML fills in the note's content rendered to sanitized HTML.
+// Mermaid blocks are passed through for the client to draw. The HTML is
+// cached in its own table with the hash of the content it was rendered
+// from, so it is only rendered again after the content changes.
+func (s *Server) renderNoteHTML(ctx context.Context, note *Note) {
+	sum := sha256.Sum256([]byte(note.Content))
+	hash := hex.EncodeToString(sum[:])
+
+	rendered, ok, err := s.store.GetNoteRender(ctx, note.ID, hash)
+	if err != nil {
+		golog.Warnf("failed to read rendered HTML of note %s: %v", note.ID, err)
+	}
+	if ok {
+		note.HTML = rendered
+		return
+	}
+
+	note.HTML = markdownToHTML(note.Content, nil)
+	if err := s.store.SaveNoteRender(ctx, note.ID, hash, note.HTML); err != nil {
+		golog.Errorf("failed to cache rendered HTML of note %s: %v", note.ID, err)
+	}
+}
+
+// resolveRelatedNotes fills in the linked notes of a note with their titles.
+// Links to notes deleted since are left out.
+func (s *Server) resolveRelatedNotes(ctx context.Context, note *Note) error {
+	titles, err := s.store.NoteTitles(ctx, note.NotebookID, note.RelatedNoteIDs)
+	if err != nil {
+		return err
+	}
+	note.RelatedNotes = nil
+	for _, id := range note.RelatedNoteIDs {
+		if title, ok := titles[id]; ok {
+			note.RelatedNotes = append(note.RelatedNotes, NoteLink{ID: id, Title: title})
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleAddNoteLinks(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+
+	var req struct {
+		NoteIDs []string `json:"note_ids" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	titles, err := s.store.NoteTitles(ctx, notebookID, req.NoteIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to link notes", Code: ErrCodeInternal})
+		return
+	}
+	for _, id := range req.NoteIDs {
+		if id == noteID {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "A note cannot link to itself", Code: ErrCodeInvalidRequest})
+			return
+		}
+		if _, ok := titles[id]; !ok {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "Linked note not found in this notebook", Code: ErrCodeNoteNotFound, Details: id})
+			return
+		}
+		if !slices.Contains(note.RelatedNoteIDs, id) {
+			note.RelatedNoteIDs = append(note.RelatedNoteIDs, id)
+		}
+	}
+
+	if err := s.store.SetRelatedNotes(ctx, noteID, note.RelatedNoteIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to link notes", Code: ErrCodeInternal})
+		return
+	}
+	if err := s.resolveRelatedNotes(ctx, note); err != nil {
+		golog.Errorf("failed to resolve linked notes of note %s: %v", noteID, err)
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+func (s *Server) handleRemoveNoteLink(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+	linkedID := c.Param("linkedId")
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	i := slices.Index(note.RelatedNoteIDs, linkedID)
+	if i < 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note link not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+	note.RelatedNoteIDs = slices.Delete(note.RelatedNoteIDs, i, i+1)
+
+	if err := s.store.SetRelatedNotes(ctx, noteID, note.RelatedNoteIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to remove note link", Code: ErrCodeInternal})
+		return
+	}
+	if err := s.resolveRelatedNotes(ctx, note); err != nil {
+		golog.Errorf("failed to resolve linked notes of note %s: %v", noteID, err)
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+func (s *Server) handleUpdateNote(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+
+	var req struct {
+		Title   *string `json:"title"`
+		Content *string `json:"content"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	if req.Title != nil {
+		note.Title = *req.Title
+	}
+	if req.Content != nil {
+		note.Content = *req.Content
+	}
+
+	if err := s.store.UpdateNote(ctx, note); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update note", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+// handleRegenerateNote runs a generated note's transformation again with the
+// same type, sources and options, keeping the current content as a version
+func (s *Server) handleRegenerateNote(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	length, _ := note.Metadata["length"].(string)
+	format, _ := note.Metadata["format"].(string)
+	if length == "" && format == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only generated notes can be regenerated", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	req := TransformationRequest{
+		Type:      note.Type,
+		SourceIDs: note.SourceIDs,
+		Length:    length,
+		Format:    format,
+		NoteID:    note.ID,
+	}
+	req.Prompt, _ = note.Metadata["prompt"].(string)
+	if req.Type == "custom" && req.Prompt == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "The prompt of this note was not recorded, it cannot be regenerated", Code: ErrCodeInvalidRequest})
+		return
+	}
+	if lengths, ok := note.Metadata["lengths"].([]interface{}); ok {
+		for _, l := range lengths {
+			if l, ok := l.(string); ok {
+				req.Lengths = append(req.Lengths, l)
+			}
+		}
+	}
+
+	s.respondTransformation(c, notebookID, &req)
+}
+
+func (s *Server) handleListNoteVersions(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	versions, err := s.store.ListNoteVersions(ctx, noteID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list note versions", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+// handleRestoreNoteVersion makes a previous version the current content. The
+// content it replaces is itself kept as a version, so a restore can be undone.
+func (s *Server) handleRestoreNoteVersion(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	version, err := s.store.GetNoteVersion(ctx, c.Param("versionId"))
+	if err != nil || version.NoteID != note.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note version not found", Code: ErrCodeNoteVersionNotFound})
+		return
+	}
+
+	note.Title = version.Title
+	note.Content = version.Content
+	note.SourceIDs = version.SourceIDs
+	note.Metadata = version.Metadata
+
+	if err := s.store.UpdateNote(ctx, note); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to restore note version", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+func (s *Server) handleGetNoteTrace(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found", Code: ErrCodeNoteNotFound})
+		return
+	}
+
+	trace, ok := note.Metadata["trace"]
+	if !ok {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "No generation trace recorded for this note", Code: ErrCodeTraceNotFound})
+		return
+	}
+
+	c.JSON(http.StatusOK, NoteTraceResponse{
+		NoteID:    note.ID,
+		Type:      note.Type,
+		SourceIDs: note.SourceIDs,
+		CreatedAt: note.CreatedAt,
+		Trace:     trace,
+	})
+}
+
+// Transformation handlers
+
+func (s *Server) handleTransform(c *gin.Context) {
+	notebookID := c.Param("id")
+
+	var req TransformationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	s.respondTransformation(c, notebookID, &req)
+}
+
+// respondTransformation runs a transformation and responds with the note,
+// or with a 202 and the job when it runs in the background
+func (s *Server) respondTransformation(c *gin.Context, notebookID string, req *TransformationRequest) {
+	ctx := c.Request.Context()
+
+	idem, replayed := s.beginIdempotent(c, req)
+	if replayed {
+		return
+	}
+	defer idem.release()
+
+	if err := s.resolveTransformOptions(ctx, notebookID, req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	if runsAsJob(req) {
+		job, err := s.startTransformJob(ctx, notebookID, req)
+		if err != nil {
+			apiErr := asAPIError(err)
+			c.JSON(apiErr.Status, apiErr.response())
+			return
+		}
+		idem.record(ctx, idempotentJob, job.ID, http.StatusAccepted)
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+
+	if req.Stream {
+		s.streamTransformation(c, notebookID, req, idem)
+		return
+	}
+
+	note, err := s.runTransformation(ctx, notebookID, req)
+	if err != nil {
+		apiErr := asAPIError(err)
+		c.JSON(apiErr.Status, apiErr.response())
+		return
+	}
+	idem.record(ctx, idempotentNote, note.ID, http.StatusOK)
+
+	c.JSON(http.StatusOK, note)
+}
+
+// runsAsJob tells whether a transformation runs as a background job. Image
+// and audio generation can take minutes, and a callback URL is only called
+// for background jobs.
+func runsAsJob(req *TransformationRequest) bool {
+	return req.Async || asyncTransformTypes[req.Type] || req.CallbackURL != ""
+}
+
+// startTransformJob validates the callback URL of a transformation, stores
+// it as a job and queues the job
+func (s *Server) startTransformJob(ctx context.Context, notebookID string, req *TransformationRequest) (*Job, error) {
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(s.cfg, req.CallbackURL); err != nil {
+			return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: err.Error()}
+		}
+	}
+	job := &Job{NotebookID: notebookID, Type: req.Type, Request: *req}
+	if err := s.store.CreateJob(ctx, job); err != nil {
+		return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to create job", Details: err.Error()}
+	}
+	s.enqueueJob(job.ID)
+	return job, nil
+}
+
+func (s *Server) handleBatchTransform(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	var req BatchTransformationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	if len(req.Requests) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "requests must not be empty", Code: ErrCodeInvalidRequest})
+		return
+	}
+	if len(req.Requests) > s.cfg.TransformBatchMax {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("at most %d transformations can be run at once", s.cfg.TransformBatchMax), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
+		return
+	}
+
+	workers := 1
+	if req.Parallel {
+		workers = s.cfg.TransformBatchWorkers
+		if workers <= 0 {
+			workers = 1
+		}
+	}
+
+	results := make([]BatchTransformationResult, len(req.Requests))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				item := req.Requests[i]
+				result := BatchTransformationResult{Index: i, Type: item.Type}
+				var note *Note
+				var err error
+				if !runsAsJob(&item) {
+					note, err = s.runTransformation(ctx, notebookID, &item)
+				} else if err = s.resolveTransformOptions(ctx, notebookID, &item); err != nil {
+					err = &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: err.Error()}
+				} else {
+					// Queued like a single request, with its callback
+					result.Job, err = s.startTransformJob(ctx, notebookID, &item)
+				}
+				if err != nil {
+					golog.Errorf("batch transformation %d (%s) failed: %v", i, item.Type, err)
+					result.Error = err.Error()
+					result.ErrorCode = errorCodeOf(err)
+				} else {
+					result.Note = note
+				}
+				results[i] = result
+			}
+		}()
+	}
+
+	for i := range req.Requests {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	c.JSON(http.StatusOK, results)
+}
+
+// Transformation lengths and formats
+var (
+	transformLengths = map[string]bool{"short": true, "medium": true, "long": true}
+	transformFormats = map[string]bool{"markdown": true, "bullet_points": true, "paragraphs": true}
+)
+
+// resolveTransformOptions fills in the length and format a request omits,
+// from the notebook's default_length and default_format metadata or else
+// medium markdown, and validates them
+func (s *Server) resolveTransformOptions(ctx context.Context, notebookID string, req *TransformationRequest) error {
+	if req.Length == "" || req.Format == "" {
+		var defaults map[string]interface{}
+		if nb, err := s.store.GetNotebook(ctx, notebookID); err == nil {
+			defaults = nb.Metadata
+		}
+		if req.Length == "" {
+			req.Length, _ = defaults["default_length"].(string)
+		}
+		if req.Format == "" {
+			req.Format, _ = defaults["default_format"].(string)
+		}
+	}
+	if req.Length == "" {
+		req.Length = "medium"
+	}
+	if req.Format == "" {
+		req.Format = "markdown"
+	}
+
+	if !transformLengths[req.Length] {
+		return fmt.Errorf("Invalid length %q, must be short, medium or long", req.Length)
+	}
+	if !transformFormats[req.Format] && !isQuizJSON(req) {
+		return fmt.Errorf("Invalid format %q, must be markdown, bullet_points or paragraphs (or json for quizzes)", req.Format)
+	}
+	for _, length := range req.Lengths {
+		if !transformLengths[length] {
+			return fmt.Errorf("Invalid length %q, must be short, medium or long", length)
+		}
+	}
+	if len(req.Lengths) > 1 && req.Type != "summary" {
+		return fmt.Errorf("Multiple lengths are only supported for summaries")
+	}
+	req.TargetLanguage = strings.TrimSpace(req.TargetLanguage)
+	if req.Type == "translate" && req.TargetLanguage == "" {
+		return fmt.Errorf("Translation needs a target_language")
+	}
+	if req.Type == "compare" && len(req.SourceIDs) < 2 {
+		return fmt.Errorf("Comparison needs at least two sources in source_ids")
+	}
+	if err := s.agent.ValidateModel(req.Model); err != nil {
+		return err
+	}
+	req.Query = strings.TrimSpace(req.Query)
+	if req.TopK < 0 {
+		return fmt.Errorf("Invalid top_k %d, must not be negative", req.TopK)
+	}
+	return nil
+}
+
+// runTransformation generates a transformation for the notebook and saves it
+// as a note. Errors are *apiError with the status and code that best
+// describe them.
+func (s *Server) runTransformation(ctx context.Context, notebookID string, req *TransformationRequest) (*Note, error) {
+	if err := s.resolveTransformOptions(ctx, notebookID, req); err != nil {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: err.Error()}
+	}
+
+	// Regenerating replaces the content of an existing note
+	var existing *Note
+	if req.NoteID != "" {
+		note, err := s.store.GetNote(ctx, req.NoteID)
+		if err != nil || note.NotebookID != notebookID {
+			return nil, &apiError{Status: http.StatusNotFound, Code: ErrCodeNoteNotFound, Message: "Note not found"}
+		}
+		existing = note
+	}
+
+	// Get sources without content; it is loaded below depending on the total size
+	sources, err := s.store.ListSourceHeaders(ctx, notebookID)
+	if err != nil {
+		return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to get sources"}
 	}
 
 	if len(req.SourceIDs) > 0 {
@@ -500,27 +2042,103 @@ func (s *Server) handleTransform(c *gin.Context) {
 	}
 
 	if len(sources) == 0 {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No sources available"})
-		return
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeNoSourceContent, Message: "No sources available"}
+	}
+	if req.Type == "compare" && len(sources) < 2 {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeInvalidRequest, Message: "Comparison needs at least two sources of this notebook"}
+	}
+	if req.Type != "translate" {
+		req.Language = s.outputLanguage(ctx, req.Language, sources)
+	}
+	hasContent := false
+	for _, src := range sources {
+		if src.ContentLength > 0 {
+			hasContent = true
+			break
+		}
+	}
+	if !hasContent {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeNoSourceContent, Message: "None of the selected sources has any content yet"}
+	}
+
+	totalLength := 0
+	for _, src := range sources {
+		totalLength += src.ContentLength
 	}
 
-	// Generate transformation
-	response, err := s.agent.GenerateTransformation(ctx, &req, sources)
+	// Generate transformation. Large inputs are streamed from the store in
+	// windows and map-reduced instead of being loaded into memory at once.
+	var response *TransformationResponse
+	var retrieved int
+	if req.Query != "" {
+		// Only the chunks relevant to the query make up the context, so the
+		// size of the notebook doesn't matter
+		sources, retrieved, err = s.retrievedSources(ctx, notebookID, req, sources)
+		if err != nil {
+			return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to search sources", Details: err.Error()}
+		}
+		if len(sources) == 0 {
+			return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeNoSourceContent, Message: "Nothing in the selected sources matches the query"}
+		}
+		req.SourceIDs = make([]string, len(sources))
+		for i, src := range sources {
+			req.SourceIDs[i] = src.ID
+		}
+		if req.Type == "compare" && len(sources) < 2 {
+			return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeNoSourceContent, Message: "Comparison needs at least two sources matching the query"}
+		}
+		response, err = s.agent.GenerateTransformation(ctx, req, sources)
+	} else if req.Type != "translate" && s.cfg.StreamingThreshold > 0 && totalLength > s.cfg.StreamingThreshold {
+		// Translations keep all of the text, so they are never condensed
+		golog.Infof("source content (%d chars) exceeds streaming threshold, using map-reduce", totalLength)
+		response, err = s.agent.GenerateTransformationStreaming(ctx, req, sources, s.store.ReadSourceContent)
+	} else {
+		for i := range sources {
+			full, err := s.store.GetSource(ctx, sources[i].ID)
+			if err != nil {
+				return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to get sources"}
+			}
+			sources[i] = *full
+		}
+		response, err = s.agent.GenerateTransformation(ctx, req, sources)
+	}
+	if errors.Is(err, errNoSourceContent) {
+		return nil, &apiError{Status: http.StatusBadRequest, Code: ErrCodeNoSourceContent, Message: "None of the selected sources has any content yet"}
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Generation failed: %v", err)})
-		return
+		status, resp := s.generationError("Generation failed", err)
+		return nil, &apiError{Status: status, Code: resp.Code, Message: resp.Error, Details: resp.Details}
 	}
 
 	metadata := map[string]interface{}{
 		"length": req.Length,
 		"format": req.Format,
 	}
+	if req.Type == "custom" {
+		// Kept so the note can be regenerated
+		metadata["prompt"] = req.Prompt
+	}
+	if req.Language != "" {
+		metadata["language"] = req.Language
+	}
+	if req.Query != "" {
+		metadata["query"] = req.Query
+		metadata["retrieved_chunks"] = retrieved
+	}
+	for key, value := range response.Metadata {
+		metadata[key] = value
+	}
+
+	// Images and audio generated for the note, registered as assets once it
+	// is saved
+	var generatedFiles []string
 
 	// If type is infograph, generate the image as well
 	if req.Type == "infograph" {
 		extra := "**注意：无论来源是什么语言，请务必使用中文**"
 		prompt := response.Content + "\n\n" + extra
-		imagePath, err := s.agent.provider.GenerateImage(ctx, "gemini-3-pro-image-preview", prompt)
+		imagePath, model, err := s.agent.GenerateImage(ctx, prompt, s.agent.infographOptions())
+		metadata["image_model"] = model
 		if err != nil {
 			golog.Errorf("failed to generate infographic image: %v", err)
 			metadata["image_error"] = err.Error()
@@ -528,6 +2146,7 @@ func (s *Server) handleTransform(c *gin.Context) {
 			// Convert local path to web path
 			webPath := "/uploads/" + filepath.Base(imagePath)
 			metadata["image_url"] = webPath
+			generatedFiles = append(generatedFiles, imagePath)
 		}
 	}
 
@@ -541,57 +2160,273 @@ func (s *Server) handleTransform(c *gin.Context) {
 			var slideURLs []string
 			golog.Infof("generating %d slides for ppt...", len(slides))
 
-			for i, slide := range slides {
-				golog.Infof("generating image for slide %d/%d...", i+1, len(slides))
-				// Combine style and slide content for the image generator
-				prompt := fmt.Sprintf("Style: %s\n\nSlide Content: %s", slides[0].Style, slide.Content)
-				prompt += "\n\n**注意：无论来源是什么语言，请务必使用中文**\n"
-				imagePath, err := s.agent.provider.GenerateImage(ctx, "gemini-3-pro-image-preview", prompt)
-				if err != nil {
-					golog.Errorf("failed to generate slide %d: %v", i+1, err)
-					continue
-				}
-				slideURLs = append(slideURLs, "/uploads/"+filepath.Base(imagePath))
-			}
-			metadata["slides"] = slideURLs
+			for i, slide := range slides {
+				golog.Infof("generating image for slide %d/%d...", i+1, len(slides))
+				// Combine style and slide content for the image generator
+				prompt := fmt.Sprintf("Style: %s\n\nSlide Content: %s", slides[0].Style, slide.Content)
+				prompt += "\n\n**注意：无论来源是什么语言，请务必使用中文**\n"
+				imagePath, model, err := s.agent.GenerateImage(ctx, prompt, ImageOptions{})
+				metadata["image_model"] = model
+				if err != nil {
+					golog.Errorf("failed to generate slide %d: %v", i+1, err)
+					continue
+				}
+				slideURLs = append(slideURLs, "/uploads/"+filepath.Base(imagePath))
+				generatedFiles = append(generatedFiles, imagePath)
+			}
+			metadata["slides"] = slideURLs
+		}
+	}
+
+	// If type is podcast, read the script aloud with a voice per host
+	if req.Type == "podcast" && s.cfg.EnablePodcast {
+		audio, err := s.agent.SynthesizePodcast(ctx, response.Content)
+		if err != nil {
+			golog.Errorf("failed to generate podcast audio: %v", err)
+			metadata["audio_error"] = err.Error()
+		} else {
+			metadata["audio_url"] = "/uploads/" + filepath.Base(audio.Path)
+			metadata["duration"] = audio.Duration
+			metadata["segments"] = audio.Segments
+			generatedFiles = append(generatedFiles, audio.Path)
+		}
+	}
+
+	// Save as note. The title follows the output language, or the target
+	// language of a translation.
+	titleLanguage := req.Language
+	if req.Type == "translate" {
+		titleLanguage = req.TargetLanguage
+	}
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = noteTitle(req.Type, titleLanguage)
+	}
+	note := &Note{
+		NotebookID: notebookID,
+		Title:      title,
+		Content:    response.Content,
+		Type:       req.Type,
+		SourceIDs:  req.SourceIDs,
+		Metadata:   metadata,
+	}
+
+	if existing != nil {
+		note.ID = existing.ID
+		if req.Title == "" {
+			note.Title = existing.Title
+		}
+		note.CreatedAt = existing.CreatedAt
+		err = s.store.UpdateNote(ctx, note)
+	} else {
+		err = s.store.CreateNote(ctx, note)
+	}
+	if err != nil {
+		removeFiles(generatedFiles)
+		return nil, &apiError{Status: http.StatusInternalServerError, Code: ErrCodeInternal, Message: "Failed to save note"}
+	}
+
+	note.Assets = s.registerGeneratedAssets(ctx, note, generatedFiles)
+
+	return note, nil
+}
+
+// retrievedSources searches the selected sources for the chunks most relevant
+// to req.Query and returns them as sources whose content is only those
+// excerpts, in document order, along with the number of chunks used. Chunks
+// returned more than once and the overlap between neighbouring chunks are
+// dropped so the same text doesn't reach the model twice.
+func (s *Server) retrievedSources(ctx context.Context, notebookID string, req *TransformationRequest, sources []Source) ([]Source, int, error) {
+	topK := req.TopK
+	if topK <= 0 {
+		topK = s.cfg.TransformTopK
+	}
+	sourceIDs := make([]string, len(sources))
+	for i, src := range sources {
+		sourceIDs[i] = src.ID
+	}
+
+	s.ensureNotebookIndexed(ctx, notebookID)
+	docs, err := s.vectorStore.SearchNotebook(ctx, notebookID, req.Query, topK, sourceIDs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type excerpt struct {
+		text       string
+		start, end int
+	}
+	bySource := make(map[string][]excerpt)
+	seen := make(map[string]bool)
+	used := 0
+	for _, doc := range docs {
+		id, _ := doc.Metadata["source_id"].(string)
+		text := strings.TrimSpace(doc.PageContent)
+		key := id + "\x00" + text
+		if id == "" || text == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		start, _ := doc.Metadata["start_offset"].(int)
+		end, _ := doc.Metadata["end_offset"].(int)
+		bySource[id] = append(bySource[id], excerpt{text: doc.PageContent, start: start, end: end})
+		used++
+	}
+
+	var result []Source
+	for _, src := range sources {
+		excerpts := bySource[src.ID]
+		if len(excerpts) == 0 {
+			continue
+		}
+		sort.Slice(excerpts, func(i, j int) bool { return excerpts[i].start < excerpts[j].start })
+
+		var content strings.Builder
+		end := -1
+		for _, e := range excerpts {
+			text := e.text
+			switch {
+			case end < 0:
+			case e.start < end && e.end-e.start == len([]rune(text)):
+				// Skip the part the previous chunk already covered; offsets
+				// count runes
+				if e.end <= end {
+					continue
+				}
+				text = string([]rune(text)[end-e.start:])
+			default:
+				content.WriteString("\n\n...\n\n")
+			}
+			content.WriteString(text)
+			if e.end > end {
+				end = e.end
+			}
+		}
+		src.Content = content.String()
+		src.ContentLength = utf8.RuneCountInString(src.Content)
+		result = append(result, src)
+	}
+	golog.Infof("transformation query %q retrieved %d chunks from %d sources", req.Query, used, len(result))
+	return result, used, nil
+}
+
+// registerGeneratedAssets records generated image and audio files as assets
+// of a note so they are removed together with it
+func (s *Server) registerGeneratedAssets(ctx context.Context, note *Note, paths []string) []Asset {
+	var assets []Asset
+	for _, path := range paths {
+		asset := &Asset{
+			NotebookID: note.NotebookID,
+			NoteID:     note.ID,
+			Type:       "image",
+			FileName:   filepath.Base(path),
+			URL:        "/uploads/" + filepath.Base(path),
+			MimeType:   "image/png",
+		}
+		if filepath.Ext(path) == ".wav" {
+			asset.Type, asset.MimeType = "audio", "audio/wav"
+		}
+		if info, err := os.Stat(path); err == nil {
+			asset.FileSize = info.Size()
+		}
+		if err := s.storage.Put(ctx, asset.FileName, path); err != nil {
+			golog.Errorf("failed to store asset %s: %v", asset.FileName, err)
+		}
+		if err := s.store.CreateAsset(ctx, asset); err != nil {
+			golog.Errorf("failed to register asset %s: %v", asset.FileName, err)
+			continue
+		}
+		assets = append(assets, *asset)
+	}
+	return assets
+}
+
+// removeAssetFiles deletes the files backing the given assets
+func (s *Server) removeAssetFiles(ctx context.Context, assets []Asset) {
+	for _, asset := range assets {
+		if err := s.storage.Delete(ctx, filepath.Base(asset.FileName)); err != nil {
+			golog.Warnf("failed to remove asset file %s: %v", asset.FileName, err)
+		}
+	}
+}
+
+// handleServeUpload serves a stored file, redirecting to the storage's
+// public URL when it has one
+func (s *Server) handleServeUpload(c *gin.Context) {
+	name := filepath.Base(c.Param("name"))
+	if url := s.storage.PublicURL(name); url != "" {
+		c.Redirect(http.StatusFound, url)
+		return
+	}
+
+	body, size, err := s.storage.Get(c.Request.Context(), name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			golog.Errorf("failed to read stored file %s: %v", name, err)
+		}
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.DataFromReader(http.StatusOK, size, contentType, body, nil)
+}
+
+// removeFiles deletes files, logging failures other than already missing files
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			golog.Warnf("failed to remove file %s: %v", path, err)
 		}
 	}
+}
 
-	// Save as note
-	note := &Note{
-		NotebookID: notebookID,
-		Title:      getTitleForType(req.Type),
-		Content:    response.Content,
-		Type:       req.Type,
-		SourceIDs:  req.SourceIDs,
-		Metadata:   metadata,
+// Prompt handlers
+
+func (s *Server) handleExportPrompts(c *gin.Context) {
+	c.JSON(http.StatusOK, s.agent.prompts.Export())
+}
+
+func (s *Server) handleImportPrompts(c *gin.Context) {
+	var bundle PromptBundle
+	if err := c.ShouldBindJSON(&bundle); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
 	}
 
-	if err := s.store.CreateNote(ctx, note); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save note"})
+	if err := s.agent.prompts.Import(bundle); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Failed to import prompts: %v", err), Code: ErrCodeInvalidRequest})
 		return
 	}
 
-	c.JSON(http.StatusOK, note)
+	c.JSON(http.StatusOK, s.agent.prompts.Export())
 }
 
-func getTitleForType(t string) string {
-	titles := map[string]string{
-		"summary":     "摘要",
-		"faq":         "常见问题解答",
-		"study_guide": "学习指南",
-		"outline":     "大纲",
-		"podcast":     "播客脚本",
-		"timeline":    "时间线",
-		"glossary":    "术语表",
-		"quiz":        "测验",
-		"infograph":   "信息图",
-		"ppt":         "幻灯片",
+func (s *Server) handleResetPrompt(c *gin.Context) {
+	transformType := c.Param("type")
+
+	template, err := s.agent.prompts.Reset(transformType)
+	if err != nil {
+		golog.Errorf("failed to reset prompt %s: %v", transformType, err)
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Failed to reset prompt: %v", err), Code: ErrCodeInvalidRequest})
+		return
 	}
-	if title, ok := titles[t]; ok {
-		return title
+
+	c.JSON(http.StatusOK, PromptTemplateResponse{Type: transformType, Template: template})
+}
+
+func (s *Server) handleResetAllPrompts(c *gin.Context) {
+	if err := s.agent.prompts.ResetAll(); err != nil {
+		golog.Errorf("failed to reset prompts: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to reset prompts: %v", err), Code: ErrCodeInternal})
+		return
 	}
-	return "笔记"
+
+	c.JSON(http.StatusOK, s.agent.prompts.Export())
 }
 
 // Chat handlers
@@ -602,13 +2437,48 @@ func (s *Server) handleListChatSessions(c *gin.Context) {
 
 	sessions, err := s.store.ListChatSessions(ctx, notebookID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chat sessions"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chat sessions", Code: ErrCodeInternal})
 		return
 	}
 
 	c.JSON(http.StatusOK, sessions)
 }
 
+// Default and maximum number of messages returned by
+// handleListRecentChatMessages
+const (
+	defaultRecentChatMessages = 20
+	maxRecentChatMessages     = 200
+)
+
+func (s *Server) handleListRecentChatMessages(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	limit := defaultRecentChatMessages
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid limit, must be a positive integer", Code: ErrCodeInvalidRequest})
+			return
+		}
+		limit = min(n, maxRecentChatMessages)
+	}
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
+		return
+	}
+
+	messages, err := s.store.ListRecentChatMessages(ctx, notebookID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chat messages", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, messages)
+}
+
 func (s *Server) handleCreateChatSession(c *gin.Context) {
 	ctx := context.Background()
 	notebookID := c.Param("id")
@@ -621,78 +2491,276 @@ func (s *Server) handleCreateChatSession(c *gin.Context) {
 
 	session, err := s.store.CreateChatSession(ctx, notebookID, req.Title)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create chat session"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create chat session", Code: ErrCodeInternal})
 		return
 	}
 
 	c.JSON(http.StatusCreated, session)
 }
 
+func (s *Server) handleRenameChatSession(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	sessionID := c.Param("sessionId")
+
+	var req struct {
+		Title string `json:"title" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title must not be empty", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	session, err := s.store.GetChatSession(ctx, sessionID)
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat session not found", Code: ErrCodeChatSessionNotFound})
+		return
+	}
+
+	if err := s.store.UpdateChatSessionTitle(ctx, sessionID, title); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to rename chat session", Code: ErrCodeInternal})
+		return
+	}
+	session.Title = title
+
+	c.JSON(http.StatusOK, session)
+}
+
 func (s *Server) handleDeleteChatSession(c *gin.Context) {
 	ctx := context.Background()
 	sessionID := c.Param("sessionId")
 
 	if err := s.store.DeleteChatSession(ctx, sessionID); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete chat session"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete chat session", Code: ErrCodeInternal})
 		return
 	}
 
 	c.Status(http.StatusNoContent)
 }
 
-func (s *Server) handleSendMessage(c *gin.Context) {
+func (s *Server) handleMergeChatSessions(c *gin.Context) {
 	ctx := context.Background()
 	notebookID := c.Param("id")
+
+	var req struct {
+		TargetSessionID string `json:"target_session_id" binding:"required"`
+		SourceSessionID string `json:"source_session_id" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	if req.TargetSessionID == req.SourceSessionID {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Cannot merge a chat session into itself", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	for _, id := range []string{req.TargetSessionID, req.SourceSessionID} {
+		session, err := s.store.GetChatSession(ctx, id)
+		if err != nil || session.NotebookID != notebookID {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("Chat session %s not found", id), Code: ErrCodeChatSessionNotFound})
+			return
+		}
+	}
+
+	session, err := s.store.MergeChatSessions(ctx, req.TargetSessionID, req.SourceSessionID)
+	if err != nil {
+		golog.Errorf("failed to merge chat sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to merge chat sessions", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) handleSendMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
 	sessionID := c.Param("sessionId")
 
 	var req ChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if err := s.agent.ValidateModel(req.Model); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
 		return
 	}
 
-	// Add user message
-	_, err := s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil)
+	// Get session history; a session of another notebook is not found
+	session, err := s.store.GetChatSession(ctx, sessionID)
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat session not found", Code: ErrCodeChatSessionNotFound})
+		return
+	}
+	scope, err := s.chatScope(ctx, session, req.SourceIDs, req.NoteID, req.NoteOnly)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to add message"})
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error(), Code: ErrCodeNoteNotFound})
 		return
 	}
+	scope.Debug = req.Debug
+	scope.Model = req.Model
 
-	// Get session history
-	session, err := s.store.GetChatSession(ctx, sessionID)
+	// Add user message
+	userMsg, err := s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil, chatQuestionMetadata(&req))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get session"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to add message", Code: ErrCodeInternal})
 		return
 	}
+	session.Messages = append(session.Messages, *userMsg)
+	if countUserMessages(session.Messages) == 1 {
+		s.autoTitleSession(session, req.Message)
+	}
 
 	// Generate response
-	response, err := s.agent.Chat(ctx, notebookID, req.Message, session.Messages)
+	s.ensureNotebookIndexed(ctx, notebookID)
+	history, summary := s.chatHistory(ctx, session, session.Messages)
+	scope.HistorySummary = summary
+	response, err := s.agent.Chat(ctx, notebookID, req.Message, scope, history)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
+		c.JSON(s.generationError("Chat failed", err))
 		return
 	}
 
 	// Add assistant message
-	sourceIDs := make([]string, len(response.Sources))
-	for i, src := range response.Sources {
-		sourceIDs[i] = src.ID
-	}
-	_, err = s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs)
+	assistantMsg, err := s.saveAssistantMessage(ctx, sessionID, response)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save response"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save response", Code: ErrCodeInternal})
 		return
 	}
 
+	response.SessionID = sessionID
+	response.MessageID = assistantMsg.ID
+	response.UserMessageID = userMsg.ID
+	recordPruned(response, s.pruneChatHistory(ctx, sessionID))
+
 	c.JSON(http.StatusOK, response)
 }
 
+// handleDeleteChatMessage deletes a message of a session of the notebook;
+// a message of another session or notebook is not found
+func (s *Server) handleDeleteChatMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	sessionID := c.Param("sessionId")
+	messageID := c.Param("messageId")
+
+	session, err := s.store.GetChatSession(ctx, sessionID)
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat session not found", Code: ErrCodeChatSessionNotFound})
+		return
+	}
+	if err := s.store.DeleteChatMessage(ctx, sessionID, messageID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat message not found", Code: ErrCodeChatMessageNotFound})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleRegenerateMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	sessionID := c.Param("sessionId")
+
+	// The body is optional
+	var req struct {
+		Temperature *float64 `json:"temperature"`
+		Model       string   `json:"model"` // defaults to the model the question was asked with
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	session, err := s.store.GetChatSession(ctx, sessionID)
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat session not found", Code: ErrCodeChatSessionNotFound})
+		return
+	}
+
+	// Find the last user message; everything after it is the answer to replace
+	lastUser := -1
+	for i := len(session.Messages) - 1; i >= 0; i-- {
+		if session.Messages[i].Role == "user" {
+			lastUser = i
+			break
+		}
+	}
+	if lastUser == -1 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No user message to regenerate a response for", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	var options []llms.CallOption
+	if req.Temperature != nil {
+		options = append(options, llms.WithTemperature(*req.Temperature))
+	}
+
+	question := session.Messages[lastUser]
+	model := req.Model
+	if model == "" {
+		model, _ = question.Metadata["model"].(string)
+	}
+	if err := s.agent.ValidateModel(model); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	scope, err := s.chatScope(ctx, session, chatFilterSourceIDs(question.Metadata), OptionalString{}, false)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error(), Code: ErrCodeNoteNotFound})
+		return
+	}
+	scope.Model = model
+	scope.Debug, _ = question.Metadata["debug"].(bool)
+	s.ensureNotebookIndexed(ctx, notebookID)
+	history, summary := s.chatHistory(ctx, session, session.Messages[:lastUser+1])
+	scope.HistorySummary = summary
+	response, err := s.agent.Chat(ctx, notebookID, question.Content, scope, history, options...)
+	if err != nil {
+		c.JSON(s.generationError("Chat failed", err))
+		return
+	}
+
+	// Drop the previous answer only once the new one is ready
+	for _, msg := range session.Messages[lastUser+1:] {
+		if msg.Role != "assistant" {
+			continue
+		}
+		if err := s.store.DeleteChatMessage(ctx, sessionID, msg.ID); err != nil {
+			golog.Errorf("failed to delete previous assistant message %s: %v", msg.ID, err)
+		}
+	}
+
+	msg, err := s.saveAssistantMessage(ctx, sessionID, response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save response", Code: ErrCodeInternal})
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
 func (s *Server) handleChat(c *gin.Context) {
-	ctx := context.Background()
+	ctx := c.Request.Context()
 	notebookID := c.Param("id")
 
 	var req ChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if err := s.agent.ValidateModel(req.Model); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
 		return
 	}
 
@@ -701,41 +2769,304 @@ func (s *Server) handleChat(c *gin.Context) {
 	if sessionID == "" {
 		session, err := s.store.CreateChatSession(ctx, notebookID, "")
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create session"})
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create session", Code: ErrCodeInternal})
 			return
 		}
 		sessionID = session.ID
 	}
 
-	// Get session history
+	// Get session history; a session of another notebook is not found
 	session, err := s.store.GetChatSession(ctx, sessionID)
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat session not found", Code: ErrCodeChatSessionNotFound})
+		return
+	}
+
+	scope, err := s.chatScope(ctx, session, req.SourceIDs, req.NoteID, req.NoteOnly)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get session"})
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error(), Code: ErrCodeNoteNotFound})
 		return
 	}
+	scope.Debug = req.Debug
+	scope.Model = req.Model
 
 	// Generate response
-	response, err := s.agent.Chat(ctx, notebookID, req.Message, session.Messages)
+	s.ensureNotebookIndexed(ctx, notebookID)
+	history, summary := s.chatHistory(ctx, session, session.Messages)
+	scope.HistorySummary = summary
+	response, err := s.agent.Chat(ctx, notebookID, req.Message, scope, history)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
+		c.JSON(s.generationError("Chat failed", err))
 		return
 	}
 
 	response.SessionID = sessionID
 
 	// Add messages
+	userMsg, err := s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil, chatQuestionMetadata(&req))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to add message", Code: ErrCodeInternal})
+		return
+	}
+	if countUserMessages(session.Messages) == 0 {
+		s.autoTitleSession(session, req.Message)
+	}
+	assistantMsg, err := s.saveAssistantMessage(ctx, sessionID, response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save response", Code: ErrCodeInternal})
+		return
+	}
+
+	response.MessageID = assistantMsg.ID
+	response.UserMessageID = userMsg.ID
+	recordPruned(response, s.pruneChatHistory(ctx, sessionID))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// statusClientClosedRequest is logged for generations aborted because the
+// client disconnected (nginx's convention)
+const statusClientClosedRequest = 499
+
+// generationError builds the response for a failed LLM generation: 504 when
+// the model timed out, 499 when the client went away, 429 when the provider
+// rate limits, 503 when it is unreachable, 500 otherwise
+func (s *Server) generationError(prefix string, err error) (int, ErrorResponse) {
+	switch {
+	case errors.Is(err, ErrLLMTimeout):
+		msg := "The model did not respond in time"
+		if s.cfg.LLMTimeout > 0 {
+			msg = fmt.Sprintf("The model did not respond within %s", s.cfg.LLMTimeout)
+		}
+		return http.StatusGatewayTimeout, ErrorResponse{
+			Error:   msg + "; try again, use a faster model or raise LLM_TIMEOUT_SECONDS",
+			Code:    ErrCodeLLMTimeout,
+			Details: err.Error(),
+		}
+	case errors.Is(err, context.Canceled):
+		golog.Infof("generation canceled: %v", err)
+		return statusClientClosedRequest, ErrorResponse{Error: "Request canceled", Code: ErrCodeCanceled}
+	}
+	status, code := classifyLLMError(err)
+	return status, ErrorResponse{Error: fmt.Sprintf("%s: %v", prefix, err), Code: code}
+}
+
+// saveAssistantMessage stores a chat answer together with the passages it
+// was generated from, so the retrieval can be inspected later
+func (s *Server) saveAssistantMessage(ctx context.Context, sessionID string, response *ChatResponse) (*ChatMessage, error) {
 	sourceIDs := make([]string, len(response.Sources))
 	for i, src := range response.Sources {
 		sourceIDs[i] = src.ID
 	}
-	s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil)
-	s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs)
 
-	c.JSON(http.StatusOK, response)
+	metadata := make(map[string]interface{}, len(response.Metadata)+1)
+	for key, value := range response.Metadata {
+		if key == "debug" {
+			// Debug prompts are for the response only
+			continue
+		}
+		metadata[key] = value
+	}
+	metadata["retrieval"] = response.Citations
+
+	return s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs, metadata)
+}
+
+// chatScope builds the scope of a chat answer. A note_id anchors the session
+// to that note, stored in the session metadata so follow-up questions (and
+// regenerated answers) keep it as context.
+func (s *Server) chatScope(ctx context.Context, session *ChatSession, sourceIDs []string, noteID OptionalString, noteOnly bool) (ChatScope, error) {
+	scope, err := s.chatNoteScope(ctx, session, sourceIDs, noteID, noteOnly)
+	if err == nil && !scope.NoteOnly && s.cfg.ChatMaxImages > 0 && s.cfg.IsMultimodal() {
+		scope.LoadImages = func(ctx context.Context, sourceIDs []string) []ChatImage {
+			return s.chatImages(ctx, session.NotebookID, sourceIDs)
+		}
+	}
+	return scope, err
+}
+
+// maxChatImageBytes bounds the size of an image attached to a chat question
+const maxChatImageBytes = 20 << 20
+
+// chatImages loads the image sources of a notebook among sourceIDs, in
+// their order, up to CHAT_MAX_IMAGES
+func (s *Server) chatImages(ctx context.Context, notebookID string, sourceIDs []string) []ChatImage {
+	if len(sourceIDs) == 0 {
+		return nil
+	}
+	sources, err := s.store.ListSourceHeaders(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to list image sources of notebook %s: %v", notebookID, err)
+		return nil
+	}
+	byID := make(map[string]Source, len(sources))
+	for _, src := range sources {
+		byID[src.ID] = src
+	}
+
+	var images []ChatImage
+	for _, id := range sourceIDs {
+		if len(images) >= s.cfg.ChatMaxImages {
+			break
+		}
+		src, ok := byID[id]
+		if !ok || src.Type != "image" || src.FileName == "" {
+			continue
+		}
+		mimeType, _ := src.Metadata["mime_type"].(string)
+		if mimeType == "" {
+			mimeType = imageMIMETypes[strings.ToLower(filepath.Ext(src.FileName))]
+		}
+
+		rc, _, err := s.storage.Get(ctx, src.FileName)
+		if err != nil {
+			golog.Warnf("failed to open image source %s: %v", src.ID, err)
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxChatImageBytes+1))
+		rc.Close()
+		if err != nil {
+			golog.Warnf("failed to read image source %s: %v", src.ID, err)
+			continue
+		}
+		if len(data) > maxChatImageBytes {
+			golog.Warnf("image source %s is too large to attach to chat", src.ID)
+			continue
+		}
+		images = append(images, ChatImage{SourceID: src.ID, Name: src.Name, MimeType: mimeType, Data: data})
+	}
+	return images
+}
+
+// chatNoteScope resolves the note a chat answer is anchored to. An explicit
+// null or empty note_id detaches the session from its note.
+func (s *Server) chatNoteScope(ctx context.Context, session *ChatSession, sourceIDs []string, noteID OptionalString, noteOnly bool) (ChatScope, error) {
+	scope := ChatScope{SourceIDs: sourceIDs}
+
+	if noteID.Set && noteID.Value == "" {
+		if _, ok := session.Metadata["note_id"]; ok {
+			delete(session.Metadata, "note_id")
+			delete(session.Metadata, "note_only")
+			if err := s.store.UpdateChatSessionMetadata(ctx, session.ID, session.Metadata); err != nil {
+				golog.Errorf("failed to detach chat session %s from its note: %v", session.ID, err)
+			}
+		}
+		return scope, nil
+	}
+
+	if noteID.Set {
+		note, err := s.store.GetNote(ctx, noteID.Value)
+		if err != nil || note.NotebookID != session.NotebookID {
+			return scope, fmt.Errorf("Note not found")
+		}
+		if session.Metadata == nil {
+			session.Metadata = make(map[string]interface{})
+		}
+		if session.Metadata["note_id"] != noteID.Value || session.Metadata["note_only"] != noteOnly {
+			session.Metadata["note_id"] = noteID.Value
+			session.Metadata["note_only"] = noteOnly
+			if err := s.store.UpdateChatSessionMetadata(ctx, session.ID, session.Metadata); err != nil {
+				golog.Errorf("failed to anchor chat session %s to note %s: %v", session.ID, noteID.Value, err)
+			}
+		}
+		scope.Note, scope.NoteOnly = note, noteOnly
+		return scope, nil
+	}
+
+	anchored, _ := session.Metadata["note_id"].(string)
+	if anchored == "" {
+		return scope, nil
+	}
+	note, err := s.store.GetNote(ctx, anchored)
+	if err != nil {
+		// The note was deleted; carry on with the sources only
+		golog.Warnf("note %s of chat session %s is gone: %v", anchored, session.ID, err)
+		return scope, nil
+	}
+	scope.Note = note
+	scope.NoteOnly, _ = session.Metadata["note_only"].(bool)
+	return scope, nil
+}
+
+// chatQuestionMetadata records the source filter, model and debug flag of a
+// question in the user message, so a regenerated answer searches the same
+// sources with the same model
+func chatQuestionMetadata(req *ChatRequest) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	if len(req.SourceIDs) > 0 {
+		metadata["source_ids"] = req.SourceIDs
+	}
+	if req.Model != "" {
+		metadata["model"] = req.Model
+	}
+	if req.Debug {
+		metadata["debug"] = true
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// chatFilterSourceIDs reads the source filter stored by chatQuestionMetadata
+func chatFilterSourceIDs(metadata map[string]interface{}) []string {
+	ids, _ := metadata["source_ids"].([]interface{})
+	sourceIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id, ok := id.(string); ok {
+			sourceIDs = append(sourceIDs, id)
+		}
+	}
+	return sourceIDs
 }
 
 // Utility functions
 
+// parseListOptions reads the sort, order, since and until query parameters
+// of list endpoints
+func parseListOptions(c *gin.Context) (ListOptions, error) {
+	opts := ListOptions{SortBy: c.Query("sort"), Order: strings.ToLower(c.Query("order"))}
+	if opts.SortBy != "" && opts.SortBy != "created_at" && opts.SortBy != "updated_at" {
+		return opts, fmt.Errorf("Invalid sort %q, must be created_at or updated_at", opts.SortBy)
+	}
+	if opts.Order != "" && opts.Order != "asc" && opts.Order != "desc" {
+		return opts, fmt.Errorf("Invalid order %q, must be asc or desc", opts.Order)
+	}
+
+	var err error
+	if opts.Since, err = parseTimeParam(c.Query("since")); err != nil {
+		return opts, fmt.Errorf("Invalid since: %v", err)
+	}
+	if opts.Until, err = parseTimeParam(c.Query("until")); err != nil {
+		return opts, fmt.Errorf("Invalid until: %v", err)
+	}
+	return opts, nil
+}
+
+// parseTimeParam parses a unix timestamp in seconds or an RFC 3339 time. An
+// empty value gives the zero time.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a unix timestamp or an RFC 3339 time")
+	}
+	return t, nil
+}
+
+// contentHash returns a SHA-256 hash of the content with whitespace and case
+// normalized, so re-extractions of the same document hash identically
+func contentHash(content string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(content), " "))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
 func writeFile(path, content string) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
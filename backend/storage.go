@@ -0,0 +1,204 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Storage backends
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+// FileStorage keeps uploaded files and generated assets. Files are always
+// written to the uploads directory first, then handed to the storage under
+// their base name, which is also the name used in /uploads URLs.
+type FileStorage interface {
+	// Put stores the local file at path under name. Backends other than
+	// the local one remove the local copy once it is stored.
+	Put(ctx context.Context, name, path string) error
+	// Get opens a stored file and returns its size, or -1 if unknown
+	Get(ctx context.Context, name string) (io.ReadCloser, int64, error)
+	// Delete removes a stored file; missing files are not an error
+	Delete(ctx context.Context, name string) error
+	// PublicURL returns a URL clients can fetch the file from directly, or
+	// "" when it has to be served through /uploads
+	PublicURL(name string) string
+}
+
+// NewFileStorage creates the storage selected by STORAGE_BACKEND
+func NewFileStorage(cfg Config) (FileStorage, error) {
+	switch cfg.StorageBackend {
+	case "", StorageBackendLocal:
+		return &localStorage{dir: cfg.UploadsDir}, nil
+	case StorageBackendS3:
+		return newS3Storage(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
+
+// localStorage keeps files in the uploads directory itself
+type localStorage struct {
+	dir string
+}
+
+func (l *localStorage) Put(ctx context.Context, name, path string) error {
+	dst := filepath.Join(l.dir, name)
+	if filepath.Clean(path) == filepath.Clean(dst) {
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (l *localStorage) Get(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(l.dir, name))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (l *localStorage) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(filepath.Join(l.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *localStorage) PublicURL(name string) string {
+	return ""
+}
+
+// s3Storage keeps files in an S3 or S3-compatible bucket
+type s3Storage struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	publicURL string
+}
+
+func newS3Storage(cfg Config) (*s3Storage, error) {
+	if cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for the s3 storage backend")
+	}
+	region := cfg.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := cfg.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %s", endpoint)
+	}
+
+	lookup := minio.BucketLookupDNS
+	if cfg.S3PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure:       u.Scheme != "http",
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	prefix := strings.Trim(cfg.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Storage{
+		client:    client,
+		bucket:    cfg.S3Bucket,
+		prefix:    prefix,
+		publicURL: strings.TrimSuffix(cfg.S3PublicURL, "/"),
+	}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, name, path string) error {
+	if _, err := s.client.FPutObject(ctx, s.bucket, s.prefix+name, path, minio.PutObjectOptions{}); err != nil {
+		return fmt.Errorf("s3 upload failed: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("stored %s but failed to remove local copy: %w", name, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	// GetObject sends no request until the object is read or stat'ed
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if s3NotFound(err) {
+			return nil, 0, os.ErrNotExist
+		}
+		return nil, 0, fmt.Errorf("s3 download failed: %w", err)
+	}
+	return obj, info.Size, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, s.prefix+name, minio.RemoveObjectOptions{})
+	if err != nil && !s3NotFound(err) {
+		return fmt.Errorf("s3 delete failed: %w", err)
+	}
+	return nil
+}
+
+func (s *s3Storage) PublicURL(name string) string {
+	if s.publicURL == "" {
+		return ""
+	}
+	u, err := url.JoinPath(s.publicURL, s.prefix+name)
+	if err != nil {
+		return ""
+	}
+	return u
+}
+
+// s3NotFound reports whether an S3 error means the object does not exist
+func s3NotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound
+}
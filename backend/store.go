@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,6 +18,48 @@ import (
 type Store struct {
 	db     *sql.DB
 	dbPath string
+
+	noteHistoryLimit int // versions kept per note, 0 disables history
+}
+
+// ListOptions orders list queries and filters them by date. Since and Until
+// apply to the SortBy column, or to created_at when no sort is given.
+type ListOptions struct {
+	SortBy string    // "created_at" or "updated_at", empty for the list's default column
+	Order  string    // "asc" or "desc", empty for descending
+	Since  time.Time // zero for no lower bound
+	Until  time.Time // zero for no upper bound
+}
+
+// clauses returns the extra WHERE conditions (each prefixed with AND), their
+// arguments and the ORDER BY expression for a query sorted by defaultSort
+// unless SortBy is set
+func (o ListOptions) clauses(defaultSort string) (string, []interface{}, string) {
+	column := "created_at"
+	if o.SortBy == "updated_at" {
+		column = "updated_at"
+	}
+
+	var where strings.Builder
+	var args []interface{}
+	if !o.Since.IsZero() {
+		where.WriteString(" AND " + column + " >= ?")
+		args = append(args, o.Since.Unix())
+	}
+	if !o.Until.IsZero() {
+		where.WriteString(" AND " + column + " <= ?")
+		args = append(args, o.Until.Unix())
+	}
+
+	sortColumn := column
+	if o.SortBy == "" {
+		sortColumn = defaultSort
+	}
+	direction := "DESC"
+	if o.Order == "asc" {
+		direction = "ASC"
+	}
+	return where.String(), args, sortColumn + " " + direction
 }
 
 // NewStore creates a new store
@@ -39,7 +82,7 @@ func NewStore(cfg Config) (*Store, error) {
 		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
 	}
 
-	store := &Store{db: db, dbPath: cfg.StorePath}
+	store := &Store{db: db, dbPath: cfg.StorePath, noteHistoryLimit: cfg.NoteHistoryLimit}
 
 	// Initialize schema
 	if err := store.initSchema(); err != nil {
@@ -87,9 +130,22 @@ func (s *Store) initSchema() error {
 		created_at INTEGER NOT NULL,
 		updated_at INTEGER NOT NULL,
 		metadata TEXT,
+		related_note_ids TEXT,
 		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS note_versions (
+		id TEXT PRIMARY KEY,
+		note_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		content TEXT NOT NULL,
+		source_ids TEXT,
+		created_at INTEGER NOT NULL,
+		metadata TEXT,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
 	CREATE TABLE IF NOT EXISTS chat_sessions (
 		id TEXT PRIMARY KEY,
 		notebook_id TEXT NOT NULL,
@@ -127,14 +183,110 @@ func (s *Store) initSchema() error {
 		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS assets (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		note_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		url TEXT NOT NULL,
+		mime_type TEXT,
+		file_size INTEGER DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		request TEXT NOT NULL,
+		note_id TEXT,
+		error TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		resource_type TEXT NOT NULL,
+		resource_id TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		body_hash TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (scope, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS note_renders (
+		note_id TEXT PRIMARY KEY,
+		content_hash TEXT NOT NULL,
+		html TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_sources_notebook ON sources(notebook_id);
 	CREATE INDEX IF NOT EXISTS idx_notes_notebook ON notes(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_note_versions_note ON note_versions(note_id, version);
 	CREATE INDEX IF NOT EXISTS idx_chat_sessions_notebook ON chat_sessions(notebook_id);
 	CREATE INDEX IF NOT EXISTS idx_chat_messages_session ON chat_messages(session_id);
 	CREATE INDEX IF NOT EXISTS idx_podcasts_notebook ON podcasts(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_assets_notebook ON assets(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_assets_note ON assets(note_id);
+	CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
 	`
 
-	_, err := s.db.Exec(schema)
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+
+	// Columns added after the first release, missing in older databases
+	if err := s.addColumn("notes", "related_note_ids", "TEXT"); err != nil {
+		return err
+	}
+	if err := s.addColumn("idempotency_keys", "body_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// Older releases recorded the server path of uploaded files in source
+	// metadata, where API responses exposed it
+	_, err := s.db.Exec(`
+		UPDATE sources SET metadata = json_remove(metadata, '$.path')
+		WHERE json_valid(metadata) AND json_type(metadata, '$.path') IS NOT NULL
+	`)
+	return err
+}
+
+// addColumn adds a column to a table unless the table already has it
+func (s *Store) addColumn(table, column, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
@@ -187,12 +339,18 @@ func (s *Store) GetNotebook(ctx context.Context, id string) (*Notebook, error) {
 	return &nb, nil
 }
 
-// ListNotebooks retrieves all notebooks
-func (s *Store) ListNotebooks(ctx context.Context) ([]Notebook, error) {
+// ListNotebooks retrieves all notebooks, or only those tagged with tag
+// (case-insensitive) when it is not empty, filtered and ordered by opts
+func (s *Store) ListNotebooks(ctx context.Context, tag string, opts ListOptions) ([]Notebook, error) {
+	where, args, orderBy := opts.clauses("updated_at")
 	rows, err := s.db.QueryContext(ctx, `
 		SELECT id, name, description, created_at, updated_at, metadata
-		FROM notebooks ORDER BY updated_at DESC
-	`)
+		FROM notebooks
+		WHERE (? = '' OR EXISTS (
+			SELECT 1 FROM json_each(`+notebookTagsJSON+`, '$.tags')
+			WHERE type = 'text' AND lower(value) = lower(?)
+		))`+where+`
+		ORDER BY `+orderBy, append([]interface{}{tag, tag}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -223,6 +381,57 @@ func (s *Store) ListNotebooks(ctx context.Context) ([]Notebook, error) {
 	return notebooks, nil
 }
 
+// notebookTagsJSON guards json_each against notebooks whose metadata is
+// empty or not valid JSON
+const notebookTagsJSON = `CASE WHEN json_valid(notebooks.metadata) THEN notebooks.metadata ELSE '{}' END`
+
+// ListTags returns the distinct notebook tags with the number of notebooks
+// using each, most used first. Tags differing only in case are counted
+// together.
+func (s *Store) ListTags(ctx context.Context) ([]TagCount, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT min(tags.value), COUNT(DISTINCT notebooks.id) AS count
+		FROM notebooks, json_each(`+notebookTagsJSON+`, '$.tags') AS tags
+		WHERE tags.type = 'text'
+		GROUP BY lower(tags.value)
+		ORDER BY count DESC, lower(tags.value) ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]TagCount, 0)
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Tag, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// FindNotebookByName returns the oldest notebook with the given name
+// (case-insensitive, ignoring surrounding whitespace), or nil if there is none
+func (s *Store) FindNotebookByName(ctx context.Context, name string) (*Notebook, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id FROM notebooks
+		WHERE lower(trim(name)) = lower(trim(?))
+		ORDER BY created_at ASC LIMIT 1
+	`, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetNotebook(ctx, id)
+}
+
 // UpdateNotebook updates a notebook
 func (s *Store) UpdateNotebook(ctx context.Context, id string, name, description string, metadata map[string]interface{}) (*Notebook, error) {
 	now := time.Now()
@@ -334,12 +543,214 @@ func (s *Store) ListSources(ctx context.Context, notebookID string) ([]Source, e
 	return sources, nil
 }
 
+// FindSourceByHash returns the source in a notebook whose metadata records the
+// given content hash, or nil if there is none
+func (s *Store) FindSourceByHash(ctx context.Context, notebookID, hash string) (*Source, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id FROM sources
+		WHERE notebook_id = ? AND json_extract(metadata, '$.content_hash') = ?
+		ORDER BY created_at ASC LIMIT 1
+	`, notebookID, hash).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetSource(ctx, id)
+}
+
+// ListSourceHeaders retrieves all sources for a notebook without loading
+// their content; ContentLength reports the content size in characters
+func (s *Store) ListSourceHeaders(ctx context.Context, notebookID string) ([]Source, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, name, type, url, length(content), file_name, file_size, chunk_count, created_at, updated_at, metadata
+		FROM sources WHERE notebook_id = ? ORDER BY created_at DESC
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := make([]Source, 0)
+	for rows.Next() {
+		var src Source
+		var metadataJSON string
+		var contentLength sql.NullInt64
+		var createdAt, updatedAt int64
+
+		if err := rows.Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &contentLength,
+			&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON); err != nil {
+			return nil, err
+		}
+
+		src.ContentLength = int(contentLength.Int64)
+		src.CreatedAt = time.Unix(createdAt, 0)
+		src.UpdatedAt = time.Unix(updatedAt, 0)
+
+		if metadataJSON != "" {
+			json.Unmarshal([]byte(metadataJSON), &src.Metadata)
+		} else {
+			src.Metadata = make(map[string]interface{})
+		}
+
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
+
+// ListSourceSnippets retrieves all sources for a notebook with the first
+// snippetLength characters of their content as Snippet instead of the full
+// content, so large sources are not read from disk
+func (s *Store) ListSourceSnippets(ctx context.Context, notebookID string, snippetLength int) ([]Source, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, name, type, url, substr(content, 1, ?), length(content), file_name, file_size, chunk_count, created_at, updated_at, metadata
+		FROM sources WHERE notebook_id = ? ORDER BY created_at DESC
+	`, snippetLength, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := make([]Source, 0)
+	for rows.Next() {
+		var src Source
+		var metadataJSON string
+		var snippet sql.NullString
+		var contentLength sql.NullInt64
+		var createdAt, updatedAt int64
+
+		if err := rows.Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &snippet, &contentLength,
+			&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON); err != nil {
+			return nil, err
+		}
+
+		src.Snippet = snippet.String
+		src.ContentLength = int(contentLength.Int64)
+		src.CreatedAt = time.Unix(createdAt, 0)
+		src.UpdatedAt = time.Unix(updatedAt, 0)
+
+		if metadataJSON != "" {
+			json.Unmarshal([]byte(metadataJSON), &src.Metadata)
+		} else {
+			src.Metadata = make(map[string]interface{})
+		}
+
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
+
+// ReadSourceContent reads a window of a source's content, starting at the
+// given character offset, without loading the rest of the content
+func (s *Store) ReadSourceContent(ctx context.Context, id string, offset, length int) (string, error) {
+	var content sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT substr(content, ?, ?) FROM sources WHERE id = ?`, offset+1, length, id).Scan(&content)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("source not found")
+	}
+	if err != nil {
+		return "", err
+	}
+	return content.String, nil
+}
+
 // DeleteSource deletes a source
 func (s *Store) DeleteSource(ctx context.Context, id string) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM sources WHERE id = ?`, id)
 	return err
 }
 
+// DeleteSources deletes sources of a notebook in one transaction and returns
+// the IDs that were deleted; IDs of other notebooks or unknown IDs are
+// skipped. A nil ids deletes every source of the notebook.
+func (s *Store) DeleteSources(ctx context.Context, notebookID string, ids []string) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id FROM sources WHERE notebook_id = ?`
+	args := []interface{}{notebookID}
+	if ids != nil {
+		if len(ids) == 0 {
+			return []string{}, nil
+		}
+		query += ` AND id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deleted = append(deleted, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range deleted {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM sources WHERE id = ?`, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// AppendSourceContent appends text to a source's stored content and saves
+// its new metadata. It returns the length of the content in characters
+// after the append.
+func (s *Store) AppendSourceContent(ctx context.Context, source *Source, text string) (int, error) {
+	source.UpdatedAt = time.Now()
+
+	metadataJSON, _ := json.Marshal(source.Metadata)
+
+	var length int
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE sources SET content = content || ?, metadata = ?, updated_at = ?
+		WHERE id = ?
+		RETURNING length(content)
+	`, text, string(metadataJSON), source.UpdatedAt.Unix(), source.ID).Scan(&length)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("source not found")
+	}
+	return length, err
+}
+
+// TruncateSourceContent cuts a source's content back to its first length
+// characters and restores its metadata, undoing an append
+func (s *Store) TruncateSourceContent(ctx context.Context, id string, length int, metadata map[string]interface{}) error {
+	metadataJSON, _ := json.Marshal(metadata)
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sources SET content = substr(content, 1, ?), metadata = ? WHERE id = ?
+	`, length, string(metadataJSON), id)
+	return err
+}
+
+// AddSourceChunkCount adds n chunks to the chunk count of a source
+func (s *Store) AddSourceChunkCount(ctx context.Context, id string, n int) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE sources SET chunk_count = chunk_count + ? WHERE id = ?`, n, id)
+	return err
+}
+
 // UpdateSourceChunkCount updates the chunk count for a source
 func (s *Store) UpdateSourceChunkCount(ctx context.Context, id string, chunkCount int) error {
 	_, err := s.db.ExecContext(ctx, `UPDATE sources SET chunk_count = ? WHERE id = ?`, chunkCount, id)
@@ -357,12 +768,13 @@ func (s *Store) CreateNote(ctx context.Context, note *Note) error {
 
 	metadataJSON, _ := json.Marshal(note.Metadata)
 	sourceIDsJSON, _ := json.Marshal(note.SourceIDs)
+	relatedJSON, _ := json.Marshal(note.RelatedNoteIDs)
 
 	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO notes (id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO notes (id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata, related_note_ids)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, note.ID, note.NotebookID, note.Title, note.Content, note.Type, string(sourceIDsJSON),
-		now.Unix(), now.Unix(), string(metadataJSON))
+		now.Unix(), now.Unix(), string(metadataJSON), string(relatedJSON))
 
 	return err
 }
@@ -370,14 +782,15 @@ func (s *Store) CreateNote(ctx context.Context, note *Note) error {
 // GetNote retrieves a note by ID
 func (s *Store) GetNote(ctx context.Context, id string) (*Note, error) {
 	var note Note
-	var metadataJSON, sourceIDsJSON string
+	var metadataJSON, sourceIDsJSON, relatedJSON string
 	var createdAt, updatedAt int64
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata
+		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata,
+			COALESCE(related_note_ids, '')
 		FROM notes WHERE id = ?
 	`, id).Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
-		&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON)
+		&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON, &relatedJSON)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("note not found")
 	}
@@ -398,15 +811,21 @@ func (s *Store) GetNote(ctx context.Context, id string) (*Note, error) {
 		json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
 	}
 
+	if relatedJSON != "" {
+		json.Unmarshal([]byte(relatedJSON), &note.RelatedNoteIDs)
+	}
+
 	return &note, nil
 }
 
-// ListNotes retrieves all notes for a notebook
-func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error) {
+// ListNotes retrieves the notes of a notebook, filtered and ordered by opts
+func (s *Store) ListNotes(ctx context.Context, notebookID string, opts ListOptions) ([]Note, error) {
+	where, args, orderBy := opts.clauses("created_at")
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata
-		FROM notes WHERE notebook_id = ? ORDER BY created_at DESC
-	`, notebookID)
+		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata,
+			COALESCE(related_note_ids, '')
+		FROM notes WHERE notebook_id = ?`+where+`
+		ORDER BY `+orderBy, append([]interface{}{notebookID}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -415,11 +834,11 @@ func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error
 	notes := make([]Note, 0)
 	for rows.Next() {
 		var note Note
-		var metadataJSON, sourceIDsJSON string
+		var metadataJSON, sourceIDsJSON, relatedJSON string
 		var createdAt, updatedAt int64
 
 		if err := rows.Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
-			&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON); err != nil {
+			&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON, &relatedJSON); err != nil {
 			return nil, err
 		}
 
@@ -436,27 +855,349 @@ func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error
 			json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
 		}
 
+		if relatedJSON != "" {
+			json.Unmarshal([]byte(relatedJSON), &note.RelatedNoteIDs)
+		}
+
 		notes = append(notes, note)
 	}
 
 	return notes, nil
 }
 
+// UpdateNote saves the note's title, content, sources and metadata. When the
+// title or content changes, the previous ones are kept as a version, up to
+// the configured history limit.
+func (s *Store) UpdateNote(ctx context.Context, note *Note) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.noteHistoryLimit > 0 {
+		// Archive the current row as the next version, unless only sources
+		// or metadata change
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO note_versions (id, note_id, version, title, content, source_ids, created_at, metadata)
+			SELECT ?, id, (SELECT COALESCE(MAX(version), 0) + 1 FROM note_versions WHERE note_id = ?),
+				title, content, source_ids, updated_at, metadata
+			FROM notes WHERE id = ? AND (title <> ? OR content <> ?)
+		`, uuid.New().String(), note.ID, note.ID, note.Title, note.Content); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM note_versions WHERE note_id = ? AND id NOT IN (
+				SELECT id FROM note_versions WHERE note_id = ? ORDER BY version DESC LIMIT ?
+			)
+		`, note.ID, note.ID, s.noteHistoryLimit); err != nil {
+			return err
+		}
+	}
+
+	note.UpdatedAt = time.Now()
+	metadataJSON, _ := json.Marshal(note.Metadata)
+	sourceIDsJSON, _ := json.Marshal(note.SourceIDs)
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE notes SET title = ?, content = ?, source_ids = ?, updated_at = ?, metadata = ?
+		WHERE id = ?
+	`, note.Title, note.Content, string(sourceIDsJSON), note.UpdatedAt.Unix(), string(metadataJSON), note.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("note not found")
+	}
+
+	return tx.Commit()
+}
+
+// SetRelatedNotes replaces the notes a note links to. Links are not part of
+// the note's content, so no version is archived.
+func (s *Store) SetRelatedNotes(ctx context.Context, noteID string, relatedIDs []string) error {
+	relatedJSON, _ := json.Marshal(relatedIDs)
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE notes SET related_note_ids = ? WHERE id = ?
+	`, string(relatedJSON), noteID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("note not found")
+	}
+	return nil
+}
+
+// GetNoteRender returns the HTML a note was rendered to from the content
+// with the given hash, and false when it has not been rendered from it
+func (s *Store) GetNoteRender(ctx context.Context, noteID, contentHash string) (string, bool, error) {
+	var html string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT html FROM note_renders WHERE note_id = ? AND content_hash = ?
+	`, noteID, contentHash).Scan(&html)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return html, true, nil
+}
+
+// SaveNoteRender caches the HTML a note was rendered to, replacing the one
+// rendered from earlier content
+func (s *Store) SaveNoteRender(ctx context.Context, noteID, contentHash, html string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO note_renders (note_id, content_hash, html, created_at)
+		VALUES (?, ?, ?, ?)
+	`, noteID, contentHash, html, time.Now().Unix())
+	return err
+}
+
+// NoteTitles returns the titles of the notes of a notebook among ids, keyed
+// by ID; deleted notes are left out
+func (s *Store) NoteTitles(ctx context.Context, notebookID string, ids []string) (map[string]string, error) {
+	titles := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		return titles, nil
+	}
+
+	args := []interface{}{notebookID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, title FROM notes
+		WHERE notebook_id = ? AND id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, title string
+		if err := rows.Scan(&id, &title); err != nil {
+			return nil, err
+		}
+		titles[id] = title
+	}
+	return titles, rows.Err()
+}
+
+// ListNoteVersions retrieves the previous versions of a note, newest first
+func (s *Store) ListNoteVersions(ctx context.Context, noteID string) ([]NoteVersion, error) {
+	return s.queryNoteVersions(ctx, `
+		SELECT id, note_id, version, title, content, source_ids, created_at, metadata
+		FROM note_versions WHERE note_id = ? ORDER BY version DESC
+	`, noteID)
+}
+
+// GetNoteVersion retrieves a note version by ID
+func (s *Store) GetNoteVersion(ctx context.Context, id string) (*NoteVersion, error) {
+	versions, err := s.queryNoteVersions(ctx, `
+		SELECT id, note_id, version, title, content, source_ids, created_at, metadata
+		FROM note_versions WHERE id = ?
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("note version not found")
+	}
+	return &versions[0], nil
+}
+
+func (s *Store) queryNoteVersions(ctx context.Context, query string, args ...interface{}) ([]NoteVersion, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]NoteVersion, 0)
+	for rows.Next() {
+		var version NoteVersion
+		var metadataJSON, sourceIDsJSON sql.NullString
+		var createdAt int64
+
+		if err := rows.Scan(&version.ID, &version.NoteID, &version.Version, &version.Title, &version.Content,
+			&sourceIDsJSON, &createdAt, &metadataJSON); err != nil {
+			return nil, err
+		}
+
+		version.CreatedAt = time.Unix(createdAt, 0)
+		if metadataJSON.String != "" {
+			json.Unmarshal([]byte(metadataJSON.String), &version.Metadata)
+		}
+		if sourceIDsJSON.String != "" {
+			json.Unmarshal([]byte(sourceIDsJSON.String), &version.SourceIDs)
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
 // DeleteNote deletes a note
 func (s *Store) DeleteNote(ctx context.Context, id string) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM notes WHERE id = ?`, id)
 	return err
 }
 
+// Asset operations
+
+// CreateAsset records a generated file belonging to a note
+func (s *Store) CreateAsset(ctx context.Context, asset *Asset) error {
+	asset.ID = uuid.New().String()
+	asset.CreatedAt = time.Now()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO assets (id, notebook_id, note_id, type, file_name, url, mime_type, file_size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, asset.ID, asset.NotebookID, asset.NoteID, asset.Type, asset.FileName, asset.URL,
+		asset.MimeType, asset.FileSize, asset.CreatedAt.Unix())
+
+	return err
+}
+
+// ListAssets retrieves all assets for a notebook
+func (s *Store) ListAssets(ctx context.Context, notebookID string) ([]Asset, error) {
+	return s.queryAssets(ctx, `
+		SELECT id, notebook_id, note_id, type, file_name, url, mime_type, file_size, created_at
+		FROM assets WHERE notebook_id = ? ORDER BY created_at, rowid
+	`, notebookID)
+}
+
+// ListNoteAssets retrieves the assets generated for a note
+func (s *Store) ListNoteAssets(ctx context.Context, noteID string) ([]Asset, error) {
+	return s.queryAssets(ctx, `
+		SELECT id, notebook_id, note_id, type, file_name, url, mime_type, file_size, created_at
+		FROM assets WHERE note_id = ? ORDER BY created_at, rowid
+	`, noteID)
+}
+
+func (s *Store) queryAssets(ctx context.Context, query string, args ...interface{}) ([]Asset, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := make([]Asset, 0)
+	for rows.Next() {
+		var asset Asset
+		var mimeType sql.NullString
+		var createdAt int64
+
+		if err := rows.Scan(&asset.ID, &asset.NotebookID, &asset.NoteID, &asset.Type, &asset.FileName,
+			&asset.URL, &mimeType, &asset.FileSize, &createdAt); err != nil {
+			return nil, err
+		}
+
+		asset.MimeType = mimeType.String
+		asset.CreatedAt = time.Unix(createdAt, 0)
+		assets = append(assets, asset)
+	}
+
+	return assets, rows.Err()
+}
+
+// Job operations
+
+// CreateJob records a new pending job
+func (s *Store) CreateJob(ctx context.Context, job *Job) error {
+	job.ID = uuid.New().String()
+	job.Status = JobStatusPending
+	now := time.Now()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	requestJSON, _ := json.Marshal(job.Request)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO jobs (id, notebook_id, type, status, request, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, job.NotebookID, job.Type, job.Status, string(requestJSON), now.Unix(), now.Unix())
+
+	return err
+}
+
+// GetJob retrieves a job by ID
+func (s *Store) GetJob(ctx context.Context, id string) (*Job, error) {
+	jobs, err := s.queryJobs(ctx, `
+		SELECT id, notebook_id, type, status, request, note_id, error, created_at, updated_at
+		FROM jobs WHERE id = ?
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("job not found")
+	}
+	return &jobs[0], nil
+}
+
+// ListUnfinishedJobs retrieves pending and running jobs, oldest first
+func (s *Store) ListUnfinishedJobs(ctx context.Context) ([]Job, error) {
+	return s.queryJobs(ctx, `
+		SELECT id, notebook_id, type, status, request, note_id, error, created_at, updated_at
+		FROM jobs WHERE status IN (?, ?) ORDER BY created_at, rowid
+	`, JobStatusPending, JobStatusRunning)
+}
+
+// UpdateJobStatus updates a job's status and, once finished, its result
+func (s *Store) UpdateJobStatus(ctx context.Context, id, status, noteID, errMsg string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, note_id = ?, error = ?, updated_at = ? WHERE id = ?
+	`, status, noteID, errMsg, time.Now().Unix(), id)
+	return err
+}
+
+func (s *Store) queryJobs(ctx context.Context, query string, args ...interface{}) ([]Job, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]Job, 0)
+	for rows.Next() {
+		var job Job
+		var requestJSON string
+		var noteID, errMsg sql.NullString
+		var createdAt, updatedAt int64
+
+		if err := rows.Scan(&job.ID, &job.NotebookID, &job.Type, &job.Status, &requestJSON,
+			&noteID, &errMsg, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+
+		json.Unmarshal([]byte(requestJSON), &job.Request)
+		job.NoteID = noteID.String
+		job.Error = errMsg.String
+		job.CreatedAt = time.Unix(createdAt, 0)
+		job.UpdatedAt = time.Unix(updatedAt, 0)
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
 // Chat operations
 
+// DefaultChatTitle is the title of a chat session until it is named
+const DefaultChatTitle = "New Chat"
+
 // CreateChatSession creates a new chat session
 func (s *Store) CreateChatSession(ctx context.Context, notebookID, title string) (*ChatSession, error) {
 	id := uuid.New().String()
 	now := time.Now()
 
 	if title == "" {
-		title = "New Chat"
+		title = DefaultChatTitle
 	}
 
 	metadataJSON, _ := json.Marshal(map[string]interface{}{})
@@ -507,6 +1248,52 @@ func (s *Store) GetChatSession(ctx context.Context, id string) (*ChatSession, er
 	return &session, nil
 }
 
+// UpdateChatSessionTitle renames a chat session
+func (s *Store) UpdateChatSessionTitle(ctx context.Context, id, title string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE chat_sessions SET title = ?, updated_at = ? WHERE id = ?
+	`, title, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("chat session not found")
+	}
+	return nil
+}
+
+// ReplaceDefaultChatTitle names a chat session that still has the default
+// title and reports whether it did; a session renamed meanwhile keeps its
+// name
+func (s *Store) ReplaceDefaultChatTitle(ctx context.Context, id, title string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE chat_sessions SET title = ?, updated_at = ? WHERE id = ? AND title = ?
+	`, title, time.Now().Unix(), id, DefaultChatTitle)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// UpdateChatSessionMetadata replaces the metadata of a chat session
+func (s *Store) UpdateChatSessionMetadata(ctx context.Context, id string, metadata map[string]interface{}) error {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE chat_sessions SET metadata = ?, updated_at = ? WHERE id = ?
+	`, string(metadataJSON), time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("chat session not found")
+	}
+	return nil
+}
+
 // ListChatSessions retrieves all chat sessions for a notebook
 func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]ChatSession, error) {
 	rows, err := s.db.QueryContext(ctx, `
@@ -543,12 +1330,57 @@ func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]Chat
 	return sessions, nil
 }
 
-// AddChatMessage adds a message to a chat session
-func (s *Store) AddChatMessage(ctx context.Context, sessionID, role, content string, sources []string) (*ChatMessage, error) {
+// ListRecentChatMessages retrieves the latest messages across all chat
+// sessions of a notebook, newest first, with the title of their session
+func (s *Store) ListRecentChatMessages(ctx context.Context, notebookID string, limit int) ([]RecentChatMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.id, m.session_id, m.role, m.content, m.sources, m.created_at, m.metadata, cs.title
+		FROM chat_messages m JOIN chat_sessions cs ON cs.id = m.session_id
+		WHERE cs.notebook_id = ?
+		ORDER BY m.created_at DESC, m.rowid DESC LIMIT ?
+	`, notebookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]RecentChatMessage, 0)
+	for rows.Next() {
+		var msg RecentChatMessage
+		var metadataJSON, sourcesJSON string
+		var createdAt int64
+
+		if err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &createdAt, &metadataJSON, &msg.SessionTitle); err != nil {
+			return nil, err
+		}
+
+		msg.CreatedAt = time.Unix(createdAt, 0)
+
+		if metadataJSON != "" {
+			json.Unmarshal([]byte(metadataJSON), &msg.Metadata)
+		} else {
+			msg.Metadata = make(map[string]interface{})
+		}
+
+		if sourcesJSON != "" {
+			json.Unmarshal([]byte(sourcesJSON), &msg.Sources)
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// AddChatMessage adds a message to a chat session. metadata may be nil.
+func (s *Store) AddChatMessage(ctx context.Context, sessionID, role, content string, sources []string, metadata map[string]interface{}) (*ChatMessage, error) {
 	id := uuid.New().String()
 	now := time.Now()
 
-	metadataJSON, _ := json.Marshal(map[string]interface{}{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadataJSON, _ := json.Marshal(metadata)
 	sourcesJSON, _ := json.Marshal(sources)
 
 	_, err := s.db.ExecContext(ctx, `
@@ -639,13 +1471,129 @@ func (s *Store) getChatMessage(ctx context.Context, id string) (*ChatMessage, er
 	return &msg, nil
 }
 
+// DeleteChatMessage deletes a single message from a chat session
+func (s *Store) DeleteChatMessage(ctx context.Context, sessionID, messageID string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM chat_messages WHERE id = ? AND session_id = ?`, messageID, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("chat message not found")
+	}
+	return nil
+}
+
+// DeleteChatMessages deletes messages of a chat session and returns how many
+// were deleted
+func (s *Store) DeleteChatMessages(ctx context.Context, sessionID string, ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{sessionID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM chat_messages WHERE session_id = ? AND id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
 // DeleteChatSession deletes a chat session
 func (s *Store) DeleteChatSession(ctx context.Context, id string) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM chat_sessions WHERE id = ?`, id)
 	return err
 }
 
+// MergeChatSessions moves all messages from sourceID into targetID and deletes
+// the source session. Messages keep their original timestamps and sources, so
+// the merged session reads as one chronological thread.
+func (s *Store) MergeChatSessions(ctx context.Context, targetID, sourceID string) (*ChatSession, error) {
+	if targetID == sourceID {
+		return nil, fmt.Errorf("cannot merge a chat session into itself")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE chat_messages SET session_id = ? WHERE session_id = ?`, targetID, sourceID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chat_sessions WHERE id = ?`, sourceID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE chat_sessions SET updated_at = ? WHERE id = ?`, time.Now().Unix(), targetID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetChatSession(ctx, targetID)
+}
+
+// Ping checks that the database is reachable and responding
+func (s *Store) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return err
+	}
+	var one int
+	return s.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+}
+
 // Close closes the database connection
 func (s *Store) Close() error {
 	return s.db.Close()
 }
+
+// Idempotency keys
+
+// IdempotencyRecord is the resource created by a request carrying an
+// Idempotency-Key, with the status it was answered with and the hash of
+// the request body
+type IdempotencyRecord struct {
+	ResourceType string
+	ResourceID   string
+	Status       int
+	BodyHash     string
+}
+
+// GetIdempotencyKey returns the record of a key used in scope after since,
+// or nil when the key is new
+func (s *Store) GetIdempotencyKey(ctx context.Context, scope, key string, since time.Time) (*IdempotencyRecord, error) {
+	var rec IdempotencyRecord
+	err := s.db.QueryRowContext(ctx, `
+		SELECT resource_type, resource_id, status, body_hash FROM idempotency_keys
+		WHERE scope = ? AND key = ? AND created_at >= ?
+	`, scope, key, since.Unix()).Scan(&rec.ResourceType, &rec.ResourceID, &rec.Status, &rec.BodyHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// SaveIdempotencyKey records the resource created for a key, dropping keys
+// created before expiredBefore
+func (s *Store) SaveIdempotencyKey(ctx context.Context, scope, key string, rec IdempotencyRecord, expiredBefore time.Time) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < ?`, expiredBefore.Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO idempotency_keys (scope, key, resource_type, resource_id, status, body_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, scope, key, rec.ResourceType, rec.ResourceID, rec.Status, rec.BodyHash, time.Now().Unix())
+	return err
+}
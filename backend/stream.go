@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamKeepAlive is how often a comment is sent while nothing else is, so
+// proxies keep the stream open during long silent steps such as map-reduce
+const streamKeepAlive = 15 * time.Second
+
+// eventStream writes server-sent events. Its methods may be called from
+// several goroutines.
+type eventStream struct {
+	mu sync.Mutex
+	c  *gin.Context
+}
+
+// newEventStream starts an event stream response
+func newEventStream(c *gin.Context) *eventStream {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	return &eventStream{c: c}
+}
+
+// send writes an event with data encoded as JSON
+func (e *eventStream) send(event string, data interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.c.SSEvent(event, data)
+	e.c.Writer.Flush()
+}
+
+// keepAlive sends comments until stop is called; stop returns once the last
+// one is written
+func (e *eventStream) keepAlive() (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(streamKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				e.mu.Lock()
+				e.c.Writer.WriteString(": keep-alive\n\n")
+				e.c.Writer.Flush()
+				e.mu.Unlock()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// streamTransformation runs a transformation and sends its content as
+// server-sent events while it is generated: "delta" events carry pieces of
+// the content, then "done" carries the saved note, or "error" an
+// ErrorResponse. The note's content is final; it replaces the streamed text,
+// which differs after a retry or post-processing such as quiz rendering.
+// Translations and slide decks are generated in parts and only sent whole.
+func (s *Server) streamTransformation(c *gin.Context, notebookID string, req *TransformationRequest, idem *idempotentRequest) {
+	ctx := c.Request.Context()
+
+	stream := newEventStream(c)
+	stop := stream.keepAlive()
+	req.OnChunk = func(chunk string) {
+		stream.send("delta", gin.H{"content": chunk})
+	}
+
+	note, err := s.runTransformation(ctx, notebookID, req)
+	stop()
+	req.OnChunk = nil
+	if err != nil {
+		stream.send("error", asAPIError(err).response())
+		return
+	}
+	idem.record(ctx, idempotentNote, note.ID, http.StatusOK)
+
+	stream.send("done", note)
+}
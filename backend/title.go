@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kataras/golog"
+)
+
+// Chat title modes
+const (
+	ChatTitleModeLLM      = "llm"
+	ChatTitleModeTruncate = "truncate"
+)
+
+// maxChatTitleLength is the longest generated chat title, in characters
+const maxChatTitleLength = 30
+
+// truncateTitle derives a title from the first line of a message, cut at a
+// word boundary when the message is long
+func truncateTitle(message string) string {
+	line := strings.TrimSpace(message)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	line = strings.TrimSpace(markdownMarkupPattern.ReplaceAllString(line, ""))
+	line = strings.Join(strings.Fields(line), " ")
+
+	runes := []rune(line)
+	if len(runes) <= maxChatTitleLength {
+		return line
+	}
+	cut := maxChatTitleLength
+	for i := cut; i > maxChatTitleLength/2; i-- {
+		if unicode.IsSpace(runes[i]) {
+			cut = i
+			break
+		}
+	}
+	return strings.TrimSpace(string(runes[:cut])) + "…"
+}
+
+// GenerateChatTitle asks the LLM for a short title summarizing the first
+// message of a chat
+func (a *Agent) GenerateChatTitle(ctx context.Context, message string) (string, error) {
+	return a.generateTitle(ctx, fmt.Sprintf("请为以下对话的第一条消息起一个简洁的标题（不超过15个字），只输出标题本身，不要引号和标点：\n\n%s", truncateUTF8(message, 2000)))
+}
+
+// GenerateSourceTitle asks the LLM for a short title of pasted text, in the
+// language of the text
+func (a *Agent) GenerateSourceTitle(ctx context.Context, content string) (string, error) {
+	return a.generateTitle(ctx, fmt.Sprintf("请为以下文本起一个简洁的标题（不超过15个字），使用文本本身的语言，只输出标题本身，不要引号和标点：\n\n%s", truncateUTF8(content, 2000)))
+}
+
+// generateTitle runs a titling prompt and cleans up the answer
+func (a *Agent) generateTitle(ctx context.Context, prompt string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	title, err := a.generateWithRetry(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+
+	title = strings.TrimSpace(title)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = title[:i]
+	}
+	title = strings.Trim(strings.TrimSpace(title), "\"'“”‘’「」《》#*。.")
+	if title == "" {
+		return "", fmt.Errorf("empty title")
+	}
+	if len([]rune(title)) > maxChatTitleLength {
+		title = string([]rune(title)[:maxChatTitleLength]) + "…"
+	}
+	return title, nil
+}
+
+// autoTitleSession names a session after its first user message, unless it
+// was already named. It runs in the background, so a slow title never
+// delays the answer, and leaves alone a session renamed in the meantime.
+func (s *Server) autoTitleSession(session *ChatSession, message string) {
+	if session.Title != DefaultChatTitle {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		title := ""
+		if s.cfg.ChatTitleMode == ChatTitleModeLLM {
+			generated, err := s.agent.GenerateChatTitle(ctx, message)
+			if err != nil {
+				golog.Warnf("failed to generate title for chat session %s: %v", session.ID, err)
+			}
+			title = generated
+		}
+		if title == "" {
+			title = truncateTitle(message)
+		}
+		if title == "" {
+			return
+		}
+		if _, err := s.store.ReplaceDefaultChatTitle(ctx, session.ID, title); err != nil {
+			golog.Errorf("failed to title chat session %s: %v", session.ID, err)
+		}
+	}()
+}
+
+// pastedSourceTitle names a text source added without a name: after the
+// title of an HTML page or the first heading, after a first line short
+// enough to be a title, or by asking the LLM, falling back to the start of
+// the text
+func (s *Server) pastedSourceTitle(ctx context.Context, content, htmlTitle string) string {
+	if title := strings.TrimSpace(htmlTitle); title != "" {
+		return title
+	}
+
+	firstLine := ""
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			firstLine = line
+			break
+		}
+	}
+	// A first line ending like a sentence is the start of the text, not its
+	// title
+	isHeading := strings.HasPrefix(firstLine, "#")
+	if title := truncateTitle(firstLine); title != "" && !strings.HasSuffix(title, "…") {
+		last, _ := utf8.DecodeLastRuneInString(title)
+		if isHeading || !strings.ContainsRune(".。!！?？:：;；,，", last) {
+			return title
+		}
+	}
+
+	title, err := s.agent.GenerateSourceTitle(ctx, content)
+	if err != nil {
+		golog.Warnf("failed to generate title for pasted source: %v", err)
+		return truncateTitle(content)
+	}
+	return title
+}
+
+// countUserMessages returns the number of user messages in a chat
+func countUserMessages(messages []ChatMessage) int {
+	n := 0
+	for _, msg := range messages {
+		if msg.Role == "user" {
+			n++
+		}
+	}
+	return n
+}
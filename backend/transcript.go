@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// speakerLinePattern matches transcript lines such as "Alice: text",
+// "Dr. Bob Smith: text", "[00:01:02] Alice: text" or "主持人：内容"
+var speakerLinePattern = regexp.MustCompile(`^\s*(?:\[?\(?\d{1,2}:\d{2}(?::\d{2})?\)?\]?\s*)?([\p{Lu}\p{Han}][\p{L}\p{N} .'_-]{0,39}?)\s*[:：]\s*(\S.*)$`)
+
+// speakerTurn is one uninterrupted utterance in a transcript
+type speakerTurn struct {
+	Speaker string
+	Text    string
+	Start   int // span in the original text, in characters
+	End     int
+}
+
+// transcriptChunk is a chunk of consecutive speaker turns
+type transcriptChunk struct {
+	Text     string
+	Speakers []string
+	Start    int // span in the original text, in characters
+	End      int
+}
+
+// parseTranscript detects "Speaker: text" transcripts and splits them into
+// turns. It returns false when the text does not look like a transcript, so
+// callers can fall back to regular chunking.
+func parseTranscript(text string) ([]speakerTurn, bool) {
+	var turns []speakerTurn
+	lines := strings.Split(text, "\n")
+	nonEmpty, labeled := 0, 0
+	speakers := make(map[string]bool)
+
+	offset := 0
+	for _, raw := range lines {
+		lineStart, lineEnd := offset, offset+utf8.RuneCountInString(raw)
+		offset = lineEnd + 1
+
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			continue
+		}
+		nonEmpty++
+
+		if m := speakerLinePattern.FindStringSubmatch(line); m != nil && !strings.Contains(m[1], "http") {
+			labeled++
+			speaker := strings.TrimSpace(m[1])
+			speakers[speaker] = true
+			turns = append(turns, speakerTurn{Speaker: speaker, Text: strings.TrimSpace(m[2]), Start: lineStart, End: lineEnd})
+			continue
+		}
+
+		// Continuation line of the previous turn
+		if len(turns) > 0 {
+			turns[len(turns)-1].Text += "\n" + line
+			turns[len(turns)-1].End = lineEnd
+		}
+	}
+
+	// Require several labeled turns from a small, recurring cast of speakers
+	if labeled < 4 || len(speakers) < 2 || len(speakers) > labeled/2 {
+		return nil, false
+	}
+	if float64(labeled)/float64(nonEmpty) < 0.5 {
+		return nil, false
+	}
+
+	return turns, true
+}
+
+// chunkTranscript groups consecutive turns into chunks of roughly chunkSize
+// (words, or characters for CJK text) without splitting a turn
+func chunkTranscript(turns []speakerTurn, chunkSize int, cjk bool) []transcriptChunk {
+	if chunkSize <= 0 {
+		chunkSize = 1000
+	}
+
+	var chunks []transcriptChunk
+	var current strings.Builder
+	var speakers []string
+	seen := make(map[string]bool)
+	size, start, end := 0, 0, 0
+
+	flush := func() {
+		if current.Len() == 0 {
+			return
+		}
+		chunks = append(chunks, transcriptChunk{Text: current.String(), Speakers: speakers, Start: start, End: end})
+		current.Reset()
+		speakers = nil
+		seen = make(map[string]bool)
+		size = 0
+	}
+
+	for _, turn := range turns {
+		line := turn.Speaker + ": " + turn.Text
+		turnSize := len(strings.Fields(line))
+		if cjk {
+			turnSize = len([]rune(line))
+		}
+
+		if size > 0 && size+turnSize > chunkSize {
+			flush()
+		}
+
+		if current.Len() > 0 {
+			current.WriteString("\n")
+		} else {
+			start = turn.Start
+		}
+		current.WriteString(line)
+		end = turn.End
+		size += turnSize
+		if !seen[turn.Speaker] {
+			seen[turn.Speaker] = true
+			speakers = append(speakers, turn.Speaker)
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// speakersInText returns the known speakers whose label appears in text, in
+// the order they are listed. Used when a transcript is split by window rather
+// than by turn.
+func speakersInText(text string, known []string) []string {
+	var speakers []string
+	for _, speaker := range known {
+		if strings.Contains(text, speaker+":") || strings.Contains(text, speaker+"：") {
+			speakers = append(speakers, speaker)
+		}
+	}
+	return speakers
+}
+
+// transcriptSpeakers returns the distinct speakers of a transcript in order
+// of first appearance
+func transcriptSpeakers(turns []speakerTurn) []string {
+	var speakers []string
+	seen := make(map[string]bool)
+	for _, turn := range turns {
+		if !seen[turn.Speaker] {
+			seen[turn.Speaker] = true
+			speakers = append(speakers, turn.Speaker)
+		}
+	}
+	return speakers
+}
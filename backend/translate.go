@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/prompts"
+)
+
+// translate translates the full content of the sources into
+// req.TargetLanguage. Unlike other transformations nothing is condensed, so
+// long sources are cut into pieces of TranslateChunkSize characters at
+// paragraph boundaries, translated separately and joined in order.
+func (a *Agent) translate(ctx context.Context, req *TransformationRequest, sources []Source) (*TransformationResponse, error) {
+	sources, skipped := splitEmptySources(sources)
+	if len(sources) == 0 {
+		return nil, errNoSourceContent
+	}
+
+	chunkSize := a.cfg.TranslateChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 4000
+	}
+
+	type piece struct {
+		source int
+		text   string
+	}
+	var pieces []piece
+	for i, src := range sources {
+		for _, text := range splitForTranslation(src.Content, chunkSize) {
+			pieces = append(pieces, piece{source: i, text: text})
+		}
+	}
+
+	golog.Infof("translating %d sources into %s in %d pieces", len(sources), req.TargetLanguage, len(pieces))
+	startedAt := time.Now()
+
+	translated := make([]string, len(pieces))
+	err := a.forEachBounded(ctx, len(pieces), func(ctx context.Context, i int) error {
+		text, err := a.translatePiece(ctx, req, pieces[i].text)
+		if err != nil {
+			return fmt.Errorf("failed to translate %s: %w", sources[pieces[i].source].Name, err)
+		}
+		translated[i] = strings.TrimSpace(text)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Stitch the pieces back together, with a heading per source when there
+	// are several
+	var content strings.Builder
+	for i, p := range pieces {
+		if i == 0 || pieces[i-1].source != p.source {
+			if content.Len() > 0 {
+				content.WriteString("\n\n")
+			}
+			if len(sources) > 1 {
+				content.WriteString(fmt.Sprintf("## %s\n\n", sources[p.source].Name))
+			}
+		} else {
+			content.WriteString("\n\n")
+		}
+		content.WriteString(translated[i])
+	}
+
+	sourceSummaries := make([]SourceSummary, len(sources))
+	for i, src := range sources {
+		sourceSummaries[i] = SourceSummary{
+			ID:   src.ID,
+			Name: src.Name,
+			Type: src.Type,
+		}
+	}
+
+	metadata := map[string]interface{}{
+		"target_language": req.TargetLanguage,
+		"chunks":          len(pieces),
+		"chunk_size":      chunkSize,
+		"trace": GenerationTrace{
+			Model:                 a.modelName(),
+			PromptTemplate:        req.Type,
+			PromptTemplateVersion: promptTemplateVersion,
+			SourceCount:           len(sources),
+			ContextLength:         totalContentLength(sources),
+			StartedAt:             startedAt,
+			DurationMs:            time.Since(startedAt).Milliseconds(),
+		},
+	}
+	if len(skipped) > 0 {
+		metadata["skipped_sources"] = skipped
+	}
+
+	return &TransformationResponse{
+		Type:      req.Type,
+		Content:   content.String(),
+		Sources:   sourceSummaries,
+		CreatedAt: time.Now(),
+		Metadata:  metadata,
+	}, nil
+}
+
+// translatePiece translates one piece of a source
+func (a *Agent) translatePiece(ctx context.Context, req *TransformationRequest, text string) (string, error) {
+	prompt := prompts.NewPromptTemplate(
+		translatePrompt(),
+		[]string{"language", "prompt", "content"},
+	)
+	prompt.TemplateFormat = prompts.TemplateFormatFString
+
+	extra := req.Prompt
+	if extra == "" {
+		extra = "无"
+	}
+
+	promptValue, err := prompt.Format(map[string]any{
+		"language": req.TargetLanguage,
+		"prompt":   extra,
+		"content":  text,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+
+	ctx, cancel := a.llmContext(ctx)
+	defer cancel()
+
+	_, seedOptions := a.seedOptions(req)
+	response, err := a.generateWithRetry(ctx, promptValue, seedOptions...)
+	if err != nil {
+		return "", llmError(ctx, err)
+	}
+	return response, nil
+}
+
+// splitForTranslation cuts text into pieces of at most size characters,
+// preferring paragraph breaks, then line breaks, then sentence ends, so
+// that no piece starts mid-sentence unless a sentence is longer than size
+func splitForTranslation(text string, size int) []string {
+	text = strings.TrimSpace(text)
+	var pieces []string
+	for utf8.RuneCountInString(text) > size {
+		window := truncateRunes(text, size)
+		limit := len(window)
+		cut := -1
+		for _, sep := range []string{"\n\n", "\n", "。", ". ", "！", "？", "! ", "? "} {
+			// Ignore breaks in the first half, which would make tiny pieces
+			if i := strings.LastIndex(window, sep); i > limit/2 {
+				cut = i + len(sep)
+				break
+			}
+		}
+		if cut < 0 {
+			cut = limit
+		}
+		if cut == 0 {
+			// size is smaller than the first rune
+			_, cut = utf8.DecodeRuneInString(text)
+		}
+		if piece := strings.TrimSpace(text[:cut]); piece != "" {
+			pieces = append(pieces, piece)
+		}
+		text = strings.TrimSpace(text[cut:])
+	}
+	if text != "" {
+		pieces = append(pieces, text)
+	}
+	return pieces
+}
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -9,9 +10,11 @@ type Source struct {
 	ID          string                 `json:"id"`
 	NotebookID  string                 `json:"notebook_id"`
 	Name        string                 `json:"name"`
-	Type        string                 `json:"type"` // "file", "url", "text", "youtube"
+	Type        string                 `json:"type"` // "file", "image", "url", "text", "youtube"
 	URL         string                 `json:"url,omitempty"`
 	Content     string                 `json:"content,omitempty"`
+	ContentLength int                  `json:"content_length,omitempty"` // Set when Content is not loaded
+	Snippet     string                 `json:"snippet,omitempty"`             // Start of the content, in source lists
 	FileName    string                 `json:"file_name,omitempty"`
 	FileSize    int64                  `json:"file_size,omitempty"`
 	ChunkCount  int                    `json:"chunk_count"`
@@ -20,6 +23,16 @@ type Source struct {
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// SourceChunk represents a single indexed chunk of a source
+type SourceChunk struct {
+	ID          string `json:"id"` // Stable across re-ingestion of unchanged content
+	Index       int    `json:"index"`
+	Text        string `json:"text"`
+	StartOffset int    `json:"start_offset"` // Character offsets into the source content
+	EndOffset   int    `json:"end_offset"`
+	HasVector   bool   `json:"has_vector"`
+}
+
 // Note represents a note generated from sources
 type Note struct {
 	ID          string                 `json:"id"`
@@ -28,9 +41,46 @@ type Note struct {
 	Content     string                 `json:"content"`
 	Type        string                 `json:"type"` // "summary", "faq", "study_guide", "outline", "custom"
 	SourceIDs   []string               `json:"source_ids"`
+	Assets      []Asset                `json:"assets,omitempty"`
 	CreatedAt   time.Time              `json:"created_at"`
 	UpdatedAt   time.Time              `json:"updated_at"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+
+	RelatedNoteIDs []string   `json:"related_note_ids,omitempty"` // Notes of the notebook this note links to
+	RelatedNotes   []NoteLink `json:"related_notes,omitempty"`    // The linked notes with their titles, when fetched
+	HTML           string     `json:"html,omitempty"`             // The content rendered to HTML, when fetched with render=html
+}
+
+// NoteLink is a note linked from another note
+type NoteLink struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// NoteVersion is a previous state of a note, saved when it was edited or
+// regenerated
+type NoteVersion struct {
+	ID        string                 `json:"id"`
+	NoteID    string                 `json:"note_id"`
+	Version   int                    `json:"version"`
+	Title     string                 `json:"title"`
+	Content   string                 `json:"content"`
+	SourceIDs []string               `json:"source_ids"`
+	CreatedAt time.Time              `json:"created_at"` // When this content was written
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// Asset represents a file generated for a note, such as an infographic or slide image
+type Asset struct {
+	ID         string    `json:"id"`
+	NotebookID string    `json:"notebook_id"`
+	NoteID     string    `json:"note_id"`
+	Type       string    `json:"type"` // "image"
+	FileName   string    `json:"file_name"`
+	URL        string    `json:"url"`
+	MimeType   string    `json:"mime_type,omitempty"`
+	FileSize   int64     `json:"file_size"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 // Notebook represents a collection of sources and notes
@@ -54,6 +104,13 @@ type ChatMessage struct {
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// RecentChatMessage is a chat message listed across the sessions of a
+// notebook, with the title of its session
+type RecentChatMessage struct {
+	ChatMessage
+	SessionTitle string `json:"session_title"`
+}
+
 // ChatSession represents a chat session within a notebook
 type ChatSession struct {
 	ID           string                 `json:"id"`
@@ -83,11 +140,56 @@ type Podcast struct {
 
 // TransformationRequest represents a request to generate a note
 type TransformationRequest struct {
-	Type       string   `json:"type"`       // "summary", "faq", "study_guide", "outline", "podcast", "custom"
+	Type       string   `json:"type"`       // "summary", "faq", "study_guide", "outline", "podcast", "translate", "custom"
 	Prompt     string   `json:"prompt"`     // Custom prompt for "custom" type
 	SourceIDs  []string `json:"source_ids"` // Specific sources to use, empty = all
 	Length     string   `json:"length"`     // "short", "medium", "long"
-	Format     string   `json:"format"`     // "markdown", "bullet_points", "paragraphs"
+	Lengths    []string `json:"lengths,omitempty"` // Several summary lengths generated in one call
+	Format     string   `json:"format"`     // "markdown", "bullet_points", "paragraphs"; "json" for a structured quiz
+	Async      bool     `json:"async,omitempty"` // Run as a background job; always true for image types
+	NoteID     string   `json:"note_id,omitempty"` // Regenerate into this note, keeping its previous content as a version
+	CallbackURL string  `json:"callback_url,omitempty"` // Run as a background job and POST the result here when done
+	Seed       *int     `json:"seed,omitempty"` // Sampling seed for reproducible output, defaults to LLM_SEED
+	Model      string   `json:"model,omitempty"` // Generate with this model, one of LLM_ALLOWED_MODELS
+	Query      string   `json:"query,omitempty"` // Build the context from chunks relevant to this topic instead of whole sources
+	TopK       int      `json:"top_k,omitempty"` // Chunks retrieved for Query, defaults to TRANSFORM_TOP_K
+	Language   string   `json:"language,omitempty"` // Output language, a code like "en", a name or "auto"; defaults to OUTPUT_LANGUAGE
+	TargetLanguage string `json:"target_language,omitempty"` // Language the "translate" type translates into, e.g. "English" or "中文"
+	Debug      bool     `json:"debug,omitempty"` // Include the rendered prompt in the metadata, as with DEBUG_PROMPTS
+	Title      string   `json:"title,omitempty"` // Title of the note, defaults to the type's title in the output language
+	Stream     bool     `json:"stream,omitempty"` // Send the content as server-sent events while it is generated
+
+	// OnChunk receives the content as the model generates it
+	OnChunk func(chunk string) `json:"-"`
+}
+
+// Job represents a transformation running in the background
+type Job struct {
+	ID         string                `json:"id"`
+	NotebookID string                `json:"notebook_id"`
+	Type       string                `json:"type"`   // Transformation type
+	Status     string                `json:"status"` // "pending", "running", "completed", "failed", "canceled"
+	Request    TransformationRequest `json:"request"`
+	NoteID     string                `json:"note_id,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	CreatedAt  time.Time             `json:"created_at"`
+	UpdatedAt  time.Time             `json:"updated_at"`
+}
+
+// BatchTransformationRequest represents a request to run several transformations at once
+type BatchTransformationRequest struct {
+	Requests []TransformationRequest `json:"requests"`
+	Parallel bool                    `json:"parallel"` // Run items concurrently with a bounded worker pool
+}
+
+// BatchTransformationResult is the per-item outcome of a batch transformation
+type BatchTransformationResult struct {
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Note  *Note  `json:"note,omitempty"`
+	Job   *Job   `json:"job,omitempty"` // for items run as background jobs
+	Error string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
 }
 
 // TransformationResponse represents the response from a transformation
@@ -100,6 +202,57 @@ type TransformationResponse struct {
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// Quiz is the structured form of a quiz generated with format "json"
+type Quiz struct {
+	Questions []QuizQuestion `json:"questions"`
+}
+
+// QuizQuestion is a single quiz question with its answer
+type QuizQuestion struct {
+	Type        string   `json:"type"` // "multiple_choice", "true_false", "short_answer"
+	Question    string   `json:"question"`
+	Options     []string `json:"options,omitempty"` // Choices for multiple_choice questions
+	Answer      string   `json:"answer"`            // One of Options, "true"/"false", or the expected answer
+	Explanation string   `json:"explanation,omitempty"`
+}
+
+// TokenUsage reports the tokens consumed by an LLM call
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// GenerationTrace records how a note was generated
+type GenerationTrace struct {
+	Model                 string      `json:"model"`
+	PromptTemplate        string      `json:"prompt_template"`
+	PromptTemplateVersion string      `json:"prompt_template_version"`
+	TokenUsage            *TokenUsage `json:"token_usage,omitempty"`
+	Seed                  int         `json:"seed,omitempty"`
+	SourceCount           int         `json:"source_count"`
+	ContextLength         int         `json:"context_length"`
+	PromptLength          int         `json:"prompt_length"`
+	StartedAt             time.Time   `json:"started_at"`
+	DurationMs            int64       `json:"duration_ms"`
+}
+
+// PromptDebug is the prompt of a generation as sent to the model, returned
+// in the metadata when DEBUG_PROMPTS or a request's debug flag is set
+type PromptDebug struct {
+	Prompt  string `json:"prompt"`
+	Context string `json:"context"` // the source or retrieved text inserted into the prompt
+}
+
+// NoteTraceResponse exposes the generation provenance of a note
+type NoteTraceResponse struct {
+	NoteID    string      `json:"note_id"`
+	Type      string      `json:"type"`
+	SourceIDs []string    `json:"source_ids"`
+	CreatedAt time.Time   `json:"created_at"`
+	Trace     interface{} `json:"trace"`
+}
+
 // SourceSummary is a lightweight source reference
 type SourceSummary struct {
 	ID   string `json:"id"`
@@ -107,22 +260,183 @@ type SourceSummary struct {
 	Type string `json:"type"`
 }
 
+// Citation points at the passage of a source used to answer a chat message
+type Citation struct {
+	Label       int    `json:"label"` // Matches the [来源 N] marker in the prompt context and the answer
+	SourceID    string `json:"source_id"`
+	SourceName  string `json:"source_name"`
+	ChunkIndex  int    `json:"chunk_index"`
+	StartOffset int    `json:"start_offset"` // Character offsets into the source content
+	EndOffset   int    `json:"end_offset"`
+	ChunkID     string `json:"chunk_id,omitempty"`
+	Score       float32 `json:"score"` // Retrieval score (0-1): cosine similarity, or normalized keyword match score
+	Cited       bool    `json:"cited,omitempty"` // The answer cites this chunk by its label
+}
+
 // ChatRequest represents a chat request
 type ChatRequest struct {
 	Message   string                 `json:"message"`
 	SessionID string                 `json:"session_id,omitempty"`
 	Context   map[string]interface{} `json:"context,omitempty"`
+	SourceIDs []string               `json:"source_ids,omitempty"` // restricts retrieval to these sources
+	NoteID    OptionalString         `json:"note_id"`              // anchors the session to a note used as context, null or "" detaches it
+	NoteOnly  bool                   `json:"note_only,omitempty"`  // answer from the note alone, without retrieval
+	Debug     bool                   `json:"debug,omitempty"`      // include the rendered prompt in the metadata, as with DEBUG_PROMPTS
+	Model     string                 `json:"model,omitempty"`      // answer with this model, one of LLM_ALLOWED_MODELS
+}
+
+// OptionalString is a JSON string field that tells an absent field from
+// one set to null or a string
+type OptionalString struct {
+	Set   bool   // the field was present
+	Value string // empty when the field was null
+}
+
+// UnmarshalJSON records that the field was present
+func (o *OptionalString) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Value = ""
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}
+
+// MarshalJSON encodes the value, or null when it is empty
+func (o OptionalString) MarshalJSON() ([]byte, error) {
+	if o.Value == "" {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.Value)
 }
 
 // ChatResponse represents a chat response
 type ChatResponse struct {
 	Message     string                 `json:"message"`
 	Sources     []SourceSummary        `json:"sources"`
+	Citations   []Citation             `json:"citations,omitempty"`
 	SessionID   string                 `json:"session_id"`
 	MessageID   string                 `json:"message_id"`
+	UserMessageID string               `json:"user_message_id,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// PromptTemplateResponse represents the effective prompt template for a transformation type
+type PromptTemplateResponse struct {
+	Type     string `json:"type"`
+	Template string `json:"template"`
+}
+
+// AddSourceRequest represents a request to add a text, URL or sitemap source
+type AddSourceRequest struct {
+	Name     string                 `json:"name"` // optional for text, titled from the content
+	Type     string                 `json:"type" binding:"required"`
+	URL      string                 `json:"url"`
+	Content  string                 `json:"content"`
+	Metadata map[string]interface{} `json:"metadata"`
+	Force    bool                   `json:"force"`
+	Index    *bool                  `json:"index"` // add to the vector index; nil follows the notebook's default
+
+	// Sitemap options
+	Include  []string `json:"include"`
+	Exclude  []string `json:"exclude"`
+	MaxPages int      `json:"max_pages"`
+}
+
+// BatchAddSourcesRequest represents a request to add several sources at once
+type BatchAddSourcesRequest struct {
+	Sources []AddSourceRequest `json:"sources"`
+}
+
+// BatchAddSourceResult is the per-item outcome of a batch source addition
+type BatchAddSourceResult struct {
+	Index     int     `json:"index"`
+	Source    *Source `json:"source,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	ErrorCode string  `json:"error_code,omitempty"`
+	Details   string  `json:"details,omitempty"`
+}
+
+// DeleteSourcesRequest selects the sources to delete at once
+type DeleteSourcesRequest struct {
+	SourceIDs []string `json:"source_ids"`
+	All       bool     `json:"all"` // Delete every source of the notebook
+}
+
+// DeleteSourcesResponse reports a bulk source deletion
+type DeleteSourcesResponse struct {
+	Deleted       int      `json:"deleted"`
+	DeletedIDs    []string `json:"deleted_ids"`
+	NotFound      []string `json:"not_found,omitempty"` // Requested IDs that are not sources of the notebook
+	ChunksRemoved int      `json:"chunks_removed"`
+}
+
+// SitemapIngestResponse reports the sources created from a sitemap
+type SitemapIngestResponse struct {
+	Sitemap string        `json:"sitemap"`
+	Found   int           `json:"found"`   // Matching page URLs listed in the sitemap
+	Sources []Source      `json:"sources"` // Created sources, without content
+	Skipped []SkippedPage `json:"skipped,omitempty"`
+}
+
+// SkippedPage is a sitemap page that was not added as a source
+type SkippedPage struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+// TagCount is a notebook tag with the number of notebooks using it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// ReindexResponse reports the result of rebuilding a notebook's index
+type ReindexResponse struct {
+	NotebookID string `json:"notebook_id"`
+	Sources    int    `json:"sources"`
+	Chunks     int    `json:"chunks"`
+}
+
+// UploadInitRequest starts a resumable upload of a file sent in parts
+type UploadInitRequest struct {
+	NotebookID string `json:"notebook_id" binding:"required"`
+	FileName   string `json:"file_name" binding:"required"`
+	Size       int64  `json:"size" binding:"required"` // total file size in bytes
+	PartSize   int64  `json:"part_size,omitempty"`     // bytes per part, all but the last part must be this size
+	Force      bool   `json:"force,omitempty"`         // add the file even if it duplicates a source
+	Index      *bool  `json:"index,omitempty"`         // add the file to the vector index; nil follows the notebook's default
+}
+
+// UploadSession is the state of a resumable upload. Part n (from 1) holds
+// bytes [(n-1)*part_size, n*part_size) of the file.
+type UploadSession struct {
+	ID            string    `json:"upload_id"`
+	NotebookID    string    `json:"notebook_id"`
+	FileName      string    `json:"file_name"`
+	Size          int64     `json:"size"`
+	PartSize      int64     `json:"part_size"`
+	TotalParts    int       `json:"total_parts"`
+	ReceivedParts []int     `json:"received_parts"`
+	Force         bool      `json:"force,omitempty"`
+	Index         *bool     `json:"index,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// SimilarityRequest compares a text with another text or with a source
+type SimilarityRequest struct {
+	TextA    string `json:"text_a" binding:"required"`
+	TextB    string `json:"text_b,omitempty"`
+	SourceID string `json:"source_id,omitempty"`
+}
+
+// SimilarityResponse reports how similar two texts are and how it was measured
+type SimilarityResponse struct {
+	Similarity float64 `json:"similarity"`
+	Method     string  `json:"method"` // "embedding_cosine" or "keyword_overlap"
+	Model      string  `json:"model,omitempty"`
+}
+
 // ErrorResponse represents an error response
 type ErrorResponse struct {
 	Error   string `json:"error"`
@@ -132,8 +446,25 @@ type ErrorResponse struct {
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status    string            `json:"status"`
-	Version   string            `json:"version"`
-	Timestamp int64             `json:"timestamp"`
-	Services  map[string]string `json:"services"`
+	Status    string                  `json:"status"` // "ok" or "unavailable"
+	Version   string                  `json:"version"`
+	Timestamp int64                   `json:"timestamp"`
+	Services  map[string]string       `json:"services"`
+	Checks    map[string]ServiceCheck `json:"checks"`
+	LLMLoad   *LLMLoad                `json:"llm_load,omitempty"` // set with LLM_MAX_CONCURRENCY
+}
+
+// LLMLoad is the use of the LLM_MAX_CONCURRENCY generation slots
+type LLMLoad struct {
+	InFlight       int `json:"in_flight"`
+	Queued         int `json:"queued"`
+	MaxConcurrency int `json:"max_concurrency"`
+	MaxQueue       int `json:"max_queue"` // 0 for no limit
+}
+
+// ServiceCheck is the result of probing a dependency
+type ServiceCheck struct {
+	Status    string `json:"status"` // "ok", "error" or "skipped"
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
 }
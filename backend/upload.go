@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultUploadExtensions are the file types ingestion can extract text from
+var defaultUploadExtensions = []string{
+	".txt", ".md", ".markdown", ".csv", ".json", ".html", ".htm", ".xml", ".srt", ".vtt", ".log",
+	".pdf", ".docx", ".doc", ".pptx", ".ppt", ".xlsx", ".xls",
+	".png", ".jpg", ".jpeg", ".tif", ".tiff", ".bmp", ".gif", ".webp",
+}
+
+// multipartOverhead allows for form fields and part headers on top of the
+// file itself when limiting upload request bodies
+const multipartOverhead = 1 << 20
+
+// uploadExtensionAllowed reports whether a file name has an extension listed
+// in ALLOWED_UPLOAD_EXTENSIONS (with or without the dot, any case)
+func uploadExtensionAllowed(allowed []string, name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == "*" {
+			return true
+		}
+		if ext != "" && "."+strings.TrimPrefix(a, ".") == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds of sanitized upload names, in characters
+const (
+	maxUploadBaseName  = 100
+	maxUploadExtension = 16
+)
+
+// cleanUploadName returns the last element of a client-supplied file name,
+// NFC-normalized and without control characters. It is meant for display;
+// use uniqueUploadName for names on disk.
+func cleanUploadName(name string) string {
+	name = norm.NFC.String(name)
+	// Some clients send a full path, with either separator
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// reservedUploadNames are Windows device names, which cannot be used as a
+// file name with any extension
+var reservedUploadNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// sanitizeUploadName reduces a client-supplied file name to a safe base name
+// and extension: letters, digits, '-', '_' and '.', no leading dots, bounded
+// in length, and not a reserved device name. Anything else becomes '_'.
+func sanitizeUploadName(name string) (base, ext string) {
+	name = cleanUploadName(name)
+	ext = filepath.Ext(name)
+	base = strings.TrimSuffix(name, ext)
+
+	safe := func(s string, max int) string {
+		var b strings.Builder
+		n := 0
+		for _, r := range s {
+			if n == max {
+				break
+			}
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+				b.WriteRune(r)
+			} else {
+				b.WriteRune('_')
+			}
+			n++
+		}
+		return b.String()
+	}
+
+	base = strings.TrimLeft(safe(base, maxUploadBaseName), ".")
+	ext = safe(strings.TrimPrefix(ext, "."), maxUploadExtension)
+	if base == "" {
+		base = "upload"
+	}
+	if stem, _, _ := strings.Cut(base, "."); reservedUploadNames[strings.ToLower(stem)] {
+		base = "_" + base
+	}
+	if ext != "" {
+		ext = "." + ext
+	}
+	return base, ext
+}
+
+// uniqueUploadName builds the name an upload is stored under: the sanitized
+// client name with a random suffix to avoid conflicts
+func uniqueUploadName(name string) string {
+	base, ext := sanitizeUploadName(name)
+	return fmt.Sprintf("%s_%s%s", base, uuid.New().String()[:8], ext)
+}
+
+// uploadPath joins a file name to the uploads directory and verifies the
+// result stays directly inside it
+func uploadPath(dir, name string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(absDir, name)
+	if filepath.Dir(full) != absDir {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return full, nil
+}
@@ -0,0 +1,346 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// Resumable uploads: the client opens a session, sends the file in numbered
+// parts that can be resent after a dropped connection, then completes the
+// session, which assembles the file and ingests it like POST /api/upload.
+// Sessions are directories under UPLOAD_SESSIONS_DIR holding session.json
+// and one file per received part, so they survive restarts.
+
+const (
+	defaultUploadPartSize = 8 << 20
+	minUploadPartSize     = 256 << 10
+	maxUploadPartSize     = 64 << 20
+
+	// uploadSessionTTL is how long a session may sit idle before it is
+	// removed
+	uploadSessionTTL = 24 * time.Hour
+)
+
+func (s *Server) handleInitUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req UploadInitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error(), Code: ErrCodeInvalidRequest})
+		return
+	}
+	if _, err := s.store.GetNotebook(ctx, req.NotebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found", Code: ErrCodeNotebookNotFound})
+		return
+	}
+	if req.Size <= 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "size must be positive", Code: ErrCodeInvalidRequest})
+		return
+	}
+	if s.cfg.MaxUploadBytes > 0 && req.Size > s.cfg.MaxUploadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, uploadTooLargeError(s.cfg.MaxUploadBytes))
+		return
+	}
+	if !uploadExtensionAllowed(s.cfg.AllowedUploadExtensions, req.FileName) {
+		c.JSON(http.StatusUnsupportedMediaType, ErrorResponse{
+			Error: fmt.Sprintf("File type %q is not allowed, allowed types: %s",
+				filepath.Ext(req.FileName), strings.Join(s.cfg.AllowedUploadExtensions, ", ")),
+			Code: ErrCodeUnsupportedFileType,
+		})
+		return
+	}
+	if cleanUploadName(req.FileName) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file name", Code: ErrCodeInvalidRequest})
+		return
+	}
+
+	partSize := req.PartSize
+	if partSize == 0 {
+		partSize = defaultUploadPartSize
+	}
+	if partSize < minUploadPartSize || partSize > maxUploadPartSize {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("part_size must be between %d and %d bytes", minUploadPartSize, maxUploadPartSize),
+			Code:  ErrCodeInvalidRequest,
+		})
+		return
+	}
+
+	s.removeExpiredUploadSessions()
+
+	session := &UploadSession{
+		ID:         uuid.New().String(),
+		NotebookID: req.NotebookID,
+		FileName:   req.FileName,
+		Size:       req.Size,
+		PartSize:   partSize,
+		TotalParts: int((req.Size + partSize - 1) / partSize),
+		Force:      req.Force,
+		Index:      req.Index,
+		CreatedAt:  time.Now(),
+	}
+	if err := s.saveUploadSession(session); err != nil {
+		golog.Errorf("failed to create upload session: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create upload session", Code: ErrCodeInternal})
+		return
+	}
+	session.ReceivedParts = []int{}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// handleGetUpload reports which parts were received, so an interrupted
+// client knows where to resume
+func (s *Server) handleGetUpload(c *gin.Context) {
+	session, ok := s.uploadSessionOrAbort(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) handleUploadPart(c *gin.Context) {
+	session, ok := s.uploadSessionOrAbort(c)
+	if !ok {
+		return
+	}
+
+	part, err := strconv.Atoi(c.Param("part"))
+	if err != nil || part < 1 || part > session.TotalParts {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("part must be a number from 1 to %d", session.TotalParts),
+			Code:  ErrCodeInvalidRequest,
+		})
+		return
+	}
+
+	// Every part but the last covers exactly part_size bytes
+	start := int64(part-1) * session.PartSize
+	expected := session.PartSize
+	if rest := session.Size - start; rest < expected {
+		expected = rest
+	}
+	if c.Request.ContentLength >= 0 && c.Request.ContentLength != expected {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("part %d must be %d bytes, got %d", part, expected, c.Request.ContentLength),
+			Code:  ErrCodeInvalidRequest,
+		})
+		return
+	}
+
+	// Write to a temporary file first, so a dropped connection never leaves
+	// a truncated part that counts as received
+	dir := s.uploadSessionDir(session.ID)
+	tmp, err := os.CreateTemp(dir, "part-*.tmp")
+	if err != nil {
+		golog.Errorf("failed to write upload part: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save part", Code: ErrCodeInternal})
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(c.Request.Body, expected+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		golog.Warnf("upload %s part %d interrupted: %v", session.ID, part, err)
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to receive part", Code: ErrCodeInvalidRequest, Details: err.Error()})
+		return
+	}
+	if n != expected {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("part %d must be %d bytes, got %d", part, expected, n),
+			Code:  ErrCodeInvalidRequest,
+		})
+		return
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, uploadPartName(part))); err != nil {
+		golog.Errorf("failed to save upload part: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save part", Code: ErrCodeInternal})
+		return
+	}
+
+	session.ReceivedParts = s.receivedUploadParts(session.ID)
+	c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) handleCompleteUpload(c *gin.Context) {
+	session, ok := s.uploadSessionOrAbort(c)
+	if !ok {
+		return
+	}
+	if missing := missingUploadParts(session); len(missing) > 0 {
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   fmt.Sprintf("%d of %d parts are missing", len(missing), session.TotalParts),
+			Code:    ErrCodeUploadIncomplete,
+			Details: fmt.Sprintf("missing parts: %v", missing),
+		})
+		return
+	}
+
+	displayName := cleanUploadName(session.FileName)
+	uniqueFileName := uniqueUploadName(displayName)
+	filePath, err := uploadPath(s.cfg.UploadsDir, uniqueFileName)
+	if err == nil {
+		err = os.MkdirAll(s.cfg.UploadsDir, 0755)
+	}
+	if err == nil {
+		err = s.assembleUpload(session, filePath)
+	}
+	if err != nil {
+		golog.Errorf("failed to assemble upload %s: %v", session.ID, err)
+		os.Remove(filePath)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to assemble file", Code: ErrCodeInternal})
+		return
+	}
+	os.RemoveAll(s.uploadSessionDir(session.ID))
+
+	s.ingestUpload(c, session.NotebookID, displayName, uniqueFileName, filePath, IngestFileOptions{Force: session.Force, Index: session.Index}, nil)
+}
+
+func (s *Server) handleAbortUpload(c *gin.Context) {
+	session, ok := s.uploadSessionOrAbort(c)
+	if !ok {
+		return
+	}
+	if err := os.RemoveAll(s.uploadSessionDir(session.ID)); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to abort upload", Code: ErrCodeInternal})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// uploadSessionOrAbort loads the session named in the URL, responding with
+// a 404 when there is none
+func (s *Server) uploadSessionOrAbort(c *gin.Context) (*UploadSession, bool) {
+	id := c.Param("uploadId")
+	// IDs are UUIDs; anything else could escape the sessions directory
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Upload not found", Code: ErrCodeUploadNotFound})
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(s.uploadSessionDir(id), "session.json"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Upload not found", Code: ErrCodeUploadNotFound})
+		return nil, false
+	}
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		golog.Errorf("corrupt upload session %s: %v", id, err)
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Upload not found", Code: ErrCodeUploadNotFound})
+		return nil, false
+	}
+	session.ReceivedParts = s.receivedUploadParts(id)
+	return &session, true
+}
+
+func (s *Server) uploadSessionDir(id string) string {
+	return filepath.Join(s.cfg.UploadSessionsDir, id)
+}
+
+func (s *Server) saveUploadSession(session *UploadSession) error {
+	dir := s.uploadSessionDir(session.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "session.json"), data, 0644)
+}
+
+func uploadPartName(part int) string {
+	return fmt.Sprintf("part-%06d", part)
+}
+
+// receivedUploadParts lists the numbers of the parts stored for a session
+func (s *Server) receivedUploadParts(id string) []int {
+	entries, _ := os.ReadDir(s.uploadSessionDir(id))
+	parts := []int{}
+	for _, entry := range entries {
+		var n int
+		if _, err := fmt.Sscanf(entry.Name(), "part-%06d", &n); err == nil && !strings.HasSuffix(entry.Name(), ".tmp") {
+			parts = append(parts, n)
+		}
+	}
+	sort.Ints(parts)
+	return parts
+}
+
+func missingUploadParts(session *UploadSession) []int {
+	received := make(map[int]bool, len(session.ReceivedParts))
+	for _, part := range session.ReceivedParts {
+		received[part] = true
+	}
+	var missing []int
+	for part := 1; part <= session.TotalParts; part++ {
+		if !received[part] {
+			missing = append(missing, part)
+		}
+	}
+	return missing
+}
+
+// assembleUpload concatenates the parts of a session into a file
+func (s *Server) assembleUpload(session *UploadSession, filePath string) error {
+	out, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	dir := s.uploadSessionDir(session.ID)
+	var written int64
+	for part := 1; part <= session.TotalParts; part++ {
+		in, err := os.Open(filepath.Join(dir, uploadPartName(part)))
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+	if written != session.Size {
+		return fmt.Errorf("assembled %d bytes, expected %d", written, session.Size)
+	}
+	return out.Close()
+}
+
+// removeExpiredUploadSessions deletes sessions that received nothing for
+// uploadSessionTTL
+func (s *Server) removeExpiredUploadSessions() {
+	entries, err := os.ReadDir(s.cfg.UploadSessionsDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			golog.Warnf("failed to list upload sessions: %v", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || time.Since(info.ModTime()) < uploadSessionTTL {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.cfg.UploadSessionsDir, entry.Name())); err == nil {
+			golog.Infof("removed expired upload session %s", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeUploadName(t *testing.T) {
+	tests := []struct {
+		name     string
+		wantBase string
+		wantExt  string
+	}{
+		{"report.pdf", "report", ".pdf"},
+		{"../../etc/passwd", "passwd", ""},
+		{"..\\..\\windows\\system32\\cmd.exe", "cmd", ".exe"},
+		{"/var/www/../../root/.ssh/id_rsa.pub", "id_rsa", ".pub"},
+		{"evil\x00.php.txt", "evil.php", ".txt"},
+		{"notes\r\n.md", "notes", ".md"},
+		{"..", "upload", ""},
+		{".", "upload", ""},
+		{"", "upload", ""},
+		{".htaccess", "upload", ".htaccess"},
+		{"...hidden.txt", "hidden", ".txt"},
+		{"a b;rm -rf $HOME.txt", "a_b_rm_-rf__HOME", ".txt"},
+		{"résumé.docx", "résumé", ".docx"},
+	}
+	for _, tt := range tests {
+		base, ext := sanitizeUploadName(tt.name)
+		if base != tt.wantBase || ext != tt.wantExt {
+			t.Errorf("sanitizeUploadName(%q) = %q, %q, want %q, %q", tt.name, base, ext, tt.wantBase, tt.wantExt)
+		}
+	}
+}
+
+func TestSanitizeUploadNameBoundsLength(t *testing.T) {
+	base, ext := sanitizeUploadName(strings.Repeat("長", 500) + "." + strings.Repeat("x", 100))
+	if n := utf8.RuneCountInString(base); n != maxUploadBaseName {
+		t.Errorf("base has %d characters, want %d", n, maxUploadBaseName)
+	}
+	if n := utf8.RuneCountInString(ext); n != maxUploadExtension+1 {
+		t.Errorf("extension has %d characters, want %d", n, maxUploadExtension+1)
+	}
+}
+
+func TestUniqueUploadNameAvoidsReservedNames(t *testing.T) {
+	for _, name := range []string{"CON", "nul.txt", "AUX.tar.gz", "com1.log", "LPT1"} {
+		unique := uniqueUploadName(name)
+		stem, _, _ := strings.Cut(unique, ".")
+		if reservedUploadNames[strings.ToLower(stem)] {
+			t.Errorf("uniqueUploadName(%q) = %q, a reserved device name", name, unique)
+		}
+	}
+}
+
+func TestUploadPathStaysInUploadsDir(t *testing.T) {
+	dir := t.TempDir()
+	malicious := []string{
+		"../../etc/passwd",
+		"..\\..\\boot.ini",
+		"evil\x00.txt",
+		"..",
+		"/etc/shadow",
+		"a/../../b.txt",
+	}
+	for _, name := range malicious {
+		unique := uniqueUploadName(name)
+		if strings.ContainsAny(unique, "/\\\x00") || strings.HasPrefix(unique, ".") {
+			t.Errorf("uniqueUploadName(%q) = %q, want a plain file name", name, unique)
+		}
+		full, err := uploadPath(dir, unique)
+		if err != nil {
+			t.Errorf("uploadPath(%q) error = %v", unique, err)
+			continue
+		}
+		if filepath.Dir(full) != dir {
+			t.Errorf("uploadPath(%q) = %s, outside %s", unique, full, dir)
+		}
+
+		// Unsanitized names are refused rather than resolved
+		if _, err := uploadPath(dir, name); err == nil && strings.ContainsAny(name, "/") {
+			t.Errorf("uploadPath(%q) accepted a name with a path", name)
+		}
+	}
+}
@@ -1,29 +1,86 @@
 package backend
 
 import (
+	"container/heap"
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"unicode"
 
+	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/schema"
+	"golang.org/x/sync/singleflight"
 )
 
 // VectorStore wraps different vector store implementations
 type VectorStore struct {
-	cfg  Config
-	docs []schema.Document
-	mu   sync.RWMutex
+	cfg   Config
+	index chunkIndex
+	mu    sync.Mutex // serializes writes, so replacing a source's chunks is atomic
+
+	embedder       embeddings.Embedder // nil when no embedding model is configured
+	embedders      map[string]embeddings.Embedder
+	notebookModels map[string]string // per-notebook embedding model overrides
+	embedMu        sync.Mutex
+
+	// Notebooks indexed on first use, most recently used first, when
+	// SKIP_STARTUP_REINDEX defers indexing. lazyMu only guards the list;
+	// indexing runs outside it, one run per notebook at a time.
+	lazyMu   sync.Mutex
+	hot      *list.List
+	hotIndex map[string]*list.Element
+	indexing singleflight.Group
+
+	llmLimiter *llmLimiter // shared with the agent, bounds vision OCR
+	reranker   Reranker    // nil unless RERANK_ENABLED
+}
+
+// chunkIndex stores the indexed chunks of every notebook. The in-memory index
+// is the default; others keep chunks in a shared database. Embeddings are
+// passed alongside the documents, nil for chunks without one.
+type chunkIndex interface {
+	// add stores chunks, replacing chunks with the same chunk_id
+	add(ctx context.Context, docs []schema.Document, vectors []*chunkVector) error
+	// remove drops the chunks of a source and returns how many were removed
+	remove(ctx context.Context, notebookID, sourceKey string) (int, error)
+	// sourceChunks returns the chunks of a source, in no particular order
+	sourceChunks(ctx context.Context, notebookID, sourceKey string) ([]schema.Document, []*chunkVector, error)
+	// searchable returns the chunks searched for a notebook: its own and
+	// those not tied to any notebook, or all chunks for an empty notebook
+	// ID, limited to the given sources when there are any
+	searchable(ctx context.Context, notebookID string, sourceKeys []string) ([]schema.Document, []*chunkVector, error)
+	stats(ctx context.Context, provider, model string) (VectorStats, error)
+	// persistent reports whether chunks outlive the process
+	persistent() bool
+}
+
+// notebookRemover is implemented by indexes that can drop a whole notebook,
+// which lazy indexing needs to evict notebooks
+type notebookRemover interface {
+	removeNotebook(ctx context.Context, notebookID string) (int, error)
+}
+
+// knnSearcher is implemented by indexes that run nearest-neighbour search
+// themselves. Results carry their cosine similarity as Score and only
+// include chunks embedded with the query's provider and model.
+type knnSearcher interface {
+	knn(ctx context.Context, notebookID string, sourceKeys []string, query *chunkVector, k int, threshold float64) ([]schema.Document, error)
 }
 
 // VectorStats contains statistics about the vector store
 type VectorStats struct {
 	TotalDocuments int
 	TotalVectors   int
-	Dimension      int
+	StaleVectors   int // embedded by a provider other than the active one
+	Dimension      int // of the default embedding model, 0 before anything is embedded
 }
 
 // NewVectorStore creates a new vector store based on configuration
@@ -33,9 +90,36 @@ func NewVectorStore(cfg Config) (*VectorStore, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	embedder, err := createEmbedder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedder: %w", err)
+	}
+
+	var index chunkIndex
+	switch cfg.VectorStoreType {
+	case "redis":
+		index, err = newRedisIndex(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to redis: %w", err)
+		}
+	case "pgvector", "postgres":
+		index, err = newPGVectorIndex(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+		}
+	default:
+		index = newMemoryIndex()
+	}
+
 	return &VectorStore{
-		cfg:  cfg,
-		docs: make([]schema.Document, 0),
+		cfg:            cfg,
+		index:          index,
+		embedder:       embedder,
+		embedders:      make(map[string]embeddings.Embedder),
+		notebookModels: make(map[string]string),
+		hot:            list.New(),
+		hotIndex:       make(map[string]*list.Element),
+		reranker:       newReranker(cfg),
 	}, nil
 }
 
@@ -60,68 +144,282 @@ func (vs *VectorStore) IngestDocuments(ctx context.Context, paths []string) erro
 
 // ExtractDocument reads and converts a document to text/markdown
 func (vs *VectorStore) ExtractDocument(ctx context.Context, path string) (string, error) {
+	text, _, err := vs.extractDocument(ctx, path)
+	return text, err
+}
+
+// extractDocument is ExtractDocument, also returning the extraction method.
+// Documents markitdown fails on, or all of them when it is disabled, get a
+// best-effort plain extraction instead.
+func (vs *VectorStore) extractDocument(ctx context.Context, path string) (string, string, error) {
+	// Images are converted to text with OCR
+	if isImageFile(path) {
+		text, err := vs.extractImageText(ctx, path)
+		return text, extractionOCR, err
+	}
+
 	// Check if file needs markitdown conversion
 	ext := strings.ToLower(filepath.Ext(path))
-	if vs.cfg.EnableMarkitdown && vs.needsMarkitdown(ext) {
-		return vs.convertWithMarkitdown(path)
+	if vs.needsMarkitdown(ext) {
+		if !vs.cfg.EnableMarkitdown {
+			return vs.extractPlain(ctx, path)
+		}
+		text, err := vs.convertWithMarkitdown(ctx, path)
+		if err == nil {
+			return text, extractionMarkitdown, nil
+		}
+		fmt.Printf("[VectorStore] Falling back to plain extraction for %s\n", path)
+		text, method, fallbackErr := vs.extractPlain(ctx, path)
+		if fallbackErr != nil {
+			return "", "", fmt.Errorf("%w; plain extraction failed: %v", err, fallbackErr)
+		}
+		return text, method, nil
 	}
 
-	// Direct read for text files or when markitdown is disabled
-	bytes, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
-	}
-	return string(bytes), nil
+	// Direct read for text files, converting legacy encodings such as GBK or
+	// Latin-1 to UTF-8
+	text, err := vs.readTextFile(path)
+	return text, extractionText, err
+}
+
+// IngestOptions controls how a source is indexed
+type IngestOptions struct {
+	SourceID         string // ID of the stored source, used for citations
+	NotebookID       string // scopes the chunks to a notebook for search
+	EmbeddingModel   string // overrides EMBEDDING_MODEL for this notebook
+	ChunkSize        int    // overrides CHUNK_SIZE when > 0
+	ChunkOverlap     int    // overrides CHUNK_OVERLAP when ChunkOverlapMode is set
+	ChunkOverlapMode string
+}
+
+// WithSource returns a copy of the options for indexing the given source
+func (o IngestOptions) WithSource(sourceID string) IngestOptions {
+	o.SourceID = sourceID
+	return o
 }
 
 // IngestText ingests raw text content
 func (vs *VectorStore) IngestText(ctx context.Context, sourceName, content string) error {
-	// Split content into chunks
-	chunks := vs.splitText(content, vs.cfg.ChunkSize, vs.cfg.ChunkOverlap)
+	return vs.IngestTextWithOptions(ctx, sourceName, content, IngestOptions{})
+}
+
+// IngestTextWithOptions ingests raw text content for a notebook, embedding
+// the chunks with the notebook's embedding model when one is available
+func (vs *VectorStore) IngestTextWithOptions(ctx context.Context, sourceName, content string, opts IngestOptions) error {
+	chunks, chunkSpeakers, isTranscript := vs.chunkContent(content, opts)
+	vectors := vs.embedTextChunks(ctx, chunks, opts)
+	sourceKey := ingestSourceKey(sourceName, opts)
 
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
-	// Create documents
+	// Re-ingesting a source replaces its previous chunks
+	replaced, err := vs.index.remove(ctx, opts.NotebookID, sourceKey)
+	if err != nil {
+		return fmt.Errorf("failed to replace chunks: %w", err)
+	}
+	if err := vs.addChunks(ctx, sourceName, sourceKey, chunks, chunkSpeakers, isTranscript, vectors, 0, 0, opts); err != nil {
+		return err
+	}
+
+	fmt.Printf("[VectorStore] Ingested %d chunks from source '%s', replacing %d\n", len(chunks), sourceName, replaced)
+	return nil
+}
+
+// AppendText indexes text appended to a source that is already indexed,
+// without re-chunking what was there. offset is the length of the source
+// content before the appended text, in characters, so the new chunks record
+// their span in the full source. Returns the number of chunks added.
+func (vs *VectorStore) AppendText(ctx context.Context, sourceName string, offset int, text string, opts IngestOptions) (int, error) {
+	chunks, chunkSpeakers, isTranscript := vs.chunkContent(text, opts)
+	vectors := vs.embedTextChunks(ctx, chunks, opts)
+	sourceKey := ingestSourceKey(sourceName, opts)
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	// Number the new chunks after the existing ones
+	existing, _, err := vs.index.sourceChunks(ctx, opts.NotebookID, sourceKey)
+	if err != nil {
+		return 0, err
+	}
+	firstIndex := 0
+	for _, doc := range existing {
+		if index, _ := doc.Metadata["chunk"].(int); index >= firstIndex {
+			firstIndex = index + 1
+		}
+	}
+	if err := vs.addChunks(ctx, sourceName, sourceKey, chunks, chunkSpeakers, isTranscript, vectors, firstIndex, offset, opts); err != nil {
+		return 0, err
+	}
+
+	fmt.Printf("[VectorStore] Appended %d chunks to source '%s'\n", len(chunks), sourceName)
+	return len(chunks), nil
+}
+
+// chunkContent splits content into chunks with the notebook's chunking
+// settings. Transcripts with speaker labels keep track of who is speaking,
+// and are split on turn boundaries when enabled.
+func (vs *VectorStore) chunkContent(content string, opts IngestOptions) ([]textChunk, [][]string, bool) {
+	chunkSize := vs.cfg.ChunkSize
+	if opts.ChunkSize > 0 {
+		chunkSize = opts.ChunkSize
+	}
+	chunkOverlap, overlapMode := vs.cfg.ChunkOverlap, vs.cfg.ChunkOverlapMode
+	if opts.ChunkOverlapMode != "" {
+		chunkOverlap, overlapMode = opts.ChunkOverlap, opts.ChunkOverlapMode
+	}
+
+	var chunks []textChunk
+	var chunkSpeakers [][]string
+	turns, isTranscript := parseTranscript(content)
+	if isTranscript && vs.cfg.TranscriptChunkByTurn {
+		fmt.Printf("[VectorStore] Detected transcript with %d turns, splitting by speaker turn\n", len(turns))
+		for _, tc := range chunkTranscript(turns, chunkSize, isCJKText(content)) {
+			chunks = append(chunks, textChunk{Text: tc.Text, Start: tc.Start, End: tc.End})
+			chunkSpeakers = append(chunkSpeakers, tc.Speakers)
+		}
+	} else {
+		chunks = vs.splitText(content, chunkSize, chunkOverlap, overlapMode)
+		if isTranscript {
+			known := transcriptSpeakers(turns)
+			for _, chunk := range chunks {
+				chunkSpeakers = append(chunkSpeakers, speakersInText(chunk.Text, known))
+			}
+		}
+	}
+	return chunks, chunkSpeakers, isTranscript
+}
+
+// embedTextChunks embeds chunks with the notebook's embedding model
+func (vs *VectorStore) embedTextChunks(ctx context.Context, chunks []textChunk, opts IngestOptions) []*chunkVector {
+	texts := make([]string, len(chunks))
 	for i, chunk := range chunks {
+		texts[i] = chunk.Text
+	}
+
+	if opts.NotebookID != "" {
+		vs.SetNotebookEmbeddingModel(opts.NotebookID, opts.EmbeddingModel)
+	}
+	return vs.embedChunks(ctx, opts.EmbeddingModel, texts)
+}
+
+// ingestSourceKey returns the key chunks of a source are stored under
+func ingestSourceKey(sourceName string, opts IngestOptions) string {
+	if opts.SourceID != "" {
+		return opts.SourceID
+	}
+	return sourceName
+}
+
+// addChunks stores chunks of a source, numbering them from firstIndex and
+// shifting their offsets by offset. The caller must hold vs.mu.
+func (vs *VectorStore) addChunks(ctx context.Context, sourceName, sourceKey string, chunks []textChunk, chunkSpeakers [][]string, isTranscript bool, vectors []*chunkVector, firstIndex, offset int, opts IngestOptions) error {
+	docs := make([]schema.Document, len(chunks))
+	docVectors := make([]*chunkVector, len(chunks))
+	for i, chunk := range chunks {
+		index := firstIndex + i
 		doc := schema.Document{
-			PageContent: chunk,
+			PageContent: chunk.Text,
 			Metadata: map[string]any{
-				"source": sourceName,
-				"chunk":  i,
+				"chunk_id":     chunkID(opts.NotebookID, sourceKey, index, chunk.Text),
+				"source":       sourceName,
+				"chunk":        index,
+				"start_offset": offset + chunk.Start,
+				"end_offset":   offset + chunk.End,
 			},
 		}
-		vs.docs = append(vs.docs, doc)
+		if opts.NotebookID != "" {
+			doc.Metadata["notebook_id"] = opts.NotebookID
+		}
+		if opts.SourceID != "" {
+			doc.Metadata["source_id"] = opts.SourceID
+		}
+		var vector *chunkVector
+		if vectors != nil && vectors[i] != nil {
+			vector = vectors[i]
+			doc.Metadata["embedding_provider"] = vector.Provider
+			doc.Metadata["embedding_model"] = vector.Model
+			doc.Metadata["embedding_dim"] = len(vector.Values)
+		}
+		if isTranscript {
+			doc.Metadata["transcript"] = true
+			if speakers := chunkSpeakers[i]; len(speakers) > 0 {
+				doc.Metadata["speakers"] = speakers
+				if len(speakers) == 1 {
+					doc.Metadata["speaker"] = speakers[0]
+				}
+			}
+		}
+		docs[i] = doc
+		docVectors[i] = vector
+	}
+	if err := vs.index.add(ctx, docs, docVectors); err != nil {
+		return fmt.Errorf("failed to store chunks: %w", err)
 	}
-
-	fmt.Printf("[VectorStore] Ingested %d chunks from source '%s' (total docs: %d)\n", len(chunks), sourceName, len(vs.docs))
 	return nil
 }
 
-// splitText splits text into chunks
-func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []string {
+// chunkID derives a stable identifier for a chunk, so the same content
+// ingested again for the same source gets the same ID
+func chunkID(notebookID, sourceKey string, index int, text string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00", notebookID, sourceKey, index)
+	h.Write([]byte(text))
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// chunkSourceKey identifies the source a chunk belongs to: the stored source
+// ID when known, otherwise the source name
+func chunkSourceKey(doc schema.Document) string {
+	if id, ok := doc.Metadata["source_id"].(string); ok && id != "" {
+		return id
+	}
+	name, _ := doc.Metadata["source"].(string)
+	return name
+}
+
+// belongsTo reports whether a chunk was ingested for the given notebook and
+// source key
+func belongsTo(doc schema.Document, notebookID, sourceKey string) bool {
+	docNotebook, _ := doc.Metadata["notebook_id"].(string)
+	return docNotebook == notebookID && chunkSourceKey(doc) == sourceKey
+}
+
+// textChunk is a chunk of a source with its span in the original text, in
+// characters (Unicode code points)
+type textChunk struct {
+	Text  string
+	Start int
+	End   int
+}
+
+// splitText splits text into chunks. When overlapMode is OverlapModePercent,
+// chunkOverlap is a percentage of chunkSize rather than an absolute value.
+// Each chunk records its span in the original text.
+func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int, overlapMode string) []textChunk {
 	if chunkSize <= 0 {
 		chunkSize = 1000
 	}
+	if overlapMode == OverlapModePercent {
+		chunkOverlap = chunkSize * chunkOverlap / 100
+	}
 	if chunkOverlap < 0 {
 		chunkOverlap = 200
 	}
+	if chunkOverlap >= chunkSize {
+		// Overlap must leave room to advance, otherwise splitting never terminates
+		chunkOverlap = chunkSize / 5
+	}
 
 	fmt.Printf("[VectorStore] Splitting text (len=%d, chunkSize=%d, overlap=%d)\n", len(text), chunkSize, chunkOverlap)
 
-	var chunks []string
+	var chunks []textChunk
 
 	// Check if text contains mostly CJK characters (Chinese, Japanese, Korean)
 	runes := []rune(text)
-	cjkCount := 0
-	for _, r := range runes {
-		if r >= 0x4E00 && r <= 0x9FFF { // CJK Unified Ideographs
-			cjkCount++
-		}
-	}
-	cjkRatio := float64(cjkCount) / float64(len(runes))
 
-	if cjkRatio > 0.3 {
+	if isCJKText(text) {
 		// For CJK text, split by character count (runes)
 		fmt.Println("[VectorStore] Using CJK splitting (by character count)")
 		for i := 0; i < len(runes); i += (chunkSize - chunkOverlap) {
@@ -130,8 +428,7 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 				end = len(runes)
 			}
 
-			chunk := string(runes[i:end])
-			chunks = append(chunks, chunk)
+			chunks = append(chunks, textChunk{Text: string(runes[i:end]), Start: i, End: end})
 
 			if end >= len(runes) {
 				break
@@ -140,7 +437,7 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 	} else {
 		// For Western text, split by words
 		fmt.Println("[VectorStore] Using word-based splitting")
-		words := strings.Fields(text)
+		words := wordSpans(runes)
 
 		for i := 0; i < len(words); i += (chunkSize - chunkOverlap) {
 			end := i + chunkSize
@@ -148,8 +445,15 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 				end = len(words)
 			}
 
-			chunk := strings.Join(words[i:end], " ")
-			chunks = append(chunks, chunk)
+			parts := make([]string, 0, end-i)
+			for _, w := range words[i:end] {
+				parts = append(parts, string(runes[w[0]:w[1]]))
+			}
+			chunks = append(chunks, textChunk{
+				Text:  strings.Join(parts, " "),
+				Start: words[i][0],
+				End:   words[end-1][1],
+			})
 
 			if end >= len(words) {
 				break
@@ -161,34 +465,258 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 	return chunks
 }
 
-// SimilaritySearch performs a similarity search (simple keyword matching for now)
+// wordSpans returns the [start, end) rune offsets of the whitespace
+// separated words in text, matching strings.Fields
+func wordSpans(runes []rune) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range runes {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(runes)})
+	}
+	return spans
+}
+
+// isCJKText reports whether text consists mostly of CJK characters
+func isCJKText(text string) bool {
+	runes := []rune(text)
+	if len(runes) == 0 {
+		return false
+	}
+	cjkCount := 0
+	for _, r := range runes {
+		if r >= 0x4E00 && r <= 0x9FFF { // CJK Unified Ideographs
+			cjkCount++
+		}
+	}
+	return float64(cjkCount)/float64(len(runes)) > 0.3
+}
+
+// SimilaritySearch performs a similarity search across all notebooks
 func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDocs int) ([]schema.Document, error) {
+	return vs.SearchNotebook(ctx, "", query, numDocs, nil)
+}
+
+// SearchNotebook performs a similarity search over a notebook's chunks (and
+// chunks not tied to any notebook). Chunks embedded with the notebook's
+// embedding model are ranked by cosine similarity; otherwise it falls back
+// to keyword matching. Both scores range from 0 to 1, and chunks scoring
+// below SIMILARITY_THRESHOLD are dropped, so the result may be empty. When
+// sourceIDs is not empty, only chunks of those sources are searched.
+//
+// With RERANK_ENABLED, RERANK_CANDIDATES chunks are retrieved and the
+// reranker picks the numDocs best of them; should it fail, the retrieval
+// order is kept.
+func (vs *VectorStore) SearchNotebook(ctx context.Context, notebookID, query string, numDocs int, sourceIDs []string) ([]schema.Document, error) {
 	if numDocs <= 0 {
 		numDocs = 5
 	}
+	if vs.reranker == nil {
+		return vs.searchNotebook(ctx, notebookID, query, numDocs, sourceIDs)
+	}
 
-	vs.mu.RLock()
-	defer vs.mu.RUnlock()
+	docs, err := vs.searchNotebook(ctx, notebookID, query, max(numDocs, vs.cfg.RerankCandidates), sourceIDs)
+	if err != nil || len(docs) < 2 {
+		return docs, err
+	}
+	reranked, err := rerankDocs(ctx, vs.reranker, query, docs, numDocs)
+	if err != nil {
+		fmt.Printf("[VectorStore] Rerank failed, keeping the retrieval order: %v\n", err)
+		return docs[:min(numDocs, len(docs))], nil
+	}
+	fmt.Printf("[VectorStore] Reranked %d candidates, returning top %d\n", len(docs), len(reranked))
+	return reranked, nil
+}
 
-	fmt.Printf("[VectorStore] Searching for '%s' (total docs: %d)\n", query, len(vs.docs))
+// searchNotebook retrieves the numDocs best chunks for SearchNotebook
+func (vs *VectorStore) searchNotebook(ctx context.Context, notebookID, query string, numDocs int, sourceIDs []string) ([]schema.Document, error) {
+
+	queryVector := vs.embedQuery(ctx, vs.notebookEmbeddingModel(notebookID), query)
+
+	fmt.Printf("[VectorStore] Searching for '%s'\n", query)
+
+	// Indexes with their own nearest-neighbour search rank by embedding
+	// themselves; keyword matching below remains the fallback
+	if searcher, ok := vs.index.(knnSearcher); ok && queryVector != nil {
+		result, err := searcher.knn(ctx, notebookID, sourceIDs, queryVector, numDocs, vs.cfg.SimilarityThreshold)
+		switch {
+		case err != nil:
+			// Rank in process below instead
+			fmt.Printf("[VectorStore] Index search failed, searching in process: %v\n", err)
+		case len(result) > 0:
+			fmt.Printf("[VectorStore] Returning top %d results by embedding (best score: %.3f)\n", len(result), result[0].Score)
+			return result, nil
+		default:
+			queryVector = nil
+		}
+	}
 
-	if len(vs.docs) == 0 {
+	docs, vectors, err := vs.index.searchable(ctx, notebookID, sourceIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chunks: %w", err)
+	}
+	if len(docs) == 0 {
 		fmt.Println("[VectorStore] No documents available for search")
 		return []schema.Document{}, nil
 	}
 
+	if queryVector != nil {
+		if result := vs.vectorSearch(queryVector, docs, vectors, numDocs); len(result) > 0 {
+			return vs.withUnembedded(query, result, docs, vectors, numDocs), nil
+		}
+	}
+
+	return vs.keywordSearch(query, docs, numDocs), nil
+}
+
+// vectorSearch ranks the candidates that were embedded with the same model as
+// the query by cosine similarity. Chunks embedded with another model are
+// never compared against the query. vectors is aligned with docs.
+func (vs *VectorStore) vectorSearch(queryVector *chunkVector, docs []schema.Document, vectors []*chunkVector, numDocs int) []schema.Document {
+	scores := make([]docScore, 0, len(docs))
+	mismatched := 0
+	for i, vector := range vectors {
+		if vector == nil {
+			continue
+		}
+		score, err := compareVectors(queryVector, vector)
+		if err != nil {
+			mismatched++
+			continue
+		}
+		if score < vs.cfg.SimilarityThreshold {
+			continue
+		}
+		scores = append(scores, docScore{doc: docs[i], score: score})
+	}
+
+	if mismatched > 0 {
+		fmt.Printf("[VectorStore] Skipped %d chunks not comparable with the query embedding (%s %s, %d dimensions), reindex the notebook to search them by embedding\n",
+			mismatched, queryVector.Provider, queryVector.Model, len(queryVector.Values))
+	}
+
+	scores = topScores(scores, numDocs)
+
+	result := make([]schema.Document, 0, len(scores))
+	for i := range scores {
+		doc := scores[i].doc
+		doc.Score = float32(scores[i].score)
+		result = append(result, doc)
+	}
+
+	if len(result) > 0 {
+		fmt.Printf("[VectorStore] Returning top %d results by embedding (best score: %.3f)\n", len(result), scores[0].score)
+	}
+
+	return result
+}
+
+// withUnembedded adds the chunks without an embedding, whose embedding
+// failed, to embedding results when they match the query by keyword.
+// vectors is aligned with docs.
+func (vs *VectorStore) withUnembedded(query string, result, docs []schema.Document, vectors []*chunkVector, numDocs int) []schema.Document {
+	var unembedded []schema.Document
+	for i, vector := range vectors {
+		if vector == nil {
+			unembedded = append(unembedded, docs[i])
+		}
+	}
+	if len(unembedded) == 0 {
+		return result
+	}
+	keywordScores := vs.keywordScores(query, unembedded)
+	if len(keywordScores) == 0 {
+		return result
+	}
+
+	scores := make([]docScore, 0, len(result)+len(keywordScores))
+	for _, doc := range result {
+		scores = append(scores, docScore{doc: doc, score: float64(doc.Score)})
+	}
+	scores = topScores(append(scores, keywordScores...), numDocs)
+	merged := make([]schema.Document, len(scores))
+	for i := range scores {
+		merged[i] = scores[i].doc
+		merged[i].Score = float32(scores[i].score)
+	}
+	return merged
+}
+
+// keywordSearch ranks the candidates by keyword matching
+func (vs *VectorStore) keywordSearch(query string, candidates []schema.Document, numDocs int) []schema.Document {
+	scores := vs.keywordScores(query, candidates)
+	fmt.Printf("[VectorStore] Found %d matching documents\n", len(scores))
+
+	// If no matches found, return all documents (fallback)
+	// This allows the LLM to use the full context. With a similarity
+	// threshold nothing is returned instead, weak context is worse than none.
+	if len(scores) == 0 && vs.cfg.SimilarityThreshold > 0 {
+		fmt.Printf("[VectorStore] No documents above similarity threshold %.2f\n", vs.cfg.SimilarityThreshold)
+		return []schema.Document{}
+	}
+	if len(scores) == 0 {
+		fmt.Println("[VectorStore] No matches found, returning all documents as fallback")
+		result := make([]schema.Document, 0, min(numDocs, len(candidates)))
+		for i := 0; i < cap(result); i++ {
+			result = append(result, candidates[i])
+		}
+		return result
+	}
+
+	// Return top results
+	scores = topScores(scores, numDocs)
+	result := make([]schema.Document, 0, len(scores))
+	for i := range scores {
+		doc := scores[i].doc
+		doc.Score = float32(scores[i].score)
+		result = append(result, doc)
+	}
+
+	if len(result) > 0 {
+		fmt.Printf("[VectorStore] Returning top %d results (best score: %.3f)\n", len(result), scores[0].score)
+	}
+
+	return result
+}
+
+// keywordScores scores the candidates matching the query by keywords, from 0
+// to 1, dropping those below SIMILARITY_THRESHOLD
+func (vs *VectorStore) keywordScores(query string, candidates []schema.Document) []docScore {
 	// For Chinese and general text, use substring matching
 	// Also extract individual words for English
 	queryLower := strings.ToLower(query)
 	queryRunes := []rune(queryLower)
+	queryWords := strings.Fields(queryLower)
+
+	// Best possible score: substring, all characters, every word and the
+	// question keyword boost
+	maxScore := 10.0 + 5.0 + 1.0
+	for _, word := range queryWords {
+		if len(word) > 2 {
+			maxScore += 2.0
+		}
+	}
 
-	type docScore struct {
-		doc   schema.Document
-		score float64
+	// If the query asks about the document, all documents get a boost
+	questionBoost := 0.0
+	for _, keyword := range []string{"介绍", "什么", "啥", "内容", "文档", "说"} {
+		if strings.Contains(queryLower, keyword) {
+			questionBoost = 1.0
+			break
+		}
 	}
 
-	scores := make([]docScore, 0, len(vs.docs))
-	for _, doc := range vs.docs {
+	scores := make([]docScore, 0, len(candidates))
+	for _, doc := range candidates {
 		content := strings.ToLower(doc.PageContent)
 		score := 0.0
 
@@ -211,61 +739,130 @@ func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDo
 		}
 
 		// 3. Word-based matching for English/Space-separated languages
-		queryWords := strings.Fields(queryLower)
 		for _, word := range queryWords {
 			if len(word) > 2 && strings.Contains(content, word) {
 				score += 2.0
 			}
 		}
 
-		// 4. Check for common question keywords in Chinese
-		questionKeywords := []string{"介绍", "什么", "啥", "内容", "文档", "说"}
-		for _, keyword := range questionKeywords {
-			if strings.Contains(queryLower, keyword) {
-				// If query asks about the document, boost all documents
-				score += 1.0
-				break
-			}
-		}
+		// 4. Common question keywords in Chinese
+		score += questionBoost
 
-		if score > 0 {
+		// Normalize to 0-1 by the best score this query could get
+		score /= maxScore
+		if score > 0 && score >= vs.cfg.SimilarityThreshold {
 			scores = append(scores, docScore{doc: doc, score: score})
 		}
 	}
+	return scores
+}
 
-	fmt.Printf("[VectorStore] Found %d matching documents\n", len(scores))
+// docScore is a search candidate with its score
+type docScore struct {
+	doc   schema.Document
+	score float64
+}
 
-	// Sort by score descending
-	for i := 0; i < len(scores); i++ {
-		for j := i + 1; j < len(scores); j++ {
-			if scores[j].score > scores[i].score {
-				scores[i], scores[j] = scores[j], scores[i]
-			}
-		}
+// rankedBefore orders search results by score, breaking ties by chunk
+// index, then source name, then chunk ID, so identical queries always return
+// the same results in the same order
+func rankedBefore(a, b docScore) bool {
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	chunkA, _ := a.doc.Metadata["chunk"].(int)
+	chunkB, _ := b.doc.Metadata["chunk"].(int)
+	if chunkA != chunkB {
+		return chunkA < chunkB
+	}
+	sourceA, _ := a.doc.Metadata["source"].(string)
+	sourceB, _ := b.doc.Metadata["source"].(string)
+	if sourceA != sourceB {
+		return sourceA < sourceB
 	}
+	idA, _ := a.doc.Metadata["chunk_id"].(string)
+	idB, _ := b.doc.Metadata["chunk_id"].(string)
+	return idA < idB
+}
 
-	// If no matches found, return all documents (fallback)
-	// This allows the LLM to use the full context
-	if len(scores) == 0 {
-		fmt.Println("[VectorStore] No matches found, returning all documents as fallback")
-		result := make([]schema.Document, 0, min(numDocs, len(vs.docs)))
-		for i := 0; i < len(result); i++ {
-			result = append(result, vs.docs[i])
+// topScores returns the k best scores in rank order. Only k candidates are
+// kept while scanning, so large indexes are not sorted in full.
+func topScores(scores []docScore, k int) []docScore {
+	if len(scores) > k {
+		h := &worstFirst{}
+		for _, score := range scores {
+			if h.Len() < k {
+				heap.Push(h, score)
+			} else if rankedBefore(score, (*h)[0]) {
+				(*h)[0] = score
+				heap.Fix(h, 0)
+			}
 		}
-		return result, nil
+		scores = *h
 	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return rankedBefore(scores[i], scores[j])
+	})
+	return scores
+}
 
-	// Return top results
-	result := make([]schema.Document, 0, numDocs)
-	for i := 0; i < len(scores) && i < numDocs; i++ {
-		result = append(result, scores[i].doc)
+// worstFirst is a heap of search candidates with the lowest ranked on top
+type worstFirst []docScore
+
+func (h worstFirst) Len() int           { return len(h) }
+func (h worstFirst) Less(i, j int) bool { return rankedBefore(h[j], h[i]) }
+func (h worstFirst) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *worstFirst) Push(x any)        { *h = append(*h, x.(docScore)) }
+func (h *worstFirst) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// diversifyBySource picks n of the ranked docs taking at most perSource
+// chunks of each source first, so one long document cannot crowd out the
+// others. Slots left over are filled with the remaining chunks in rank order.
+// perSource <= 0 keeps the ranking as is.
+func diversifyBySource(docs []schema.Document, n, perSource int) []schema.Document {
+	if perSource <= 0 || len(docs) <= 1 {
+		return docs[:min(n, len(docs))]
 	}
 
-	if len(result) > 0 {
-		fmt.Printf("[VectorStore] Returning top %d results (best score: %.2f)\n", len(result), scores[0].score)
+	picked := make([]bool, len(docs))
+	counts := make(map[string]int)
+	selected := 0
+	for i, doc := range docs {
+		if selected == n {
+			break
+		}
+		key, _ := doc.Metadata["source_id"].(string)
+		if key == "" {
+			key, _ = doc.Metadata["source"].(string)
+		}
+		if counts[key] < perSource {
+			counts[key]++
+			picked[i] = true
+			selected++
+		}
+	}
+	for i := range docs {
+		if selected == n {
+			break
+		}
+		if !picked[i] {
+			picked[i] = true
+			selected++
+		}
 	}
 
-	return result, nil
+	result := make([]schema.Document, 0, selected)
+	for i, doc := range docs {
+		if picked[i] {
+			result = append(result, doc)
+		}
+	}
+	return result
 }
 
 func min(a, b int) int {
@@ -275,37 +872,103 @@ func min(a, b int) int {
 	return b
 }
 
-// Delete removes documents by source
-func (vs *VectorStore) Delete(ctx context.Context, source string) error {
+// Delete removes the chunks of a source in a notebook. source is the stored
+// source ID, or the source name for text ingested without one.
+func (vs *VectorStore) Delete(ctx context.Context, notebookID, source string) error {
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
-	filtered := make([]schema.Document, 0, len(vs.docs))
-	for _, doc := range vs.docs {
-		if docSource, ok := doc.Metadata["source"].(string); !ok || docSource != source {
-			filtered = append(filtered, doc)
+	_, err := vs.index.remove(ctx, notebookID, source)
+	return err
+}
+
+// DeleteSources removes the chunks of several sources of a notebook under a
+// single lock and returns the number of chunks removed
+func (vs *VectorStore) DeleteSources(ctx context.Context, notebookID string, sources []string) (int, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	total := 0
+	for _, source := range sources {
+		removed, err := vs.index.remove(ctx, notebookID, source)
+		total += removed
+		if err != nil {
+			return total, err
 		}
 	}
-	vs.docs = filtered
-
-	return nil
+	return total, nil
 }
 
-// GetStats returns statistics about the vector store
-func (vs *VectorStore) GetStats(ctx context.Context) (VectorStats, error) {
-	vs.mu.RLock()
-	defer vs.mu.RUnlock()
+// DeleteNotebook removes the chunks of a deleted notebook: those of its
+// sources, and with indexes that can drop a whole notebook also chunks
+// ingested without a source ID. The notebook is no longer counted as
+// indexed by lazy indexing.
+func (vs *VectorStore) DeleteNotebook(ctx context.Context, notebookID string, sources []string) (int, error) {
+	total, err := vs.DeleteSources(ctx, notebookID, sources)
+	if err != nil {
+		return total, err
+	}
+	if remover, ok := vs.index.(notebookRemover); ok {
+		vs.mu.Lock()
+		removed, err := remover.removeNotebook(ctx, notebookID)
+		vs.mu.Unlock()
+		total += removed
+		if err != nil {
+			return total, err
+		}
+	}
+
+	vs.lazyMu.Lock()
+	if el, ok := vs.hotIndex[notebookID]; ok {
+		vs.hot.Remove(el)
+		delete(vs.hotIndex, notebookID)
+	}
+	vs.lazyMu.Unlock()
+	return total, nil
+}
 
-	stats := VectorStats{
-		TotalDocuments: len(vs.docs),
-		Dimension:      1536, // Default for OpenAI embeddings
+// ListChunks returns the indexed chunks of a source in a notebook in chunk
+// order. source is matched as in Delete.
+func (vs *VectorStore) ListChunks(ctx context.Context, notebookID, source string) ([]SourceChunk, error) {
+	docs, vectors, err := vs.index.sourceChunks(ctx, notebookID, source)
+	if err != nil {
+		return nil, err
 	}
 
-	if vs.cfg.IsOllama() {
-		stats.Dimension = 768 // Common for Ollama models
+	chunks := make([]SourceChunk, 0, len(docs))
+	for i, doc := range docs {
+		id, _ := doc.Metadata["chunk_id"].(string)
+		index, _ := doc.Metadata["chunk"].(int)
+		start, _ := doc.Metadata["start_offset"].(int)
+		end, _ := doc.Metadata["end_offset"].(int)
+		chunks = append(chunks, SourceChunk{
+			ID:          id,
+			Index:       index,
+			Text:        doc.PageContent,
+			StartOffset: start,
+			EndOffset:   end,
+			HasVector:   vectors[i] != nil,
+		})
 	}
 
-	return stats, nil
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Index < chunks[j].Index
+	})
+
+	return chunks, nil
+}
+
+// GetStats returns statistics about the vector store
+func (vs *VectorStore) GetStats(ctx context.Context) (VectorStats, error) {
+	// Dimension is that of the default model's vectors; vectors from another
+	// provider need a reindex before they can be searched again
+	return vs.index.stats(ctx, embeddingProvider(vs.cfg), vs.cfg.EmbeddingModel)
+}
+
+// Persistent reports whether indexed chunks outlive the process, so they
+// need not be rebuilt on startup
+func (vs *VectorStore) Persistent() bool {
+	return vs.index.persistent()
 }
 
 // needsMarkitdown checks if a file extension requires markitdown conversion
@@ -323,14 +986,22 @@ func (vs *VectorStore) needsMarkitdown(ext string) bool {
 }
 
 // convertWithMarkitdown converts a document to Markdown using the markitdown CLI tool
-func (vs *VectorStore) convertWithMarkitdown(filePath string) (string, error) {
+func (vs *VectorStore) convertWithMarkitdown(ctx context.Context, filePath string) (string, error) {
 	fmt.Printf("[VectorStore] Converting with markitdown: %s\n", filePath)
 
 	// Create temporary output file
-	tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("markitdown_%s.md", filepath.Base(filePath)))
+	if err := os.MkdirAll(vs.cfg.TempDir(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(vs.cfg.TempDir(), "markitdown_*.md")
+	if err != nil {
+		return "", fmt.Errorf("failed to create markitdown output file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
 
 	// Run markitdown command
-	cmd := exec.Command("markitdown", filePath, "-o", tmpFile)
+	cmd := exec.CommandContext(ctx, "markitdown", filePath, "-o", tmp.Name())
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Printf("[VectorStore] markitdown error: %s\n", string(output))
@@ -338,13 +1009,13 @@ func (vs *VectorStore) convertWithMarkitdown(filePath string) (string, error) {
 	}
 
 	// Read the converted markdown content
-	content, err := os.ReadFile(tmpFile)
+	content, err := os.ReadFile(tmp.Name())
 	if err != nil {
 		return "", fmt.Errorf("failed to read markitdown output: %w", err)
 	}
-
-	// Clean up temporary file
-	os.Remove(tmpFile)
+	if strings.TrimSpace(string(content)) == "" {
+		return "", fmt.Errorf("markitdown produced no text")
+	}
 
 	fmt.Printf("[VectorStore] markitdown conversion successful, output size: %d bytes\n", len(content))
 	return string(content), nil
@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"context"
+	"sync"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// memoryIndex keeps chunks in process memory. It is rebuilt from the stored
+// sources on startup.
+type memoryIndex struct {
+	mu      sync.RWMutex
+	docs    []schema.Document
+	vectors []*chunkVector // aligned with docs, nil for chunks without an embedding
+}
+
+func newMemoryIndex() *memoryIndex {
+	return &memoryIndex{docs: make([]schema.Document, 0)}
+}
+
+func (m *memoryIndex) add(ctx context.Context, docs []schema.Document, vectors []*chunkVector) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.docs = append(m.docs, docs...)
+	m.vectors = append(m.vectors, vectors...)
+	return nil
+}
+
+func (m *memoryIndex) remove(ctx context.Context, notebookID, sourceKey string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	filtered := make([]schema.Document, 0, len(m.docs))
+	filteredVectors := make([]*chunkVector, 0, len(m.vectors))
+	for i, doc := range m.docs {
+		if !belongsTo(doc, notebookID, sourceKey) {
+			filtered = append(filtered, doc)
+			filteredVectors = append(filteredVectors, m.vectors[i])
+		}
+	}
+	removed := len(m.docs) - len(filtered)
+	m.docs = filtered
+	m.vectors = filteredVectors
+	return removed, nil
+}
+
+// removeNotebook drops the chunks of a notebook, for lazy indexing to evict
+// notebooks that are no longer used
+func (m *memoryIndex) removeNotebook(ctx context.Context, notebookID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	filtered := make([]schema.Document, 0, len(m.docs))
+	filteredVectors := make([]*chunkVector, 0, len(m.vectors))
+	for i, doc := range m.docs {
+		if docNotebook, _ := doc.Metadata["notebook_id"].(string); docNotebook != notebookID {
+			filtered = append(filtered, doc)
+			filteredVectors = append(filteredVectors, m.vectors[i])
+		}
+	}
+	removed := len(m.docs) - len(filtered)
+	m.docs = filtered
+	m.vectors = filteredVectors
+	return removed, nil
+}
+
+func (m *memoryIndex) sourceChunks(ctx context.Context, notebookID, sourceKey string) ([]schema.Document, []*chunkVector, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var docs []schema.Document
+	var vectors []*chunkVector
+	for i, doc := range m.docs {
+		if belongsTo(doc, notebookID, sourceKey) {
+			docs = append(docs, doc)
+			vectors = append(vectors, m.vectors[i])
+		}
+	}
+	return docs, vectors, nil
+}
+
+func (m *memoryIndex) searchable(ctx context.Context, notebookID string, sourceKeys []string) ([]schema.Document, []*chunkVector, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var sourceFilter map[string]bool
+	if len(sourceKeys) > 0 {
+		sourceFilter = make(map[string]bool, len(sourceKeys))
+		for _, key := range sourceKeys {
+			sourceFilter[key] = true
+		}
+	}
+
+	var docs []schema.Document
+	var vectors []*chunkVector
+	for i, doc := range m.docs {
+		if notebookID != "" {
+			if docNotebook, ok := doc.Metadata["notebook_id"].(string); ok && docNotebook != notebookID {
+				continue
+			}
+		}
+		if sourceFilter != nil && !sourceFilter[chunkSourceKey(doc)] {
+			continue
+		}
+		docs = append(docs, doc)
+		vectors = append(vectors, m.vectors[i])
+	}
+	return docs, vectors, nil
+}
+
+func (m *memoryIndex) stats(ctx context.Context, provider, model string) (VectorStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := VectorStats{TotalDocuments: len(m.docs)}
+	for _, vector := range m.vectors {
+		if vector == nil {
+			continue
+		}
+		stats.TotalVectors++
+		if vector.Provider != provider {
+			stats.StaleVectors++
+		} else if vector.Model == model {
+			stats.Dimension = len(vector.Values)
+		}
+	}
+	return stats, nil
+}
+
+func (m *memoryIndex) persistent() bool {
+	return false
+}
@@ -0,0 +1,296 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// pgvectorBatchSize bounds the chunks inserted with one batch
+const pgvectorBatchSize = 200
+
+var pgIdentifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// pgvectorIndex keeps chunks in a PostgreSQL table with the pgvector
+// extension. Chunks not tied to a notebook have an empty notebook_id. The
+// embedding column has no fixed dimension so models can be mixed; each
+// dimension gets its own partial HNSW or IVFFlat index over a cast to that
+// dimension, created when the first chunk of that dimension is stored.
+//
+// Values are always bound as parameters. Only the table name, validated as
+// an identifier, and dimensions are formatted into statements.
+type pgvectorIndex struct {
+	pool      *pgxpool.Pool
+	table     string // quoted
+	name      string
+	indexType string
+
+	mu      sync.Mutex
+	indexed map[int]bool // dimensions with a vector index
+}
+
+// newPGVectorIndex connects to POSTGRES_URL, whose sslmode (disable, allow,
+// prefer, require, verify-ca or verify-full) is honored, and creates the
+// table
+func newPGVectorIndex(cfg Config) (*pgvectorIndex, error) {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, cfg.PostgreSQLURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid POSTGRES_URL: %w", err)
+	}
+	p := &pgvectorIndex{
+		pool:      pool,
+		table:     pgx.Identifier{cfg.PGVectorTable}.Sanitize(),
+		name:      cfg.PGVectorTable,
+		indexType: cfg.PGVectorIndex,
+		indexed:   make(map[int]bool),
+	}
+
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS vector",
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	chunk_id TEXT PRIMARY KEY,
+	notebook_id TEXT NOT NULL,
+	source_key TEXT NOT NULL,
+	content TEXT NOT NULL,
+	metadata JSONB NOT NULL,
+	provider TEXT,
+	model TEXT,
+	dim INTEGER NOT NULL DEFAULT 0,
+	embedding vector
+)`, p.table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (notebook_id, source_key)",
+			pgx.Identifier{p.name + "_source_idx"}.Sanitize(), p.table),
+	}
+	for _, sql := range statements {
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("failed to create pgvector table: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// ensureVectorIndex creates the vector index for embeddings of a dimension.
+// Queries must filter on dim and cast to vector(dim) to use it.
+func (p *pgvectorIndex) ensureVectorIndex(ctx context.Context, dim int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.indexed[dim] {
+		return nil
+	}
+
+	method := "hnsw"
+	options := ""
+	if p.indexType == PGVectorIndexIVFFlat {
+		method = "ivfflat"
+		options = " WITH (lists = 100)"
+	}
+	indexName := pgx.Identifier{fmt.Sprintf("%s_%s_%d", p.name, method, dim)}.Sanitize()
+	_, err := p.pool.Exec(ctx, fmt.Sprintf(
+		"CREATE INDEX IF NOT EXISTS %[1]s ON %[2]s USING %[3]s ((embedding::vector(%[4]d)) vector_cosine_ops)%[5]s WHERE dim = %[4]d",
+		indexName, p.table, method, dim, options))
+	if err != nil {
+		return fmt.Errorf("failed to create pgvector index: %w", err)
+	}
+	p.indexed[dim] = true
+	return nil
+}
+
+func (p *pgvectorIndex) add(ctx context.Context, docs []schema.Document, vectors []*chunkVector) error {
+	insert := fmt.Sprintf(`INSERT INTO %s (chunk_id, notebook_id, source_key, content, metadata, provider, model, dim, embedding)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::vector)
+ON CONFLICT (chunk_id) DO UPDATE SET notebook_id = EXCLUDED.notebook_id, source_key = EXCLUDED.source_key,
+	content = EXCLUDED.content, metadata = EXCLUDED.metadata, provider = EXCLUDED.provider,
+	model = EXCLUDED.model, dim = EXCLUDED.dim, embedding = EXCLUDED.embedding`, p.table)
+
+	for start := 0; start < len(docs); start += pgvectorBatchSize {
+		end := min(start+pgvectorBatchSize, len(docs))
+		batch := &pgx.Batch{}
+		for i := start; i < end; i++ {
+			doc := docs[i]
+			chunkID, _ := doc.Metadata["chunk_id"].(string)
+			if chunkID == "" {
+				return fmt.Errorf("chunk without chunk_id")
+			}
+			metadata, err := json.Marshal(doc.Metadata)
+			if err != nil {
+				return fmt.Errorf("failed to encode chunk metadata: %w", err)
+			}
+			notebookID, _ := doc.Metadata["notebook_id"].(string)
+
+			var provider, model, embedding *string
+			dim := 0
+			if vector := vectors[i]; vector != nil {
+				dim = len(vector.Values)
+				if err := p.ensureVectorIndex(ctx, dim); err != nil {
+					return err
+				}
+				literal := pgVectorLiteral(vector.Values)
+				provider, model, embedding = &vector.Provider, &vector.Model, &literal
+			}
+			batch.Queue(insert, chunkID, notebookID, chunkSourceKey(doc), pgTextValue(doc.PageContent),
+				string(metadata), provider, model, dim, embedding)
+		}
+		if err := p.pool.SendBatch(ctx, batch).Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pgvectorIndex) remove(ctx context.Context, notebookID, sourceKey string) (int, error) {
+	tag, err := p.pool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE notebook_id = $1 AND source_key = $2", p.table),
+		notebookID, sourceKey)
+	return int(tag.RowsAffected()), err
+}
+
+func (p *pgvectorIndex) sourceChunks(ctx context.Context, notebookID, sourceKey string) ([]schema.Document, []*chunkVector, error) {
+	return p.load(ctx, "notebook_id = $1 AND source_key = $2", notebookID, sourceKey)
+}
+
+func (p *pgvectorIndex) searchable(ctx context.Context, notebookID string, sourceKeys []string) ([]schema.Document, []*chunkVector, error) {
+	where, args := p.filter(notebookID, sourceKeys, nil)
+	return p.load(ctx, where, args...)
+}
+
+// filter builds the WHERE clause selecting the chunks searched for a
+// notebook, as described on chunkIndex.searchable. Its parameters are
+// appended to args and numbered after them.
+func (p *pgvectorIndex) filter(notebookID string, sourceKeys []string, args []any) (string, []any) {
+	conditions := []string{"TRUE"}
+	if notebookID != "" {
+		args = append(args, notebookID)
+		conditions = append(conditions, fmt.Sprintf("notebook_id IN ($%d, '')", len(args)))
+	}
+	if len(sourceKeys) > 0 {
+		args = append(args, sourceKeys)
+		conditions = append(conditions, fmt.Sprintf("source_key = ANY($%d)", len(args)))
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (p *pgvectorIndex) knn(ctx context.Context, notebookID string, sourceKeys []string, query *chunkVector, k int, threshold float64) ([]schema.Document, error) {
+	dim := len(query.Values)
+	args := []any{pgVectorLiteral(query.Values), query.Provider, query.Model, k}
+	where, args := p.filter(notebookID, sourceKeys, args)
+	distance := fmt.Sprintf("embedding::vector(%[1]d) <=> $1::vector(%[1]d)", dim)
+	rows, err := p.pool.Query(ctx, fmt.Sprintf(
+		"SELECT content, metadata::text, 1 - (%[2]s) FROM %[1]s WHERE dim = %[3]d AND provider = $2 AND model = $3 AND %[4]s ORDER BY %[2]s LIMIT $4",
+		p.table, distance, dim, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]schema.Document, 0, k)
+	for rows.Next() {
+		var content, metadata string
+		var score float64
+		if err := rows.Scan(&content, &metadata, &score); err != nil {
+			return nil, err
+		}
+		if score < threshold {
+			continue
+		}
+		doc := schema.Document{PageContent: content, Metadata: decodeChunkMetadata(metadata)}
+		doc.Score = float32(score)
+		result = append(result, doc)
+	}
+	return result, rows.Err()
+}
+
+func (p *pgvectorIndex) stats(ctx context.Context, provider, model string) (VectorStats, error) {
+	var stats VectorStats
+	err := p.pool.QueryRow(ctx, fmt.Sprintf(`SELECT count(*), count(embedding),
+	count(embedding) FILTER (WHERE provider <> $1),
+	coalesce(max(dim) FILTER (WHERE provider = $1 AND model = $2), 0)
+FROM %s`, p.table), provider, model).Scan(&stats.TotalDocuments, &stats.TotalVectors, &stats.StaleVectors, &stats.Dimension)
+	return stats, err
+}
+
+func (p *pgvectorIndex) persistent() bool {
+	return true
+}
+
+// load reads the chunks matching a WHERE clause with its parameters
+func (p *pgvectorIndex) load(ctx context.Context, where string, args ...any) ([]schema.Document, []*chunkVector, error) {
+	rows, err := p.pool.Query(ctx, fmt.Sprintf(
+		"SELECT content, metadata::text, provider, model, embedding::text FROM %s WHERE %s", p.table, where), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var docs []schema.Document
+	var vectors []*chunkVector
+	for rows.Next() {
+		var content, metadata string
+		var provider, model, embedding *string
+		if err := rows.Scan(&content, &metadata, &provider, &model, &embedding); err != nil {
+			return nil, nil, err
+		}
+		docs = append(docs, schema.Document{PageContent: content, Metadata: decodeChunkMetadata(metadata)})
+		var vector *chunkVector
+		if embedding != nil {
+			values, err := parsePGVector(*embedding)
+			if err != nil {
+				return nil, nil, err
+			}
+			vector = &chunkVector{Provider: derefString(provider), Model: derefString(model), Values: values}
+		}
+		vectors = append(vectors, vector)
+	}
+	return docs, vectors, rows.Err()
+}
+
+// pgTextValue drops NUL bytes, which PostgreSQL text values cannot hold
+func pgTextValue(s string) string {
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// pgVectorLiteral formats an embedding in pgvector's text format, "[1,2,3]"
+func pgVectorLiteral(values []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func parsePGVector(s string) ([]float32, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	values := make([]float32, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector value %q: %w", part, err)
+		}
+		values[i] = float32(v)
+	}
+	return values, nil
+}
@@ -0,0 +1,439 @@
+package backend
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// redisGlobalNotebook tags chunks not tied to any notebook, which are
+// searched for every notebook
+const redisGlobalNotebook = "_global"
+
+// redisBatchSize bounds the chunks handled by one pipeline
+const redisBatchSize = 500
+
+// redisIndex keeps chunks in Redis so they are shared between instances and
+// survive restarts. Each chunk is a hash holding its text, metadata and
+// embedding; sets per notebook and source track which chunks belong where.
+// Embeddings are searched with a RediSearch HNSW index, one per dimension,
+// created when the first chunk of that dimension is stored.
+type redisIndex struct {
+	client *redis.Client
+	prefix string
+
+	mu      sync.Mutex
+	indexed map[int]bool // dimensions with a search index
+}
+
+// newRedisIndex connects to REDIS_URL, a redis:// or rediss:// URL
+func newRedisIndex(cfg Config) (*redisIndex, error) {
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	// RediSearch replies are parsed in their RESP2 shape
+	opts.Protocol = 2
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisIndex{client: client, prefix: cfg.RedisPrefix, indexed: make(map[int]bool)}, nil
+}
+
+func (r *redisIndex) chunkKey(chunkID string) string {
+	return r.prefix + ":chunk:" + chunkID
+}
+
+func (r *redisIndex) notebookKey(notebookID string) string {
+	return r.prefix + ":notebook:" + redisNotebookTag(notebookID)
+}
+
+func (r *redisIndex) sourceKey(notebookID, sourceKey string) string {
+	return r.prefix + ":source:" + redisNotebookTag(notebookID) + ":" + sourceKey
+}
+
+func redisNotebookTag(notebookID string) string {
+	if notebookID == "" {
+		return redisGlobalNotebook
+	}
+	return notebookID
+}
+
+func (r *redisIndex) add(ctx context.Context, docs []schema.Document, vectors []*chunkVector) error {
+	return r.pipelined(ctx, len(docs), func(pipe redis.Pipeliner, i int) error {
+		doc := docs[i]
+		chunkID, _ := doc.Metadata["chunk_id"].(string)
+		if chunkID == "" {
+			return fmt.Errorf("chunk without chunk_id")
+		}
+		metadata, err := json.Marshal(doc.Metadata)
+		if err != nil {
+			return fmt.Errorf("failed to encode chunk metadata: %w", err)
+		}
+		notebookID, _ := doc.Metadata["notebook_id"].(string)
+		source := chunkSourceKey(doc)
+		key := r.chunkKey(chunkID)
+
+		fields := []interface{}{
+			"notebook_id", redisNotebookTag(notebookID),
+			"source_key", source,
+			"content", doc.PageContent,
+			"metadata", metadata,
+			"dim", 0,
+		}
+		if vector := vectors[i]; vector != nil {
+			if err := r.ensureSearchIndex(ctx, len(vector.Values)); err != nil {
+				return err
+			}
+			fields = append(fields,
+				"provider", vector.Provider,
+				"model", vector.Model,
+				"dim", len(vector.Values),
+				"embedding", encodeFloat32s(vector.Values))
+		}
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, fields...)
+		pipe.SAdd(ctx, r.notebookKey(notebookID), key)
+		pipe.SAdd(ctx, r.sourceKey(notebookID, source), key)
+		return nil
+	})
+}
+
+// ensureSearchIndex creates the HNSW index for embeddings of a dimension
+func (r *redisIndex) ensureSearchIndex(ctx context.Context, dim int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.indexed[dim] {
+		return nil
+	}
+
+	err := r.client.Do(ctx, "FT.CREATE", r.searchIndexName(dim),
+		"ON", "HASH", "PREFIX", 1, r.prefix+":chunk:",
+		"FILTER", fmt.Sprintf("@dim==%d", dim),
+		"SCHEMA",
+		"notebook_id", "TAG",
+		"source_key", "TAG",
+		"provider", "TAG",
+		"model", "TAG",
+		"embedding", "VECTOR", "HNSW", 6, "TYPE", "FLOAT32", "DIM", dim, "DISTANCE_METRIC", "COSINE").Err()
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "index already exists") {
+		return fmt.Errorf("failed to create redis search index: %w", err)
+	}
+	r.indexed[dim] = true
+	return nil
+}
+
+func (r *redisIndex) searchIndexName(dim int) string {
+	return fmt.Sprintf("%s:idx:%d", r.prefix, dim)
+}
+
+func (r *redisIndex) remove(ctx context.Context, notebookID, sourceKey string) (int, error) {
+	setKey := r.sourceKey(notebookID, sourceKey)
+	keys, err := r.members(ctx, setKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	err = r.pipelined(ctx, len(keys), func(pipe redis.Pipeliner, i int) error {
+		pipe.Del(ctx, keys[i])
+		pipe.SRem(ctx, r.notebookKey(notebookID), keys[i])
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := r.client.Del(ctx, setKey).Err(); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+func (r *redisIndex) sourceChunks(ctx context.Context, notebookID, sourceKey string) ([]schema.Document, []*chunkVector, error) {
+	keys, err := r.members(ctx, r.sourceKey(notebookID, sourceKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.load(ctx, keys)
+}
+
+func (r *redisIndex) searchable(ctx context.Context, notebookID string, sourceKeys []string) ([]schema.Document, []*chunkVector, error) {
+	var keys []string
+	var err error
+	switch {
+	case notebookID == "":
+		// All notebooks; sources are filtered after loading
+		keys, err = r.scanChunks(ctx)
+	default:
+		sets := []string{r.notebookKey(notebookID), r.notebookKey("")}
+		if len(sourceKeys) > 0 {
+			sets = sets[:0]
+			for _, source := range sourceKeys {
+				sets = append(sets, r.sourceKey(notebookID, source), r.sourceKey("", source))
+			}
+		}
+		keys, err = r.client.SUnion(ctx, sets...).Result()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	docs, vectors, err := r.load(ctx, keys)
+	if err != nil || notebookID != "" || len(sourceKeys) == 0 {
+		return docs, vectors, err
+	}
+	wanted := make(map[string]bool, len(sourceKeys))
+	for _, source := range sourceKeys {
+		wanted[source] = true
+	}
+	var filteredDocs []schema.Document
+	var filteredVectors []*chunkVector
+	for i, doc := range docs {
+		if wanted[chunkSourceKey(doc)] {
+			filteredDocs = append(filteredDocs, doc)
+			filteredVectors = append(filteredVectors, vectors[i])
+		}
+	}
+	return filteredDocs, filteredVectors, nil
+}
+
+func (r *redisIndex) knn(ctx context.Context, notebookID string, sourceKeys []string, query *chunkVector, k int, threshold float64) ([]schema.Document, error) {
+	dim := len(query.Values)
+	if err := r.ensureSearchIndex(ctx, dim); err != nil {
+		return nil, err
+	}
+
+	filters := []string{
+		"@provider:{" + redisEscapeTag(query.Provider) + "}",
+		"@model:{" + redisEscapeTag(query.Model) + "}",
+	}
+	if notebookID != "" {
+		filters = append(filters, "@notebook_id:{"+redisEscapeTag(notebookID)+" | "+redisGlobalNotebook+"}")
+	}
+	if len(sourceKeys) > 0 {
+		escaped := make([]string, len(sourceKeys))
+		for i, source := range sourceKeys {
+			escaped[i] = redisEscapeTag(source)
+		}
+		filters = append(filters, "@source_key:{"+strings.Join(escaped, " | ")+"}")
+	}
+	q := fmt.Sprintf("(%s)=>[KNN %d @embedding $vec AS dist]", strings.Join(filters, " "), k)
+
+	reply, err := r.client.Do(ctx, "FT.SEARCH", r.searchIndexName(dim), q,
+		"PARAMS", 2, "vec", encodeFloat32s(query.Values),
+		"SORTBY", "dist",
+		"RETURN", 3, "content", "metadata", "dist",
+		"LIMIT", 0, k,
+		"DIALECT", 2).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Reply: total, then key and field/value list for each result
+	items, _ := reply.([]interface{})
+	result := make([]schema.Document, 0, k)
+	for i := 2; i < len(items); i += 2 {
+		fields := redisFields(items[i])
+		dist, err := strconv.ParseFloat(fields["dist"], 64)
+		if err != nil {
+			continue
+		}
+		score := 1 - dist
+		if score < threshold {
+			continue
+		}
+		doc := schema.Document{PageContent: fields["content"], Metadata: decodeChunkMetadata(fields["metadata"])}
+		doc.Score = float32(score)
+		result = append(result, doc)
+	}
+	return result, nil
+}
+
+func (r *redisIndex) stats(ctx context.Context, provider, model string) (VectorStats, error) {
+	keys, err := r.scanChunks(ctx)
+	if err != nil {
+		return VectorStats{}, err
+	}
+
+	stats := VectorStats{TotalDocuments: len(keys)}
+	cmds := make([]*redis.SliceCmd, len(keys))
+	err = r.pipelined(ctx, len(keys), func(pipe redis.Pipeliner, i int) error {
+		cmds[i] = pipe.HMGet(ctx, keys[i], "provider", "model", "dim")
+		return nil
+	})
+	if err != nil {
+		return VectorStats{}, err
+	}
+	for _, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) != 3 {
+			continue
+		}
+		dim, _ := strconv.Atoi(redisString(values[2]))
+		if dim == 0 {
+			continue
+		}
+		stats.TotalVectors++
+		if redisString(values[0]) != provider {
+			stats.StaleVectors++
+		} else if redisString(values[1]) == model {
+			stats.Dimension = dim
+		}
+	}
+	return stats, nil
+}
+
+func (r *redisIndex) persistent() bool {
+	return true
+}
+
+// pipelined queues the commands for n items with queue and sends them in
+// pipelines of redisBatchSize items, failing on the first error
+func (r *redisIndex) pipelined(ctx context.Context, n int, queue func(pipe redis.Pipeliner, i int) error) error {
+	for start := 0; start < n; start += redisBatchSize {
+		end := min(start+redisBatchSize, n)
+		pipe := r.client.Pipeline()
+		for i := start; i < end; i++ {
+			if err := queue(pipe, i); err != nil {
+				pipe.Discard()
+				return err
+			}
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisIndex) members(ctx context.Context, setKey string) ([]string, error) {
+	return r.client.SMembers(ctx, setKey).Result()
+}
+
+// scanChunks returns the keys of all chunks
+func (r *redisIndex) scanChunks(ctx context.Context) ([]string, error) {
+	var keys []string
+	iter := r.client.Scan(ctx, 0, r.prefix+":chunk:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// load reads chunks by key. Keys that no longer exist are skipped.
+func (r *redisIndex) load(ctx context.Context, keys []string) ([]schema.Document, []*chunkVector, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(keys))
+	err := r.pipelined(ctx, len(keys), func(pipe redis.Pipeliner, i int) error {
+		cmds[i] = pipe.HGetAll(ctx, keys[i])
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var docs []schema.Document
+	var vectors []*chunkVector
+	for _, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		docs = append(docs, schema.Document{PageContent: fields["content"], Metadata: decodeChunkMetadata(fields["metadata"])})
+		var vector *chunkVector
+		if embedding := fields["embedding"]; embedding != "" {
+			vector = &chunkVector{Provider: fields["provider"], Model: fields["model"], Values: decodeFloat32s([]byte(embedding))}
+		}
+		vectors = append(vectors, vector)
+	}
+	return docs, vectors, nil
+}
+
+// decodeChunkMetadata restores chunk metadata from JSON with the Go types
+// it was stored with, as JSON numbers and arrays come back as float64 and
+// []interface{}
+func decodeChunkMetadata(data string) map[string]any {
+	metadata := make(map[string]any)
+	if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+		return metadata
+	}
+	for _, key := range []string{"chunk", "start_offset", "end_offset", "embedding_dim"} {
+		if v, ok := metadata[key].(float64); ok {
+			metadata[key] = int(v)
+		}
+	}
+	if items, ok := metadata["speakers"].([]interface{}); ok {
+		speakers := make([]string, 0, len(items))
+		for _, item := range items {
+			if s, ok := item.(string); ok {
+				speakers = append(speakers, s)
+			}
+		}
+		metadata["speakers"] = speakers
+	}
+	return metadata
+}
+
+// redisEscapeTag escapes a value for a TAG query
+func redisEscapeTag(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(",.<>{}[]\"':;!@#$%^&*()-+=~|/\\ ", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// redisString converts a string or integer reply to a string
+func redisString(reply interface{}) string {
+	switch v := reply.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
+
+// redisFields converts a field/value array reply to a map
+func redisFields(reply interface{}) map[string]string {
+	items, _ := reply.([]interface{})
+	fields := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		fields[redisString(items[i])] = redisString(items[i+1])
+	}
+	return fields
+}
+
+// encodeFloat32s encodes an embedding as little-endian FLOAT32, the layout
+// RediSearch expects for vector fields and query parameters
+func encodeFloat32s(values []float32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return b
+}
+
+func decodeFloat32s(b []byte) []float32 {
+	values := make([]float32, len(b)/4)
+	for i := range values {
+		values[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return values
+}
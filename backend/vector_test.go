@@ -0,0 +1,243 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testSourceContent = "one two three four five six seven eight nine ten eleven twelve"
+
+// newTestVectorStore returns an in-memory vector store without embeddings
+// that splits text into chunks of five words
+func newTestVectorStore(t *testing.T) *VectorStore {
+	t.Helper()
+	vs, err := NewVectorStore(Config{
+		SQLitePath:       filepath.Join(t.TempDir(), "notex.db"),
+		ChunkSize:        5,
+		ChunkOverlapMode: OverlapModeAbsolute,
+	})
+	if err != nil {
+		t.Fatalf("NewVectorStore() error = %v", err)
+	}
+	return vs
+}
+
+func chunkIDs(t *testing.T, vs *VectorStore, notebookID, source string) []string {
+	t.Helper()
+	chunks, err := vs.ListChunks(context.Background(), notebookID, source)
+	if err != nil {
+		t.Fatalf("ListChunks() error = %v", err)
+	}
+	ids := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		ids[i] = chunk.ID
+	}
+	return ids
+}
+
+func TestIngestSameSourceTwiceKeepsOneCopy(t *testing.T) {
+	ctx := context.Background()
+	vs := newTestVectorStore(t)
+	opts := IngestOptions{NotebookID: "nb1"}.WithSource("src1")
+
+	if err := vs.IngestTextWithOptions(ctx, "notes.txt", testSourceContent, opts); err != nil {
+		t.Fatalf("first IngestTextWithOptions() error = %v", err)
+	}
+	first := chunkIDs(t, vs, "nb1", "src1")
+	if len(first) != 3 {
+		t.Fatalf("first ingest stored %d chunks, want 3", len(first))
+	}
+
+	if err := vs.IngestTextWithOptions(ctx, "notes.txt", testSourceContent, opts); err != nil {
+		t.Fatalf("second IngestTextWithOptions() error = %v", err)
+	}
+	second := chunkIDs(t, vs, "nb1", "src1")
+	if len(second) != len(first) {
+		t.Fatalf("re-ingest stored %d chunks, want %d", len(second), len(first))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("chunk %d ID changed from %s to %s", i, first[i], second[i])
+		}
+	}
+
+	stats, err := vs.GetStats(ctx)
+	if err != nil {
+		t.Fatalf("GetStats() error = %v", err)
+	}
+	if stats.TotalDocuments != len(first) {
+		t.Errorf("store holds %d chunks, want %d", stats.TotalDocuments, len(first))
+	}
+}
+
+func TestIngestSameSourceInTwoNotebooks(t *testing.T) {
+	ctx := context.Background()
+	vs := newTestVectorStore(t)
+
+	for _, notebookID := range []string{"nb1", "nb2"} {
+		opts := IngestOptions{NotebookID: notebookID}.WithSource("src1")
+		if err := vs.IngestTextWithOptions(ctx, "notes.txt", testSourceContent, opts); err != nil {
+			t.Fatalf("IngestTextWithOptions(%s) error = %v", notebookID, err)
+		}
+	}
+
+	nb1, nb2 := chunkIDs(t, vs, "nb1", "src1"), chunkIDs(t, vs, "nb2", "src1")
+	if len(nb1) != 3 || len(nb2) != 3 {
+		t.Fatalf("notebooks hold %d and %d chunks, want 3 each", len(nb1), len(nb2))
+	}
+	if nb1[0] == nb2[0] {
+		t.Errorf("chunks of different notebooks share ID %s", nb1[0])
+	}
+
+	if err := vs.Delete(ctx, "nb1", "src1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if ids := chunkIDs(t, vs, "nb2", "src1"); len(ids) != 3 {
+		t.Errorf("deleting from nb1 left %d chunks in nb2, want 3", len(ids))
+	}
+}
+
+// stubEmbedder embeds every text as the same unit vector of dim dimensions
+type stubEmbedder struct {
+	dim int
+}
+
+func (e stubEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i := range texts {
+		vectors[i], _ = e.EmbedQuery(ctx, texts[i])
+	}
+	return vectors, nil
+}
+
+func (e stubEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	vector := make([]float32, e.dim)
+	vector[0] = 1
+	return vector, nil
+}
+
+// useEmbedder switches the store to another embedding provider and model
+func useEmbedder(vs *VectorStore, provider, model string, dim int) {
+	vs.cfg.LLMProvider = provider
+	vs.cfg.EmbeddingModel = model
+	vs.embedder = stubEmbedder{dim: dim}
+}
+
+func TestEmbeddingProviderSwitchFlagsStaleVectors(t *testing.T) {
+	ctx := context.Background()
+	vs := newTestVectorStore(t)
+	// Only embedding search can match the query, keyword search scores 0
+	vs.cfg.SimilarityThreshold = 0.5
+	const query = "zzz"
+	opts := IngestOptions{NotebookID: "nb1"}.WithSource("src1")
+
+	useEmbedder(vs, LLMProviderOpenAI, "text-embedding-3-small", 4)
+	if err := vs.IngestTextWithOptions(ctx, "notes.txt", testSourceContent, opts); err != nil {
+		t.Fatalf("IngestTextWithOptions() error = %v", err)
+	}
+	stats, _ := vs.GetStats(ctx)
+	if stats.TotalVectors != 3 || stats.StaleVectors != 0 || stats.Dimension != 4 {
+		t.Fatalf("stats after ingest = %+v, want 3 vectors of 4 dimensions, none stale", stats)
+	}
+
+	useEmbedder(vs, LLMProviderOllama, "nomic-embed-text", 3)
+	stats, _ = vs.GetStats(ctx)
+	if stats.StaleVectors != 3 || stats.Dimension != 0 {
+		t.Errorf("stats after switching provider = %+v, want 3 stale vectors and no dimension", stats)
+	}
+	docs, err := vs.SearchNotebook(ctx, "nb1", query, 5, nil)
+	if err != nil {
+		t.Fatalf("SearchNotebook() error = %v", err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("SearchNotebook() compared %d chunks embedded by another provider", len(docs))
+	}
+
+	// Re-ingesting embeds the chunks with the new provider
+	if err := vs.IngestTextWithOptions(ctx, "notes.txt", testSourceContent, opts); err != nil {
+		t.Fatalf("re-ingest error = %v", err)
+	}
+	stats, _ = vs.GetStats(ctx)
+	if stats.TotalVectors != 3 || stats.StaleVectors != 0 || stats.Dimension != 3 {
+		t.Errorf("stats after re-ingest = %+v, want 3 vectors of 3 dimensions, none stale", stats)
+	}
+	if docs, _ := vs.SearchNotebook(ctx, "nb1", query, 5, nil); len(docs) != 3 {
+		t.Errorf("SearchNotebook() after re-ingest found %d chunks, want 3", len(docs))
+	}
+}
+
+func TestEmbeddingModelSwitchSkipsOldVectors(t *testing.T) {
+	ctx := context.Background()
+	vs := newTestVectorStore(t)
+	vs.cfg.SimilarityThreshold = 0.5
+	opts := IngestOptions{NotebookID: "nb1"}.WithSource("src1")
+
+	// Same provider and dimension, so only the model tells them apart
+	useEmbedder(vs, LLMProviderOllama, "nomic-embed-text", 4)
+	if err := vs.IngestTextWithOptions(ctx, "notes.txt", testSourceContent, opts); err != nil {
+		t.Fatalf("IngestTextWithOptions() error = %v", err)
+	}
+	useEmbedder(vs, LLMProviderOllama, "mxbai-embed-large", 4)
+
+	docs, err := vs.SearchNotebook(ctx, "nb1", "zzz", 5, nil)
+	if err != nil {
+		t.Fatalf("SearchNotebook() error = %v", err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("SearchNotebook() compared %d chunks embedded with another model", len(docs))
+	}
+}
+
+// failingEmbedder fails every batch holding a text that contains fail
+type failingEmbedder struct {
+	stubEmbedder
+	fail string
+}
+
+func (e failingEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	for _, text := range texts {
+		if strings.Contains(text, e.fail) {
+			return nil, errors.New("API returned unexpected status code: 400")
+		}
+	}
+	return e.stubEmbedder.EmbedDocuments(ctx, texts)
+}
+
+func TestFailedEmbeddingBatchKeepsOtherVectors(t *testing.T) {
+	ctx := context.Background()
+	vs := newTestVectorStore(t)
+	vs.cfg.EmbeddingBatchSize = 1
+	vs.cfg.SimilarityThreshold = 0.5
+	useEmbedder(vs, LLMProviderOpenAI, "text-embedding-3-small", 4)
+	vs.embedder = failingEmbedder{stubEmbedder: stubEmbedder{dim: 4}, fail: "eleven"}
+
+	opts := IngestOptions{NotebookID: "nb1"}.WithSource("src1")
+	if err := vs.IngestTextWithOptions(ctx, "notes.txt", testSourceContent, opts); err != nil {
+		t.Fatalf("IngestTextWithOptions() error = %v", err)
+	}
+	chunks, _ := vs.ListChunks(ctx, "nb1", "src1")
+	var withVector []bool
+	for _, chunk := range chunks {
+		withVector = append(withVector, chunk.HasVector)
+	}
+	if want := []bool{true, true, false}; !slices.Equal(withVector, want) {
+		t.Fatalf("chunks with a vector = %v, want %v", withVector, want)
+	}
+
+	// The chunk without a vector is still found by keyword
+	docs, err := vs.SearchNotebook(ctx, "nb1", "eleven twelve", 5, nil)
+	if err != nil {
+		t.Fatalf("SearchNotebook() error = %v", err)
+	}
+	found := false
+	for _, doc := range docs {
+		found = found || strings.Contains(doc.PageContent, "eleven")
+	}
+	if !found {
+		t.Errorf("SearchNotebook() = %d chunks without the unembedded one", len(docs))
+	}
+}
@@ -0,0 +1,316 @@
+package backend
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+	"golang.org/x/net/html"
+)
+
+// maxPageBytes bounds how much of a fetched web page or sitemap is read
+const maxPageBytes = 10 << 20
+
+// webPage is the extracted text of a fetched web page
+type webPage struct {
+	URL     string
+	Title   string
+	Content string
+}
+
+// sitemapXML covers both <urlset> sitemaps and <sitemapindex> files
+type sitemapXML struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// newWebClient returns the HTTP client used to fetch web sources. Unless
+// allowPrivate, it only fetches from public addresses.
+func newWebClient(allowPrivate bool) *http.Client {
+	return newFetchClient(60*time.Second, allowPrivate)
+}
+
+// fetchURL downloads a URL and returns its body and content type
+func fetchURL(ctx context.Context, client *http.Client, rawURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "notex/1.0 (+https://github.com/smallnest/notex)")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageBytes))
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// fetchPage downloads a web page and extracts its readable text
+func fetchPage(ctx context.Context, client *http.Client, pageURL string) (*webPage, error) {
+	body, contentType, err := fetchURL(ctx, client, pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &webPage{URL: pageURL}
+	switch {
+	case strings.Contains(contentType, "html") || contentType == "":
+		page.Title, page.Content = htmlToText(string(body))
+	case strings.HasPrefix(contentType, "text/"):
+		page.Content = string(body)
+	default:
+		return nil, fmt.Errorf("unsupported content type: %s", contentType)
+	}
+
+	page.Content = strings.TrimSpace(page.Content)
+	if page.Content == "" {
+		return nil, fmt.Errorf("page has no text content")
+	}
+	return page, nil
+}
+
+// htmlSkipTags are elements whose text is not part of the page content
+var htmlSkipTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "svg": true,
+	"nav": true, "header": true, "footer": true, "aside": true, "form": true,
+}
+
+// htmlBlockTags are elements that start a new line in the extracted text
+var htmlBlockTags = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "main": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"li": true, "tr": true, "br": true, "pre": true, "blockquote": true, "table": true,
+}
+
+var (
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+	whitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+var (
+	htmlTagPattern        = regexp.MustCompile(`(?i)<(?:html|head|body|p|div|span|br|h[1-6]|ul|ol|li|table|tr|td|a|article|section|strong|em)\b[^>]*>`)
+	markdownLinePattern   = regexp.MustCompile(`(?m)^\s*(?:#{1,6}\s|[-*+]\s|\d+\.\s|>\s|` + "```" + `|\|.*\|\s*$)`)
+	markdownInlinePattern = regexp.MustCompile(`\*\*[^*\n]+\*\*|\[[^\]\n]+\]\([^)\n]+\)|` + "`[^`\n]+`")
+)
+
+// Formats of pasted text sources, recorded in their "format" metadata
+const (
+	PastedFormatText     = "text"
+	PastedFormatMarkdown = "markdown"
+	PastedFormatHTML     = "html"
+)
+
+// detectPastedFormat tells HTML and Markdown apart from plain text, so
+// pasted HTML can be reduced to its text while Markdown is kept as is
+func detectPastedFormat(content string) string {
+	sample := truncateUTF8(content, 20000)
+	trimmed := strings.TrimSpace(sample)
+	tags := len(htmlTagPattern.FindAllStringIndex(sample, 10))
+	if tags >= 3 || (strings.HasPrefix(trimmed, "<") && tags >= 1) {
+		return PastedFormatHTML
+	}
+	if len(markdownLinePattern.FindAllStringIndex(sample, 3))+len(markdownInlinePattern.FindAllStringIndex(sample, 3)) >= 2 {
+		return PastedFormatMarkdown
+	}
+	return PastedFormatText
+}
+
+// htmlToText extracts the title and the visible text of an HTML document,
+// rendering headings and list items with Markdown markers
+func htmlToText(document string) (string, string) {
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+
+	var title string
+	var text strings.Builder
+	skipDepth := 0
+	inTitle := false
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			lines := strings.Split(text.String(), "\n")
+			for i, line := range lines {
+				lines[i] = strings.TrimSpace(line)
+			}
+			content := blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+			return strings.TrimSpace(title), strings.TrimSpace(content)
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if htmlSkipTags[tag] {
+				skipDepth++
+				continue
+			}
+			if tag == "title" {
+				inTitle = true
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			if htmlBlockTags[tag] {
+				text.WriteString("\n")
+			}
+			switch tag {
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				text.WriteString(strings.Repeat("#", int(tag[1]-'0')) + " ")
+			case "li":
+				text.WriteString("- ")
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if htmlSkipTags[tag] && skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if tag == "title" {
+				inTitle = false
+			}
+			if skipDepth == 0 && htmlBlockTags[tag] {
+				text.WriteString("\n")
+			}
+
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			text.WriteString(whitespacePattern.ReplaceAllString(string(tokenizer.Text()), " "))
+		}
+	}
+}
+
+// parseSitemap returns the page URLs listed in a sitemap, following nested
+// sitemap indexes up to a small depth
+func parseSitemap(ctx context.Context, client *http.Client, sitemapURL string, depth int) ([]string, error) {
+	body, _, err := fetchURL(ctx, client, sitemapURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sitemap %s: %w", sitemapURL, err)
+	}
+
+	var sm sitemapXML
+	if err := xml.Unmarshal(body, &sm); err != nil {
+		return nil, fmt.Errorf("failed to parse sitemap %s: %w", sitemapURL, err)
+	}
+
+	var pages []string
+	for _, u := range sm.URLs {
+		if loc := strings.TrimSpace(u.Loc); loc != "" {
+			pages = append(pages, loc)
+		}
+	}
+
+	if depth > 0 {
+		for _, nested := range sm.Sitemaps {
+			loc := strings.TrimSpace(nested.Loc)
+			if loc == "" {
+				continue
+			}
+			nestedPages, err := parseSitemap(ctx, client, loc, depth-1)
+			if err != nil {
+				golog.Warnf("skipping nested sitemap: %v", err)
+				continue
+			}
+			pages = append(pages, nestedPages...)
+		}
+	}
+
+	return pages, nil
+}
+
+// filterURLs keeps the http(s) URLs that match any include pattern (all when
+// none are given) and no exclude pattern, without duplicates
+func filterURLs(urls []string, include, exclude []*regexp.Regexp) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || seen[u] {
+			continue
+		}
+		if len(include) > 0 && !matchAny(include, u) {
+			continue
+		}
+		if matchAny(exclude, u) {
+			continue
+		}
+		seen[u] = true
+		result = append(result, u)
+	}
+	return result
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePatterns compiles URL filter regular expressions
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL pattern %q: %w", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// fetchPages fetches pages with bounded concurrency. Results are returned in
+// the order of urls; failed pages have a nil page and an error.
+func fetchPages(ctx context.Context, client *http.Client, urls []string, workers int) ([]*webPage, []error) {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	pages := make([]*webPage, len(urls))
+	errs := make([]error, len(urls))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for i, u := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			pages[i], errs[i] = fetchPage(ctx, client, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	return pages, errs
+}
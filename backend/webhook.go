@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// Webhook events
+const (
+	WebhookEventJobCompleted = "job.completed"
+	WebhookEventJobFailed    = "job.failed"
+	WebhookEventJobCanceled  = "job.canceled"
+)
+
+// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+// keyed with WEBHOOK_SECRET, as "sha256=<hex>"
+const WebhookSignatureHeader = "X-Notex-Signature"
+
+// WebhookPayload is POSTed to a job's callback URL when it finishes
+type WebhookPayload struct {
+	Event string `json:"event"`
+	Job   *Job   `json:"job"`
+	Note  *Note  `json:"note,omitempty"`
+}
+
+// validateCallbackURL checks that a callback URL is an absolute http(s) URL
+// the server may post to. Webhooks are always signed, so they need
+// WEBHOOK_SECRET.
+func validateCallbackURL(cfg Config, raw string) error {
+	if cfg.WebhookSecret == "" {
+		return fmt.Errorf("callback_url needs WEBHOOK_SECRET to be set on the server")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http or https URL")
+	}
+	if !cfg.FetchAllowPrivate {
+		if err := checkFetchHost(u.Hostname()); err != nil {
+			return fmt.Errorf("callback_url: %w", err)
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the signature header value for a body
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyJob delivers the outcome of a job to its callback URL, if any,
+// retrying with exponential backoff when the receiver fails
+func (s *Server) notifyJob(ctx context.Context, job *Job, note *Note) {
+	callbackURL := job.Request.CallbackURL
+	if callbackURL == "" {
+		return
+	}
+	if s.cfg.WebhookSecret == "" {
+		golog.Errorf("not sending the webhook for job %s: WEBHOOK_SECRET is not set", job.ID)
+		return
+	}
+
+	payload := WebhookPayload{Event: WebhookEventJobCompleted, Job: job, Note: note}
+	switch job.Status {
+	case JobStatusFailed:
+		payload.Event = WebhookEventJobFailed
+	case JobStatusCanceled:
+		payload.Event = WebhookEventJobCanceled
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		golog.Errorf("failed to encode webhook for job %s: %v", job.ID, err)
+		return
+	}
+
+	retries := s.cfg.WebhookMaxRetries
+	if retries < 0 {
+		retries = 0
+	}
+	backoff := time.Second
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		err = s.postWebhook(ctx, callbackURL, payload.Event, body)
+		if err == nil {
+			golog.Infof("webhook for job %s delivered to %s", job.ID, callbackURL)
+			return
+		}
+		golog.Warnf("webhook for job %s failed (attempt %d/%d): %v", job.ID, attempt+1, retries+1, err)
+	}
+	golog.Errorf("giving up on webhook for job %s: %v", job.ID, err)
+}
+
+func (s *Server) postWebhook(ctx context.Context, callbackURL, event string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notex-Event", event)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(s.cfg.WebhookSecret, body))
+
+	resp, err := newFetchClient(0, s.cfg.FetchAllowPrivate).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
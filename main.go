@@ -5,8 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/kataras/golog"
@@ -19,9 +19,10 @@ var Version = "1.0.0"
 func main() {
 	// Command line flags
 	serverMode := flag.Bool("server", false, "Run in HTTP server mode")
-	ingestFile := flag.String("ingest", "", "Path to a file to ingest")
+	ingestFile := flag.String("ingest", "", "Path to a file (or URL of a web page) to ingest")
 	notebookName := flag.String("notebook", "", "Notebook name (for ingest)")
 	version := flag.Bool("version", false, "Show version information")
+	configFile := flag.String("config", "", "Path to a YAML or JSON config file; environment variables override its values")
 	flag.Parse()
 
 	if *version {
@@ -55,24 +56,35 @@ func main() {
 
 	// Load and validate configuration
 	cfg := backend.LoadConfig()
+	if *configFile != "" {
+		if cfg, err = backend.LoadConfigFile(*configFile); err != nil {
+			fatalf("configuration error: %v", err)
+		}
+	}
 	if err := backend.ValidateConfig(cfg); err != nil {
-		golog.Fatalf("configuration error: %v\n\n"+
+		fatalf("configuration error: %v\n\n"+
 			"Required environment variables:\n"+
 			"  - OPENAI_API_KEY (for OpenAI) or\n"+
 			"  - OLLAMA_BASE_URL (for local Ollama)\n\n"+
 			"Optional:\n"+
 			"  - VECTOR_STORE_TYPE (default: sqlite)\n"+
-			"  - STORE_PATH (default: ./data/checkpoints.db)\n"+
+			"  - DATA_DIR (default: ./data)\n"+
 			"  - SERVER_PORT (default: 8080)\n"+
 			"Error: %v", err, err)
 	}
 
 	ctx := context.Background()
 
+	if *ingestFile != "" && !*serverMode {
+		if err := backend.EnsureDataDir(cfg); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
 	switch {
 	case *serverMode:
 		// Server mode
-		runServerMode(cfg)
+		runServerMode(ctx, cfg)
 
 	case *ingestFile != "":
 		// Ingest mode
@@ -86,19 +98,36 @@ func main() {
 	}
 }
 
-func runServerMode(cfg backend.Config) {
-	server, err := backend.NewServer(cfg)
+// fatalf logs a startup error and exits. The log only goes to ./logs, so the
+// error is printed on stderr too.
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "notex: "+format+"\n", args...)
+	golog.Fatalf(format, args...)
+}
+
+func runServerMode(ctx context.Context, cfg backend.Config) {
+	port, err := backend.ResolveServerPort(cfg)
 	if err != nil {
-		golog.Fatalf("failed to create server: %v", err)
+		fatalf("cannot start: %v", err)
 	}
+	cfg.ServerPort = port
 
 	golog.Infof("version:     %s", Version)
 	golog.Infof("server:      http://%s:%s", cfg.ServerHost, cfg.ServerPort)
 	golog.Infof("llm:         %s", cfg.OpenAIModel)
 	golog.Infof("vector store: %s", cfg.VectorStoreType)
 
+	if err := backend.Preflight(ctx, cfg); err != nil {
+		fatalf("cannot start: %v", err)
+	}
+
+	server, err := backend.NewServer(cfg)
+	if err != nil {
+		fatalf("failed to create server: %v", err)
+	}
+
 	if err := server.Start(); err != nil {
-		golog.Fatalf("server error: %v", err)
+		fatalf("server error: %v", err)
 	}
 }
 
@@ -118,51 +147,37 @@ func runIngestMode(ctx context.Context, cfg backend.Config, filePath, notebookNa
 	}
 
 	// Create or get notebook
-	notebooks, _ := store.ListNotebooks(ctx)
-	var notebookID string
-	for _, nb := range notebooks {
-		if nb.Name == notebookName {
-			notebookID = nb.ID
+	notebooks, _ := store.ListNotebooks(ctx, "", backend.ListOptions{})
+	var notebook *backend.Notebook
+	for i := range notebooks {
+		if notebooks[i].Name == notebookName {
+			notebook = &notebooks[i]
 			break
 		}
 	}
 
-	if notebookID == "" {
+	if notebook == nil {
 		nb, err := store.CreateNotebook(ctx, notebookName, "Created by ingest mode", nil)
 		if err != nil {
 			golog.Fatalf("failed to create notebook: %v", err)
 		}
-		notebookID = nb.ID
+		notebook = nb
 		golog.Infof("📓 created notebook: %s", notebookName)
 	}
-
-	// Extract content
-	content, err := vectorStore.ExtractDocument(ctx, filePath)
-	if err != nil {
-		golog.Fatalf("extraction failed: %v", err)
+	notebookID := notebook.ID
+
+	// Ingest the file, or the page when given a URL
+	var source *backend.Source
+	if strings.HasPrefix(filePath, "http://") || strings.HasPrefix(filePath, "https://") {
+		source, err = backend.IngestURL(ctx, store, vectorStore, notebookID, filePath)
+	} else {
+		source, err = backend.IngestFile(ctx, store, vectorStore, notebookID, filePath)
 	}
-
-	// Create source in database
-	fileInfo, _ := os.Stat(filePath)
-	source := &backend.Source{
-		NotebookID: notebookID,
-		Name:       filepath.Base(filePath),
-		Type:       "file",
-		FileName:   filepath.Base(filePath),
-		FileSize:   fileInfo.Size(),
-		Content:    content,
-		Metadata:   map[string]interface{}{"path": filePath},
-	}
-
-	if err := store.CreateSource(ctx, source); err != nil {
-		golog.Fatalf("failed to create source: %v", err)
-	}
-
-	// Ingest document
-	if err := vectorStore.IngestText(ctx, source.Name, content); err != nil {
+	if err != nil {
 		golog.Fatalf("ingestion failed: %v", err)
 	}
 
+	golog.Infof("📄 source: %s (%d chunks)", source.Name, source.ChunkCount)
 	golog.Infof("✅ ingestion complete!")
 	golog.Infof("📓 notebook: %s (ID: %s)", notebookName, notebookID)
 }
@@ -173,8 +188,9 @@ func printUsage() {
 	fmt.Println("  open-notebook [options]")
 	fmt.Println("\nOptions:")
 	fmt.Println("  -server          Start the web server")
-	fmt.Println("  -ingest <file>   Ingest a file into the vector store")
+	fmt.Println("  -ingest <file>   Ingest a file or web page URL into the vector store")
 	fmt.Println("  -notebook <name> Notebook name for ingest (default: 'Default Notebook')")
+	fmt.Println("  -config <file>   Load settings from a YAML or JSON file (environment variables win)")
 	fmt.Println("  -version         Show version information")
 	fmt.Println("\nExamples:")
 	fmt.Println("  # Start web server")